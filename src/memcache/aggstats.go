@@ -0,0 +1,239 @@
+/*
+ * stats, stats items and stats slabs of the primary cluster merged with the
+ * proxy's own counters, in the format of memcached, so its tools and checks
+ * work against the proxy unmodified
+ */
+
+package memcache
+
+import (
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// the servers behind the proxy, swapped as a whole by SetBackends
+type backendSet struct {
+    hosts    []*Host // of the primary cluster, merged in stats
+    replicas int     // copies of every key in hosts
+    flush    []*Host // of all the clusters, flushed by flush_all
+    own      []*Host // of flush not from the scheduler, closed with the set
+}
+
+var (
+    backendsLock sync.Mutex   // held by SetBackends
+    backends     atomic.Value // *backendSet
+)
+
+func currentBackends() *backendSet {
+    if b, _ := backends.Load().(*backendSet); b != nil {
+        return b
+    }
+    return &backendSet{replicas: 1}
+}
+
+// stats of the backends are cached this long, so `stats` doesn't wait on
+// all of them every time
+var BackendStatsTTL = time.Second
+
+type cachedStats struct {
+    at     time.Time
+    sts    []map[string]string
+    failed int
+}
+
+var (
+    statsCacheLock sync.Mutex
+    statsCache     = make(map[string]*cachedStats) // stats name -> stats
+)
+
+// set the servers behind the proxy: the primary cluster with replicas of
+// every key, and all the clusters. Hosts of sch are reused, so requests for
+// stats go through their maintenance, ejection and limits, the servers of
+// clusters not routed by sch (shadow, datacenters) are only flushed. The
+// hosts of the last call are closed, SetBackends(nil, nil, nil, 1) closes them.
+func SetBackends(sch Scheduler, primary, all []string, replicas int) {
+    b := &backendSet{}
+    known := make(map[string]*Host)
+    for _, h := range SchedulerHosts(sch) {
+        known[NormalizeAddr(h.Addr)] = h
+    }
+    hostsOf := func(addrs []string, create bool) []*Host {
+        var hosts []*Host
+        for _, addr := range addrs {
+            if h, ok := known[NormalizeAddr(addr)]; ok {
+                hosts = append(hosts, h)
+            } else if create {
+                h = NewHost(addr)
+                known[NormalizeAddr(addr)] = h
+                b.own = append(b.own, h)
+                hosts = append(hosts, h)
+            }
+        }
+        return hosts
+    }
+    if replicas < 1 {
+        replicas = 1
+    }
+    b.hosts, b.replicas = hostsOf(primary, false), replicas
+    b.flush = appendHosts(hostsOf(primary, false), hostsOf(all, true))
+    backendsLock.Lock()
+    old := currentBackends()
+    backends.Store(b)
+    backendsLock.Unlock()
+    closeHosts(old.own)
+    statsCacheLock.Lock()
+    statsCache = make(map[string]*cachedStats)
+    statsCacheLock.Unlock()
+}
+
+// the same on every backend, or a level, not summed but the max is taken,
+// the last part of keys like items:1:age is the name
+var maxStats = map[string]bool{
+    "pointer_size": true, "accepting_conns": true, "hash_power_level": true,
+    "hash_is_expanding": true, "slab_reassign_running": true, "lru_crawler_running": true,
+    "active_slabs": true, "chunk_size": true, "chunks_per_page": true,
+    "age": true, "age_hot": true, "age_warm": true, "evicted_time": true,
+}
+
+func isMaxStat(key string) bool {
+    return maxStats[key[strings.LastIndex(key, ":")+1:]]
+}
+
+// stats of the backends in parallel, with the number of failed ones, none
+// for an embedded store, which is a backend itself
+func backendStats(store DistributeStorage, keys []string) (sts []map[string]string, failed int) {
+    if _, ok := store.(*localStorage); ok {
+        return nil, 0
+    }
+    name := strings.Join(keys, " ")
+    statsCacheLock.Lock()
+    c, ok := statsCache[name]
+    statsCacheLock.Unlock()
+    if ok && time.Since(c.at) < BackendStatsTTL {
+        return c.sts, c.failed
+    }
+    defer func() {
+        statsCacheLock.Lock()
+        statsCache[name] = &cachedStats{time.Now(), sts, failed}
+        statsCacheLock.Unlock()
+    }()
+    var lock sync.Mutex
+    var wg sync.WaitGroup
+    for _, host := range currentBackends().hosts {
+        wg.Add(1)
+        go func(host *Host) {
+            defer wg.Done()
+            st, err := host.Stat(keys)
+            lock.Lock()
+            defer lock.Unlock()
+            if err != nil {
+                ErrorLog.Printf("stats %s of %s failed: %s", strings.Join(keys, " "), host.Addr, err)
+                failed++
+                return
+            }
+            sts = append(sts, st)
+        }(host)
+    }
+    wg.Wait()
+    return
+}
+
+// numeric stats summed up and divided by the replicas of keys, or the max
+// of them, the others are dropped
+func mergeStats(sts []map[string]string, replicas int) map[string]string {
+    sums := make(map[string]float64)
+    isInt := make(map[string]bool)
+    for _, st := range sts {
+        for k, s := range st {
+            v, err := strconv.ParseFloat(s, 64)
+            if err != nil {
+                continue
+            }
+            if _, ok := sums[k]; !ok {
+                sums[k], isInt[k] = v, true
+            } else if isMaxStat(k) {
+                if v > sums[k] {
+                    sums[k] = v
+                }
+            } else {
+                sums[k] += v
+            }
+            if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+                isInt[k] = false
+            }
+        }
+    }
+    r := make(map[string]string, len(sums))
+    for k, v := range sums {
+        if !isMaxStat(k) {
+            v /= float64(replicas)
+        }
+        if isInt[k] {
+            r[k] = strconv.FormatInt(int64(v), 10)
+        } else {
+            r[k] = strconv.FormatFloat(v, 'f', 6, 64)
+        }
+    }
+    return r
+}
+
+// `stats`: the counters of the proxy, with what only the backends know
+// (items, bytes, evictions, ...) merged from them
+func generalStats(st map[string]int64, store DistributeStorage) map[string]string {
+    sts, failed := backendStats(store, nil)
+    b := currentBackends()
+    r := mergeStats(sts, b.replicas)
+    for k, v := range st {
+        if _, ok := r[k]; ok && (k == "curr_items" || k == "total_items") {
+            continue
+        }
+        r[k] = strconv.FormatInt(v, 10)
+    }
+    r["version"] = VERSION
+    if _, local := store.(*localStorage); !local && len(b.hosts) > 0 {
+        r["backends"] = strconv.Itoa(len(b.hosts))
+        r["backends_failed"] = strconv.Itoa(failed)
+        r["replicas"] = strconv.Itoa(b.replicas)
+    }
+    return r
+}
+
+// `stats items` or `stats slabs` of the backends merged
+func backendSubStats(store DistributeStorage, name string) map[string]string {
+    sts, _ := backendStats(store, []string{name})
+    return mergeStats(sts, currentBackends().replicas)
+}
+
+// keys like items:2:number before items:10:number
+func lessStatKey(a, b string) bool {
+    as, bs := strings.Split(a, ":"), strings.Split(b, ":")
+    for i := 0; i < len(as) && i < len(bs); i++ {
+        if as[i] == bs[i] {
+            continue
+        }
+        an, ea := strconv.Atoi(as[i])
+        bn, eb := strconv.Atoi(bs[i])
+        if ea == nil && eb == nil {
+            return an < bn
+        }
+        return as[i] < bs[i]
+    }
+    return len(as) < len(bs)
+}
+
+func statLines(st map[string]string) string {
+    keys := make([]string, 0, len(st))
+    for k := range st {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool { return lessStatKey(keys[i], keys[j]) })
+    lines := make([]string, len(keys))
+    for i, k := range keys {
+        lines[i] = "STAT " + k + " " + st[k] + "\r\n"
+    }
+    return strings.Join(lines, "")
+}
@@ -0,0 +1,143 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a backend answering the commands by replies
+func fakeStatsBackend(t *testing.T, replies map[string]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(replies[strings.TrimSpace(line)] + "END\r\n"))
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestAggregatedStats(t *testing.T) {
+	defer SetBackends(nil, nil, nil, 1)
+	a := fakeStatsBackend(t, map[string]string{
+		"stats":       "STAT curr_items 3\r\nSTAT bytes 100\r\nSTAT evictions 1\r\nSTAT pointer_size 64\r\nSTAT version 1.6.9\r\nSTAT cmd_get 1000\r\n",
+		"stats items": "STAT items:1:number 3\r\nSTAT items:1:age 50\r\nSTAT items:10:number 1\r\n",
+		"stats slabs": "STAT 1:chunk_size 96\r\nSTAT 1:used_chunks 3\r\nSTAT active_slabs 1\r\nSTAT total_malloced 1048576\r\n",
+	})
+	b := fakeStatsBackend(t, map[string]string{
+		"stats":       "STAT curr_items 2\r\nSTAT bytes 50\r\nSTAT evictions 2\r\nSTAT pointer_size 64\r\n",
+		"stats items": "STAT items:1:number 2\r\nSTAT items:1:age 70\r\nSTAT items:2:number 4\r\n",
+		"stats slabs": "STAT 1:chunk_size 96\r\nSTAT 1:used_chunks 2\r\nSTAT active_slabs 1\r\nSTAT total_malloced 1048576\r\n",
+	})
+	shadow := fakeStatsBackend(t, map[string]string{"stats": "STAT curr_items 100\r\n"})
+	sch := NewModScheduler([]string{a, b}, "fnv1a1")
+	SetBackends(sch, []string{a, b}, []string{a, b, shadow}, 1)
+	if b := currentBackends(); len(b.hosts) != 2 || b.hosts[0] != sch.(HostLister).Hosts()[0] || len(b.flush) != 3 {
+		t.Fatalf("hosts of the scheduler should be reused: %v %v", b.hosts, b.flush)
+	}
+
+	store := newMapDistStore()
+	stats := NewStats()
+	stats.cmd_get = 7
+	process := func(cmd string) string {
+		req := new(Request)
+		req.Read(bufio.NewReader(bytes.NewBufferString(cmd)))
+		resp, _, _ := req.Process(store, stats)
+		wr := new(bytes.Buffer)
+		resp.Write(wr)
+		return wr.String()
+	}
+
+	r := process("stats\r\n")
+	for _, line := range []string{"STAT curr_items 5\r\n", "STAT bytes 150\r\n", "STAT evictions 3\r\n",
+		"STAT pointer_size 64\r\n", "STAT cmd_get 7\r\n", "STAT version " + VERSION + "\r\n",
+		"STAT backends 2\r\n", "STAT backends_failed 0\r\n"} {
+		if !strings.Contains(r, line) {
+			t.Errorf("%q not in stats:\n%s", line, r)
+		}
+	}
+	if !strings.HasSuffix(r, "END\r\n") {
+		t.Errorf("stats should end with END: %q", r)
+	}
+	if r := process("stats items\r\n"); r != "STAT items:1:age 70\r\nSTAT items:1:number 5\r\n"+
+		"STAT items:2:number 4\r\nSTAT items:10:number 1\r\nEND\r\n" {
+		t.Errorf("bad stats items: %q", r)
+	}
+	if r := process("stats slabs\r\n"); r != "STAT 1:chunk_size 96\r\nSTAT 1:used_chunks 5\r\n"+
+		"STAT active_slabs 1\r\nSTAT total_malloced 2097152\r\nEND\r\n" {
+		t.Errorf("bad stats slabs: %q", r)
+	}
+	if r := process("stats cmd_get\r\n"); r != "STAT cmd_get 7\r\nEND\r\n" {
+		t.Errorf("bad stats of keys: %q", r)
+	}
+
+	// every key is on both of them
+	SetBackends(sch, []string{a, b}, []string{a, b}, 2)
+	r = process("stats\r\n")
+	for _, line := range []string{"STAT curr_items 2\r\n", "STAT bytes 75\r\n",
+		"STAT pointer_size 64\r\n", "STAT replicas 2\r\n"} {
+		if !strings.Contains(r, line) {
+			t.Errorf("%q not in stats:\n%s", line, r)
+		}
+	}
+}
+
+func TestBackendStatsCached(t *testing.T) {
+	defer SetBackends(nil, nil, nil, 1)
+	replies := map[string]string{"stats": "STAT curr_items 3\r\n"}
+	a := fakeStatsBackend(t, replies)
+	SetBackends(NewModScheduler([]string{a}, "fnv1a1"), []string{a}, []string{a}, 1)
+	store := newMapDistStore()
+	backendStats(store, nil)
+	replies["stats"] = "STAT curr_items 4\r\n"
+	if sts, _ := backendStats(store, nil); len(sts) != 1 || sts[0]["curr_items"] != "3" {
+		t.Errorf("stats should be cached: %v", sts)
+	}
+	BackendStatsTTL = 0
+	defer func() { BackendStatsTTL = time.Second }()
+	if sts, _ := backendStats(store, nil); len(sts) != 1 || sts[0]["curr_items"] != "4" {
+		t.Errorf("stats should be fetched after the ttl: %v", sts)
+	}
+}
+
+func TestSetBackendsConcurrently(t *testing.T) {
+	defer SetBackends(nil, nil, nil, 1)
+	a := fakeStatsBackend(t, map[string]string{"stats": "STAT curr_items 3\r\n"})
+	defer func(ttl time.Duration) { BackendStatsTTL = ttl }(BackendStatsTTL)
+	BackendStatsTTL = 0
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			SetBackends(nil, []string{a}, []string{a}, i%3+1)
+		}
+		close(done)
+	}()
+	store := newMapDistStore()
+	for i := 0; i < 20; i++ {
+		generalStats(map[string]int64{}, store)
+	}
+	<-done
+	if b := currentBackends(); b.replicas != 2 || len(b.own) != 1 || b.own[0].isClosed() {
+		t.Errorf("the last backends should be kept: %+v", b)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * free-text notes of operators on hosts and buckets, like
+ * "disk replaced 2024-05-02", to keep the context with the tool
+ */
+
+package memcache
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "sync"
+)
+
+type Annotations struct {
+    Hosts   map[string]string // address -> note
+    Buckets map[int]string    // bucket -> note
+}
+
+var annotations = struct {
+    sync.RWMutex
+    Annotations
+}{Annotations: Annotations{Hosts: map[string]string{}, Buckets: map[int]string{}}}
+
+// annotate the host, an empty note removes it
+func AnnotateHost(addr, note string) {
+    annotations.Lock()
+    defer annotations.Unlock()
+    if note == "" {
+        delete(annotations.Hosts, addr)
+    } else {
+        annotations.Hosts[addr] = note
+    }
+}
+
+// annotate the bucket, an empty note removes it
+func AnnotateBucket(bucket int, note string) {
+    annotations.Lock()
+    defer annotations.Unlock()
+    if note == "" {
+        delete(annotations.Buckets, bucket)
+    } else {
+        annotations.Buckets[bucket] = note
+    }
+}
+
+func HostAnnotation(addr string) string {
+    annotations.RLock()
+    defer annotations.RUnlock()
+    return annotations.Hosts[addr]
+}
+
+// a copy of all the annotations
+func GetAnnotations() *Annotations {
+    annotations.RLock()
+    defer annotations.RUnlock()
+    r := &Annotations{Hosts: make(map[string]string, len(annotations.Hosts)),
+        Buckets: make(map[int]string, len(annotations.Buckets))}
+    for k, v := range annotations.Hosts {
+        r.Hosts[k] = v
+    }
+    for k, v := range annotations.Buckets {
+        r.Buckets[k] = v
+    }
+    return r
+}
+
+func SaveAnnotations(path string) error {
+    data, err := json.Marshal(GetAnnotations())
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(path, data, 0644)
+}
+
+// replace the annotations by the saved ones
+func LoadAnnotations(path string) error {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    var a Annotations
+    if err := json.Unmarshal(data, &a); err != nil {
+        return err
+    }
+    if a.Hosts == nil {
+        a.Hosts = map[string]string{}
+    }
+    if a.Buckets == nil {
+        a.Buckets = map[int]string{}
+    }
+    annotations.Lock()
+    defer annotations.Unlock()
+    annotations.Annotations = a
+    return nil
+}
@@ -0,0 +1,41 @@
+package memcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "annotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "annotations.json")
+
+	AnnotateHost("host1", "disk replaced 2024-05-02")
+	AnnotateBucket(3, "moving to host2")
+	if err := SaveAnnotations(path); err != nil {
+		t.Fatal(err)
+	}
+	AnnotateHost("host1", "")
+	AnnotateBucket(3, "")
+	if a := GetAnnotations(); len(a.Hosts) != 0 || len(a.Buckets) != 0 {
+		t.Errorf("empty notes should remove the annotations: %+v", a)
+	}
+
+	if err := LoadAnnotations(path); err != nil {
+		t.Fatal(err)
+	}
+	defer AnnotateBucket(3, "")
+	defer AnnotateHost("host1", "")
+	if HostAnnotation("host1") != "disk replaced 2024-05-02" || GetAnnotations().Buckets[3] != "moving to host2" {
+		t.Errorf("annotations should be loaded: %+v", GetAnnotations())
+	}
+	schd := newTestManualScheduler(map[string][]string{"host1": {"0"}}, 1, 1)
+	if st := StatsV2(schd)["host1"]; st.Annotation != "disk replaced 2024-05-02" {
+		t.Errorf("annotation should be in the stats: %+v", st)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * move buckets of ManualScheduler between its hosts at runtime, for routine
+ * reassignments without editing the config and reloading it
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// a host could serve this many times the average buckets of hosts at most
+// after buckets are assigned to it, 0 or less for no limit
+var MaxBucketLoad = 1.5
+
+// check the assignments and apply them at once, or none of them if any is
+// invalid. assign maps buckets to their new hosts, addresses prefixed by "-"
+// are backups, like in the config. only hosts of the scheduler could be used,
+// new hosts are added by Reload.
+func (c *ManualScheduler) AssignBuckets(assign map[int][]string) error {
+    if len(assign) == 0 {
+        return nil
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    buckets, backups, err := c.assign(assign)
+    if err != nil {
+        return err
+    }
+    c.buckets = buckets
+    c.backups = backups
+    if c.fixed {
+        c.sortByOrder()
+    }
+    moved := make([]string, 0, len(assign))
+    for b := range assign {
+        moved = append(moved, fmt.Sprintf("%x", b))
+    }
+    sort.Strings(moved)
+    ErrorLog.Printf("buckets %s of ManualScheduler reassigned", strings.Join(moved, ","))
+    RecordEvent("assign", "", "buckets "+strings.Join(moved, ","))
+    return nil
+}
+
+// check the assignments like AssignBuckets, without applying them
+func (c *ManualScheduler) CheckAssignment(assign map[int][]string) error {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    _, _, err := c.assign(assign)
+    return err
+}
+
+// the new bucket table, c.lock should be held
+func (c *ManualScheduler) assign(assign map[int][]string) (buckets, backups [][]int, err error) {
+    bs := len(c.buckets)
+    offsets := make(map[string]int, len(c.hosts))
+    for j, h := range c.hosts {
+        offsets[h.Addr] = j
+    }
+    buckets = append([][]int(nil), c.buckets...)
+    backups = append([][]int(nil), c.backups...)
+    for b, addrs := range assign {
+        if b < 0 || b >= bs {
+            return nil, nil, fmt.Errorf("invalid bucket %x", b)
+        }
+        var primary, backup []int
+        seen := make(map[int]bool, len(addrs))
+        for _, addr := range addrs {
+            isBackup := strings.HasPrefix(addr, "-")
+            addr = strings.TrimPrefix(addr, "-")
+            j, ok := offsets[addr]
+            if !ok {
+                return nil, nil, fmt.Errorf("%s is not a host of the scheduler", addr)
+            }
+            if seen[j] {
+                return nil, nil, fmt.Errorf("%s is assigned to bucket %x twice", addr, b)
+            }
+            seen[j] = true
+            if isBackup {
+                backup = append(backup, j)
+            } else {
+                primary = append(primary, j)
+            }
+        }
+        if len(primary) == 0 || len(primary) < c.N {
+            return nil, nil, fmt.Errorf("bucket %x has %d hosts, less than %d", b, len(primary), c.N)
+        }
+        buckets[b] = primary
+        backups[b] = backup
+    }
+    if err = checkBucketLoad(c.hosts, c.buckets, buckets); err != nil {
+        return nil, nil, err
+    }
+    return
+}
+
+// only hosts given more buckets are checked, the ones overloaded by the
+// config are not made worse
+func checkBucketLoad(hosts []*Host, old, buckets [][]int) error {
+    if MaxBucketLoad <= 0 || len(hosts) == 0 {
+        return nil
+    }
+    before := make([]int, len(hosts))
+    after := make([]int, len(hosts))
+    total := 0
+    for b := range buckets {
+        for _, j := range old[b] {
+            before[j]++
+        }
+        for _, j := range buckets[b] {
+            after[j]++
+        }
+        total += len(buckets[b])
+    }
+    limit := MaxBucketLoad * float64(total) / float64(len(hosts))
+    for j, h := range hosts {
+        if after[j] > before[j] && float64(after[j]) > limit {
+            return fmt.Errorf("%s would serve %d buckets, more than %.1f", h.Addr, after[j], limit)
+        }
+    }
+    return nil
+}
+
+// the bucket table in the format of the config, address -> buckets in hex,
+// backups prefixed by "-"
+func (c *ManualScheduler) BucketConfig() map[string][]string {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    config := make(map[string][]string, len(c.hosts))
+    for _, h := range c.hosts {
+        config[h.Addr] = []string{}
+    }
+    for b := range c.buckets {
+        for _, j := range c.buckets[b] {
+            addr := c.hosts[j].Addr
+            config[addr] = append(config[addr], fmt.Sprintf("%x", b))
+        }
+        for _, j := range c.backups[b] {
+            addr := c.hosts[j].Addr
+            config[addr] = append(config[addr], fmt.Sprintf("-%x", b))
+        }
+    }
+    return config
+}
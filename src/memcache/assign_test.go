@@ -0,0 +1,69 @@
+package memcache
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestAssignBuckets(t *testing.T) {
+	schd := newTestManualScheduler(map[string][]string{
+		"assign1": {"0", "1"},
+		"assign2": {"2", "3"},
+		"assign3": {"-0", "-1"},
+		"assign4": {},
+	}, 4, 1)
+	before := schd.BucketConfig()
+
+	for _, assign := range []map[int][]string{
+		{4: {"assign1"}},                 // out of range
+		{0: {"assign5"}},                 // unknown host
+		{0: {"-assign3"}},                // no primary left
+		{0: {"assign3", "assign3"}},      // twice
+		{0: {"assign2"}, 1: {"assign2"}}, // 4 buckets of 4, more than 1.5 times the average
+		{0: {"assign4"}, 1: {}},          // the valid one is not applied either
+	} {
+		if err := schd.CheckAssignment(assign); err == nil {
+			t.Errorf("%v should be rejected", assign)
+		}
+		if err := schd.AssignBuckets(assign); err == nil {
+			t.Errorf("%v should be rejected", assign)
+		}
+	}
+	if got := schd.BucketConfig(); !reflect.DeepEqual(got, before) {
+		t.Errorf("rejected assignments should not change buckets: %v", got)
+	}
+
+	if err := schd.AssignBuckets(map[int][]string{1: {"assign4", "-assign1"}}); err != nil {
+		t.Fatal(err)
+	}
+	config := schd.BucketConfig()
+	for addr := range config {
+		sort.Strings(config[addr])
+	}
+	want := map[string][]string{
+		"assign1": {"-1", "0"},
+		"assign2": {"2", "3"},
+		"assign3": {"-0"},
+		"assign4": {"1"},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("buckets should be assigned: %v", config)
+	}
+	if _, _, _, err := parseManualConfig(config, 4, nil); err != nil {
+		t.Errorf("bucket config should be parsed: %s", err)
+	}
+	hosts := schd.GetHostsByKey(keyOfBucket(schd, 1))
+	if hosts[0].Addr != "assign4" || hosts[1].Addr != "assign1" {
+		t.Errorf("bucket 1 should go to the new hosts: %s %s", hosts[0].Addr, hosts[1].Addr)
+	}
+}
+
+func keyOfBucket(schd *ManualScheduler, bucket int) string {
+	for i := 0; ; i++ {
+		key := "key" + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		if getBucketByKey(schd.hashMethod, schd.bucketWidth, key) == bucket {
+			return key
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * sample keys on hosts and check they are where the scheduler routes them,
+ * keys written under an older topology are left behind after migrations
+ */
+
+package memcache
+
+import (
+    "math/rand"
+    "strings"
+    "sync"
+    "time"
+)
+
+// examples of misplaced keys kept in a report
+var MaxAuditExamples = 20
+
+type AuditReport struct {
+    Time      time.Time
+    Sampled   int
+    Misplaced []int    // misplaced keys sampled in every bucket
+    Errors    int      // buckets failed to be listed
+    Examples  []string // "key on host"
+}
+
+func (r *AuditReport) Total() (n int) {
+    for _, m := range r.Misplaced {
+        n += m
+    }
+    return
+}
+
+// up to n keys of the directory, from random sub directories
+func sampleKeys(host *Host, dir string, n int) ([]string, error) {
+    lines, err := listDir(host, dir)
+    if err != nil {
+        return nil, err
+    }
+    rand.Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+    var keys []string
+    for _, fields := range lines {
+        if len(keys) >= n {
+            break
+        }
+        name := string(fields[0])
+        if strings.HasSuffix(name, "/") {
+            sub, err := sampleKeys(host, dir+name[:len(name)-1], n-len(keys))
+            if err != nil {
+                return nil, err
+            }
+            keys = append(keys, sub...)
+        } else {
+            keys = append(keys, name)
+        }
+    }
+    return keys, nil
+}
+
+// sample up to sample keys in every bucket of every host, count the keys
+// on a host not routed to it. The hosts of the scheduler are listed with
+// their connections, the others are opened and closed for the audit.
+func AuditRouting(sch Scheduler, addrs []string, bs, sample int) (*AuditReport, error) {
+    r := &AuditReport{Time: time.Now(), Misplaced: make([]int, bs)}
+    hosts := make(map[string]*Host)
+    for _, h := range SchedulerHosts(sch) {
+        hosts[h.Addr] = h
+    }
+    for _, addr := range addrs {
+        host, ok := hosts[addr]
+        if !ok {
+            host = NewHost(addr)
+        }
+        err := auditHost(r, sch, host, bs, sample)
+        if !ok {
+            host.Close()
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    return r, nil
+}
+
+func auditHost(r *AuditReport, sch Scheduler, host *Host, bs, sample int) error {
+    for b := 0; b < bs; b++ {
+        dir, err := bucketDir(b, bs)
+        if err != nil {
+            return err
+        }
+        keys, err := sampleKeys(host, dir, sample)
+        if err != nil {
+            ErrorLog.Printf("audit: list %s on %s failed: %s", dir, host.Addr, err)
+            r.Errors++
+            continue
+        }
+        for _, key := range keys {
+            r.Sampled++
+            if !routedTo(sch, key, host.Addr) {
+                r.Misplaced[b]++
+                if len(r.Examples) < MaxAuditExamples {
+                    r.Examples = append(r.Examples, key+" on "+host.Addr)
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// routed by the placement of the key, the hosts skipped while they are down
+// included, so the keys on an ejected host are not counted as misplaced
+func routedTo(sch Scheduler, key, addr string) bool {
+    for _, h := range ExplainRoute(sch, key).Hosts {
+        if h.Addr == addr {
+            return true
+        }
+    }
+    return false
+}
+
+// audit the routing periodically, the last report is kept
+type RoutingAudit struct {
+    Scheduler Scheduler
+    Addrs     []string
+    Buckets   int
+    Sample    int // keys sampled in every bucket of every host
+    Interval  time.Duration
+    Done      <-chan struct{} // closed to stop Run, nil runs forever
+    lock      sync.Mutex
+    last      *AuditReport
+}
+
+func (a *RoutingAudit) Last() *AuditReport {
+    a.lock.Lock()
+    defer a.lock.Unlock()
+    return a.last
+}
+
+// run forever, in a goroutine
+func (a *RoutingAudit) Run() {
+    for {
+        select {
+        case <-time.After(a.Interval):
+        case <-a.Done:
+            return
+        }
+        r, err := AuditRouting(a.Scheduler, a.Addrs, a.Buckets, a.Sample)
+        if err != nil {
+            ErrorLog.Print("routing audit failed: ", err)
+            return
+        }
+        if n := r.Total(); n > 0 {
+            ErrorLog.Printf("routing audit: %d of %d sampled keys are misplaced", n, r.Sampled)
+        }
+        a.lock.Lock()
+        a.last = r
+        a.lock.Unlock()
+    }
+}
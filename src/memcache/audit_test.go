@@ -0,0 +1,69 @@
+package memcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAuditRouting(t *testing.T) {
+	var stores []listingStore
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		store := listingStore{NewMapStore()}
+		s := NewServer(NewLocalStorage(store, ""))
+		if err := s.Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve()
+		stores = append(stores, store)
+		addrs = append(addrs, s.l.Addr().String())
+	}
+	low := []string{"0", "1", "2", "3", "4", "5", "6", "7"}
+	high := []string{"8", "9", "a", "b", "c", "d", "e", "f"}
+	schd := newTestManualScheduler(map[string][]string{addrs[0]: low, addrs[1]: high}, 16, 1)
+
+	misplaced := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		// all the keys were written to the first host
+		stores[0].Set(key, &Item{Body: []byte("v")}, false)
+		if getBucketByKey(fnv1a1, 4, key) >= 8 {
+			misplaced++
+		}
+	}
+
+	r, err := AuditRouting(schd, addrs, 16, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Sampled != 100 || r.Total() != misplaced || r.Errors != 0 {
+		t.Errorf("%d of %d keys should be misplaced: %+v", misplaced, r.Sampled, r)
+	}
+	for b := 0; b < 8; b++ {
+		if r.Misplaced[b] != 0 {
+			t.Errorf("keys of bucket %d are in place: %v", b, r.Misplaced)
+		}
+	}
+
+	if r, _ := AuditRouting(schd, addrs, 16, 1); r.Sampled > 16 {
+		t.Errorf("one key should be sampled in every bucket: %d", r.Sampled)
+	}
+
+	// keys are in place on a host skipped for its backup while it's in
+	// maintenance
+	backups := append([]string{}, high...)
+	for _, b := range low {
+		backups = append(backups, "-"+b)
+	}
+	schd = newTestManualScheduler(map[string][]string{addrs[0]: low, addrs[1]: backups}, 16, 1)
+	SetMaintenance(addrs[0], true)
+	defer SetMaintenance(addrs[0], false)
+	if r, _ := AuditRouting(schd, addrs, 16, 100); r.Total() != misplaced {
+		t.Errorf("%d keys should be misplaced with %s in maintenance: %+v", misplaced, addrs[0], r)
+	}
+	for _, h := range SchedulerHosts(schd) {
+		if h.isClosed() {
+			t.Errorf("%s of the scheduler is closed by the audit", h.Addr)
+		}
+	}
+}
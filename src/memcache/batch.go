@@ -0,0 +1,144 @@
+/*
+ * batch small writes to a backend, flushed together like nagle
+ */
+
+package memcache
+
+import (
+    "bufio"
+    "sync"
+    "time"
+)
+
+// writes are held for this long before they are sent together, 0 to disable
+var BatchWindow time.Duration = 0
+
+// a batch is sent at once when the requests in it are larger than this
+var BatchBytes = 16 * 1024
+
+// only small writes are batched
+var BatchMaxItemSize = 4 * 1024
+
+type batchResult struct {
+    resp *Response
+    err  error
+}
+
+type batchedRequest struct {
+    req  *Request
+    done chan batchResult
+}
+
+// writeBatcher send a batch of requests on one connection with a single
+// flush, then read the responses in order
+type writeBatcher struct {
+    host    *Host
+    lock    sync.Mutex
+    pending []*batchedRequest
+    size    int
+}
+
+func batchable(req *Request) bool {
+    switch req.Cmd {
+    case "set", "add", "replace", "append", "prepend", "delete", "incr":
+        return req.Item == nil || len(req.Item.Body) <= BatchMaxItemSize
+    }
+    return false
+}
+
+func requestSize(req *Request) int {
+    size := len(req.Cmd) + 32
+    for _, k := range req.Keys {
+        size += len(k) + 1
+    }
+    if req.Item != nil {
+        size += len(req.Item.Body)
+    }
+    return size
+}
+
+func (b *writeBatcher) submit(req *Request) (*Response, error) {
+    br := &batchedRequest{req, make(chan batchResult, 1)}
+    var batch []*batchedRequest
+    b.lock.Lock()
+    b.pending = append(b.pending, br)
+    b.size += requestSize(req)
+    if b.size >= BatchBytes {
+        batch = b.take()
+    } else if len(b.pending) == 1 {
+        time.AfterFunc(BatchWindow, func() {
+            b.lock.Lock()
+            batch := b.take()
+            b.lock.Unlock()
+            b.flush(batch)
+        })
+    }
+    b.lock.Unlock()
+    if batch != nil {
+        go b.flush(batch)
+    }
+    // the flush is bounded by the deadlines of the connection, this is for
+    // the window and the dialing before it
+    select {
+    case r := <-br.done:
+        return r.resp, r.err
+    case <-time.After(BatchWindow + ConnectTimeout + WriteTimeout + ReadTimeout):
+        return nil, &timeoutError{req}
+    }
+}
+
+func (b *writeBatcher) take() []*batchedRequest {
+    batch := b.pending
+    b.pending = nil
+    b.size = 0
+    return batch
+}
+
+func (b *writeBatcher) flush(batch []*batchedRequest) {
+    if len(batch) == 0 {
+        return
+    }
+    fail := func(rs []*batchedRequest, err error) {
+        for _, br := range rs {
+            br.done <- batchResult{nil, err}
+        }
+    }
+    conn, err := b.host.getConn()
+    if err != nil {
+        fail(batch, err)
+        return
+    }
+    conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+    w := bufio.NewWriterSize(conn, BatchBytes+BatchMaxItemSize)
+    for _, br := range batch {
+        br.req.Write(w)
+    }
+    if err = w.Flush(); err != nil {
+        ErrorLog.Print(b.host.Addr, " write batch failed:", err)
+        conn.Close()
+        fail(batch, err)
+        return
+    }
+    conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+    reader := bufio.NewReader(conn)
+    for i, br := range batch {
+        resp := new(Response)
+        if br.req.NoReply {
+            resp.status = "STORED"
+            br.done <- batchResult{resp, nil}
+            continue
+        }
+        if err = resp.Read(reader); err == nil {
+            err = br.req.Check(resp)
+        }
+        if err != nil {
+            ErrorLog.Print(b.host.Addr, " read batch response failed:", err)
+            conn.Close()
+            fail(batch[i:], err)
+            return
+        }
+        br.done <- batchResult{resp, nil}
+    }
+    conn.SetDeadline(time.Time{})
+    b.host.releaseConn(conn)
+}
@@ -0,0 +1,84 @@
+package memcache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteBatcher(t *testing.T) {
+	store := newMapDistStore()
+	s := NewServer(store)
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	BatchWindow = 10 * time.Millisecond
+	defer func() { BatchWindow = 0 }()
+	host := NewHost(s.l.Addr().String())
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if ok, err := host.Set(fmt.Sprintf("key%d", i), &Item{Body: []byte("v")}, false); !ok {
+				t.Errorf("set key%d failed: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if store.Len() != 10 {
+		t.Errorf("all the writes should be stored: %d", store.Len())
+	}
+	if n := s.stats.total_connections; n != 1 {
+		t.Errorf("writes should be sent in one batch: %d connections", n)
+	}
+	if ok, _ := host.Delete("missing"); ok {
+		t.Errorf("delete a missing key should fail")
+	}
+}
+
+func TestWriteBatcherTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed := make(chan bool, 1)
+	go func() {
+		// read the requests, but never answer
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		ioutil.ReadAll(conn)
+		closed <- true
+	}()
+
+	defer func(window, timeout time.Duration) { BatchWindow, ReadTimeout = window, timeout }(BatchWindow, ReadTimeout)
+	BatchWindow, ReadTimeout = time.Millisecond, 50*time.Millisecond
+	host := NewHost(l.Addr().String())
+	defer host.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := host.batcher.submit(&Request{Cmd: "set", Keys: []string{"key"}, Item: &Item{Body: []byte("v")}})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("a batch without responses should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a batch without responses should time out")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("the connection of a timed out batch should be closed")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * benchmark the proxy itself against an in-memory store over loopback,
+ * to catch regressions from config changes or drift of the environment
+ */
+
+package memcache
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// number of results kept to compare with
+var BenchHistory = 100
+
+// a run with qps lower, or p99 higher, than the median of history by this
+// fraction is a regression
+var BenchTolerance = 0.2
+
+var benchRegressions int64
+
+type BenchResult struct {
+    Time      time.Time
+    Ops       int64
+    QPS       float64
+    P50       time.Duration
+    P99       time.Duration
+    Regressed bool
+}
+
+// serve the store over loopback like the proxy, without registering the
+// connections or signals of a Server
+func serveLoopback(store DistributeStorage) (net.Listener, error) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, err
+    }
+    stats := NewStats()
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            c := newServerConn(conn)
+            c.noAccessLog = true
+            go c.Serve(store, stats)
+        }
+    }()
+    return l, nil
+}
+
+func benchWorker(addr string, id int, deadline time.Time, hist *LatencyHistogram) (ops int64, err error) {
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+    reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+    value := make([]byte, 100)
+    for i := 0; time.Now().Before(deadline); i++ {
+        key := fmt.Sprintf("bench:%d:%d", id, i%100)
+        req := &Request{Cmd: "get", Keys: []string{key}}
+        if i%2 == 0 {
+            req = &Request{Cmd: "set", Keys: []string{key}, Item: &Item{Body: value}}
+        }
+        t := time.Now()
+        if err = req.Write(writer); err == nil {
+            err = writer.Flush()
+        }
+        if err != nil {
+            return
+        }
+        resp := new(Response)
+        if err = resp.Read(reader); err != nil {
+            return
+        }
+        resp.CleanBuffer()
+        hist.Add(time.Since(t))
+        ops++
+    }
+    return
+}
+
+// RunSelfBench send sets and gets from workers for d, as a client would do
+func RunSelfBench(d time.Duration, workers int) (*BenchResult, error) {
+    l, err := serveLoopback(NewLocalStorage(NewMapStore(), "bench"))
+    if err != nil {
+        return nil, err
+    }
+    defer l.Close()
+
+    hist := NewLatencyHistogram()
+    start := time.Now()
+    deadline := start.Add(d)
+    var ops int64
+    var wg sync.WaitGroup
+    errs := make(chan error, workers)
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            n, err := benchWorker(l.Addr().String(), w, deadline, hist)
+            atomic.AddInt64(&ops, n)
+            if err != nil {
+                errs <- err
+            }
+        }(w)
+    }
+    wg.Wait()
+    close(errs)
+    if err := <-errs; err != nil {
+        return nil, err
+    }
+    return &BenchResult{Time: start, Ops: ops, QPS: float64(ops) / time.Since(start).Seconds(),
+        P50: hist.Quantile(0.5), P99: hist.Quantile(0.99)}, nil
+}
+
+// SelfBench run the benchmark every Interval in the off-peak Hours, and
+// compare every result with the history
+type SelfBench struct {
+    Interval time.Duration
+    Duration time.Duration
+    Workers  int
+    Hours    []int           // hours of day to run in, empty for all the day
+    Done     <-chan struct{} // closed to stop Run, nil runs forever
+    lock     sync.Mutex
+    results  []*BenchResult
+}
+
+func (b *SelfBench) offPeak(now time.Time) bool {
+    if len(b.Hours) == 0 {
+        return true
+    }
+    for _, h := range b.Hours {
+        if h == now.Hour() {
+            return true
+        }
+    }
+    return false
+}
+
+func median(vs []float64) float64 {
+    sort.Float64s(vs)
+    return vs[len(vs)/2]
+}
+
+// compare the result with the median of history, then keep it
+func (b *SelfBench) record(r *BenchResult) {
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    if n := len(b.results); n > 0 {
+        qps := make([]float64, n)
+        p99 := make([]float64, n)
+        for i, h := range b.results {
+            qps[i], p99[i] = h.QPS, float64(h.P99)
+        }
+        mq, mp := median(qps), median(p99)
+        if r.QPS < mq*(1-BenchTolerance) || float64(r.P99) > mp*(1+BenchTolerance) {
+            r.Regressed = true
+            atomic.AddInt64(&benchRegressions, 1)
+            ErrorLog.Printf("self benchmark regressed: qps %.0f (median %.0f), p99 %v (median %v)",
+                r.QPS, mq, r.P99, time.Duration(mp))
+        }
+    }
+    b.results = append(b.results, r)
+    if len(b.results) > BenchHistory {
+        b.results = b.results[len(b.results)-BenchHistory:]
+    }
+}
+
+func (b *SelfBench) Results() []*BenchResult {
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    return append([]*BenchResult(nil), b.results...)
+}
+
+// run forever, in a goroutine
+func (b *SelfBench) Run() {
+    for {
+        select {
+        case <-time.After(b.Interval):
+        case <-b.Done:
+            return
+        }
+        if !b.offPeak(time.Now()) {
+            continue
+        }
+        r, err := RunSelfBench(b.Duration, b.Workers)
+        if err != nil {
+            ErrorLog.Print("self benchmark failed: ", err)
+            continue
+        }
+        b.record(r)
+    }
+}
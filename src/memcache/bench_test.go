@@ -0,0 +1,33 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunSelfBench(t *testing.T) {
+	r, err := RunSelfBench(time.Millisecond*100, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Ops == 0 || r.QPS <= 0 || r.P99 < r.P50 {
+		t.Errorf("bad result: %+v", r)
+	}
+}
+
+func TestSelfBenchRegression(t *testing.T) {
+	b := &SelfBench{Hours: []int{3}}
+	if b.offPeak(time.Date(2014, 1, 1, 12, 0, 0, 0, time.Local)) {
+		t.Error("12 should not be off peak")
+	}
+	for i := 0; i < 5; i++ {
+		b.record(&BenchResult{QPS: 10000, P99: time.Millisecond})
+	}
+	b.record(&BenchResult{QPS: 9000, P99: time.Millisecond})
+	b.record(&BenchResult{QPS: 5000, P99: time.Millisecond})
+	b.record(&BenchResult{QPS: 10000, P99: time.Millisecond * 2})
+	rs := b.Results()
+	if len(rs) != 8 || rs[5].Regressed || !rs[6].Regressed || !rs[7].Regressed {
+		t.Errorf("regressions should be detected: %v %v %v", rs[5], rs[6], rs[7])
+	}
+}
@@ -0,0 +1,406 @@
+/*
+ * the binary protocol of memcached on the frontend, requests are translated
+ * into the commands of the text protocol, so they are processed the same
+ */
+
+package memcache
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "io"
+    "io/ioutil"
+    "net"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    binaryRequestMagic  = 0x80
+    binaryResponseMagic = 0x81
+    binaryHeaderLen     = 24
+)
+
+// status of responses
+const (
+    binaryNoError        = 0x00
+    binaryKeyNotFound    = 0x01
+    binaryKeyExists      = 0x02
+    binaryValueTooLarge  = 0x03
+    binaryInvalidArgs    = 0x04
+    binaryNotStored      = 0x05
+    binaryUnknownCommand = 0x81
+    binaryInternalError  = 0x84
+)
+
+var binaryMessages = map[uint16]string{
+    binaryKeyNotFound:    "Not found",
+    binaryKeyExists:      "Data exists for key",
+    binaryValueTooLarge:  "Too large",
+    binaryInvalidArgs:    "Invalid arguments",
+    binaryNotStored:      "Not stored",
+    binaryUnknownCommand: "Unknown command",
+    binaryInternalError:  "Internal error",
+}
+
+type binaryCommand struct {
+    cmd     string // of the text protocol
+    quiet   bool   // no response if succeeded, or missed by get
+    withKey bool   // the key is in the response of get
+}
+
+var binaryCommands = map[byte]binaryCommand{
+    0x00: {cmd: "get"},
+    0x01: {cmd: "set"},
+    0x02: {cmd: "add"},
+    0x03: {cmd: "replace"},
+    0x04: {cmd: "delete"},
+    0x05: {cmd: "incr"},
+    0x06: {cmd: "decr"},
+    0x07: {cmd: "quit"},
+    0x08: {cmd: "flush_all"},
+    0x09: {cmd: "get", quiet: true},
+    0x0a: {cmd: "noop"},
+    0x0b: {cmd: "version"},
+    0x0c: {cmd: "get", withKey: true},
+    0x0d: {cmd: "get", quiet: true, withKey: true},
+    0x0e: {cmd: "append"},
+    0x0f: {cmd: "prepend"},
+    0x10: {cmd: "stats"},
+    0x11: {cmd: "set", quiet: true},
+    0x12: {cmd: "add", quiet: true},
+    0x13: {cmd: "replace", quiet: true},
+    0x14: {cmd: "delete", quiet: true},
+    0x15: {cmd: "incr", quiet: true},
+    0x16: {cmd: "decr", quiet: true},
+    0x17: {cmd: "quit", quiet: true},
+    0x18: {cmd: "flush_all", quiet: true},
+    0x19: {cmd: "append", quiet: true},
+    0x1a: {cmd: "prepend", quiet: true},
+    0x1c: {cmd: "touch"},
+    0x1d: {cmd: "gat"},
+    0x1e: {cmd: "gat", quiet: true},
+    0x23: {cmd: "gat", withKey: true},
+    0x24: {cmd: "gat", quiet: true, withKey: true},
+}
+
+var binaryRequests int64
+
+type binaryRequest struct {
+    opcode byte
+    opaque uint32
+    cas    uint64
+    extras []byte
+    key    string
+    value  []byte
+    large  bool // the value is larger than MaxBodyLength, it's skipped
+}
+
+func (r *binaryRequest) Read(b *bufio.Reader) error {
+    var h [binaryHeaderLen]byte
+    if _, e := io.ReadFull(b, h[:]); e != nil {
+        return e
+    }
+    if h[0] != binaryRequestMagic {
+        return errors.New("invalid magic")
+    }
+    r.opcode = h[1]
+    keyLen := int(binary.BigEndian.Uint16(h[2:]))
+    extLen := int(h[4])
+    bodyLen := int(binary.BigEndian.Uint32(h[8:]))
+    r.opaque = binary.BigEndian.Uint32(h[12:])
+    r.cas = binary.BigEndian.Uint64(h[16:])
+    if bodyLen < keyLen+extLen {
+        return errors.New("invalid body length")
+    }
+    head := make([]byte, extLen+keyLen)
+    if _, e := io.ReadFull(b, head); e != nil {
+        return e
+    }
+    r.extras, r.key = head[:extLen], string(head[extLen:])
+    length := bodyLen - keyLen - extLen
+    r.large = length > MaxBodyLength
+    if r.large {
+        _, e := io.CopyN(ioutil.Discard, b, int64(length))
+        return e
+    }
+    r.value = make([]byte, length)
+    _, e := io.ReadFull(b, r.value)
+    return e
+}
+
+// the command of the text protocol, or the status to reject it
+func (r *binaryRequest) request(bc binaryCommand) (*Request, uint16) {
+    req := &Request{Cmd: bc.cmd}
+    switch bc.cmd {
+    case "get", "delete", "set", "add", "replace", "append", "prepend", "incr", "decr", "touch", "gat":
+        if r.key == "" || len(r.key) > MaxKeyLength {
+            return nil, binaryInvalidArgs
+        }
+        req.Keys = []string{r.key}
+    case "stats":
+        if r.key != "" {
+            req.Keys = []string{r.key}
+        }
+    }
+
+    switch bc.cmd {
+    case "set", "add", "replace":
+        if len(r.extras) != 8 {
+            return nil, binaryInvalidArgs
+        }
+        if r.large {
+            return nil, binaryValueTooLarge
+        }
+        req.Item = &Item{
+            Flag:    int(binary.BigEndian.Uint32(r.extras)),
+            Exptime: int(binary.BigEndian.Uint32(r.extras[4:])),
+            Body:    r.value,
+        }
+        if r.cas != 0 {
+            req.Cmd = "cas"
+            req.Item.Cas = int(r.cas)
+        }
+    case "append", "prepend":
+        if r.large {
+            return nil, binaryValueTooLarge
+        }
+        req.Item = &Item{Body: r.value}
+    case "incr", "decr":
+        if len(r.extras) != 20 {
+            return nil, binaryInvalidArgs
+        }
+        delta := binary.BigEndian.Uint64(r.extras)
+        req.Item = &Item{Body: []byte(strconv.FormatUint(delta, 10))}
+    case "touch", "gat":
+        if len(r.extras) != 4 {
+            return nil, binaryInvalidArgs
+        }
+        req.Item = &Item{Exptime: int(binary.BigEndian.Uint32(r.extras))}
+    case "flush_all":
+        // the delay is optional
+        if len(r.extras) == 4 {
+            req.Keys = []string{strconv.FormatUint(uint64(binary.BigEndian.Uint32(r.extras)), 10)}
+        } else if len(r.extras) != 0 {
+            return nil, binaryInvalidArgs
+        }
+    }
+    return req, binaryNoError
+}
+
+func writeBinaryResponse(w io.Writer, opcode byte, status uint16, opaque uint32, cas uint64,
+    extras []byte, key string, value []byte) error {
+    var h [binaryHeaderLen]byte
+    h[0] = binaryResponseMagic
+    h[1] = opcode
+    binary.BigEndian.PutUint16(h[2:], uint16(len(key)))
+    h[4] = byte(len(extras))
+    binary.BigEndian.PutUint16(h[6:], status)
+    binary.BigEndian.PutUint32(h[8:], uint32(len(extras)+len(key)+len(value)))
+    binary.BigEndian.PutUint32(h[12:], opaque)
+    binary.BigEndian.PutUint64(h[16:], cas)
+    if e := WriteFull(w, h[:]); e != nil {
+        return e
+    }
+    WriteFull(w, extras)
+    io.WriteString(w, key)
+    return WriteFull(w, value)
+}
+
+func (r *binaryRequest) writeError(w io.Writer, status uint16, msg string) error {
+    if msg == "" {
+        msg = binaryMessages[status]
+    }
+    return writeBinaryResponse(w, r.opcode, status, r.opaque, 0, nil, "", []byte(msg))
+}
+
+// the status of the response of the text protocol
+func binaryStatus(cmd string, resp *Response) uint16 {
+    switch resp.status {
+    case "VALUE", "STORED", "DELETED", "TOUCHED", "OK", "VERSION", "STAT", "INCR", "DECR":
+        return binaryNoError
+    case "NOT_FOUND":
+        return binaryKeyNotFound
+    case "EXISTS":
+        return binaryKeyExists
+    case "NOT_STORED":
+        switch cmd {
+        case "add":
+            return binaryKeyExists
+        case "replace":
+            return binaryKeyNotFound
+        }
+        return binaryNotStored
+    case "CLIENT_ERROR":
+        return binaryInvalidArgs
+    }
+    return binaryInternalError
+}
+
+func (r *binaryRequest) writeResponse(w io.Writer, bc binaryCommand, req *Request, resp *Response) error {
+    status := binaryStatus(req.Cmd, resp)
+    if status != binaryNoError {
+        return r.writeError(w, status, resp.msg)
+    }
+
+    switch bc.cmd {
+    case "get", "gat":
+        key := ""
+        if bc.withKey {
+            key = r.key
+        }
+        item, ok := resp.items[r.key]
+        if !ok {
+            if bc.quiet {
+                return nil
+            }
+            return writeBinaryResponse(w, r.opcode, binaryKeyNotFound, r.opaque, 0, nil, key,
+                []byte(binaryMessages[binaryKeyNotFound]))
+        }
+        var flags [4]byte
+        binary.BigEndian.PutUint32(flags[:], uint32(item.Flag))
+        return writeBinaryResponse(w, r.opcode, status, r.opaque, uint64(item.Cas), flags[:], key, item.Body)
+
+    case "incr", "decr":
+        if bc.quiet {
+            return nil
+        }
+        n, _ := strconv.ParseUint(strings.TrimSpace(resp.msg), 10, 64)
+        var v [8]byte
+        binary.BigEndian.PutUint64(v[:], n)
+        return writeBinaryResponse(w, r.opcode, status, r.opaque, 0, nil, "", v[:])
+
+    case "stats":
+        for _, line := range strings.Split(resp.msg, "\r\n") {
+            // values like rusage or version may have spaces
+            parts := strings.SplitN(line, " ", 3)
+            if len(parts) != 3 || parts[0] != "STAT" {
+                continue
+            }
+            if e := writeBinaryResponse(w, r.opcode, status, r.opaque, 0, nil, parts[1], []byte(parts[2])); e != nil {
+                return e
+            }
+        }
+        return writeBinaryResponse(w, r.opcode, status, r.opaque, 0, nil, "", nil)
+
+    case "version":
+        return writeBinaryResponse(w, r.opcode, status, r.opaque, 0, nil, "", []byte(resp.msg))
+    }
+
+    if bc.quiet {
+        return nil
+    }
+    return writeBinaryResponse(w, r.opcode, status, r.opaque, 0, nil, "", nil)
+}
+
+// missing keys of incr and decr are created with the initial value, unless
+// the expiration is all ones
+func (r *binaryRequest) incrInitial(req *Request, resp *Response, store DistributeStorage, stats *Stats) (*Response, []string) {
+    exptime := binary.BigEndian.Uint32(r.extras[16:])
+    if resp.status != "NOT_FOUND" || exptime == 0xffffffff {
+        return resp, nil
+    }
+    initial := strconv.FormatUint(binary.BigEndian.Uint64(r.extras[8:]), 10)
+    add := &Request{Cmd: "add", Keys: req.Keys, Item: &Item{Exptime: int(exptime), Body: []byte(initial)}}
+    r2, targets, _ := add.Process(store, stats)
+    if r2 == nil || r2.status != "STORED" {
+        return resp, nil
+    }
+    return &Response{status: "INCR", msg: initial}, targets
+}
+
+// commands of the binary protocol
+func (c *ServerConn) serveBinary(rbuf *bufio.Reader, wbuf *bufio.Writer, store DistributeStorage, stats *Stats) (e error) {
+    defer wbuf.Flush()
+    for {
+        if rbuf.Buffered() == 0 {
+            // replies of quiet commands are sent with the following one
+            if e = wbuf.Flush(); e != nil {
+                break
+            }
+        }
+        c.setIdleDeadline()
+        var r binaryRequest
+        if e = r.Read(rbuf); e != nil {
+            if ne, ok := e.(net.Error); ok && ne.Timeout() {
+                atomic.AddInt64(&idleClosed, 1)
+            }
+            break
+        }
+        c.countCmd()
+        atomic.AddInt64(&binaryRequests, 1)
+
+        bc, ok := binaryCommands[r.opcode]
+        if !ok {
+            if e = r.writeError(wbuf, binaryUnknownCommand, ""); e != nil {
+                break
+            }
+            continue
+        }
+        if bc.cmd == "noop" {
+            if e = writeBinaryResponse(wbuf, r.opcode, binaryNoError, r.opaque, 0, nil, "", nil); e != nil {
+                break
+            }
+            continue
+        }
+        if bc.cmd == "quit" {
+            if !bc.quiet {
+                writeBinaryResponse(wbuf, r.opcode, binaryNoError, r.opaque, 0, nil, "", nil)
+            }
+            return
+        }
+        req, status := r.request(bc)
+        if status != binaryNoError {
+            if e = r.writeError(wbuf, status, ""); e != nil {
+                break
+            }
+            continue
+        }
+
+        t := time.Now()
+        req.admin = c.admin
+        c.mem.hold(requestBytes(req), 0)
+        resp, hosts, err := req.Process(store, stats)
+        if resp == nil {
+            c.mem.hold(0, 0)
+            // not supported by the text protocol either
+            if e = r.writeError(wbuf, binaryUnknownCommand, ""); e != nil {
+                break
+            }
+            continue
+        }
+        if req.Cmd == "incr" || req.Cmd == "decr" {
+            var targets []string
+            if resp, targets = r.incrInitial(req, resp, store, stats); targets != nil {
+                hosts = targets
+            }
+        }
+        dt := time.Since(t)
+        if dt > SlowCmdTime {
+            stats.UpdateStat("slow_cmd", 1)
+        }
+
+        if CompressFlag != 0 && len(resp.items) > 0 {
+            decompressItems(resp)
+        }
+        c.mem.hold(requestBytes(req), responseBytes(resp))
+        if e = r.writeResponse(wbuf, bc, req, resp); e != nil {
+            break
+        }
+        c.fingerprint(req, err, dt)
+        c.logAccess(req, resp, hosts, err, dt)
+        c.capture(req, resp, rbuf.Buffered())
+
+        req.Clear()
+        resp.CleanBuffer()
+        c.mem.hold(0, 0)
+
+        if c.closeAfterReply {
+            break
+        }
+    }
+    return
+}
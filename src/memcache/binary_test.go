@@ -0,0 +1,152 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func binaryPacket(opcode byte, opaque uint32, extras []byte, key string, value []byte) []byte {
+	var b bytes.Buffer
+	writeBinaryResponse(&b, opcode, 0, opaque, 0, extras, key, value)
+	p := b.Bytes()
+	p[0] = binaryRequestMagic
+	return p
+}
+
+type binaryReply struct {
+	opcode byte
+	status uint16
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+func readBinaryReply(t *testing.T, r io.Reader) binaryReply {
+	var h [binaryHeaderLen]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	if h[0] != binaryResponseMagic {
+		t.Fatalf("bad magic %x", h[0])
+	}
+	keyLen := int(binary.BigEndian.Uint16(h[2:]))
+	extLen := int(h[4])
+	body := make([]byte, binary.BigEndian.Uint32(h[8:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return binaryReply{
+		opcode: h[1],
+		status: binary.BigEndian.Uint16(h[6:]),
+		opaque: binary.BigEndian.Uint32(h[12:]),
+		cas:    binary.BigEndian.Uint64(h[16:]),
+		extras: body[:extLen],
+		key:    string(body[extLen : extLen+keyLen]),
+		value:  body[extLen+keyLen:],
+	}
+}
+
+func TestBinaryProtocol(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newServerConn(server)
+	done := make(chan error, 1)
+	go func() { done <- c.Serve(newMapDistStore(), NewStats()) }()
+	r := bufio.NewReader(client)
+	send := func(p []byte) {
+		if _, err := client.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setExtras := []byte{0, 0, 0, 7, 0, 0, 0, 0}
+	send(binaryPacket(0x01, 1, setExtras, "k", []byte("v1")))
+	if rep := readBinaryReply(t, r); rep.status != binaryNoError || rep.opaque != 1 {
+		t.Errorf("set: %+v", rep)
+	}
+
+	send(binaryPacket(0x0c, 2, nil, "k", nil))
+	rep := readBinaryReply(t, r)
+	if rep.status != binaryNoError || rep.key != "k" || string(rep.value) != "v1" ||
+		binary.BigEndian.Uint32(rep.extras) != 7 || rep.cas == 0 {
+		t.Errorf("getk: %+v", rep)
+	}
+
+	// the miss of getq is not replied, noop is
+	send(append(binaryPacket(0x09, 3, nil, "missing", nil), binaryPacket(0x0a, 4, nil, "", nil)...))
+	if rep := readBinaryReply(t, r); rep.opcode != 0x0a || rep.opaque != 4 {
+		t.Errorf("getq of missing key should be quiet: %+v", rep)
+	}
+
+	send(binaryPacket(0x1c, 5, []byte{0, 0, 0, 10}, "k", nil))
+	if rep := readBinaryReply(t, r); rep.status != binaryNoError {
+		t.Errorf("touch: %+v", rep)
+	}
+	send(binaryPacket(0x23, 5, []byte{0, 0, 0, 20}, "k", nil))
+	if rep := readBinaryReply(t, r); rep.status != binaryNoError || rep.key != "k" || string(rep.value) != "v1" {
+		t.Errorf("gatk: %+v", rep)
+	}
+
+	send(binaryPacket(0x04, 5, nil, "k", nil))
+	if rep := readBinaryReply(t, r); rep.status != binaryNoError {
+		t.Errorf("delete: %+v", rep)
+	}
+	send(binaryPacket(0x04, 6, nil, "k", nil))
+	if rep := readBinaryReply(t, r); rep.status != binaryKeyNotFound {
+		t.Errorf("delete of missing key: %+v", rep)
+	}
+
+	// created with the initial value, then incremented
+	incr := make([]byte, 20)
+	binary.BigEndian.PutUint64(incr, 2)
+	binary.BigEndian.PutUint64(incr[8:], 5)
+	for _, want := range []uint64{5, 7} {
+		send(binaryPacket(0x05, 7, incr, "n", nil))
+		rep := readBinaryReply(t, r)
+		if rep.status != binaryNoError || len(rep.value) != 8 || binary.BigEndian.Uint64(rep.value) != want {
+			t.Errorf("incr should be %d: %+v", want, rep)
+		}
+	}
+
+	send(binaryPacket(0x0b, 8, nil, "", nil))
+	if rep := readBinaryReply(t, r); string(rep.value) != VersionString() {
+		t.Errorf("version: %+v", rep)
+	}
+
+	send(binaryPacket(0x40, 9, nil, "", nil))
+	if rep := readBinaryReply(t, r); rep.status != binaryUnknownCommand || rep.opaque != 9 {
+		t.Errorf("unknown command: %+v", rep)
+	}
+
+	send(binaryPacket(0x07, 10, nil, "", nil))
+	if rep := readBinaryReply(t, r); rep.opcode != 0x07 {
+		t.Errorf("quit: %+v", rep)
+	}
+	<-done
+}
+
+func TestBinaryStats(t *testing.T) {
+	r := &binaryRequest{opcode: 0x10, opaque: 1}
+	resp := &Response{status: "STAT", msg: "STAT pid 1\r\nSTAT version 1.6.9 beansdb\r\nSTAT rusage_user 0.1\r\n"}
+	var b bytes.Buffer
+	if err := r.writeResponse(&b, binaryCommands[0x10], &Request{Cmd: "stats"}, resp); err != nil {
+		t.Fatal(err)
+	}
+	stats := make(map[string]string)
+	for {
+		rep := readBinaryReply(t, &b)
+		if rep.key == "" {
+			break
+		}
+		stats[rep.key] = string(rep.value)
+	}
+	if len(stats) != 3 || stats["version"] != "1.6.9 beansdb" || stats["pid"] != "1" {
+		t.Errorf("stat values should be kept with their spaces: %v", stats)
+	}
+}
@@ -0,0 +1,439 @@
+/*
+ * embedded storage like bitcask in beansdb: append-only data files with
+ * an in-memory index of the latest record of every key
+ */
+
+package memcache
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// crc, exptime, flag, version, key size, value size
+const bitcaskHeaderSize = 24
+
+// default size of data files, a new data file is started when the active
+// one is larger than this
+var BitcaskMaxFileSize int64 = 1 << 30
+
+// fsync after every write
+var BitcaskSync = false
+
+type bitcaskEntry struct {
+    file   int
+    offset int64
+    size   int
+    ver    int32
+}
+
+// exptime of items is kept but not enforced, as beansdb does
+type BitcaskStore struct {
+    MaxFileSize int64
+    lock        sync.RWMutex
+    dir         string
+    files       map[int]*os.File
+    active      int
+    size        int64 // size of active file
+    index       map[string]*bitcaskEntry
+}
+
+func bitcaskPath(dir string, id int) string {
+    return filepath.Join(dir, fmt.Sprintf("%03d.data", id))
+}
+
+// open the store in dir, the index is rebuilt by scanning all the data files
+func OpenBitcaskStore(dir string) (*BitcaskStore, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    paths, err := filepath.Glob(filepath.Join(dir, "*.data"))
+    if err != nil {
+        return nil, err
+    }
+    var ids []int
+    for _, path := range paths {
+        var id int
+        if _, err := fmt.Sscanf(filepath.Base(path), "%d.data", &id); err == nil {
+            ids = append(ids, id)
+        }
+    }
+    sort.Ints(ids)
+
+    s := new(BitcaskStore)
+    s.MaxFileSize = BitcaskMaxFileSize
+    s.dir = dir
+    s.files = make(map[int]*os.File)
+    s.index = make(map[string]*bitcaskEntry)
+    for i, id := range ids {
+        f, err := os.OpenFile(bitcaskPath(dir, id), os.O_RDWR, 0644)
+        if err != nil {
+            s.Close()
+            return nil, err
+        }
+        s.files[id] = f
+        size := s.scan(id, f, i == len(ids)-1)
+        if i == len(ids)-1 {
+            s.active = id
+            s.size = size
+        }
+    }
+    if len(ids) == 0 {
+        if err := s.rotate(); err != nil {
+            return nil, err
+        }
+    }
+    return s, nil
+}
+
+// load records of the file into index, return the size of valid records,
+// a broken tail of the active file is truncated
+func (s *BitcaskStore) scan(id int, f *os.File, active bool) int64 {
+    var offset int64
+    for {
+        _, _, ver, key, _, size, err := readBitcaskRecord(f, offset)
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            ErrorLog.Printf("broken record in %s at %d: %s", f.Name(), offset, err)
+            if active {
+                if e := f.Truncate(offset); e != nil {
+                    ErrorLog.Print("truncate failed: ", e)
+                }
+            }
+            break
+        }
+        if ver < 0 {
+            delete(s.index, key)
+        } else {
+            s.index[key] = &bitcaskEntry{id, offset, size, ver}
+        }
+        offset += int64(size)
+    }
+    return offset
+}
+
+func readBitcaskRecord(f *os.File, offset int64) (exptime, flag int, ver int32, key string, value []byte, size int, err error) {
+    var header [bitcaskHeaderSize]byte
+    if _, err = f.ReadAt(header[:], offset); err != nil {
+        if err == io.EOF {
+            // partial header
+            if st, e := f.Stat(); e == nil && st.Size() > offset {
+                err = io.ErrUnexpectedEOF
+            }
+        }
+        return
+    }
+    ksz := binary.LittleEndian.Uint32(header[16:])
+    vsz := binary.LittleEndian.Uint32(header[20:])
+    if ksz == 0 || ksz > MaxKeyLength || vsz > MaxBodyLength {
+        err = errors.New("invalid size of key or value")
+        return
+    }
+    buf := make([]byte, ksz+vsz)
+    if _, err = f.ReadAt(buf, offset+bitcaskHeaderSize); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return
+    }
+    crc := crc32.NewIEEE()
+    crc.Write(header[4:])
+    crc.Write(buf)
+    if crc.Sum32() != binary.LittleEndian.Uint32(header[0:]) {
+        err = errors.New("crc mismatch")
+        return
+    }
+    exptime = int(int32(binary.LittleEndian.Uint32(header[4:])))
+    flag = int(int32(binary.LittleEndian.Uint32(header[8:])))
+    ver = int32(binary.LittleEndian.Uint32(header[12:]))
+    key = string(buf[:ksz])
+    value = buf[ksz:]
+    size = bitcaskHeaderSize + len(buf)
+    return
+}
+
+// start a new active data file
+func (s *BitcaskStore) rotate() error {
+    id := s.active + 1
+    if len(s.files) == 0 {
+        id = 0
+    }
+    f, err := os.OpenFile(bitcaskPath(s.dir, id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+    if err != nil {
+        return err
+    }
+    s.files[id] = f
+    s.active = id
+    s.size = 0
+    return nil
+}
+
+// append a record to the active file, negative ver means deleted
+func (s *BitcaskStore) write(key string, exptime, flag int, ver int32, value []byte) (*bitcaskEntry, error) {
+    size := bitcaskHeaderSize + len(key) + len(value)
+    if s.size > 0 && s.size+int64(size) > s.MaxFileSize {
+        if err := s.rotate(); err != nil {
+            return nil, err
+        }
+    }
+    buf := make([]byte, size)
+    binary.LittleEndian.PutUint32(buf[4:], uint32(int32(exptime)))
+    binary.LittleEndian.PutUint32(buf[8:], uint32(int32(flag)))
+    binary.LittleEndian.PutUint32(buf[12:], uint32(ver))
+    binary.LittleEndian.PutUint32(buf[16:], uint32(len(key)))
+    binary.LittleEndian.PutUint32(buf[20:], uint32(len(value)))
+    copy(buf[bitcaskHeaderSize:], key)
+    copy(buf[bitcaskHeaderSize+len(key):], value)
+    binary.LittleEndian.PutUint32(buf[0:], crc32.ChecksumIEEE(buf[4:]))
+
+    f := s.files[s.active]
+    if _, err := f.WriteAt(buf, s.size); err != nil {
+        return nil, err
+    }
+    if BitcaskSync {
+        if err := f.Sync(); err != nil {
+            return nil, err
+        }
+    }
+    e := &bitcaskEntry{s.active, s.size, size, ver}
+    s.size += int64(size)
+    return e, nil
+}
+
+func (s *BitcaskStore) get(key string) (*Item, error) {
+    e, ok := s.index[key]
+    if !ok {
+        return nil, nil
+    }
+    exptime, flag, ver, _, value, _, err := readBitcaskRecord(s.files[e.file], e.offset)
+    if err != nil {
+        ErrorLog.Printf("read %s from %s failed: %s", key, s.files[e.file].Name(), err)
+        return nil, err
+    }
+    return &Item{Flag: flag, Exptime: exptime, Cas: int(ver), Body: value}, nil
+}
+
+func (s *BitcaskStore) set(key string, item *Item) error {
+    var ver int32 = 1
+    if e, ok := s.index[key]; ok {
+        ver = e.ver + 1
+    }
+    e, err := s.write(key, item.Exptime, item.Flag, ver, item.Body)
+    if err != nil {
+        ErrorLog.Printf("write %s failed: %s", key, err)
+        return err
+    }
+    s.index[key] = e
+    item.Cas = int(ver)
+    return nil
+}
+
+func (s *BitcaskStore) Get(key string) (*Item, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return s.get(key)
+}
+
+func (s *BitcaskStore) GetMulti(keys []string) (map[string]*Item, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    rs := make(map[string]*Item, len(keys))
+    for _, key := range keys {
+        r, err := s.get(key)
+        if err != nil {
+            return rs, err
+        }
+        if r != nil {
+            rs[key] = r
+        }
+    }
+    return rs, nil
+}
+
+func (s *BitcaskStore) Set(key string, item *Item, noreply bool) (bool, error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    err := s.set(key, item)
+    return err == nil, err
+}
+
+func (s *BitcaskStore) Append(key string, value []byte) (bool, error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    r, err := s.get(key)
+    if err != nil || r == nil || r.Flag != 0 {
+        return false, err
+    }
+    r.Body = append(r.Body, value...)
+    err = s.set(key, r)
+    return err == nil, err
+}
+
+func (s *BitcaskStore) Prepend(key string, value []byte) (bool, error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    r, err := s.get(key)
+    if err != nil || r == nil || r.Flag != 0 {
+        return false, err
+    }
+    r.Body = append(append([]byte(nil), value...), r.Body...)
+    err = s.set(key, r)
+    return err == nil, err
+}
+
+func (s *BitcaskStore) Incr(key string, v int) (n int, err error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    r, err := s.get(key)
+    if err != nil {
+        return
+    }
+    if r == nil {
+        return 0, ErrNotFound
+    }
+    if n, err = incrValue(r.Body, v); err != nil {
+        return
+    }
+    r.Body = []byte(strconv.Itoa(n))
+    err = s.set(key, r)
+    return
+}
+
+func (s *BitcaskStore) Delete(key string) (bool, error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    e, ok := s.index[key]
+    if !ok {
+        return false, nil
+    }
+    if _, err := s.write(key, 0, 0, -(e.ver + 1), nil); err != nil {
+        ErrorLog.Printf("delete %s failed: %s", key, err)
+        return false, err
+    }
+    delete(s.index, key)
+    return true, nil
+}
+
+func (s *BitcaskStore) Len() int {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return len(s.index)
+}
+
+// rewrite live records in old data files into the active one, then remove them
+func (s *BitcaskStore) Compact() error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    old := make(map[int]bool, len(s.files))
+    for id := range s.files {
+        if id != s.active {
+            old[id] = true
+        }
+    }
+    if len(old) == 0 {
+        return nil
+    }
+    for key, e := range s.index {
+        if !old[e.file] {
+            continue
+        }
+        exptime, flag, ver, _, value, _, err := readBitcaskRecord(s.files[e.file], e.offset)
+        if err != nil {
+            return err
+        }
+        ne, err := s.write(key, exptime, flag, ver, value)
+        if err != nil {
+            return err
+        }
+        s.index[key] = ne
+    }
+    // tombstones are dropped with the old files
+    for id := range old {
+        f := s.files[id]
+        f.Close()
+        delete(s.files, id)
+        if err := os.Remove(f.Name()); err != nil {
+            return err
+        }
+    }
+    ErrorLog.Printf("%d data files compacted in %s", len(old), s.dir)
+    return nil
+}
+
+// compact every interval in background until done is closed
+func (s *BitcaskStore) CompactEvery(interval time.Duration, done <-chan struct{}) {
+    for {
+        select {
+        case <-time.After(interval):
+        case <-done:
+            return
+        }
+        if err := s.Compact(); err != nil {
+            ErrorLog.Printf("compact %s failed: %s", s.dir, err)
+        }
+    }
+}
+
+// total size of data files
+func (s *BitcaskStore) Size() (size int64) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    for id, f := range s.files {
+        if id == s.active {
+            size += s.size
+        } else if st, err := f.Stat(); err == nil {
+            size += st.Size()
+        }
+    }
+    return
+}
+
+// remove the oldest data file with all the keys in it, used as a cache
+func (s *BitcaskStore) DropOldest() error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if len(s.files) == 1 {
+        if err := s.rotate(); err != nil {
+            return err
+        }
+    }
+    oldest := s.active
+    for id := range s.files {
+        if id < oldest {
+            oldest = id
+        }
+    }
+    for key, e := range s.index {
+        if e.file == oldest {
+            delete(s.index, key)
+        }
+    }
+    f := s.files[oldest]
+    f.Close()
+    delete(s.files, oldest)
+    return os.Remove(f.Name())
+}
+
+func (s *BitcaskStore) Close() error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    var err error
+    for id, f := range s.files {
+        if e := f.Close(); e != nil {
+            err = e
+        }
+        delete(s.files, id)
+    }
+    return err
+}
@@ -0,0 +1,98 @@
+package memcache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBitcaskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitcask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenBitcaskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("a", &Item{Flag: 0, Body: []byte("hello")}, false)
+	s.Set("b", &Item{Flag: 0, Body: []byte("1")}, false)
+	s.Set("c", &Item{Flag: 0, Body: []byte("c")}, false)
+	s.Append("a", []byte(" world"))
+	if n, _ := s.Incr("b", 2); n != 3 {
+		t.Errorf("incr should be 3: %d", n)
+	}
+	if ok, _ := s.Delete("c"); !ok {
+		t.Errorf("delete should succeed")
+	}
+	r, _ := s.Get("a")
+	if r == nil || string(r.Body) != "hello world" || r.Cas != 2 {
+		t.Errorf("append failed: %v", r)
+	}
+	s.Close()
+
+	// a half written record at the tail
+	f, _ := os.OpenFile(bitcaskPath(dir, 0), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte("broken"))
+	f.Close()
+
+	s, err = OpenBitcaskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 2 {
+		t.Errorf("index should be rebuilt with 2 keys: %d", s.Len())
+	}
+	rs, _ := s.GetMulti([]string{"a", "b", "c"})
+	if len(rs) != 2 || string(rs["a"].Body) != "hello world" || string(rs["b"].Body) != "3" {
+		t.Errorf("values should be reloaded: %v", rs)
+	}
+	s.Set("d", &Item{Flag: 0, Body: []byte("d")}, false)
+	if r, _ := s.Get("d"); r == nil || string(r.Body) != "d" {
+		t.Errorf("broken tail should be truncated before writing: %v", r)
+	}
+
+	// start a new data file
+	s.MaxFileSize = 1
+	s.Set("e", &Item{Flag: 0, Body: []byte("e")}, false)
+	s.MaxFileSize = BitcaskMaxFileSize
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.files) != 1 || s.Len() != 4 {
+		t.Errorf("old files should be compacted: %d files %d keys", len(s.files), s.Len())
+	}
+	for _, key := range []string{"a", "b", "d", "e"} {
+		if r, _ := s.Get(key); r == nil {
+			t.Errorf("%s lost after compaction", key)
+		}
+	}
+
+	s.MaxFileSize = 1
+	s.Set("f", &Item{Flag: 0, Body: []byte("f")}, false)
+	s.MaxFileSize = BitcaskMaxFileSize
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		s.CompactEvery(time.Millisecond, done)
+		close(stopped)
+	}()
+	for i := 0; i < 100; i++ {
+		s.lock.RLock()
+		n := len(s.files)
+		s.lock.RUnlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	<-stopped
+	if len(s.files) != 1 || s.Len() != 5 {
+		t.Errorf("old files should be compacted in background: %d files %d keys", len(s.files), s.Len())
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * consistent hashing with bounded loads
+ */
+
+package memcache
+
+import (
+    "math"
+    "sync"
+    "time"
+)
+
+// a host gets no more than (1+epsilon) of the average load
+var BoundedLoadEpsilon = 0.25
+
+// loads are counted in windows of this
+var BoundedLoadWindow = time.Second
+
+// BoundedLoadScheduler route a key to the first host on the ring whose
+// requests in current window are under the bound, so the excess keys of a
+// busy host spill to the next hosts on the ring.
+type BoundedLoadScheduler struct {
+    *ConsistantHashScheduler
+    epsilon float64
+    lock    sync.Mutex
+    window  time.Time
+    loads   map[*Host]int64
+    total   int64
+}
+
+func NewBoundedLoadScheduler(hosts []string, hashname string, epsilon float64) *BoundedLoadScheduler {
+    c := &BoundedLoadScheduler{epsilon: epsilon, loads: make(map[*Host]int64)}
+    c.ConsistantHashScheduler = NewConsistantHashScheduler(hosts, hashname).(*ConsistantHashScheduler)
+    return c
+}
+
+func (c *BoundedLoadScheduler) GetHostsByKey(key string) []*Host {
+    ring := c.current()
+    pos := c.ringPosition(ring, key)
+    now := time.Now()
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if now.Sub(c.window) >= BoundedLoadWindow {
+        c.window = now
+        c.loads = make(map[*Host]int64, len(ring.hosts))
+        c.total = 0
+    }
+    bound := int64(math.Ceil((1 + c.epsilon) * float64(c.total+1) / float64(len(ring.hosts))))
+    host := ring.hosts[ring.index[pos]&0xffffffff]
+    for k := 0; k < len(ring.index); k++ {
+        h := ring.hosts[ring.index[(pos+k)%len(ring.index)]&0xffffffff]
+        if c.loads[h] < bound && !h.unavailable() {
+            host = h
+            break
+        }
+    }
+    c.loads[host]++
+    c.total++
+    return []*Host{host}
+}
+
+// requests of hosts in current window
+func (c *BoundedLoadScheduler) Loads() map[string]int64 {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    r := make(map[string]int64, len(c.loads))
+    for h, n := range c.loads {
+        r[h.Addr] = n
+    }
+    return r
+}
@@ -0,0 +1,37 @@
+package memcache
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBoundedLoadScheduler(t *testing.T) {
+	BoundedLoadWindow = time.Hour
+	defer func() { BoundedLoadWindow = time.Second }()
+	hosts := make([]string, 10)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host%d:11211", i)
+	}
+	c := NewBoundedLoadScheduler(hosts, "fnv1a1", 0.25)
+	plain := NewConsistantHashScheduler(hosts, "fnv1a1")
+	if a, b := c.GetHostsByKey("key")[0].Addr, plain.GetHostsByKey("key")[0].Addr; a != b {
+		t.Errorf("key should be on its host of ring without load: %s %s", a, b)
+	}
+
+	total := 10000
+	for i := 1; i < total; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if i%3 == 0 {
+			key = "hot"
+		}
+		c.GetHostsByKey(key)
+	}
+	bound := int64(math.Ceil(1.25 * float64(total) / float64(len(hosts))))
+	for addr, n := range c.Loads() {
+		if n > bound {
+			t.Errorf("load of %s is %d, more than %d", addr, n, bound)
+		}
+	}
+}
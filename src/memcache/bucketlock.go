@@ -0,0 +1,120 @@
+/*
+ * per-bucket locks, so two jobs can not move the same bucket concurrently
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "sync"
+    "time"
+)
+
+// BucketLocker coordinate the jobs (migration, sync) which move data of buckets
+type BucketLocker interface {
+    Lock(bucket int, owner string, ttl time.Duration) error
+    Unlock(bucket int, owner string) error
+}
+
+type bucketLease struct {
+    owner  string
+    expire time.Time
+}
+
+// lock buckets in this process
+type LocalBucketLocker struct {
+    lock   sync.Mutex
+    leases map[int]*bucketLease
+}
+
+func NewLocalBucketLocker() *LocalBucketLocker {
+    return &LocalBucketLocker{leases: make(map[int]*bucketLease)}
+}
+
+func (l *LocalBucketLocker) Lock(bucket int, owner string, ttl time.Duration) error {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    now := time.Now()
+    if lease, ok := l.leases[bucket]; ok && lease.owner != owner && lease.expire.After(now) {
+        return fmt.Errorf("bucket %X is locked by %s", bucket, lease.owner)
+    }
+    l.leases[bucket] = &bucketLease{owner, now.Add(ttl)}
+    return nil
+}
+
+func (l *LocalBucketLocker) Unlock(bucket int, owner string) error {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    if lease, ok := l.leases[bucket]; ok && lease.owner != owner {
+        return fmt.Errorf("bucket %X is locked by %s", bucket, lease.owner)
+    }
+    delete(l.leases, bucket)
+    return nil
+}
+
+// lock buckets by `add` a key into a shared memcached, so that the proxies
+// and tools using the same host will see each other. Renewing and unlocking
+// are by `gets` and `cas`, so a lock expired and taken by others meanwhile
+// is never overwritten, unlocked ones are left with no owner for a second.
+type HostBucketLocker struct {
+    host *Host
+}
+
+func NewHostBucketLocker(addr string) *HostBucketLocker {
+    return &HostBucketLocker{NewHost(addr)}
+}
+
+func bucketLockKey(bucket int) string {
+    return fmt.Sprintf("__beanseye_lock_bucket_%X", bucket)
+}
+
+func (l *HostBucketLocker) Lock(bucket int, owner string, ttl time.Duration) error {
+    key := bucketLockKey(bucket)
+    item := &Item{Exptime: int(ttl / time.Second), Body: []byte(owner)}
+    ok, err := l.host.Add(key, item)
+    if err != nil {
+        return err
+    }
+    if ok {
+        return nil
+    }
+    it, err := l.host.Gets(key)
+    if err != nil {
+        return err
+    }
+    if it == nil {
+        return fmt.Errorf("bucket %X is being locked by others", bucket)
+    }
+    if len(it.Body) > 0 && string(it.Body) != owner {
+        return fmt.Errorf("bucket %X is locked by %s", bucket, it.Body)
+    }
+    // renew the lock of the same owner, or take the unlocked one
+    item.Cas = it.Cas
+    status, err := l.host.Cas(key, item)
+    if err != nil {
+        return err
+    }
+    if status != "STORED" {
+        return fmt.Errorf("bucket %X is being locked by others", bucket)
+    }
+    return nil
+}
+
+func (l *HostBucketLocker) Unlock(bucket int, owner string) error {
+    key := bucketLockKey(bucket)
+    it, err := l.host.Gets(key)
+    if err != nil || it == nil || len(it.Body) == 0 {
+        return err
+    }
+    if string(it.Body) != owner {
+        return fmt.Errorf("bucket %X is locked by %s", bucket, it.Body)
+    }
+    status, err := l.host.Cas(key, &Item{Exptime: 1, Cas: it.Cas})
+    if err != nil {
+        return err
+    }
+    if status == "EXISTS" {
+        return fmt.Errorf("bucket %X is being locked by others", bucket)
+    }
+    return nil
+}
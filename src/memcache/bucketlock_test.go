@@ -0,0 +1,64 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalBucketLocker(t *testing.T) {
+	l := NewLocalBucketLocker()
+	if err := l.Lock(1, "job1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Lock(1, "job2", time.Minute); err == nil {
+		t.Error("bucket 1 should be locked by job1")
+	}
+	if err := l.Lock(2, "job2", time.Minute); err != nil {
+		t.Error("bucket 2 should be free", err)
+	}
+	if err := l.Unlock(1, "job2"); err == nil {
+		t.Error("job2 should not unlock the bucket of job1")
+	}
+	l.Unlock(1, "job1")
+	if err := l.Lock(1, "job2", 0); err != nil {
+		t.Error("bucket 1 should be free after unlock", err)
+	}
+	if err := l.Lock(1, "job1", time.Minute); err != nil {
+		t.Error("expired lock should be taken over", err)
+	}
+}
+
+func TestHostBucketLocker(t *testing.T) {
+	node := newMockNode()
+	l := &HostBucketLocker{NewNodeHost("locks", node)}
+	if err := l.Lock(1, "job1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Lock(1, "job2", time.Minute); err == nil {
+		t.Error("bucket 1 should be locked by job1")
+	}
+	if err := l.Lock(1, "job1", time.Minute); err != nil {
+		t.Error("job1 should renew its lock", err)
+	}
+	if err := l.Unlock(1, "job2"); err == nil {
+		t.Error("job2 should not unlock the bucket of job1")
+	}
+	if err := l.Unlock(1, "job1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Lock(1, "job2", time.Minute); err != nil {
+		t.Error("bucket 1 should be free after unlock", err)
+	}
+
+	// expired and taken by job3
+	node.Set(bucketLockKey(1), &Item{Body: []byte("job3")}, false)
+	if err := l.Lock(1, "job2", time.Minute); err == nil {
+		t.Error("job2 should not renew the bucket taken by job3")
+	}
+	if err := l.Unlock(1, "job2"); err == nil {
+		t.Error("job2 should not unlock the bucket taken by job3")
+	}
+	if it, _ := node.Get(bucketLockKey(1)); it == nil || string(it.Body) != "job3" {
+		t.Errorf("the lock of job3 should be kept: %v", it)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * pin buckets onto hosts for a while, overriding the order learned by the
+ * scheduler, to mitigate an incident when the automatic choice is wrong
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// the pinned hosts go first in the bucket, in the order given, until it expires
+type BucketPin struct {
+    Hosts   []string
+    Expires time.Time
+}
+
+type BucketPinner interface {
+    PinBucket(bucket int, addrs []string, ttl time.Duration) error
+    UnpinBucket(bucket int) bool
+    BucketPins() map[string]BucketPin // hex bucket -> pin
+}
+
+type bucketPins struct {
+    count int32 // nothing to do if it's 0
+    lock  sync.RWMutex
+    pins  map[int]*BucketPin
+}
+
+// addrs should be hosts of the scheduler, known tells
+func (p *bucketPins) pin(bucket, bs int, addrs []string, ttl time.Duration, known func(addr string) bool) error {
+    if bucket < 0 || bucket >= bs {
+        return fmt.Errorf("invalid bucket %x", bucket)
+    }
+    if len(addrs) == 0 {
+        return fmt.Errorf("no hosts to pin bucket %x", bucket)
+    }
+    if ttl <= 0 {
+        return fmt.Errorf("pin of bucket %x should expire", bucket)
+    }
+    for _, addr := range addrs {
+        if !known(addr) {
+            return fmt.Errorf("%s is not a host of bucket %x", addr, bucket)
+        }
+    }
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    if p.pins == nil {
+        p.pins = make(map[int]*BucketPin)
+    }
+    p.pins[bucket] = &BucketPin{Hosts: append([]string(nil), addrs...), Expires: time.Now().Add(ttl)}
+    atomic.StoreInt32(&p.count, int32(len(p.pins)))
+    RecordEvent("bucket pin", "", fmt.Sprintf("bucket %x onto %v for %v", bucket, addrs, ttl))
+    return nil
+}
+
+func (p *bucketPins) unpin(bucket int) bool {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    if _, ok := p.pins[bucket]; !ok {
+        return false
+    }
+    delete(p.pins, bucket)
+    atomic.StoreInt32(&p.count, int32(len(p.pins)))
+    RecordEvent("bucket unpin", "", fmt.Sprintf("bucket %x", bucket))
+    return true
+}
+
+// the pins not expired yet
+func (p *bucketPins) list() map[string]BucketPin {
+    p.expire(time.Now())
+    p.lock.RLock()
+    defer p.lock.RUnlock()
+    r := make(map[string]BucketPin, len(p.pins))
+    for b, pin := range p.pins {
+        r[fmt.Sprintf("%x", b)] = *pin
+    }
+    return r
+}
+
+func (p *bucketPins) expire(now time.Time) {
+    if atomic.LoadInt32(&p.count) == 0 {
+        return
+    }
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    for b, pin := range p.pins {
+        if now.After(pin.Expires) {
+            delete(p.pins, b)
+            ErrorLog.Printf("pin of bucket %x onto %v expired", b, pin.Hosts)
+            RecordEvent("bucket unpin", "", fmt.Sprintf("bucket %x expired", b))
+        }
+    }
+    atomic.StoreInt32(&p.count, int32(len(p.pins)))
+}
+
+// move the pinned hosts of the bucket to the first, in place
+func (p *bucketPins) apply(bucket int, hosts []*Host) []*Host {
+    if atomic.LoadInt32(&p.count) == 0 {
+        return hosts
+    }
+    p.lock.RLock()
+    pin := p.pins[bucket]
+    p.lock.RUnlock()
+    if pin == nil {
+        return hosts
+    }
+    if time.Now().After(pin.Expires) {
+        p.expire(time.Now())
+        return hosts
+    }
+    rank := make(map[string]int, len(pin.Hosts))
+    for i, addr := range pin.Hosts {
+        rank[addr] = i
+    }
+    sort.SliceStable(hosts, func(i, j int) bool {
+        ri, oki := rankOf(rank, hosts[i])
+        rj, okj := rankOf(rank, hosts[j])
+        if oki && okj {
+            return ri < rj
+        }
+        return oki && !okj
+    })
+    return hosts
+}
+
+func rankOf(rank map[string]int, host *Host) (int, bool) {
+    if host == nil {
+        return 0, false
+    }
+    r, ok := rank[host.Addr]
+    return r, ok
+}
+
+func (c *AutoScheduler) PinBucket(bucket int, addrs []string, ttl time.Duration) error {
+    return c.pins.pin(bucket, len(c.buckets), addrs, ttl, func(addr string) bool {
+        for _, h := range c.hosts {
+            if h.Addr == addr {
+                return true
+            }
+        }
+        return false
+    })
+}
+
+func (c *AutoScheduler) UnpinBucket(bucket int) bool {
+    return c.pins.unpin(bucket)
+}
+
+func (c *AutoScheduler) BucketPins() map[string]BucketPin {
+    return c.pins.list()
+}
+
+func (c *ManualScheduler) PinBucket(bucket int, addrs []string, ttl time.Duration) error {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    // only the hosts of the bucket have the data
+    return c.pins.pin(bucket, len(c.buckets), addrs, ttl, func(addr string) bool {
+        for _, offsets := range [][]int{c.buckets[bucket], c.backups[bucket]} {
+            for _, offset := range offsets {
+                if c.hosts[offset].Addr == addr {
+                    return true
+                }
+            }
+        }
+        return false
+    })
+}
+
+func (c *ManualScheduler) UnpinBucket(bucket int) bool {
+    return c.pins.unpin(bucket)
+}
+
+func (c *ManualScheduler) BucketPins() map[string]BucketPin {
+    return c.pins.list()
+}
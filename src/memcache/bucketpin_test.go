@@ -0,0 +1,57 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketPins(t *testing.T) {
+	addrs := []string{"bpin1:11211", "bpin2:11211", "bpin3:11211"}
+	auto := newTestAutoScheduler(addrs, 16)
+	manual := newTestManualScheduler(map[string][]string{
+		addrs[0]: {"0", "1"}, addrs[1]: {"0", "1"}, addrs[2]: {"0"},
+	}, 16, 3)
+	manual.SetFixedOrder(addrs)
+	key := "@1" // bucket 1
+	for name, sch := range map[string]interface {
+		Scheduler
+		BucketPinner
+	}{"auto": auto, "manual": manual} {
+		if err := sch.PinBucket(1, []string{addrs[1]}, time.Minute); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if h := sch.GetHostsByKey(key)[0]; h.Addr != addrs[1] {
+			t.Errorf("%s: pinned host should be the first, got %s", name, h.Addr)
+		}
+		if h := sch.GetHostsByKey("@0")[0]; h.Addr != addrs[0] {
+			t.Errorf("%s: other buckets should not be pinned, got %s", name, h.Addr)
+		}
+		if pins := sch.BucketPins(); len(pins) != 1 || pins["1"].Hosts[0] != addrs[1] {
+			t.Errorf("%s: bad pins %v", name, pins)
+		}
+		if !sch.UnpinBucket(1) || sch.UnpinBucket(1) {
+			t.Errorf("%s: bucket should be unpinned once", name)
+		}
+		if h := sch.GetHostsByKey(key)[0]; h.Addr != addrs[0] {
+			t.Errorf("%s: unpinned bucket should be back, got %s", name, h.Addr)
+		}
+
+		sch.PinBucket(1, []string{addrs[1]}, time.Millisecond)
+		time.Sleep(2 * time.Millisecond)
+		if h := sch.GetHostsByKey(key)[0]; h.Addr != addrs[0] {
+			t.Errorf("%s: expired pin should be ignored, got %s", name, h.Addr)
+		}
+		if pins := sch.BucketPins(); len(pins) != 0 {
+			t.Errorf("%s: expired pin should be removed: %v", name, pins)
+		}
+
+		if sch.PinBucket(16, []string{addrs[1]}, time.Minute) == nil ||
+			sch.PinBucket(1, []string{"nosuch:11211"}, time.Minute) == nil ||
+			sch.PinBucket(1, []string{addrs[1]}, 0) == nil {
+			t.Errorf("%s: invalid pins should be rejected", name)
+		}
+	}
+	if manual.PinBucket(1, []string{addrs[2]}, time.Minute) == nil {
+		t.Errorf("host not serving the bucket should not be pinned")
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * read large values from dedicated bulk replicas, keep small ones fast
+ */
+
+package memcache
+
+import (
+    "strings"
+    "sync"
+)
+
+// the prefix of a key is the part before the first separator
+var PrefixSeparator = ":"
+
+// weight of the latest value in the average size of a prefix
+var SizeAlpha = 0.05
+
+// schedulers which want to know the sizes of values
+type sizeObserver interface {
+    ObserveSize(key string, size int)
+}
+
+func keyPrefix(key string) string {
+    if i := strings.Index(key, PrefixSeparator); i >= 0 {
+        return key[:i]
+    }
+    return key
+}
+
+// BulkScheduler track the average size of values by key prefix, reads of
+// prefixes with large values go to the bulk scheduler, which should route
+// to other replicas (or links) of the same buckets. Writes are not changed.
+type BulkScheduler struct {
+    Scheduler
+    bulk      Scheduler
+    threshold int // average size of bulk prefixes
+    n         int
+    lock      sync.RWMutex
+    sizes     map[string]float64
+}
+
+func NewBulkScheduler(sch, bulk Scheduler, threshold, n int) *BulkScheduler {
+    return &BulkScheduler{Scheduler: sch, bulk: bulk, threshold: threshold, n: n, sizes: make(map[string]float64)}
+}
+
+func (c *BulkScheduler) Hosts() []*Host {
+    return appendHosts(SchedulerHosts(c.Scheduler), SchedulerHosts(c.bulk))
+}
+
+func (c *BulkScheduler) ObserveSize(key string, size int) {
+    p := keyPrefix(key)
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if avg, ok := c.sizes[p]; ok {
+        c.sizes[p] = avg*(1-SizeAlpha) + float64(size)*SizeAlpha
+    } else {
+        c.sizes[p] = float64(size)
+    }
+}
+
+func (c *BulkScheduler) isBulk(key string) bool {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    return c.sizes[keyPrefix(key)] > float64(c.threshold)
+}
+
+// average size of values by prefix
+func (c *BulkScheduler) PrefixSizes() map[string]float64 {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    r := make(map[string]float64, len(c.sizes))
+    for p, s := range c.sizes {
+        r[p] = s
+    }
+    return r
+}
+
+func (c *BulkScheduler) GetReadHostsByKey(key string) []*Host {
+    if c.isBulk(key) {
+        if hosts := readHostsByKey(c.bulk, key, c.n); len(hosts) > 0 {
+            return hosts
+        }
+    }
+    return readHostsByKey(c.Scheduler, key, c.n)
+}
+
+// writes go to the primary replicas only
+func (c *BulkScheduler) GetHostsByOp(key string, op Operation) []*Host {
+    if op == OpRead {
+        return c.GetReadHostsByKey(key)
+    }
+    return hostsByOp(c.Scheduler, key, op, c.n)
+}
+
+// feedback goes to the scheduler which the host belongs to
+func (c *BulkScheduler) Feedback(host *Host, key string, ev FeedbackEvent) {
+    for _, h := range c.bulk.GetHostsByKey(key) {
+        if h == host {
+            c.bulk.Feedback(host, key, ev)
+            return
+        }
+    }
+    c.Scheduler.Feedback(host, key, ev)
+}
@@ -0,0 +1,31 @@
+package memcache
+
+import "testing"
+
+func TestBulkScheduler(t *testing.T) {
+	primary := newTestManualScheduler(map[string][]string{"p1": {"0"}, "p2": {"0"}}, 1, 2)
+	bulk := newTestManualScheduler(map[string][]string{"b1": {"0"}}, 1, 1)
+	schd := NewBulkScheduler(primary, bulk, 1000, 2)
+
+	schd.ObserveSize("img:1", 100000)
+	schd.ObserveSize("user:1", 10)
+	if hosts := schd.GetReadHostsByKey("img:2"); len(hosts) != 1 || hosts[0].Addr != "b1" {
+		t.Errorf("large values should be read from bulk: %v", hosts)
+	}
+	if hosts := schd.GetReadHostsByKey("user:2"); len(hosts) == 0 || hosts[0].Addr[0] != 'p' {
+		t.Errorf("small values should be read from primary: %v", hosts)
+	}
+	if hosts := schd.GetHostsByKey("img:2"); len(hosts) != 2 || hosts[0].Addr[0] != 'p' {
+		t.Errorf("writes should go to primary: %v", hosts)
+	}
+
+	for i := 0; i < 200; i++ {
+		schd.ObserveSize("img:1", 10)
+	}
+	if hosts := schd.GetReadHostsByKey("img:2"); hosts[0].Addr[0] != 'p' {
+		t.Errorf("prefix should leave bulk after values become small: %v", hosts)
+	}
+	if sizes := schd.PrefixSizes(); len(sizes) != 2 || sizes["user"] != 10 {
+		t.Errorf("bad sizes of prefixes: %v", sizes)
+	}
+}
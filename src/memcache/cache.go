@@ -0,0 +1,76 @@
+package memcache
+
+import (
+    "container/list"
+    "sync"
+)
+
+type cacheEntry struct {
+    key  string
+    item *Item
+}
+
+// lruCache keep items in memory up to capacity bytes of body,
+// the least recently used ones are evicted
+type lruCache struct {
+    lock     sync.Mutex
+    capacity int
+    size     int
+    ll       *list.List
+    items    map[string]*list.Element
+}
+
+func newLRUCache(capacity int) *lruCache {
+    return &lruCache{capacity: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) Get(key string) *Item {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if e, ok := c.items[key]; ok {
+        c.ll.MoveToFront(e)
+        return e.Value.(*cacheEntry).item
+    }
+    return nil
+}
+
+func (c *lruCache) Put(key string, item *Item) {
+    if len(item.Body) > c.capacity {
+        c.Remove(key)
+        return
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if e, ok := c.items[key]; ok {
+        c.size -= len(e.Value.(*cacheEntry).item.Body)
+        e.Value.(*cacheEntry).item = item
+        c.ll.MoveToFront(e)
+    } else {
+        c.items[key] = c.ll.PushFront(&cacheEntry{key, item})
+    }
+    c.size += len(item.Body)
+    for c.size > c.capacity {
+        c.removeElement(c.ll.Back())
+    }
+}
+
+func (c *lruCache) Remove(key string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if e, ok := c.items[key]; ok {
+        c.removeElement(e)
+    }
+}
+
+func (c *lruCache) removeElement(e *list.Element) {
+    ent := e.Value.(*cacheEntry)
+    c.ll.Remove(e)
+    delete(c.items, ent.key)
+    c.size -= len(ent.item.Body)
+}
+
+func (c *lruCache) Len() int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.ll.Len()
+}
@@ -0,0 +1,234 @@
+/*
+ * capture raw exchanges of a key or a client for a while, like tcpdump on the
+ * proxy, to debug incompatible clients without access to the hosts
+ */
+
+package memcache
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// directory of capture files
+var CaptureDir = os.TempDir()
+
+// bytes written to a capture file at most, by default
+var CaptureMaxBytes int64 = 10 << 20
+
+// larger max of a capture is cut to it
+var CaptureLimitBytes int64 = 100 << 20
+
+// A capture is written as records of an exchange, a header line
+//
+//     # <time> <client> <in|out> <length>
+//
+// followed by the bytes as on the wire and a new line.
+type Capture struct {
+    Path     string
+    Key      string `json:",omitempty"` // exchanges with the key, any if empty
+    Client   string `json:",omitempty"` // exchanges of the client (ip or ip:port), any if empty
+    Until    time.Time
+    MaxBytes int64
+    Redact   bool // values are masked
+    Written  int64
+    Records  int
+
+    lock sync.Mutex
+    f    *os.File
+}
+
+var (
+    captureLock   sync.Mutex
+    activeCapture *Capture
+    capturing     int32 // 1 if activeCapture is not nil, read without the lock
+)
+
+func StartCapture(key, client string, d time.Duration, maxBytes int64, redact bool) (*Capture, error) {
+    if d <= 0 {
+        return nil, errors.New("invalid duration")
+    }
+    if maxBytes <= 0 {
+        maxBytes = CaptureMaxBytes
+    }
+    if maxBytes > CaptureLimitBytes {
+        maxBytes = CaptureLimitBytes
+    }
+    captureLock.Lock()
+    defer captureLock.Unlock()
+    if activeCapture != nil {
+        return nil, errors.New("capturing to " + activeCapture.Path)
+    }
+    now := time.Now()
+    // readable by the owner only, with keys and values of clients
+    f, err := ioutil.TempFile(CaptureDir, fmt.Sprintf("capture-%s-*.log", now.Format("20060102-150405")))
+    if err != nil {
+        return nil, err
+    }
+    path := f.Name()
+    c := &Capture{Path: path, Key: key, Client: client, Until: now.Add(d),
+        MaxBytes: maxBytes, Redact: redact, f: f}
+    activeCapture = c
+    atomic.StoreInt32(&capturing, 1)
+    ErrorLog.Printf("capturing exchanges (key %q, client %q) to %s for %s", key, client, path, d)
+    return c, nil
+}
+
+// stop the capture, returns it, nil if not capturing
+func StopCapture() *Capture {
+    captureLock.Lock()
+    c := activeCapture
+    captureLock.Unlock()
+    if c != nil && c.stop() {
+        return c
+    }
+    return nil
+}
+
+// stop it if it's still running
+func (c *Capture) stop() bool {
+    captureLock.Lock()
+    if activeCapture != c {
+        captureLock.Unlock()
+        return false
+    }
+    activeCapture = nil
+    atomic.StoreInt32(&capturing, 0)
+    captureLock.Unlock()
+
+    c.lock.Lock()
+    c.f.Close()
+    c.f = nil
+    records := c.Records
+    c.lock.Unlock()
+    ErrorLog.Printf("capture to %s stopped, %d records", c.Path, records)
+    return true
+}
+
+// the running capture, nil if not capturing
+func CurrentCapture() *Capture {
+    if atomic.LoadInt32(&capturing) == 0 {
+        return nil
+    }
+    captureLock.Lock()
+    c := activeCapture
+    captureLock.Unlock()
+    if c != nil && time.Now().After(c.Until) {
+        c.stop()
+        return nil
+    }
+    return c
+}
+
+func (c *Capture) match(client string, keys []string) bool {
+    if c.Client != "" && client != c.Client && !strings.HasPrefix(client, c.Client+":") {
+        return false
+    }
+    if c.Key == "" {
+        return true
+    }
+    for _, k := range keys {
+        if k == c.Key {
+            return true
+        }
+    }
+    return false
+}
+
+func (c *Capture) record(client, dir string, p []byte) {
+    if len(p) == 0 {
+        return
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    header := fmt.Sprintf("# %s %s %s %d\n", time.Now().Format(time.RFC3339Nano), client, dir, len(p))
+    size := int64(len(header) + len(p) + 1)
+    if c.f == nil {
+        return
+    }
+    if c.Written+size > c.MaxBytes {
+        go c.stop()
+        return
+    }
+    io.WriteString(c.f, header)
+    c.f.Write(p)
+    io.WriteString(c.f, "\n")
+    c.Written += size
+    c.Records++
+}
+
+// replace the first occurrence of every value by stars, the framing is kept
+func redactValues(p []byte, values [][]byte) []byte {
+    p = append([]byte(nil), p...)
+    for _, v := range values {
+        if len(v) == 0 {
+            continue
+        }
+        if i := bytes.Index(p, v); i >= 0 {
+            copy(p[i:], bytes.Repeat([]byte{'*'}, len(v)))
+        }
+    }
+    return p
+}
+
+// bytes read and written of a connection since the last exchange, only if
+// capturing
+type captureRecorder struct {
+    rw      io.ReadWriter
+    in, out []byte
+}
+
+func (r *captureRecorder) Read(p []byte) (int, error) {
+    n, err := r.rw.Read(p)
+    if atomic.LoadInt32(&capturing) != 0 {
+        r.in = append(r.in, p[:n]...)
+    }
+    return n, err
+}
+
+func (r *captureRecorder) Write(p []byte) (int, error) {
+    n, err := r.rw.Write(p)
+    if atomic.LoadInt32(&capturing) != 0 {
+        r.out = append(r.out, p[:n]...)
+    }
+    return n, err
+}
+
+// an exchange is done, buffered is the bytes read but not consumed yet
+func (c *ServerConn) capture(req *Request, resp *Response, buffered int) {
+    r := c.recorder
+    if r == nil || len(r.in) == 0 && len(r.out) == 0 {
+        return
+    }
+    n := len(r.in) - buffered
+    if n < 0 {
+        n = 0
+    }
+    in, out := r.in[:n], r.out
+    if cp := CurrentCapture(); cp != nil && cp.match(c.RemoteAddr, req.Keys) {
+        if cp.Redact {
+            var values [][]byte
+            if req.Item != nil {
+                values = append(values, req.Item.Body)
+            }
+            if resp != nil {
+                for _, item := range resp.items {
+                    values = append(values, item.Body)
+                }
+            }
+            in, out = redactValues(in, values), redactValues(out, values)
+        }
+        cp.record(c.RemoteAddr, "in", in)
+        cp.record(c.RemoteAddr, "out", out)
+    }
+    r.in = append(r.in[:0], r.in[n:]...)
+    r.out = r.out[:0]
+}
@@ -0,0 +1,102 @@
+package memcache
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	CaptureDir = dir
+	defer func() { CaptureDir = os.TempDir() }()
+
+	c, err := StartCapture("k", "", time.Minute, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StartCapture("", "", time.Minute, 0, false); err == nil {
+		t.Errorf("only one capture should run")
+	}
+	if st, err := os.Stat(c.Path); err != nil || st.Mode().Perm() != 0600 {
+		t.Errorf("capture should be readable by the owner only: %v %v", st.Mode(), err)
+	}
+
+	client, server := net.Pipe()
+	sc := newServerConn(server)
+	done := make(chan error, 1)
+	go func() { done <- sc.Serve(newMapDistStore(), NewStats()) }()
+	r := bufio.NewReader(client)
+	for _, cmd := range []string{"set k 0 0 6\r\nsecret\r\n", "set other 0 0 1\r\nx\r\n", "get k\r\n"} {
+		client.Write([]byte(cmd))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "STORED\r\n" || line == "END\r\n" {
+				break
+			}
+		}
+	}
+	client.Close()
+	<-done
+
+	if StopCapture() != c {
+		t.Errorf("the capture should be stopped")
+	}
+	data, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(data)
+	if c.Records != 4 || !strings.Contains(s, "set k 0 0 6\r\n******\r\n") || !strings.Contains(s, "VALUE k 0 6\r\n******\r\n") {
+		t.Errorf("exchanges of k should be captured and redacted, %d records:\n%s", c.Records, s)
+	}
+	if strings.Contains(s, "other") || strings.Contains(s, "secret") {
+		t.Errorf("only exchanges of k should be captured:\n%s", s)
+	}
+	if CurrentCapture() != nil {
+		t.Errorf("no capture should run")
+	}
+}
+
+func TestCaptureLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	CaptureDir = dir
+	defer func() { CaptureDir = os.TempDir() }()
+
+	c, _ := StartCapture("", "10.0.0.1", time.Minute, 200, false)
+	if c.match("10.0.0.2:1234", nil) || !c.match("10.0.0.1:1234", nil) {
+		t.Errorf("only the client should be captured")
+	}
+	c.record("10.0.0.1:1234", "in", []byte(strings.Repeat("x", 50)))
+	c.record("10.0.0.1:1234", "in", []byte(strings.Repeat("x", 50)))
+	if c.Records != 1 {
+		t.Errorf("capture should be capped by size: %d records", c.Records)
+	}
+	StopCapture()
+
+	if c, _ = StartCapture("", "", time.Minute, CaptureLimitBytes+1, false); c.MaxBytes != CaptureLimitBytes {
+		t.Errorf("max of capture should be cut to the limit: %d", c.MaxBytes)
+	}
+	StopCapture()
+
+	c, _ = StartCapture("", "", time.Millisecond, 0, false)
+	time.Sleep(time.Millisecond * 5)
+	if CurrentCapture() != nil {
+		t.Errorf("capture should be stopped after the duration")
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * cpu quota of the container, so GOMAXPROCS is not the number of cpus of host
+ */
+
+package memcache
+
+import (
+    "io/ioutil"
+    "math"
+    "runtime"
+    "strconv"
+    "strings"
+)
+
+// files of cpu quota, cgroup v2 first
+var (
+    CgroupV2CPUMax    = "/sys/fs/cgroup/cpu.max"
+    CgroupV1CPUQuota  = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+    CgroupV1CPUPeriod = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+)
+
+func readInts(path string) ([]int64, bool) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, false
+    }
+    var vs []int64
+    for _, f := range strings.Fields(string(data)) {
+        v, err := strconv.ParseInt(f, 10, 64)
+        if err != nil {
+            return nil, false
+        }
+        vs = append(vs, v)
+    }
+    return vs, true
+}
+
+// number of cpus the cgroup could use, false if it is not limited
+func CgroupCPUQuota() (float64, bool) {
+    // "max 100000" if not limited, which is not a number
+    if vs, ok := readInts(CgroupV2CPUMax); ok && len(vs) == 2 && vs[0] > 0 && vs[1] > 0 {
+        return float64(vs[0]) / float64(vs[1]), true
+    }
+    quota, ok1 := readInts(CgroupV1CPUQuota)
+    period, ok2 := readInts(CgroupV1CPUPeriod)
+    if ok1 && ok2 && len(quota) == 1 && len(period) == 1 && quota[0] > 0 && period[0] > 0 {
+        return float64(quota[0]) / float64(period[0]), true
+    }
+    return 0, false
+}
+
+// GOMAXPROCS for the cpu quota of cgroup, rounded up, not more than the cpus
+func CgroupMaxProcs() (int, bool) {
+    quota, ok := CgroupCPUQuota()
+    if !ok {
+        return 0, false
+    }
+    n := int(math.Ceil(quota))
+    if n < 1 {
+        n = 1
+    }
+    if n > runtime.NumCPU() {
+        n = runtime.NumCPU()
+    }
+    return n, true
+}
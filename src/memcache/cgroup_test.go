@@ -0,0 +1,42 @@
+package memcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCgroupMaxProcs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v2, quota, period := CgroupV2CPUMax, CgroupV1CPUQuota, CgroupV1CPUPeriod
+	defer func() { CgroupV2CPUMax, CgroupV1CPUQuota, CgroupV1CPUPeriod = v2, quota, period }()
+	CgroupV2CPUMax = filepath.Join(dir, "cpu.max")
+	CgroupV1CPUQuota = filepath.Join(dir, "cpu.cfs_quota_us")
+	CgroupV1CPUPeriod = filepath.Join(dir, "cpu.cfs_period_us")
+
+	if _, ok := CgroupMaxProcs(); ok {
+		t.Error("no quota without cgroup files")
+	}
+	ioutil.WriteFile(CgroupV2CPUMax, []byte("max 100000\n"), 0644)
+	if _, ok := CgroupMaxProcs(); ok {
+		t.Error("max is not limited")
+	}
+	ioutil.WriteFile(CgroupV1CPUQuota, []byte("50000\n"), 0644)
+	ioutil.WriteFile(CgroupV1CPUPeriod, []byte("100000\n"), 0644)
+	if n, ok := CgroupMaxProcs(); !ok || n != 1 {
+		t.Errorf("half a cpu should be 1: %d %v", n, ok)
+	}
+	ioutil.WriteFile(CgroupV2CPUMax, []byte("150000 100000\n"), 0644)
+	if q, _ := CgroupCPUQuota(); q != 1.5 {
+		t.Errorf("cgroup v2 should be preferred: %f", q)
+	}
+	if n, _ := CgroupMaxProcs(); n != 2 && runtime.NumCPU() >= 2 {
+		t.Errorf("1.5 cpus should be rounded up: %d", n)
+	}
+}
@@ -5,9 +5,11 @@
 package memcache
 
 import (
+    "bytes"
     "errors"
-    "math"
+    "math/rand"
     "sync"
+    "sync/atomic"
     "time"
 )
 
@@ -15,8 +17,17 @@ import (
 type Client struct {
     scheduler Scheduler
     N, W, R   int
+
+    // fraction of reads which are sent to another replica to compare with
+    GraySampleRate float64
 }
 
+// counters of sampling reads, reported in stats
+var grayChecks, grayMismatches, graySlow int64
+
+// a replica slower than this times of the other one in a sampling read is reported
+var GraySlowFactor = 4.0
+
 func NewClient(sch Scheduler, N, W, R int) (c *Client) {
     c = new(Client)
     c.scheduler = sch
@@ -27,16 +38,22 @@ func NewClient(sch Scheduler, N, W, R int) (c *Client) {
 }
 
 func (c *Client) Get(key string) (r *Item, targets []string, err error) {
-    hosts := c.scheduler.GetHostsByKey(key)
+    hosts := hostsByOp(c.scheduler, key, OpRead, c.N)
     cnt := 0
-    for _, host := range hosts[:c.N] {
+    for _, host := range hosts {
         st := time.Now()
         r, err = host.Get(key)
         if err == nil {
             cnt++
             if r != nil {
-                t := float64(time.Now().Sub(st)) / 1e9
-                c.scheduler.Feedback(host, key, 1 - float64(math.Sqrt(t)*t))
+                dt := time.Now().Sub(st)
+                c.scheduler.Feedback(host, key, hitFeedback(dt))
+                if o, ok := c.scheduler.(sizeObserver); ok {
+                    o.ObserveSize(key, len(r.Body))
+                }
+                if c.GraySampleRate > 0 && rand.Float64() < c.GraySampleRate {
+                    c.sampleRead(key, host, r, dt, hosts)
+                }
                 // got the right rval
                 targets = []string{host.Addr}
                 err = nil
@@ -44,11 +61,10 @@ func (c *Client) Get(key string) (r *Item, targets []string, err error) {
                 return
             } else {
                 targets = append(targets, host.Addr)
+                c.scheduler.Feedback(host, key, FeedbackEvent{Kind: FeedbackMiss})
             }
-        } else if err.Error() != "wait for retry" {
-            c.scheduler.Feedback(host, key, -5)
         } else {
-            c.scheduler.Feedback(host, key, -2)
+            c.scheduler.Feedback(host, key, errorFeedback(err))
         }
     }
 
@@ -60,25 +76,60 @@ func (c *Client) Get(key string) (r *Item, targets []string, err error) {
     return
 }
 
+// read the key from another replica in background, report the replicas
+// which respond but disagree (gray failure) or are much slower
+func (c *Client) sampleRead(key string, host *Host, r *Item, dt time.Duration, hosts []*Host) {
+    var other *Host
+    for _, h := range hosts {
+        if h != host {
+            other = h
+            break
+        }
+    }
+    if other == nil {
+        return
+    }
+    // the body may be freed after the response was sent
+    flag, body := r.Flag, append([]byte(nil), r.Body...)
+    go func() {
+        atomic.AddInt64(&grayChecks, 1)
+        st := time.Now()
+        r2, err := other.Get(key)
+        dt2 := time.Now().Sub(st)
+        if err != nil {
+            return
+        }
+        if r2 == nil || r2.Flag != flag || !bytes.Equal(r2.Body, body) {
+            atomic.AddInt64(&grayMismatches, 1)
+            ErrorLog.Printf("gray failure: key %s differs between %s and %s", key, host.Addr, other.Addr)
+        }
+        fast, slow, d1, d2 := host, other, dt, dt2
+        if d1 > d2 {
+            fast, slow, d1, d2 = other, host, dt2, dt
+        }
+        if d2 > SlowCmdTime && float64(d2) > float64(d1)*GraySlowFactor {
+            atomic.AddInt64(&graySlow, 1)
+            ErrorLog.Printf("gray failure: %s took %v to get %s, but %s took %v", slow.Addr, d2, key, fast.Addr, d1)
+        }
+    }()
+}
+
 func (c *Client) getMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
     need := len(keys)
     rs = make(map[string]*Item, need)
-    hosts := c.scheduler.GetHostsByKey(keys[0])
+    hosts := hostsByOp(c.scheduler, keys[0], OpRead, c.N)
     suc := 0
-    for _, host := range hosts[:c.N] {
+    for _, host := range hosts {
         st := time.Now()
         r, er := host.GetMulti(keys)
         if er == nil {
             suc += 1
             if r != nil {
                 targets = append(targets, host.Addr)
-                t := float64(time.Now().Sub(st)) / 1e9
-                c.scheduler.Feedback(host, keys[0], 1 - float64(math.Sqrt(t)*t))
+                c.scheduler.Feedback(host, keys[0], hitFeedback(time.Now().Sub(st)))
             }
-        } else if er.Error() != "wait for retry" { // failed
-            c.scheduler.Feedback(host, keys[0], -5)
         } else {
-            c.scheduler.Feedback(host, keys[0], -2)
+            c.scheduler.Feedback(host, keys[0], errorFeedback(er))
         }
         err = er
         if er != nil {
@@ -144,13 +195,19 @@ func (c *Client) GetMulti(keys []string) (rs map[string]*Item, targets []string,
 }
 
 func (c *Client) Set(key string, item *Item, noreply bool) (ok bool, targets []string, final_err error) {
-    suc := 0
-    for i, host := range c.scheduler.GetHostsByKey(key) {
+    if o, ok := c.scheduler.(sizeObserver); ok {
+        o.ObserveSize(key, len(item.Body))
+    }
+    suc, tooLarge := 0, 0
+    for i, host := range hostsByOp(c.scheduler, key, OpWrite, 0) {
         if ok, err := host.Set(key, item, noreply); err == nil && ok {
             suc++
             targets = append(targets, host.Addr)
+        } else if err == ErrValueTooLarge {
+            // not the fault of the host
+            tooLarge++
         } else if err.Error() != "wait for retry" {
-            c.scheduler.Feedback(host, key, -10)
+            c.scheduler.Feedback(host, key, FeedbackEvent{Kind: FeedbackWriteError})
         }
 
         if suc >= c.W && (i+1) >= c.N {
@@ -161,49 +218,70 @@ func (c *Client) Set(key string, item *Item, noreply bool) (ok bool, targets []s
     if suc < c.W {
         ok = false
         final_err = errors.New("write failed")
+        if suc == 0 && tooLarge > 0 {
+            final_err = ErrValueTooLarge
+        }
         return
     }
     ok = true
     return
 }
 
-func (c *Client) Append(key string, value []byte) (ok bool, targets []string, final_err error) {
-    suc := 0
-    for i, host := range c.scheduler.GetHostsByKey(key) {
-        if ok, err := host.Append(key, value); err == nil && ok {
+func (c *Client) Append(key string, value []byte) (bool, []string, error) {
+    return c.concat(key, func(host *Host) (bool, error) { return host.Append(key, value) })
+}
+
+func (c *Client) Prepend(key string, value []byte) (bool, []string, error) {
+    return c.concat(key, func(host *Host) (bool, error) { return host.Prepend(key, value) })
+}
+
+// append or prepend to the replicas, the ones missing the key answered
+// NOT_STORED and are written as well as they could be, so it's stored if W
+// replicas answered and any of them stored it, not stored if none had the key
+func (c *Client) concat(key string, op func(host *Host) (bool, error)) (ok bool, targets []string, final_err error) {
+    suc, missing := 0, 0
+    for i, host := range hostsByOp(c.scheduler, key, OpWrite, 0) {
+        stored, err := op(host)
+        if err == nil && stored {
             suc++
             targets = append(targets, host.Addr)
+        } else if err == nil {
+            missing++
         } else if err.Error() != "wait for retry" {
-            c.scheduler.Feedback(host, key, -5)
+            c.scheduler.Feedback(host, key, FeedbackEvent{Kind: FeedbackAppendError})
         }
 
-        if suc >= c.W && (i+1) >= c.N {
+        if suc+missing >= c.W && (i+1) >= c.N {
             // at least try N backends, and succeed W backends
             break
         }
     }
-    if suc < c.W {
-        ok = false
+    if suc+missing < c.W {
         final_err = errors.New("write failed")
         return
     }
-    ok = true
+    ok = suc > 0
     return
 }
 
+// decremented if value < 0, the largest result of the replicas is returned,
+// ErrNotFound if none of them has the key
 func (c *Client) Incr(key string, value int) (result int, targets []string, err error) {
-    //result := 0
     suc := 0
-    for i, host := range c.scheduler.GetHostsByKey(key) {
+    for i, host := range hostsByOp(c.scheduler, key, OpWrite, 0) {
         r, e := host.Incr(key, value)
         if e != nil {
-            err = e
+            // a non-numeric value is reported over a missing one
+            if err == nil || err == ErrNotFound || e == ErrNonNumeric {
+                err = e
+            }
+            if e != ErrNotFound && e != ErrNonNumeric && e.Error() != "wait for retry" {
+                c.scheduler.Feedback(host, key, FeedbackEvent{Kind: FeedbackWriteError})
+            }
             continue
         }
-        if r > 0 {
-            suc++
-            targets = append(targets, host.Addr)
-        }
+        suc++
+        targets = append(targets, host.Addr)
         if r > result {
             result = r
         }
@@ -212,10 +290,9 @@ func (c *Client) Incr(key string, value int) (result int, targets []string, err
             break
         }
     }
-    if result > 0 {
+    if suc > 0 {
         err = nil
     }
-    //return result, err // maximize
     return
 }
 
@@ -223,7 +300,7 @@ func (c *Client) Delete(key string) (r bool, targets []string, err error) {
     suc := 0
     err_count := 0
     failed_hosts := make([]string, 2)
-    for i, host := range c.scheduler.GetHostsByKey(key) {
+    for i, host := range hostsByOp(c.scheduler, key, OpDelete, 0) {
         ok, er := host.Delete(key)
 
         if ok {
@@ -237,7 +314,7 @@ func (c *Client) Delete(key string) (r bool, targets []string, err error) {
                 continue
             }
             if er.Error() != "wait for retry" {
-                c.scheduler.Feedback(host, key, -10)
+                c.scheduler.Feedback(host, key, FeedbackEvent{Kind: FeedbackWriteError})
             }
         }
 
@@ -255,6 +332,165 @@ func (c *Client) Delete(key string) (r bool, targets []string, err error) {
     return
 }
 
+// touch the replicas like a write, succeeded if any of them has the key
+func (c *Client) Touch(key string, exptime int) (ok bool, targets []string, err error) {
+    for i, host := range hostsByOp(c.scheduler, key, OpWrite, 0) {
+        if i >= c.N {
+            break
+        }
+        touched, er := host.Touch(key, exptime)
+        if touched {
+            targets = append(targets, host.Addr)
+        } else if er != nil {
+            err = er
+            if er != ErrTouchNotSupported && er.Error() != "wait for retry" {
+                c.scheduler.Feedback(host, key, FeedbackEvent{Kind: FeedbackWriteError})
+            }
+        }
+    }
+    if len(targets) > 0 {
+        return true, targets, nil
+    }
+    return false, targets, err
+}
+
+// cas uniques differ by replica, so gets reads from the owner of the key,
+// the first host to write to, and cas goes to it too. If the owner fails,
+// the next replica answers and issues the cas unique, as cas fails over
+// to it in the same order.
+func (c *Client) Gets(key string) (r *Item, targets []string, err error) {
+    hosts := hostsByOp(c.scheduler, key, OpWrite, 0)
+    if len(hosts) == 0 {
+        return nil, nil, errors.New("no hosts of " + key)
+    }
+    return c.gets(key, hosts)
+}
+
+func (c *Client) gets(key string, hosts []*Host) (r *Item, targets []string, err error) {
+    for i, host := range hosts {
+        if i >= c.N {
+            break
+        }
+        st := time.Now()
+        r, err = host.Gets(key)
+        if err != nil {
+            c.scheduler.Feedback(host, key, errorFeedback(err))
+            continue
+        }
+        if r != nil {
+            c.scheduler.Feedback(host, key, hitFeedback(time.Now().Sub(st)))
+        } else {
+            c.scheduler.Feedback(host, key, FeedbackEvent{Kind: FeedbackMiss})
+        }
+        return r, []string{host.Addr}, nil
+    }
+    return nil, nil, err
+}
+
+// gets of many keys, batched by their owners, the keys of a failed owner
+// are read from the next replicas one by one
+func (c *Client) GetsMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+    var lock sync.Mutex
+    rs = make(map[string]*Item, len(keys))
+    byOwner := make(map[*Host][]string)
+    replicas := make(map[string][]*Host, len(keys))
+    for _, key := range keys {
+        hosts := hostsByOp(c.scheduler, key, OpWrite, 0)
+        if len(hosts) == 0 {
+            err = errors.New("no hosts of " + key)
+            continue
+        }
+        byOwner[hosts[0]] = append(byOwner[hosts[0]], key)
+        replicas[key] = hosts
+    }
+    reply := make(chan bool, len(byOwner))
+    for owner, ks := range byOwner {
+        go func(host *Host, keys []string) {
+            defer func() { reply <- true }()
+            st := time.Now()
+            r, e := host.GetsMulti(keys)
+            if e == nil {
+                c.scheduler.Feedback(host, keys[0], hitFeedback(time.Now().Sub(st)))
+                lock.Lock()
+                defer lock.Unlock()
+                for k, v := range r {
+                    rs[k] = v
+                }
+                targets = append(targets, host.Addr)
+                return
+            }
+            c.scheduler.Feedback(host, keys[0], errorFeedback(e))
+            for _, key := range keys {
+                var item *Item
+                var t []string
+                er := e
+                if rest := replicas[key][1:]; len(rest) > 0 && c.N > 1 {
+                    if len(rest) > c.N-1 {
+                        rest = rest[:c.N-1]
+                    }
+                    item, t, er = c.gets(key, rest)
+                }
+                lock.Lock()
+                if er != nil {
+                    err = er
+                } else if item != nil {
+                    rs[key] = item
+                }
+                targets = append(targets, t...)
+                lock.Unlock()
+            }
+        }(owner, ks)
+    }
+    for _ = range byOwner {
+        <-reply
+    }
+    return
+}
+
+// the item is stored on the owner by cas, then set to the other replicas,
+// the next replica is the owner if it fails, like in Gets
+func (c *Client) Cas(key string, item *Item) (status string, targets []string, err error) {
+    hosts := hostsByOp(c.scheduler, key, OpWrite, 0)
+    if len(hosts) == 0 {
+        return "", nil, errors.New("no hosts of " + key)
+    }
+    owner := -1
+    for i, host := range hosts {
+        if i >= c.N {
+            break
+        }
+        status, err = host.Cas(key, item)
+        if err == nil {
+            owner = i
+            break
+        }
+        if err == ErrValueTooLarge || err == ErrCasNotSupported {
+            return "", nil, err
+        }
+        if err.Error() != "wait for retry" {
+            c.scheduler.Feedback(host, key, FeedbackEvent{Kind: FeedbackWriteError})
+        }
+    }
+    if owner < 0 {
+        return "", nil, err
+    }
+    targets = []string{hosts[owner].Addr}
+    if status != "STORED" {
+        return
+    }
+    for i, host := range hosts[owner+1:] {
+        if owner+1+i >= c.N {
+            break
+        }
+        if ok, er := host.Set(key, item, false); ok {
+            targets = append(targets, host.Addr)
+        } else if er != nil && er != ErrValueTooLarge && er.Error() != "wait for retry" {
+            c.scheduler.Feedback(host, key, FeedbackEvent{Kind: FeedbackWriteError})
+        }
+    }
+    return
+}
+
 func (c *Client) Len() int {
     return 0
 }
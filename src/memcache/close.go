@@ -0,0 +1,127 @@
+/*
+ * stopping the goroutines of schedulers and clients and closing the
+ * connections of their hosts, so a proxy could be stopped and created
+ * again in a process
+ */
+
+package memcache
+
+// schedulers and clients with goroutines, connections or files, closing
+// more than once is harmless
+type closer interface {
+    Close()
+}
+
+func CloseScheduler(sch Scheduler) {
+    if c, ok := sch.(closer); ok {
+        c.Close()
+    }
+}
+
+// close a client and all it wraps, with their schedulers
+func CloseStorage(store DistributeStorage) {
+    if c, ok := store.(closer); ok {
+        c.Close()
+    }
+}
+
+func closeHosts(hosts []*Host) {
+    for _, h := range hosts {
+        h.Close()
+    }
+}
+
+func (c *ModScheduler) Close() {
+    closeHosts(c.hosts)
+}
+
+func (c *ConsistantHashScheduler) Close() {
+    closeHosts(c.current().hosts)
+}
+
+func (c *RendezvousScheduler) Close() {
+    closeHosts(c.current().hosts)
+}
+
+func (c *MaglevScheduler) Close() {
+    closeHosts(c.current().hosts)
+}
+
+func (c *SplitScheduler) Close() {
+    closeHosts(c.hosts)
+}
+
+func (c *FallbackScheduler) Close() {
+    CloseScheduler(c.primary)
+    CloseScheduler(c.fallback)
+}
+
+func (c *PrefixScheduler) Close() {
+    CloseScheduler(c.def)
+    for _, p := range c.prefixes {
+        CloseScheduler(c.pools[p])
+    }
+}
+
+func (c *RegionScheduler) Close() {
+    for _, name := range c.names {
+        CloseScheduler(c.regions[name])
+    }
+}
+
+func (c *BulkScheduler) Close() {
+    CloseScheduler(c.Scheduler)
+    CloseScheduler(c.bulk)
+}
+
+func (c *PinScheduler) Close() {
+    CloseScheduler(c.Scheduler)
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    for _, hosts := range c.pins {
+        closeHosts(hosts)
+    }
+}
+
+func (c *Client) Close() {
+    CloseScheduler(c.scheduler)
+}
+
+func (c *RClient) Close() {
+    CloseScheduler(c.scheduler)
+}
+
+func (c *DryRunClient) Close() {
+    CloseStorage(c.store)
+    CloseScheduler(c.scheduler)
+}
+
+func (c *DCClient) Close() {
+    for _, name := range c.names {
+        CloseStorage(c.clients[name])
+    }
+}
+
+func (c *ExperimentClient) Close() {
+    CloseStorage(c.store)
+    for _, pool := range c.pools {
+        CloseStorage(pool)
+    }
+}
+
+func (c *TierClient) Close() {
+    CloseStorage(c.hot)
+}
+
+func (c *L2CacheClient) Close() {
+    CloseStorage(c.store)
+    c.cache.Close()
+}
+
+func (c *MultiGetCacheClient) Close() {
+    CloseStorage(c.store)
+}
+
+func (c *TransformClient) Close() {
+    CloseStorage(c.store)
+}
@@ -0,0 +1,91 @@
+/*
+ * compare routing of beanseye with client libraries
+ */
+
+package memcache
+
+import (
+    "errors"
+    "strings"
+)
+
+// scheduler with the same routing as a client library:
+//   ketama          libmemcached/libketama consistent hashing
+//   mod-<hash>      modula distribution, like libmemcached's default
+//   consistent-<hash>  beanseye's consistent hashing
+func ClientScheduler(model string, servers []string) (Scheduler, error) {
+    if model == "ketama" {
+        return NewKetamaScheduler(servers), nil
+    }
+    ps := strings.SplitN(model, "-", 2)
+    if len(ps) != 2 {
+        return nil, errors.New("unknown client model: " + model)
+    }
+    if _, ok := hashMethods[ps[1]]; !ok {
+        return nil, errors.New("unknown hash method: " + ps[1])
+    }
+    switch ps[0] {
+    case "mod":
+        return NewModScheduler(servers, ps[1]), nil
+    case "consistent":
+        return NewConsistantHashScheduler(servers, ps[1]), nil
+    }
+    return nil, errors.New("unknown client model: " + model)
+}
+
+type RouteMismatch struct {
+    Key      string
+    Expected []string
+    Got      []string
+}
+
+func firstAddrs(hosts []*Host, n int) []string {
+    if n > len(hosts) {
+        n = len(hosts)
+    }
+    addrs := make([]string, n)
+    for i, h := range hosts[:n] {
+        addrs[i] = h.Addr
+    }
+    return addrs
+}
+
+func sameAddrs(a, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for _, x := range a {
+        if !contain(b, x) {
+            return false
+        }
+    }
+    return true
+}
+
+// the keys which are routed to different hosts, compare the first n hosts
+// regardless of the order
+func CompareRouting(expected, got Scheduler, keys []string, n int) []RouteMismatch {
+    var rs []RouteMismatch
+    for _, key := range keys {
+        e := firstAddrs(expected.GetHostsByKey(key), n)
+        g := firstAddrs(got.GetHostsByKey(key), n)
+        if !sameAddrs(e, g) {
+            rs = append(rs, RouteMismatch{key, e, g})
+        }
+    }
+    return rs
+}
+
+// the first n hosts of every key in keys, and how many keys every host got,
+// without contacting any of them
+func SimulateRouting(sch Scheduler, keys []string, n int) (routes [][]string, hist map[string]int) {
+    routes = make([][]string, len(keys))
+    hist = make(map[string]int)
+    for i, key := range keys {
+        routes[i] = firstAddrs(sch.GetHostsByKey(key), n)
+        for _, addr := range routes[i] {
+            hist[addr]++
+        }
+    }
+    return
+}
@@ -0,0 +1,51 @@
+package memcache
+
+import "testing"
+
+func TestCompareRouting(t *testing.T) {
+	ketama, err := ClientScheduler("ketama", ketamahosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"foo", "bar", "key:1", "key:2", "key:3", "hello world"}
+	if rs := CompareRouting(ketama, NewKetamaScheduler(ketamahosts), keys, 1); len(rs) != 0 {
+		t.Errorf("the same routing should have no mismatch: %v", rs)
+	}
+	mod, _ := ClientScheduler("mod-crc32", ketamahosts)
+	rs := CompareRouting(ketama, mod, keys, 1)
+	if len(rs) == 0 {
+		t.Errorf("ketama and mod should route some keys differently")
+	}
+	for _, r := range rs {
+		if r.Expected[0] != ketama.GetHostsByKey(r.Key)[0].Addr {
+			t.Errorf("wrong mismatch: %v", r)
+		}
+	}
+	if _, err := ClientScheduler("mod-unknown", ketamahosts); err == nil {
+		t.Errorf("unknown hash should fail")
+	}
+}
+
+func TestSimulateRouting(t *testing.T) {
+	sch := NewKetamaScheduler(ketamahosts)
+	keys := []string{"foo", "bar", "key:1", "key:2", "key:3", "hello world"}
+	routes, hist := SimulateRouting(sch, keys, 1)
+	if len(routes) != len(keys) {
+		t.Fatalf("routes of %d keys, want %d", len(routes), len(keys))
+	}
+	total := 0
+	for addr, c := range hist {
+		if !contain(ketamahosts, addr) {
+			t.Errorf("unknown host %s", addr)
+		}
+		total += c
+	}
+	if total != len(keys) {
+		t.Errorf("%d keys in histogram, want %d", total, len(keys))
+	}
+	for i, key := range keys {
+		if routes[i][0] != sch.GetHostsByKey(key)[0].Addr {
+			t.Errorf("%s routed to %v", key, routes[i])
+		}
+	}
+}
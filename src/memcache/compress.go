@@ -0,0 +1,73 @@
+/*
+ * values compressed by writers (by zlib, with CompressFlag in flags) are
+ * decompressed in proxy for the clients which could not, capable clients
+ * opt in by "compression zlib" to get them as stored, saving cpu of proxy
+ * and bandwidth, "compression none" opts out again.
+ */
+
+package memcache
+
+import (
+    "bytes"
+    "compress/zlib"
+    "errors"
+    "io"
+    "io/ioutil"
+    "sync/atomic"
+)
+
+// bit in flags of zlib compressed values, 0 to pass all the values as stored
+var CompressFlag = 0
+
+// values decompressed to more bytes than DefaultMaxValueSize, or this if it's
+// not set, are passed as stored, so a small value could not blow up the proxy
+var MaxDecompressedSize = 32 << 20
+
+var errDecompressedTooLarge = errors.New("decompressed value too large")
+
+// values decompressed for clients, and the ones failed, reported in stats
+var decompressed, decompressFailed int64
+
+// true if the client accepts compressed values
+func parseCompression(args []string) (bool, error) {
+    if len(args) != 1 {
+        return false, errors.New("usage: compression zlib|none")
+    }
+    switch args[0] {
+    case "zlib":
+        return true, nil
+    case "none":
+        return false, nil
+    }
+    return false, errors.New("unknown compression")
+}
+
+// replace compressed items of the response by decompressed ones, the items
+// may be shared by caches, so they are not changed or freed
+func decompressItems(resp *Response) {
+    limit := MaxDecompressedSize
+    if DefaultMaxValueSize > 0 {
+        limit = DefaultMaxValueSize
+    }
+    for key, item := range resp.items {
+        if item.Flag&CompressFlag == 0 {
+            continue
+        }
+        r, err := zlib.NewReader(bytes.NewReader(item.Body))
+        var body []byte
+        if err == nil {
+            body, err = ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+            if err == nil && len(body) > limit {
+                err = errDecompressedTooLarge
+            }
+        }
+        if err != nil {
+            // it's not ours to fix, pass it as stored
+            atomic.AddInt64(&decompressFailed, 1)
+            ErrorLog.Printf("decompress %s failed: %s", key, err)
+            continue
+        }
+        atomic.AddInt64(&decompressed, 1)
+        resp.items[key] = &Item{Flag: item.Flag &^ CompressFlag, Exptime: item.Exptime, Cas: item.Cas, Body: body}
+    }
+}
@@ -0,0 +1,98 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"net"
+	"testing"
+)
+
+func TestCompressionNegotiation(t *testing.T) {
+	flag := CompressFlag
+	CompressFlag = 0x10
+	defer func() { CompressFlag = flag }()
+
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write([]byte("hello hello hello"))
+	w.Close()
+	store := newMapDistStore()
+	stored := &Item{Flag: 0x11, Body: buf.Bytes()}
+	store.mapStore.Set("z", stored, false)
+	store.mapStore.Set("bad", &Item{Flag: 0x10, Body: []byte("not zlib")}, false)
+
+	s := NewServer(store)
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	conn, err := net.Dial("tcp", s.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rbuf := bufio.NewReader(conn)
+	get := func(key string) *Item {
+		req := &Request{Cmd: "get", Keys: []string{key}}
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp := new(Response)
+		if err := resp.Read(rbuf); err != nil {
+			t.Fatal(err)
+		}
+		return resp.items[key]
+	}
+	command := func(cmd string) string {
+		conn.Write([]byte(cmd))
+		line, _ := rbuf.ReadString('\n')
+		return line
+	}
+
+	if r := get("z"); r == nil || r.Flag != 0x01 || string(r.Body) != "hello hello hello" {
+		t.Errorf("value should be decompressed for clients by default: %v", r)
+	}
+	if r := get("bad"); r == nil || string(r.Body) != "not zlib" {
+		t.Errorf("invalid compressed value should be passed as stored: %v", r)
+	}
+	if r := command("compression gzip\r\n"); r != "CLIENT_ERROR unknown compression\r\n" {
+		t.Errorf("bad reply: %q", r)
+	}
+	if r := command("compression zlib\r\n"); r != "OK\r\n" {
+		t.Errorf("bad reply: %q", r)
+	}
+	if r := get("z"); r == nil || r.Flag != 0x11 || !bytes.Equal(r.Body, buf.Bytes()) {
+		t.Errorf("value should be as stored for capable clients: %v", r)
+	}
+	if r := command("compression none\r\n"); r != "OK\r\n" {
+		t.Errorf("bad reply: %q", r)
+	}
+	if r := get("z"); r == nil || r.Flag != 0x01 {
+		t.Errorf("value should be decompressed after opting out: %v", r)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	flag, limit := CompressFlag, MaxDecompressedSize
+	CompressFlag, MaxDecompressedSize = 0x10, 1024
+	defer func() { CompressFlag, MaxDecompressedSize = flag, limit }()
+
+	compress := func(n int) []byte {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		w.Write(make([]byte, n))
+		w.Close()
+		return buf.Bytes()
+	}
+	small, bomb := &Item{Flag: 0x10, Body: compress(1024)}, &Item{Flag: 0x10, Body: compress(1 << 20)}
+	resp := &Response{items: map[string]*Item{"small": small, "bomb": bomb}}
+	decompressItems(resp)
+	if r := resp.items["small"]; r == small || len(r.Body) != 1024 {
+		t.Errorf("value within the limit should be decompressed: %d", len(r.Body))
+	}
+	if r := resp.items["bomb"]; r != bomb || r.Flag != 0x10 {
+		t.Errorf("value over the limit should be passed as stored: %d", len(r.Body))
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * memcached protocol conformance checks, against the proxy or any backend
+ */
+
+package memcache
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "net"
+    "strings"
+    "time"
+)
+
+type conformanceConn struct {
+    conn   net.Conn
+    reader *bufio.Reader
+}
+
+func (c *conformanceConn) send(s string) error {
+    c.conn.SetDeadline(time.Now().Add(WriteTimeout + ReadTimeout))
+    _, err := c.conn.Write([]byte(s))
+    return err
+}
+
+func (c *conformanceConn) line() (string, error) {
+    s, err := c.reader.ReadString('\n')
+    return strings.TrimRight(s, "\r\n"), err
+}
+
+// send a command and expect the response lines
+func (c *conformanceConn) expect(cmd string, lines ...string) error {
+    if err := c.send(cmd); err != nil {
+        return err
+    }
+    for _, want := range lines {
+        got, err := c.line()
+        if err != nil {
+            return err
+        }
+        if strings.HasSuffix(want, "*") {
+            if !strings.HasPrefix(got, want[:len(want)-1]) {
+                return fmt.Errorf("%q: expect %q, but got %q", cmd, want, got)
+            }
+        } else if got != want {
+            return fmt.Errorf("%q: expect %q, but got %q", cmd, want, got)
+        }
+    }
+    return nil
+}
+
+type conformanceCheck struct {
+    name string
+    run  func(c *conformanceConn, prefix string) error
+}
+
+var conformanceChecks = []conformanceCheck{
+    {"empty value", func(c *conformanceConn, p string) error {
+        return c.expect(fmt.Sprintf("set %sempty 0 0 0\r\n\r\nget %sempty\r\n", p, p),
+            "STORED", "VALUE "+p+"empty 0 0", "", "END")
+    }},
+    {"flags round trip", func(c *conformanceConn, p string) error {
+        return c.expect(fmt.Sprintf("set %sflag 12345 0 1\r\nx\r\nget %sflag\r\n", p, p),
+            "STORED", "VALUE "+p+"flag 12345 1", "x", "END")
+    }},
+    {"max key length", func(c *conformanceConn, p string) error {
+        key := p + strings.Repeat("k", MaxKeyLength-len(p))
+        return c.expect(fmt.Sprintf("set %s 0 0 1\r\nx\r\nget %s\r\n", key, key),
+            "STORED", "VALUE "+key+" 0 1", "x", "END")
+    }},
+    {"too long key", func(c *conformanceConn, p string) error {
+        return c.expect(fmt.Sprintf("get %s\r\n", strings.Repeat("k", 251)), "CLIENT_ERROR*")
+    }},
+    {"negative expiry", func(c *conformanceConn, p string) error {
+        return c.expect(fmt.Sprintf("set %sneg 0 -1 1\r\nx\r\nget %sneg\r\n", p, p), "STORED", "END")
+    }},
+    {"expiry", func(c *conformanceConn, p string) error {
+        if err := c.expect(fmt.Sprintf("set %sexp 0 1 1\r\nx\r\n", p), "STORED"); err != nil {
+            return err
+        }
+        time.Sleep(time.Millisecond * 2100)
+        return c.expect(fmt.Sprintf("get %sexp\r\n", p), "END")
+    }},
+    {"noreply ordering", func(c *conformanceConn, p string) error {
+        return c.expect(fmt.Sprintf("set %snr 0 0 1 noreply\r\n1\r\nset %snr 0 0 1 noreply\r\n2\r\nget %snr\r\n", p, p, p),
+            "VALUE "+p+"nr 0 1", "2", "END")
+    }},
+    {"delete missing", func(c *conformanceConn, p string) error {
+        return c.expect(fmt.Sprintf("delete %smissing\r\n", p), "NOT_FOUND")
+    }},
+    {"incr", func(c *conformanceConn, p string) error {
+        return c.expect(fmt.Sprintf("set %sn 0 0 1\r\n5\r\nincr %sn 3\r\nincr %smissing 1\r\n", p, p, p),
+            "STORED", "8", "NOT_FOUND")
+    }},
+    {"multi get", func(c *conformanceConn, p string) error {
+        return c.expect(fmt.Sprintf("set %sm1 0 0 1\r\na\r\nget %sm1 %smissing %sm1\r\n", p, p, p, p),
+            "STORED", "VALUE "+p+"m1 0 1", "a", "END")
+    }},
+    {"large value", func(c *conformanceConn, p string) error {
+        v := bytes.Repeat([]byte("v"), 1000*1000)
+        if err := c.expect(fmt.Sprintf("set %slarge 0 0 %d\r\n%s\r\n", p, len(v), v), "STORED"); err != nil {
+            return err
+        }
+        if err := c.expect(fmt.Sprintf("get %slarge\r\n", p), fmt.Sprintf("VALUE %slarge 0 %d", p, len(v))); err != nil {
+            return err
+        }
+        body, err := c.line()
+        if err != nil || len(body) != len(v) {
+            return fmt.Errorf("large value: got %d bytes, %v", len(body), err)
+        }
+        return c.expect("", "END")
+    }},
+    {"unknown command", func(c *conformanceConn, p string) error {
+        return c.expect("bogus\r\n", "*")
+    }},
+}
+
+type ConformanceResult struct {
+    Name  string
+    Error error
+}
+
+// run all the checks against addr, every check on a new connection
+func RunConformance(addr string) []ConformanceResult {
+    prefix := fmt.Sprintf("__conf%d_", time.Now().UnixNano()%1000000)
+    rs := make([]ConformanceResult, len(conformanceChecks))
+    for i, check := range conformanceChecks {
+        rs[i].Name = check.name
+        conn, err := net.DialTimeout("tcp", addr, ConnectTimeout)
+        if err != nil {
+            rs[i].Error = err
+            continue
+        }
+        rs[i].Error = check.run(&conformanceConn{conn, bufio.NewReader(conn)}, prefix)
+        conn.Close()
+    }
+    return rs
+}
@@ -0,0 +1,32 @@
+package memcache
+
+import (
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("expiry check takes seconds")
+	}
+	s := NewServer(newMapDistStore())
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Shutdown()
+
+	rs := RunConformance(s.l.Addr().String())
+	if len(rs) != len(conformanceChecks) {
+		t.Fatalf("every check should have a result: %d", len(rs))
+	}
+	passed := map[string]bool{}
+	for _, r := range rs {
+		t.Log(r.Name, r.Error)
+		passed[r.Name] = r.Error == nil
+	}
+	for _, name := range []string{"empty value", "flags round trip", "noreply ordering", "too long key", "multi get"} {
+		if !passed[name] {
+			t.Errorf("%s should pass against map store", name)
+		}
+	}
+}
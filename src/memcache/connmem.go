@@ -0,0 +1,127 @@
+/*
+ * memory held by every client connection, its buffers, the value of the
+ * request being processed and the response being written, to find the
+ * clients behind a memory blowup
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+var (
+    connIDs   int64
+    liveConns sync.Map // id -> *ServerConn, of all the servers
+)
+
+type connMemory struct {
+    buffers int64 // of the buffered reader and writer
+    request int64 // value of the request being processed
+    pending int64 // response being written
+    peak    int64 // the most held at once
+}
+
+// the request and response held now, 0 after the response was written
+func (m *connMemory) hold(request, pending int) {
+    atomic.StoreInt64(&m.request, int64(request))
+    atomic.StoreInt64(&m.pending, int64(pending))
+    held := atomic.LoadInt64(&m.buffers) + int64(request) + int64(pending)
+    for {
+        peak := atomic.LoadInt64(&m.peak)
+        if held <= peak || atomic.CompareAndSwapInt64(&m.peak, peak, held) {
+            return
+        }
+    }
+}
+
+func requestBytes(req *Request) int {
+    if req.Item == nil {
+        return 0
+    }
+    return len(req.Item.Body)
+}
+
+func responseBytes(resp *Response) int {
+    n := len(resp.msg)
+    for _, item := range resp.items {
+        n += len(item.Body)
+    }
+    return n
+}
+
+func (c *ServerConn) register(buffers int) {
+    c.id = atomic.AddInt64(&connIDs, 1)
+    c.opened = time.Now()
+    atomic.StoreInt64(&c.mem.buffers, int64(buffers))
+    c.mem.hold(0, 0)
+    liveConns.Store(c.id, c)
+}
+
+func (c *ServerConn) unregister() {
+    liveConns.Delete(c.id)
+}
+
+type ConnMemory struct {
+    ID      int64
+    Addr    string
+    Opened  time.Time
+    Buffers int64
+    Request int64
+    Pending int64
+    Held    int64 // buffers, request and pending
+    Peak    int64
+}
+
+func (c *ServerConn) Memory() ConnMemory {
+    m := ConnMemory{ID: c.id, Addr: c.RemoteAddr, Opened: c.opened,
+        Buffers: atomic.LoadInt64(&c.mem.buffers),
+        Request: atomic.LoadInt64(&c.mem.request),
+        Pending: atomic.LoadInt64(&c.mem.pending),
+        Peak:    atomic.LoadInt64(&c.mem.peak)}
+    m.Held = m.Buffers + m.Request + m.Pending
+    return m
+}
+
+// the connections holding the most memory first, by the peak if they hold
+// the same, at most n of them if n > 0
+func HeaviestConns(n int) []ConnMemory {
+    var r []ConnMemory
+    liveConns.Range(func(_, c interface{}) bool {
+        r = append(r, c.(*ServerConn).Memory())
+        return true
+    })
+    sort.Slice(r, func(i, j int) bool {
+        if r[i].Held != r[j].Held {
+            return r[i].Held > r[j].Held
+        }
+        if r[i].Peak != r[j].Peak {
+            return r[i].Peak > r[j].Peak
+        }
+        return r[i].ID < r[j].ID
+    })
+    if n > 0 && len(r) > n {
+        r = r[:n]
+    }
+    return r
+}
+
+// lines of `stats conns`, like memcached prefixed by the id of connections
+func connStats() string {
+    conns := HeaviestConns(0)
+    sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+    now := time.Now()
+    var lines []string
+    for _, m := range conns {
+        lines = append(lines, fmt.Sprintf("STAT %d:addr tcp:%s\r\nSTAT %d:secs_since_open %d\r\n"+
+            "STAT %d:held %d\r\nSTAT %d:buffers %d\r\nSTAT %d:request %d\r\nSTAT %d:pending %d\r\nSTAT %d:peak %d\r\n",
+            m.ID, m.Addr, m.ID, int64(now.Sub(m.Opened).Seconds()), m.ID, m.Held, m.ID, m.Buffers,
+            m.ID, m.Request, m.ID, m.Pending, m.ID, m.Peak))
+    }
+    return strings.Join(lines, "")
+}
@@ -0,0 +1,72 @@
+package memcache
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnMemory(t *testing.T) {
+	l, err := serveLoopback(NewLocalStorage(NewMapStore(), "local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	value := strings.Repeat("v", 10000)
+	conn.Write([]byte("set k 0 0 10000\r\n" + value + "\r\nget k\r\n"))
+	for i := 0; i < 4; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var m ConnMemory
+	for _, c := range HeaviestConns(0) {
+		if c.Addr == conn.LocalAddr().String() {
+			m = c
+		}
+	}
+	if m.ID == 0 || m.Buffers <= 0 || m.Held != m.Buffers || m.Peak < m.Buffers+10000 {
+		t.Errorf("bad memory of the connection: %+v", m)
+	}
+	if top := HeaviestConns(1); len(top) != 1 || top[0].Held < m.Held {
+		t.Errorf("heaviest connections should come first: %+v", top)
+	}
+
+	conn.Write([]byte("stats conns\r\n"))
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	stats := strings.Join(lines, "")
+	if !strings.Contains(stats, "STAT "+strconv.FormatInt(m.ID, 10)+":addr tcp:"+m.Addr+"\r\n") ||
+		!strings.Contains(stats, "STAT "+strconv.FormatInt(m.ID, 10)+":peak ") {
+		t.Errorf("connection not in stats conns:\n%s", stats)
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := liveConns.Load(m.ID); !ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("closed connection should be forgotten")
+}
@@ -0,0 +1,194 @@
+/*
+ * serve a cluster spanning datacenters, every datacenter has its own pool
+ * of hosts, reads go to the local one first, writes go to all of them
+ */
+
+package memcache
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+)
+
+// how many datacenters should succeed in a write
+const (
+    ConsistencyOne   = "one"   // any of them
+    ConsistencyLocal = "local" // the local one
+    ConsistencyAll   = "all"   // all of them
+)
+
+// DCClient read from the client of local datacenter, and from the remote
+// ones in order if it failed, writes go to all the datacenters in parallel.
+type DCClient struct {
+    local       string
+    names       []string // local first
+    clients     map[string]DistributeStorage
+    consistency string
+}
+
+func NewDCClient(local string, clients map[string]DistributeStorage, order []string, consistency string) (*DCClient, error) {
+    if _, ok := clients[local]; !ok {
+        return nil, fmt.Errorf("no client of the local datacenter %s", local)
+    }
+    switch consistency {
+    case "":
+        consistency = ConsistencyLocal
+    case ConsistencyOne, ConsistencyLocal, ConsistencyAll:
+    default:
+        return nil, fmt.Errorf("unknown consistency %s", consistency)
+    }
+    c := &DCClient{local: local, names: []string{local}, clients: clients, consistency: consistency}
+    for _, name := range order {
+        if _, ok := clients[name]; ok && name != local {
+            c.names = append(c.names, name)
+        }
+    }
+    if len(c.names) != len(clients) {
+        return nil, errors.New("order of datacenters should list all of them")
+    }
+    return c, nil
+}
+
+func (c *DCClient) Get(key string) (r *Item, targets []string, err error) {
+    for _, name := range c.names {
+        if r, targets, err = c.clients[name].Get(key); err == nil {
+            return
+        }
+    }
+    return
+}
+
+func (c *DCClient) GetMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+    for _, name := range c.names {
+        if rs, targets, err = c.clients[name].GetMulti(keys); err == nil {
+            return
+        }
+    }
+    return
+}
+
+type dcResult struct {
+    ok      bool
+    targets []string
+    err     error
+    result  int
+}
+
+// run f on every datacenter in parallel, succeed by the consistency
+func (c *DCClient) write(f func(store DistributeStorage) dcResult) (ok bool, rs []dcResult, targets []string, err error) {
+    rs = make([]dcResult, len(c.names))
+    var wg sync.WaitGroup
+    for i, name := range c.names {
+        wg.Add(1)
+        go func(i int, store DistributeStorage) {
+            defer wg.Done()
+            rs[i] = f(store)
+        }(i, c.clients[name])
+    }
+    wg.Wait()
+
+    suc := 0
+    for i, r := range rs {
+        targets = append(targets, r.targets...)
+        if r.ok {
+            suc++
+        } else if r.err != nil {
+            ErrorLog.Printf("write to datacenter %s failed: %s", c.names[i], r.err)
+            err = r.err
+        }
+    }
+    switch c.consistency {
+    case ConsistencyOne:
+        ok = suc > 0
+    case ConsistencyLocal:
+        ok = rs[0].ok
+    case ConsistencyAll:
+        ok = suc == len(rs)
+    }
+    if ok {
+        err = nil
+    }
+    return
+}
+
+func (c *DCClient) Set(key string, item *Item, noreply bool) (bool, []string, error) {
+    ok, _, targets, err := c.write(func(store DistributeStorage) dcResult {
+        ok, targets, err := store.Set(key, item, noreply)
+        return dcResult{ok: ok, targets: targets, err: err}
+    })
+    return ok, targets, err
+}
+
+func (c *DCClient) Append(key string, value []byte) (bool, []string, error) {
+    ok, _, targets, err := c.write(func(store DistributeStorage) dcResult {
+        ok, targets, err := store.Append(key, value)
+        return dcResult{ok: ok, targets: targets, err: err}
+    })
+    return ok, targets, err
+}
+
+func (c *DCClient) Prepend(key string, value []byte) (bool, []string, error) {
+    ok, _, targets, err := c.write(func(store DistributeStorage) dcResult {
+        ok, targets, err := store.Prepend(key, value)
+        return dcResult{ok: ok, targets: targets, err: err}
+    })
+    return ok, targets, err
+}
+
+// the result of the nearest datacenter succeeded is returned
+func (c *DCClient) Incr(key string, value int) (int, []string, error) {
+    ok, rs, targets, err := c.write(func(store DistributeStorage) dcResult {
+        r, targets, err := store.Incr(key, value)
+        return dcResult{ok: err == nil, targets: targets, err: err, result: r}
+    })
+    if ok {
+        for _, r := range rs {
+            if r.ok {
+                return r.result, targets, nil
+            }
+        }
+    }
+    return 0, targets, err
+}
+
+func (c *DCClient) Delete(key string) (bool, []string, error) {
+    ok, _, targets, err := c.write(func(store DistributeStorage) dcResult {
+        ok, targets, err := store.Delete(key)
+        return dcResult{ok: ok, targets: targets, err: err}
+    })
+    return ok, targets, err
+}
+
+func (c *DCClient) Touch(key string, exptime int) (bool, []string, error) {
+    ok, _, targets, err := c.write(func(store DistributeStorage) dcResult {
+        ok, targets, err := store.Touch(key, exptime)
+        return dcResult{ok: ok, targets: targets, err: err}
+    })
+    return ok, targets, err
+}
+
+// cas uniques are of the local datacenter
+func (c *DCClient) Gets(key string) (*Item, []string, error) {
+    return c.clients[c.local].Gets(key)
+}
+
+// the item stored by cas in the local datacenter is set to the remote ones
+func (c *DCClient) Cas(key string, item *Item) (string, []string, error) {
+    status, targets, err := c.clients[c.local].Cas(key, item)
+    if status != "STORED" {
+        return status, targets, err
+    }
+    for _, name := range c.names[1:] {
+        ok, t, err := c.clients[name].Set(key, item, false)
+        if !ok && err != nil {
+            ErrorLog.Printf("write to datacenter %s failed: %s", name, err)
+        }
+        targets = append(targets, t...)
+    }
+    return status, targets, nil
+}
+
+func (c *DCClient) Len() int {
+    return c.clients[c.local].Len()
+}
@@ -0,0 +1,53 @@
+package memcache
+
+import (
+	"errors"
+	"testing"
+)
+
+// a DistributeStorage failing every request
+type downStore struct {
+	mapDistStore
+}
+
+var errDown = errors.New("datacenter is down")
+
+func (s *downStore) Get(key string) (*Item, []string, error) {
+	return nil, nil, errDown
+}
+
+func (s *downStore) Set(key string, item *Item, noreply bool) (bool, []string, error) {
+	return false, nil, errDown
+}
+
+func TestDCClient(t *testing.T) {
+	local, remote := newMapDistStore(), newMapDistStore()
+	down := &downStore{*newMapDistStore()}
+	if _, err := NewDCClient("dc1", map[string]DistributeStorage{"dc2": remote}, nil, ""); err == nil {
+		t.Errorf("the local datacenter is required")
+	}
+
+	c, err := NewDCClient("dc1", map[string]DistributeStorage{"dc1": local, "dc2": remote}, []string{"dc2"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, _ := c.Set("key", &Item{Body: []byte("v")}, false); !ok || local.Len() != 1 || remote.Len() != 1 {
+		t.Errorf("writes should go to all the datacenters: %v", ok)
+	}
+
+	c, _ = NewDCClient("dc1", map[string]DistributeStorage{"dc1": down, "dc2": remote}, []string{"dc2"}, ConsistencyLocal)
+	if r, _, err := c.Get("key"); err != nil || r == nil {
+		t.Errorf("reads should fall back to the remote datacenter: %v %v", r, err)
+	}
+	if ok, _, err := c.Set("key", &Item{Body: []byte("v")}, false); ok || err == nil {
+		t.Errorf("writes should fail if the local datacenter failed")
+	}
+	c, _ = NewDCClient("dc1", map[string]DistributeStorage{"dc1": down, "dc2": remote}, []string{"dc2"}, ConsistencyOne)
+	if ok, _, err := c.Set("key", &Item{Body: []byte("v")}, false); !ok || err != nil {
+		t.Errorf("writes should succeed in any datacenter: %v", err)
+	}
+	c, _ = NewDCClient("dc1", map[string]DistributeStorage{"dc1": local, "dc2": down}, []string{"dc2"}, ConsistencyAll)
+	if ok, _, _ := c.Set("key", &Item{Body: []byte("v")}, false); ok {
+		t.Errorf("writes should fail unless all the datacenters succeeded")
+	}
+}
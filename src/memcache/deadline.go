@@ -0,0 +1,41 @@
+/*
+ * annotate responses with the time spent in every hop, so clients could
+ * record where their budgets of time are spent
+ *
+ * "deadline <ms>" turns it on for the connection, with a budget of ms for
+ * every request, "deadline 0" turns it off. Every response is preceded by
+ *
+ *   DEADLINE queue=<us> backend=<us> left=<us>
+ *
+ * queue is the time in proxy before requests to backends, including reading
+ * the request, left is the budget left when the response is written, it
+ * could be negative.
+ */
+
+package memcache
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "time"
+)
+
+func parseDeadline(args []string) (time.Duration, error) {
+    if len(args) != 1 {
+        return 0, errors.New("usage: deadline <ms>")
+    }
+    ms, e := strconv.Atoi(args[0])
+    if e != nil || ms < 0 {
+        return 0, errors.New("invalid deadline")
+    }
+    return time.Duration(ms) * time.Millisecond, nil
+}
+
+func writeDeadline(w io.Writer, budget, queue, backend time.Duration) error {
+    left := budget - queue - backend
+    _, e := fmt.Fprintf(w, "DEADLINE queue=%d backend=%d left=%d\r\n",
+        queue.Nanoseconds()/1e3, backend.Nanoseconds()/1e3, left.Nanoseconds()/1e3)
+    return e
+}
@@ -0,0 +1,55 @@
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestDeadlineAnnotation(t *testing.T) {
+	s := NewServer(newMapDistStore())
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	conn, err := net.Dial("tcp", s.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rbuf := bufio.NewReader(conn)
+	command := func(cmd string) string {
+		conn.Write([]byte(cmd))
+		line, err := rbuf.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+
+	if r := command("deadline x\r\n"); r != "CLIENT_ERROR invalid deadline\r\n" {
+		t.Errorf("bad reply: %q", r)
+	}
+	if r := command("deadline 1000\r\n"); r != "OK\r\n" {
+		t.Errorf("bad reply: %q", r)
+	}
+	var queue, backend, left int64
+	r := command("set k 0 0 1\r\nv\r\n")
+	if _, err := fmt.Sscanf(r, "DEADLINE queue=%d backend=%d left=%d\r\n", &queue, &backend, &left); err != nil {
+		t.Fatalf("bad annotation %q: %s", r, err)
+	}
+	if queue < 0 || backend < 0 || left <= 0 || left > 1e6 {
+		t.Errorf("bad annotation: %q", r)
+	}
+	if r := command(""); r != "STORED\r\n" {
+		t.Errorf("bad reply: %q", r)
+	}
+	if r := command("deadline 0\r\n"); r != "OK\r\n" {
+		t.Errorf("bad reply: %q", r)
+	}
+	if r := command("delete k\r\n"); r != "DELETED\r\n" {
+		t.Errorf("should not be annotated: %q", r)
+	}
+}
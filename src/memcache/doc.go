@@ -0,0 +1,30 @@
+/*
+Package memcache is the client, routing and server of beanseye, in layers:
+
+    proto      protocol.go, Request and Response of the text protocol
+    transport  host.go batch.go flowctrl.go fault.go redis.go, connections to backends
+    routing    schedule.go hash.go and the other schedulers, keys to hosts
+    client     client.go rclient.go and its wrappers, reads and writes by routing
+    server     server.go, the proxy serving a DistributeStorage
+    stats      stats.go hoststats.go, and memcache/stats
+    logging    log.go
+
+memcache/stats is split out already, with the latency histograms of
+requests to backends and the timeout advice from them, it depends on
+nothing else. LatencyHistogram, RecordLatency and the others are kept
+here as aliases of it.
+
+The other layers are not split into packages yet, because some of them
+depend on each other:
+
+    routing returns *Host of transport, and feeds back scores through it
+    transport records into stats, and logs into logging
+    proto processes requests with a DistributeStorage of client and *Stats
+
+So the split into memcache/proto, memcache/transport, memcache/router and
+memcache/logging is not done, an embedder of any layer still builds the
+whole package with the server. Routing needs to return Node rather than
+*Host first, and logging needs ErrorLog and AccessLog behind functions, as
+variables could not be aliased across packages.
+*/
+package memcache
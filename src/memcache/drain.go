@@ -0,0 +1,81 @@
+/*
+ * drain a host before decommissioning it: it gets no writes, but serves
+ * reads for a while, then it's skipped like a host in maintenance
+ */
+
+package memcache
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// hosts draining or drained
+var drainingCount int64
+
+// the host gets no more writes, and no requests at all after t
+func DrainHost(addr string, t time.Duration) {
+    c := counterOf(addr)
+    if atomic.SwapInt64(&c.drainUntil, time.Now().Add(t).UnixNano()) == 0 {
+        atomic.AddInt64(&drainingCount, 1)
+    }
+    ErrorLog.Printf("%s is draining, drained in %v", c.addr, t)
+    RecordEvent("drain", addr, "drained in "+t.String())
+}
+
+// stop draining the host, it gets writes again
+func UndrainHost(addr string) {
+    c := counterOf(addr)
+    if atomic.SwapInt64(&c.drainUntil, 0) != 0 {
+        atomic.AddInt64(&drainingCount, -1)
+        ErrorLog.Print(c.addr, " is not draining anymore")
+        RecordEvent("undrain", addr, "")
+    }
+}
+
+// the host gets no writes
+func (host *Host) Draining() bool {
+    return host != nil && host.counter != nil && atomic.LoadInt64(&host.counter.drainUntil) != 0
+}
+
+// the host gets no requests at all
+func (host *Host) Drained() bool {
+    if host == nil || host.counter == nil {
+        return false
+    }
+    t := atomic.LoadInt64(&host.counter.drainUntil)
+    return t != 0 && time.Now().UnixNano() >= t
+}
+
+// hosts draining or drained, and when they are (or were) drained
+func DrainingHosts() map[string]time.Time {
+    r := make(map[string]time.Time)
+    if atomic.LoadInt64(&drainingCount) == 0 {
+        return r
+    }
+    hostCounters.Range(func(addr, c interface{}) bool {
+        if t := atomic.LoadInt64(&c.(*hostCounter).drainUntil); t != 0 {
+            r[addr.(string)] = time.Unix(0, t)
+        }
+        return true
+    })
+    return r
+}
+
+// hosts not draining in the same order, all of them if none is left
+func skipDraining(hosts []*Host) []*Host {
+    if atomic.LoadInt64(&drainingCount) == 0 {
+        return hosts
+    }
+    r := make([]*Host, 0, len(hosts))
+    for _, h := range hosts {
+        if !h.Draining() {
+            r = append(r, h)
+        }
+    }
+    if len(r) == 0 || len(r) == len(hosts) {
+        return hosts
+    }
+    return r
+}
+
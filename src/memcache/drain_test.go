@@ -0,0 +1,38 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainHost(t *testing.T) {
+	addrs := []string{"drain1:11211", "drain2:11211", "drain3:11211"}
+	sch := NewRendezvousScheduler(addrs, "md5")
+	first := sch.GetHostsByKey("key")[0]
+
+	DrainHost(first.Addr, 20*time.Millisecond)
+	defer UndrainHost(first.Addr)
+	if hosts := hostsByOp(sch, "key", OpRead, 2); hosts[0] != first {
+		t.Errorf("draining host should serve reads: %v", hosts)
+	}
+	for _, h := range hostsByOp(sch, "key", OpWrite, 2) {
+		if h == first {
+			t.Errorf("draining host should get no writes")
+		}
+	}
+	if _, ok := DrainingHosts()[first.Addr]; !ok || !StatsV2(sch)[first.Addr].Draining {
+		t.Errorf("draining host should be listed")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	for _, h := range hostsByOp(sch, "key", OpRead, 2) {
+		if h == first {
+			t.Errorf("drained host should get no reads")
+		}
+	}
+
+	UndrainHost(first.Addr)
+	if hostsByOp(sch, "key", OpWrite, 2)[0] != first || len(DrainingHosts()) != 0 {
+		t.Errorf("host should be back after undrained")
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * writes are routed and acknowledged, but never sent to the backends, so
+ * staging traffic could go through the whole proxy without touching the data
+ */
+
+package memcache
+
+import "sync/atomic"
+
+// writes acknowledged without being sent, reported in stats
+var dryRunWrites int64
+
+// DryRunClient reads from the store, and returns the hosts a write would be
+// sent to as its targets, like the access log, without sending it.
+type DryRunClient struct {
+    store     DistributeStorage
+    scheduler Scheduler
+    N         int
+}
+
+func NewDryRunClient(store DistributeStorage, sch Scheduler, N int) *DryRunClient {
+    return &DryRunClient{store, sch, N}
+}
+
+// the hosts the write of key would be sent to
+func (c *DryRunClient) route(key string) []string {
+    atomic.AddInt64(&dryRunWrites, 1)
+    hosts := hostsByOp(c.scheduler, key, OpWrite, 0)
+    if len(hosts) > c.N {
+        hosts = hosts[:c.N]
+    }
+    targets := make([]string, len(hosts))
+    for i, h := range hosts {
+        targets[i] = h.Addr
+    }
+    return targets
+}
+
+func (c *DryRunClient) Get(key string) (*Item, []string, error) {
+    return c.store.Get(key)
+}
+
+func (c *DryRunClient) GetMulti(keys []string) (map[string]*Item, []string, error) {
+    return c.store.GetMulti(keys)
+}
+
+func (c *DryRunClient) Set(key string, item *Item, noreply bool) (bool, []string, error) {
+    return true, c.route(key), nil
+}
+
+func (c *DryRunClient) Append(key string, value []byte) (bool, []string, error) {
+    return true, c.route(key), nil
+}
+
+func (c *DryRunClient) Prepend(key string, value []byte) (bool, []string, error) {
+    return true, c.route(key), nil
+}
+
+// the value as if it was incremented
+func (c *DryRunClient) Incr(key string, value int) (int, []string, error) {
+    targets := c.route(key)
+    r, _, err := c.store.Get(key)
+    if err != nil {
+        return 0, targets, err
+    }
+    if r == nil {
+        return 0, targets, ErrNotFound
+    }
+    v, err := incrValue(r.Body, value)
+    return v, targets, err
+}
+
+func (c *DryRunClient) Delete(key string) (bool, []string, error) {
+    return true, c.route(key), nil
+}
+
+func (c *DryRunClient) Touch(key string, exptime int) (bool, []string, error) {
+    return true, c.route(key), nil
+}
+
+func (c *DryRunClient) Gets(key string) (*Item, []string, error) {
+    return c.store.Gets(key)
+}
+
+func (c *DryRunClient) Cas(key string, item *Item) (string, []string, error) {
+    return "STORED", c.route(key), nil
+}
+
+func (c *DryRunClient) Len() int {
+    return c.store.Len()
+}
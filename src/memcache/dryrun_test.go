@@ -0,0 +1,34 @@
+package memcache
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestDryRunClient(t *testing.T) {
+	store := newMapDistStore()
+	store.Set("n", &Item{Body: []byte("41")}, false)
+	addrs := []string{"dry1:11211", "dry2:11211", "dry3:11211"}
+	c := NewDryRunClient(store, NewRendezvousScheduler(addrs, "md5"), 2)
+	writes := atomic.LoadInt64(&dryRunWrites)
+
+	ok, targets, err := c.Set("k", &Item{Body: []byte("v")}, false)
+	if !ok || err != nil || len(targets) != 2 {
+		t.Errorf("write should be acknowledged with the hosts routed to: %v %v %v", ok, targets, err)
+	}
+	if r, _, _ := c.Get("k"); r != nil {
+		t.Errorf("write should not be sent")
+	}
+	if v, _, err := c.Incr("n", 1); v != 42 || err != nil {
+		t.Errorf("incr should return the value as if it was incremented: %d %v", v, err)
+	}
+	if ok, _, _ := c.Delete("n"); !ok {
+		t.Errorf("delete should be acknowledged")
+	}
+	if r, _, _ := c.Get("n"); r == nil || string(r.Body) != "41" {
+		t.Errorf("data should not be changed: %v", r)
+	}
+	if n := atomic.LoadInt64(&dryRunWrites) - writes; n != 3 {
+		t.Errorf("3 dry run writes, got %d", n)
+	}
+}
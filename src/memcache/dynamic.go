@@ -0,0 +1,143 @@
+/*
+ * change hosts of schedulers at runtime
+ */
+
+package memcache
+
+import (
+    "errors"
+)
+
+// DynamicScheduler could add or remove hosts without restarting,
+// lookups in flight keep using the old hosts until the new ones are ready
+type DynamicScheduler interface {
+    Scheduler
+    AddHost(addr string)
+    RemoveHost(addr string) error // ErrLastHost if it's the only one
+}
+
+var ErrLastHost = errors.New("the last host could not be removed")
+
+// MembershipScheduler could replace all of its hosts at once, like a reload
+// of config, the new hosts are ready before any lookup sees them
+type MembershipScheduler interface {
+    Scheduler
+    SetHosts(addrs []string)
+}
+
+// replace the host with the same address, or append it
+func addHostSpec(specs []string, spec string) []string {
+    addr, _ := parseHostWeight(spec)
+    r := make([]string, 0, len(specs)+1)
+    added := false
+    for _, s := range specs {
+        if a, _ := parseHostWeight(s); a == addr {
+            if !added {
+                r = append(r, spec)
+                added = true
+            }
+            continue
+        }
+        r = append(r, s)
+    }
+    if !added {
+        r = append(r, spec)
+    }
+    return r
+}
+
+func removeHostSpec(specs []string, addr string) []string {
+    addr, _ = parseHostWeight(addr)
+    r := make([]string, 0, len(specs))
+    for _, s := range specs {
+        if a, _ := parseHostWeight(s); a != addr {
+            r = append(r, s)
+        }
+    }
+    return r
+}
+
+func hostAddrs(hosts []*Host) []string {
+    addrs := make([]string, len(hosts))
+    for i, h := range hosts {
+        addrs[i] = h.Addr
+    }
+    return addrs
+}
+
+// addr could be "host:port:weight"
+func (c *ConsistantHashScheduler) AddHost(addr string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.rebuild(addHostSpec(c.specs, addr))
+}
+
+func (c *ConsistantHashScheduler) RemoveHost(addr string) error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    specs := removeHostSpec(c.specs, addr)
+    if len(specs) == 0 {
+        return ErrLastHost
+    }
+    c.rebuild(specs)
+    return nil
+}
+
+// addrs could be "host:port:weight", hosts kept are reused with their connections
+func (c *ConsistantHashScheduler) SetHosts(addrs []string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.rebuild(append([]string(nil), addrs...))
+}
+
+func (c *RendezvousScheduler) AddHost(addr string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    addrs := hostAddrs(c.current().hosts)
+    if !contain(addrs, addr) {
+        c.rebuild(append(addrs, addr))
+    }
+}
+
+func (c *RendezvousScheduler) RemoveHost(addr string) error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    addrs := removeHostSpec(hostAddrs(c.current().hosts), addr)
+    if len(addrs) == 0 {
+        return ErrLastHost
+    }
+    c.rebuild(addrs)
+    return nil
+}
+
+func (c *RendezvousScheduler) SetHosts(addrs []string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.rebuild(append([]string(nil), addrs...))
+}
+
+func (c *MaglevScheduler) AddHost(addr string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    addrs := hostAddrs(c.current().hosts)
+    if !contain(addrs, addr) {
+        c.rebuild(append(addrs, addr))
+    }
+}
+
+func (c *MaglevScheduler) RemoveHost(addr string) error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    addrs := removeHostSpec(hostAddrs(c.current().hosts), addr)
+    if len(addrs) == 0 {
+        return ErrLastHost
+    }
+    c.rebuild(addrs)
+    return nil
+}
+
+func (c *MaglevScheduler) SetHosts(addrs []string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.rebuild(append([]string(nil), addrs...))
+}
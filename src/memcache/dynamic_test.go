@@ -0,0 +1,116 @@
+package memcache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func testDynamicScheduler(t *testing.T, schd DynamicScheduler, hosts []string) {
+	keys := make([]string, 500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+	before := make(map[string]string, len(keys))
+	for _, key := range keys {
+		before[key] = schd.GetHostsByKey(key)[0].Addr
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			if len(schd.GetHostsByKey(keys[i%len(keys)])) == 0 {
+				t.Error("no host during rebuilding")
+				return
+			}
+		}
+	}()
+	schd.AddHost("new:11211")
+	wg.Wait()
+
+	moved := 0
+	for _, key := range keys {
+		addr := schd.GetHostsByKey(key)[0].Addr
+		if addr != before[key] {
+			if addr != "new:11211" {
+				t.Errorf("key %s should move to the new host only, but %s", key, addr)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > len(keys)/2 {
+		t.Errorf("%d keys moved to the new host", moved)
+	}
+
+	if err := schd.RemoveHost("new:11211"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if addr := schd.GetHostsByKey(key)[0].Addr; addr != before[key] {
+			t.Errorf("key %s should move back to %s, but %s", key, before[key], addr)
+		}
+	}
+}
+
+func TestDynamicScheduler(t *testing.T) {
+	hosts := chthosts[:8]
+	testDynamicScheduler(t, NewConsistantHashScheduler(hosts, "md5").(DynamicScheduler), hosts)
+	testDynamicScheduler(t, NewRendezvousScheduler(hosts, "md5").(DynamicScheduler), hosts)
+
+	schd := DynamicScheduler(newTestMaglevScheduler(hosts[:2], 0))
+	if err := schd.RemoveHost(hosts[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := schd.RemoveHost(hosts[1]); err != ErrLastHost {
+		t.Errorf("the last host should not be removed: %v", err)
+	}
+	if hs := schd.GetHostsByKey("key"); len(hs) != 1 || hs[0].Addr != hosts[1] {
+		t.Errorf("keys should still be routed to the last host: %v", hs)
+	}
+}
+
+func testMembershipScheduler(t *testing.T, schd MembershipScheduler, hosts []string) {
+	keys := make([]string, 500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			hs := schd.GetHostsByKey(keys[i%len(keys)])
+			if len(hs) == 0 || hs[0] == nil {
+				t.Error("no host during rebuilding")
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		schd.SetHosts(hosts[:len(hosts)-i%2])
+	}
+	close(stop)
+	wg.Wait()
+
+	schd.SetHosts(hosts[1:])
+	for _, key := range keys {
+		if addr := schd.GetHostsByKey(key)[0].Addr; addr == hosts[0] {
+			t.Errorf("key %s routed to removed host %s", key, addr)
+		}
+	}
+}
+
+func TestMembershipScheduler(t *testing.T) {
+	hosts := chthosts[:8]
+	testMembershipScheduler(t, NewConsistantHashScheduler(hosts, "md5").(MembershipScheduler), hosts)
+	testMembershipScheduler(t, NewRendezvousScheduler(hosts, "md5").(MembershipScheduler), hosts)
+	testMembershipScheduler(t, newTestMaglevScheduler(hosts, 0), hosts)
+}
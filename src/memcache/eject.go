@@ -0,0 +1,117 @@
+/*
+ * eject hosts failing again and again from the schedulers, and probe them
+ * in background until they recover, so a dead host does not cost a timeout
+ * on every request
+ */
+
+package memcache
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// errors in a row to eject a host, 0 to disable
+var EjectErrors = 0
+
+// successful probes in a row to bring an ejected host back
+var RecoverProbes = 3
+
+// interval between probes of an ejected host
+var ProbeInterval time.Duration = time.Second
+
+// hosts ejected now, and ejections ever, reported in stats
+var ejectedCount, hostEjections int64
+
+var (
+    probeLock sync.Mutex
+    probeStop = make(chan struct{}) // closed by StopProbes
+)
+
+// stop probing the ejected hosts, they are not ejected anymore, like when
+// the proxy is stopped
+func StopProbes() {
+    probeLock.Lock()
+    defer probeLock.Unlock()
+    close(probeStop)
+    probeStop = make(chan struct{})
+}
+
+func (host *Host) Ejected() bool {
+    return host != nil && host.counter != nil && atomic.LoadInt32(&host.counter.ejected) != 0
+}
+
+func (c *hostCounter) eject() {
+    if !atomic.CompareAndSwapInt32(&c.ejected, 0, 1) {
+        return
+    }
+    atomic.AddInt64(&ejectedCount, 1)
+    atomic.AddInt64(&hostEjections, 1)
+    ErrorLog.Printf("%s ejected after %d errors in a row", c.addr, atomic.LoadInt32(&c.failures))
+    RecordEvent("eject", c.addr, fmt.Sprintf("%d errors in a row", atomic.LoadInt32(&c.failures)))
+    go c.probe()
+}
+
+func (c *hostCounter) probe() {
+    probeLock.Lock()
+    stop := probeStop
+    probeLock.Unlock()
+    ok := 0
+    for ok < RecoverProbes {
+        select {
+        case <-time.After(ProbeInterval):
+        case <-stop:
+            atomic.StoreInt32(&c.failures, 0)
+            atomic.StoreInt32(&c.ejected, 0)
+            atomic.AddInt64(&ejectedCount, -1)
+            return
+        }
+        if err := probeHost(c.addr); err != nil {
+            ok = 0
+            continue
+        }
+        ok++
+    }
+    atomic.StoreInt32(&c.failures, 0)
+    atomic.StoreInt32(&c.ejected, 0)
+    atomic.AddInt64(&ejectedCount, -1)
+    ErrorLog.Printf("%s recovered after %d probes", c.addr, ok)
+    RecordEvent("recover", c.addr, fmt.Sprintf("%d probes", ok))
+}
+
+// send version (or PING to redis) to the host on a new connection
+var probeHost = func(addr string) error {
+    cmd, reply := "version\r\n", "VERSION"
+    if isRedisAddr(addr) {
+        addr = addr[len(redisScheme):]
+        if !hasPort(addr) {
+            addr = addr + ":6379"
+        }
+        cmd, reply = "PING\r\n", "+PONG"
+    } else if !hasPort(addr) {
+        addr = addr + ":11211"
+    }
+    conn, err := net.DialTimeout("tcp", addr, ConnectTimeout)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(ReadTimeout))
+    if _, err := conn.Write([]byte(cmd)); err != nil {
+        return err
+    }
+    line, err := bufio.NewReader(conn).ReadString('\n')
+    if err != nil {
+        return err
+    }
+    if !strings.HasPrefix(line, reply) {
+        return errors.New("unexpected reply: " + strings.TrimSpace(line))
+    }
+    return nil
+}
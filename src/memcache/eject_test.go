@@ -0,0 +1,68 @@
+package memcache
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEjectHost(t *testing.T) {
+	errs, probes, interval, probe := EjectErrors, RecoverProbes, ProbeInterval, probeHost
+	EjectErrors, RecoverProbes, ProbeInterval = 2, 2, time.Millisecond
+	var healthy int32
+	probeHost = func(addr string) error {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return errors.New("down")
+		}
+		return nil
+	}
+	defer func() { EjectErrors, RecoverProbes, ProbeInterval, probeHost = errs, probes, interval, probe }()
+
+	addrs := []string{"eject1:11211", "eject2:11211", "eject3:11211"}
+	sch := NewRendezvousScheduler(addrs, "md5")
+	first := sch.GetHostsByKey("key")[0]
+	first.counter.fail()
+	first.counter.done(time.Millisecond)
+	first.counter.fail()
+	if first.Ejected() {
+		t.Fatalf("errors not in a row should not eject the host")
+	}
+	first.counter.fail()
+	if !first.Ejected() {
+		t.Fatalf("host should be ejected after errors in a row")
+	}
+	for _, h := range sch.GetHostsByKey("key") {
+		if h.Addr == first.Addr {
+			t.Errorf("ejected host should be skipped")
+		}
+	}
+	if !StatsV2(sch)[first.Addr].Ejected {
+		t.Errorf("ejected host should be in stats")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if !first.Ejected() {
+		t.Fatalf("host should not recover while probes fail")
+	}
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(20 * time.Millisecond)
+	if first.Ejected() || sch.GetHostsByKey("key")[0] != first {
+		t.Errorf("host should be back after successful probes")
+	}
+}
+
+func TestProbeHost(t *testing.T) {
+	s := NewServer(newMapDistStore())
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Shutdown()
+	if err := probeHost(s.l.Addr().String()); err != nil {
+		t.Errorf("probe of a live server failed: %s", err)
+	}
+	if err := probeHost("127.0.0.1:1"); err == nil {
+		t.Errorf("probe of a dead server should fail")
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * epochs of the routing, a topology is tagged by the time it was first seen
+ * by the fleet, so proxies in a rolling restart could tell the newer routing,
+ * and writes routed by an older one could be copied after the change
+ */
+
+package memcache
+
+import (
+    "container/list"
+    "math"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+var (
+    routingEpoch int64 // unix seconds, 0 if no topology
+    epochBehind  int64 // the newest epoch of a different topology seen on peers
+)
+
+var staleWrites, writesReconciled int64
+
+// recent writes kept with their epochs and hosts, to reconcile them after
+// the topology changed, 0 to disable
+var EpochLedgerSize = 0
+
+// the epoch of the topology, reported as epoch in stats, peers and clients
+// could compare it with theirs
+func RoutingEpoch() int64 {
+    return atomic.LoadInt64(&routingEpoch)
+}
+
+// the newest epoch of another topology seen on peers, this proxy routes by a
+// stale topology if it's larger than RoutingEpoch()
+func EpochBehind() int64 {
+    return atomic.LoadInt64(&epochBehind)
+}
+
+// a new topology is always newer than the last one, even if the clock went back
+func newEpoch() {
+    for {
+        old := atomic.LoadInt64(&routingEpoch)
+        e := time.Now().Unix()
+        if e <= old {
+            e = old + 1
+        }
+        if atomic.CompareAndSwapInt64(&routingEpoch, old, e) {
+            RecordEvent("epoch", "", time.Unix(e, 0).Format(time.RFC3339))
+            return
+        }
+    }
+}
+
+// the epoch of a peer, which routes by the same topology or not
+func observeEpoch(peer string, epoch int64, same bool) {
+    if epoch <= 0 {
+        return
+    }
+    own := RoutingEpoch()
+    if same {
+        // the topology was seen earlier by the peer
+        if epoch < own {
+            atomic.CompareAndSwapInt64(&routingEpoch, own, epoch)
+        }
+        return
+    }
+    for {
+        behind := atomic.LoadInt64(&epochBehind)
+        if epoch <= own || epoch <= behind {
+            return
+        }
+        if atomic.CompareAndSwapInt64(&epochBehind, behind, epoch) {
+            ErrorLog.Printf("STALE TOPOLOGY: proxy %s routes by a newer topology (epoch %d vs %d)", peer, epoch, own)
+            return
+        }
+    }
+}
+
+type EpochWrite struct {
+    Key   string
+    Epoch int64
+    Hosts []string
+}
+
+// recent writes by key, the oldest are dropped
+type epochLedger struct {
+    sync.Mutex
+    writes map[string]*list.Element
+    order  *list.List
+    hosts  map[string]*Host // connections to hosts written to, by address
+}
+
+var writeLedger = &epochLedger{
+    writes: make(map[string]*list.Element),
+    order:  list.New(),
+    hosts:  make(map[string]*Host),
+}
+
+// the write of key is sent to hosts by the current topology
+func stampWrite(key string, hosts []string) {
+    epoch := RoutingEpoch()
+    if EpochBehind() > epoch {
+        atomic.AddInt64(&staleWrites, 1)
+    }
+    if EpochLedgerSize <= 0 || len(hosts) == 0 {
+        return
+    }
+    l := writeLedger
+    l.Lock()
+    defer l.Unlock()
+    if e, ok := l.writes[key]; ok {
+        l.order.Remove(e)
+    }
+    w := &EpochWrite{key, epoch, append([]string(nil), hosts...)}
+    l.writes[key] = l.order.PushBack(w)
+    for l.order.Len() > EpochLedgerSize {
+        e := l.order.Front()
+        delete(l.writes, e.Value.(*EpochWrite).Key)
+        l.order.Remove(e)
+    }
+}
+
+// the key is deleted, it's not copied back
+func forgetWrite(key string) {
+    if EpochLedgerSize <= 0 {
+        return
+    }
+    l := writeLedger
+    l.Lock()
+    defer l.Unlock()
+    if e, ok := l.writes[key]; ok {
+        delete(l.writes, key)
+        l.order.Remove(e)
+    }
+}
+
+// writes of older epochs in the ledger
+func (l *epochLedger) before(epoch int64) []*EpochWrite {
+    l.Lock()
+    defer l.Unlock()
+    var r []*EpochWrite
+    for e := l.order.Front(); e != nil; e = e.Next() {
+        if w := e.Value.(*EpochWrite); w.Epoch < epoch {
+            r = append(r, w)
+        }
+    }
+    return r
+}
+
+func (l *epochLedger) host(addr string) *Host {
+    l.Lock()
+    defer l.Unlock()
+    h, ok := l.hosts[addr]
+    if !ok {
+        h = NewHost(addr)
+        l.hosts[addr] = h
+    }
+    return h
+}
+
+// the writes in the ledger, the oldest first
+func EpochLedger() []*EpochWrite {
+    return writeLedger.before(math.MaxInt64)
+}
+
+// the keys written under older epochs and missing from the store now are
+// copied from the hosts they were written to, without expirations, returns
+// the keys copied
+func ReconcileWrites(store DistributeStorage) (n int) {
+    epoch := RoutingEpoch()
+    for _, w := range writeLedger.before(epoch) {
+        item, _, err := store.Get(w.Key)
+        if err != nil {
+            // tried again next time
+            continue
+        }
+        if item != nil {
+            forgetWrite(w.Key)
+            continue
+        }
+        for _, addr := range w.Hosts {
+            item, err := writeLedger.host(addr).Get(w.Key)
+            if err != nil || item == nil {
+                continue
+            }
+            if ok, _, _ := store.Set(w.Key, item, false); ok {
+                n++
+            }
+            break
+        }
+        forgetWrite(w.Key)
+    }
+    atomic.AddInt64(&writesReconciled, int64(n))
+    if n > 0 {
+        RecordEvent("reconcile", "", strconv.Itoa(n)+" keys")
+    }
+    return
+}
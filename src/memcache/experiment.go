@@ -0,0 +1,156 @@
+/*
+ * A/B experiments on a fraction of keys, like another TTL or another pool
+ */
+
+package memcache
+
+import (
+    "sort"
+    "strings"
+)
+
+// Experiment change requests of a fraction of keys with the prefix, keys
+// are assigned by hash, so a key is always in or out of the experiment
+type Experiment struct {
+    ID     string  // recorded in access log as exp=ID
+    Prefix string
+    Rate   float64 // fraction of keys in the experiment
+    TTL    int     // exptime of writes, 0 to keep it
+    Pool   bool    // route the keys to the experimental pool of this ID
+}
+
+// experiments are checked in order, the first one matching wins
+var Experiments []*Experiment
+
+func (e *Experiment) has(key string) bool {
+    if !strings.HasPrefix(key, e.Prefix) {
+        return false
+    }
+    return float64(fnv1a([]byte(key))%10000) < e.Rate*10000
+}
+
+func experimentOf(key string) *Experiment {
+    for _, e := range Experiments {
+        if e.has(key) {
+            return e
+        }
+    }
+    return nil
+}
+
+// IDs of experiments of the keys, for access log
+func experimentIDs(keys []string) string {
+    var ids []string
+    for _, key := range keys {
+        if e := experimentOf(key); e != nil && !contain(ids, e.ID) {
+            ids = append(ids, e.ID)
+        }
+    }
+    sort.Strings(ids)
+    return strings.Join(ids, ",")
+}
+
+// ExperimentClient apply Experiments, pools are the experimental clusters
+// by ID of experiments
+type ExperimentClient struct {
+    store DistributeStorage
+    pools map[string]DistributeStorage
+}
+
+func NewExperimentClient(store DistributeStorage, pools map[string]DistributeStorage) *ExperimentClient {
+    return &ExperimentClient{store, pools}
+}
+
+func (c *ExperimentClient) route(key string) (DistributeStorage, *Experiment) {
+    e := experimentOf(key)
+    if e != nil && e.Pool {
+        if pool, ok := c.pools[e.ID]; ok {
+            return pool, e
+        }
+    }
+    return c.store, e
+}
+
+func (c *ExperimentClient) Get(key string) (*Item, []string, error) {
+    store, _ := c.route(key)
+    return store.Get(key)
+}
+
+func (c *ExperimentClient) GetMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+    groups := make(map[DistributeStorage][]string)
+    for _, key := range keys {
+        store, _ := c.route(key)
+        groups[store] = append(groups[store], key)
+    }
+    if len(groups) == 1 {
+        for store, ks := range groups {
+            return store.GetMulti(ks)
+        }
+    }
+    rs = make(map[string]*Item, len(keys))
+    for store, ks := range groups {
+        r, ts, e := store.GetMulti(ks)
+        if e != nil {
+            err = e
+        }
+        for key, item := range r {
+            rs[key] = item
+        }
+        targets = append(targets, ts...)
+    }
+    return
+}
+
+func (c *ExperimentClient) Set(key string, item *Item, noreply bool) (bool, []string, error) {
+    store, e := c.route(key)
+    if e != nil && e.TTL != 0 {
+        it := *item
+        it.Exptime = e.TTL
+        item = &it
+    }
+    return store.Set(key, item, noreply)
+}
+
+func (c *ExperimentClient) Append(key string, value []byte) (bool, []string, error) {
+    store, _ := c.route(key)
+    return store.Append(key, value)
+}
+
+func (c *ExperimentClient) Prepend(key string, value []byte) (bool, []string, error) {
+    store, _ := c.route(key)
+    return store.Prepend(key, value)
+}
+
+func (c *ExperimentClient) Incr(key string, value int) (int, []string, error) {
+    store, _ := c.route(key)
+    return store.Incr(key, value)
+}
+
+func (c *ExperimentClient) Delete(key string) (bool, []string, error) {
+    store, _ := c.route(key)
+    return store.Delete(key)
+}
+
+func (c *ExperimentClient) Touch(key string, exptime int) (bool, []string, error) {
+    store, _ := c.route(key)
+    return store.Touch(key, exptime)
+}
+
+func (c *ExperimentClient) Gets(key string) (*Item, []string, error) {
+    store, _ := c.route(key)
+    return store.Gets(key)
+}
+
+func (c *ExperimentClient) Cas(key string, item *Item) (string, []string, error) {
+    store, e := c.route(key)
+    if e != nil && e.TTL != 0 {
+        it := *item
+        it.Exptime = e.TTL
+        item = &it
+    }
+    return store.Cas(key, item)
+}
+
+func (c *ExperimentClient) Len() int {
+    return c.store.Len()
+}
@@ -0,0 +1,55 @@
+package memcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExperimentClient(t *testing.T) {
+	Experiments = []*Experiment{
+		{ID: "ttl", Prefix: "rec:", Rate: 0.5, TTL: 600},
+		{ID: "pool", Prefix: "img:", Rate: 1, Pool: true},
+	}
+	defer func() { Experiments = nil }()
+
+	store := NewMapStore()
+	pool := NewMapStore()
+	c := NewExperimentClient(NewLocalStorage(store, "main"),
+		map[string]DistributeStorage{"pool": NewLocalStorage(pool, "pool")})
+
+	in := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("rec:%d", i)
+		c.Set(key, &Item{Exptime: 3600, Body: []byte("v")}, false)
+		r, _ := store.Get(key)
+		switch r.Exptime {
+		case 600:
+			in++
+			if experimentIDs([]string{key}) != "ttl" {
+				t.Errorf("%s should be logged in ttl", key)
+			}
+		case 3600:
+		default:
+			t.Errorf("bad exptime of %s: %d", key, r.Exptime)
+		}
+	}
+	if in < 400 || in > 600 {
+		t.Errorf("about half of keys should be in the experiment: %d", in)
+	}
+
+	c.Set("img:1", &Item{Body: []byte("img")}, false)
+	c.Set("user:1", &Item{Body: []byte("user")}, false)
+	if r, _ := pool.Get("img:1"); r == nil {
+		t.Error("img:1 should be written to the pool")
+	}
+	if r, _ := store.Get("img:1"); r != nil {
+		t.Error("img:1 should not be written to the main store")
+	}
+	rs, targets, _ := c.GetMulti([]string{"img:1", "user:1"})
+	if len(rs) != 2 || len(targets) != 2 {
+		t.Errorf("keys should be read from both stores: %v %v", rs, targets)
+	}
+	if ids := experimentIDs([]string{"img:1", "user:1", "img:2"}); ids != "pool" {
+		t.Errorf("bad experiment ids: %s", ids)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * guard the expiries from clients before forwarding them to backends
+ */
+
+package memcache
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// expiries larger than this are unix time, others are seconds to live
+const RelativeExpiryLimit = 60 * 60 * 24 * 30
+
+// how backends interpret expiries, clients always use the memcached way
+const (
+    ExpiryMemcached = "memcached" // seconds to live up to 30 days, unix time beyond
+    ExpiryRelative  = "relative"  // always seconds to live
+    ExpiryAbsolute  = "absolute"  // always unix time
+)
+
+// expiry mode of backends by address, ExpiryMemcached by default
+var HostExpiry map[string]string
+
+// absolute expiries earlier than now by no more than this come from clients
+// with clocks behind the proxy, they would expire at once, 0 to disable
+var MaxClockSkew time.Duration
+
+// move skewed expiries to MaxClockSkew later than now, or just count and log them
+var FixClockSkew bool
+
+var skewedExpiries int64
+
+// check the expiry of key from clients, return the one to forward
+func checkClockSkew(key string, exptime int, now time.Time) int {
+    if MaxClockSkew <= 0 || exptime <= RelativeExpiryLimit {
+        return exptime
+    }
+    expire := time.Unix(int64(exptime), 0)
+    if !expire.Before(now) || now.Sub(expire) > MaxClockSkew {
+        return exptime
+    }
+    atomic.AddInt64(&skewedExpiries, 1)
+    if ErrorLog != nil {
+        ErrorLog.Printf("expiry of %s is %s behind, clock of client is skewed", key, now.Sub(expire))
+    }
+    if FixClockSkew {
+        return int(now.Add(MaxClockSkew).Unix())
+    }
+    return exptime
+}
+
+// translate the expiry from clients into the mode of backend,
+// 0 is never expire and negative is expired in all the modes
+func normalizeExpiry(exptime int, mode string, now time.Time) int {
+    if exptime == 0 {
+        return 0
+    }
+    if exptime < 0 {
+        return -1
+    }
+    switch mode {
+    case ExpiryRelative:
+        if exptime > RelativeExpiryLimit {
+            ttl := exptime - int(now.Unix())
+            if ttl <= 0 {
+                return -1
+            }
+            return ttl
+        }
+    case ExpiryAbsolute:
+        if exptime <= RelativeExpiryLimit {
+            return int(now.Unix()) + exptime
+        }
+    }
+    return exptime
+}
@@ -0,0 +1,61 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckClockSkew(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	behind := int(now.Unix()) - 60
+	if e := checkClockSkew("k", behind, now); e != behind {
+		t.Errorf("guard should be disabled by default: %d", e)
+	}
+
+	MaxClockSkew = time.Minute * 5
+	defer func() { MaxClockSkew, FixClockSkew = 0, false }()
+	n := skewedExpiries
+	for _, e := range []int{0, 3600, RelativeExpiryLimit, int(now.Unix()) + 60, int(now.Unix()) - 3600} {
+		if r := checkClockSkew("k", e, now); r != e {
+			t.Errorf("expiry %d should not be changed: %d", e, r)
+		}
+	}
+	if skewedExpiries != n {
+		t.Errorf("no expiry should be skewed")
+	}
+	if e := checkClockSkew("k", behind, now); e != behind || skewedExpiries != n+1 {
+		t.Errorf("skewed expiry should be counted only: %d", e)
+	}
+	FixClockSkew = true
+	if e := checkClockSkew("k", behind, now); e != int(now.Unix())+300 {
+		t.Errorf("skewed expiry should be fixed: %d", e)
+	}
+}
+
+func TestNormalizeExpiry(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	unix := int(now.Unix())
+	tests := []struct {
+		exptime int
+		mode    string
+		expect  int
+	}{
+		{0, ExpiryRelative, 0},
+		{0, ExpiryAbsolute, 0},
+		{-5, ExpiryAbsolute, -1},
+		{60, ExpiryMemcached, 60},
+		{unix + 60, ExpiryMemcached, unix + 60},
+		{60, ExpiryRelative, 60},
+		{unix + 60, ExpiryRelative, 60},
+		{unix - 60, ExpiryRelative, -1},
+		{unix + RelativeExpiryLimit*2, ExpiryRelative, RelativeExpiryLimit * 2},
+		{60, ExpiryAbsolute, unix + 60},
+		{RelativeExpiryLimit, ExpiryAbsolute, unix + RelativeExpiryLimit},
+		{unix + 60, ExpiryAbsolute, unix + 60},
+	}
+	for _, tt := range tests {
+		if e := normalizeExpiry(tt.exptime, tt.mode, now); e != tt.expect {
+			t.Errorf("expiry %d in %s should be %d: %d", tt.exptime, tt.mode, tt.expect, e)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * explain how a key was routed
+ */
+
+package memcache
+
+import (
+    "time"
+)
+
+type HostExplain struct {
+    Addr   string
+    Score  float64
+    Backup bool
+    Health string
+}
+
+type RouteExplain struct {
+    Key    string
+    Hash   uint32
+    Bucket int // -1 if the scheduler has no buckets
+    Hosts  []HostExplain
+    Choice string
+}
+
+type explainer interface {
+    Explain(key string) *RouteExplain
+}
+
+func (host *Host) Health() string {
+    if host.isClosed() {
+        return "closed"
+    }
+    if host.nextDial.After(time.Now()) {
+        return "down, retry at " + host.nextDial.Format("15:04:05")
+    }
+    return "ok"
+}
+
+// the routing derivation of a key
+func ExplainRoute(schd Scheduler, key string) *RouteExplain {
+    var r *RouteExplain
+    if e, ok := schd.(explainer); ok {
+        r = e.Explain(key)
+    } else {
+        r = &RouteExplain{Key: key, Bucket: -1}
+        for _, h := range schd.GetHostsByKey(key) {
+            r.Hosts = append(r.Hosts, HostExplain{Addr: h.Addr, Health: h.Health()})
+        }
+    }
+    for _, h := range r.Hosts {
+        if h.Health == "ok" {
+            r.Choice = h.Addr
+            break
+        }
+    }
+    if r.Choice == "" && len(r.Hosts) > 0 {
+        r.Choice = r.Hosts[0].Addr
+    }
+    return r
+}
+
+func explainBucket(hash_func HashMethod, bucketWidth int, key string) *RouteExplain {
+    r := &RouteExplain{Key: key}
+    k := key
+    if len(k) >= 1 && k[0] == '?' {
+        k = k[1:]
+    }
+    r.Hash = hash_func([]byte(k))
+    r.Bucket = getBucketByKey(hash_func, bucketWidth, key)
+    return r
+}
+
+func (c *ManualScheduler) Explain(key string) *RouteExplain {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    r := explainBucket(c.hashMethod, c.bucketWidth, key)
+    for i, h := range c.getHostsByKey(key) {
+        r.Hosts = append(r.Hosts, HostExplain{h.Addr, c.stats[r.Bucket][h.offset], i >= c.N, h.Health()})
+    }
+    return r
+}
+
+func (c *AutoScheduler) Explain(key string) *RouteExplain {
+    r := explainBucket(c.hashMethod, c.bucketWidth, key)
+    for _, h := range c.GetHostsByKey(key) {
+        r.Hosts = append(r.Hosts, HostExplain{h.Addr, c.stats[r.Bucket][c.hostIndex(h)], false, h.Health()})
+    }
+    return r
+}
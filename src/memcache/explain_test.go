@@ -0,0 +1,28 @@
+package memcache
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestExplainRoute(t *testing.T) {
+	config := AutoConfig([]string{"localhost:11901", "localhost:11902", "localhost:11903"}, 16)
+	config["localhost:11904"] = []string{"-" + strconv.FormatInt(int64(getBucketByKey(fnv1a1, 4, "key")), 16)}
+	schd := NewManualScheduler(config, 16, 3)
+	r := ExplainRoute(schd, "key")
+	if r.Bucket != getBucketByKey(fnv1a1, 4, "key") || r.Hash != fnv1a1([]byte("key")) {
+		t.Errorf("wrong bucket or hash: %v", r)
+	}
+	hosts := schd.GetHostsByKey("key")
+	if len(r.Hosts) != len(hosts) || r.Choice != hosts[0].Addr {
+		t.Errorf("explain should follow GetHostsByKey: %v", r)
+	}
+	if !r.Hosts[3].Backup {
+		t.Errorf("localhost:11904 should be a backup: %v", r)
+	}
+
+	r = ExplainRoute(NewModScheduler(modhosts, "md5"), "0:key:0")
+	if r.Bucket != -1 || r.Choice != "host1:11211" {
+		t.Errorf("explain of mod scheduler: %v", r)
+	}
+}
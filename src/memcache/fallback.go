@@ -0,0 +1,80 @@
+/*
+ * fall through to another cluster when all the hosts of a key are down
+ */
+
+package memcache
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// counter of keys routed to the fallback scheduler, reported in stats
+var fallbackRoutes int64
+
+// the host could not be connected and is waiting for retry, or closed
+func (host *Host) isDown() bool {
+    return host.isClosed() || host.nextDial.After(time.Now())
+}
+
+// FallbackScheduler route keys by the fallback scheduler if every host of
+// the primary scheduler is down, like a DR cluster with the same buckets.
+type FallbackScheduler struct {
+    primary  Scheduler
+    fallback Scheduler
+}
+
+func NewFallbackScheduler(primary, fallback Scheduler) *FallbackScheduler {
+    return &FallbackScheduler{primary, fallback}
+}
+
+func allDown(hosts []*Host) bool {
+    for _, h := range hosts {
+        if h != nil && !h.isDown() {
+            return false
+        }
+    }
+    return true
+}
+
+func (c *FallbackScheduler) Hosts() []*Host {
+    return appendHosts(SchedulerHosts(c.primary), SchedulerHosts(c.fallback))
+}
+
+func (c *FallbackScheduler) GetHostsByKey(key string) []*Host {
+    hosts := c.primary.GetHostsByKey(key)
+    if len(hosts) > 0 && !allDown(hosts) {
+        return hosts
+    }
+    fallback := c.fallback.GetHostsByKey(key)
+    if allDown(fallback) {
+        return hosts
+    }
+    atomic.AddInt64(&fallbackRoutes, 1)
+    return fallback
+}
+
+// feedback goes to the scheduler which the host belongs to
+func (c *FallbackScheduler) Feedback(host *Host, key string, ev FeedbackEvent) {
+    for _, h := range c.primary.GetHostsByKey(key) {
+        if h == host {
+            c.primary.Feedback(host, key, ev)
+            return
+        }
+    }
+    c.fallback.Feedback(host, key, ev)
+}
+
+func (c *FallbackScheduler) DivideKeysByBucket(keys []string) [][]string {
+    return c.primary.DivideKeysByBucket(keys)
+}
+
+func (c *FallbackScheduler) Stats() map[string][]float64 {
+    r := c.primary.Stats()
+    for addr, st := range c.fallback.Stats() {
+        if _, ok := r[addr]; !ok {
+            r[addr] = st
+        }
+    }
+    return r
+}
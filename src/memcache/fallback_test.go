@@ -0,0 +1,28 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFallbackScheduler(t *testing.T) {
+	primary := newTestManualScheduler(map[string][]string{"p1": {"0"}, "p2": {"0"}}, 1, 2)
+	dr := newTestManualScheduler(map[string][]string{"dr1": {"0"}, "dr2": {"0"}}, 1, 2)
+	schd := NewFallbackScheduler(primary, dr)
+
+	if hosts := schd.GetHostsByKey("key"); hosts[0].Addr[0] != 'p' {
+		t.Errorf("key should be routed to primary: %s", hosts[0].Addr)
+	}
+	primary.hosts[0].nextDial = time.Now().Add(time.Minute)
+	if hosts := schd.GetHostsByKey("key"); hosts[0].Addr[0] != 'p' {
+		t.Errorf("key should be routed to primary if some of the hosts are up: %s", hosts[0].Addr)
+	}
+	primary.hosts[1].nextDial = time.Now().Add(time.Minute)
+	hosts := schd.GetHostsByKey("key")
+	if hosts[0].Addr[0] != 'd' {
+		t.Errorf("key should fall through to dr if all the primary hosts are down: %s", hosts[0].Addr)
+	}
+	if st := schd.Stats(); len(st) != 4 {
+		t.Errorf("stats should include both schedulers: %v", st)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * failure injection, to rehearse failover in game-day drills
+ */
+
+package memcache
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "sync"
+    "time"
+)
+
+type hostFault struct {
+    Delay     time.Duration
+    ErrorRate float64 // percent of requests which fail
+}
+
+var faultLock sync.RWMutex
+var hostFaults = map[string]*hostFault{}
+var partitions = map[int]bool{}
+var partitionHash HashMethod = fnv1a1
+var partitionWidth int
+
+func getHostFault(addr string) *hostFault {
+    f, ok := hostFaults[addr]
+    if !ok {
+        f = new(hostFault)
+        hostFaults[addr] = f
+    }
+    return f
+}
+
+// make every request to the host slower
+func InjectDelay(addr string, delay time.Duration) {
+    faultLock.Lock()
+    defer faultLock.Unlock()
+    getHostFault(addr).Delay = delay
+    ErrorLog.Printf("fault injected: %s slow down %v", addr, delay)
+    RecordEvent("fault", addr, "slow down "+delay.String())
+}
+
+// make percent of requests to the host fail
+func InjectErrors(addr string, percent float64) {
+    faultLock.Lock()
+    defer faultLock.Unlock()
+    getHostFault(addr).ErrorRate = percent
+    ErrorLog.Printf("fault injected: %s fail %.1f%% requests", addr, percent)
+    RecordEvent("fault", addr, fmt.Sprintf("fail %.1f%% requests", percent))
+}
+
+// the hash and the bucket width keys are routed by, false if the scheduler
+// has no buckets
+func schedulerBuckets(sch Scheduler) (HashMethod, int, bool) {
+    switch c := sch.(type) {
+    case *ManualScheduler:
+        return c.hashMethod, c.bucketWidth, true
+    case *AutoScheduler:
+        return c.hashMethod, c.bucketWidth, true
+    case *SplitScheduler:
+        return c.hashMethod, c.bucketWidth, true
+    }
+    return nil, 0, false
+}
+
+// make all the hosts unreachable for keys in the bucket of the scheduler
+func PartitionBucket(sch Scheduler, bucket int) error {
+    hash, width, ok := schedulerBuckets(sch)
+    if !ok {
+        return errors.New("the scheduler has no buckets")
+    }
+    if bucket < 0 || bucket >= 1<<uint(width) {
+        return fmt.Errorf("no bucket %X in the scheduler", bucket)
+    }
+    faultLock.Lock()
+    defer faultLock.Unlock()
+    partitionHash, partitionWidth = hash, width
+    partitions[bucket] = true
+    ErrorLog.Printf("fault injected: bucket %X partitioned", bucket)
+    RecordEvent("fault", "", fmt.Sprintf("bucket %X partitioned", bucket))
+    return nil
+}
+
+func ClearFaults() {
+    faultLock.Lock()
+    defer faultLock.Unlock()
+    hostFaults = map[string]*hostFault{}
+    partitions = map[int]bool{}
+    ErrorLog.Print("all injected faults cleared")
+    RecordEvent("fault", "", "cleared")
+}
+
+// current injected faults
+func Faults() (hosts map[string]hostFault, buckets []int) {
+    faultLock.RLock()
+    defer faultLock.RUnlock()
+    hosts = make(map[string]hostFault, len(hostFaults))
+    for addr, f := range hostFaults {
+        hosts[addr] = *f
+    }
+    for b := range partitions {
+        buckets = append(buckets, b)
+    }
+    return
+}
+
+func injectFault(addr string, req *Request) error {
+    faultLock.RLock()
+    f := hostFaults[addr]
+    var fault hostFault
+    if f != nil {
+        fault = *f
+    }
+    partitioned := false
+    if len(partitions) > 0 && len(req.Keys) > 0 && req.Cmd != "stats" {
+        partitioned = partitions[getBucketByKey(partitionHash, partitionWidth, req.Keys[0])]
+    }
+    faultLock.RUnlock()
+
+    if partitioned {
+        return errors.New("injected partition")
+    }
+    if fault.Delay > 0 {
+        time.Sleep(fault.Delay)
+    }
+    if fault.ErrorRate > 0 && rand.Float64()*100 < fault.ErrorRate {
+        return errors.New("injected error")
+    }
+    return nil
+}
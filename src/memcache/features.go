@@ -0,0 +1,81 @@
+/*
+ * what the proxy is and supports, told to clients by `version` and
+ * `stats features`, so automation could adapt to the proxy's capabilities
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// scheduler of the keys, set by the proxy from its config
+var SchedulerName = "manual"
+
+// supported by every proxy
+var builtinFeatures = []string{"binary", "meta", "cas", "gat", "touch", "incr", "append", "prepend"}
+
+var (
+    featuresLock sync.RWMutex
+    features     = make(map[string]bool)
+)
+
+func init() {
+    for _, f := range builtinFeatures {
+        features[f] = true
+    }
+}
+
+// set the features of the proxy from its config, the disabled ones are
+// reported as no
+func SetFeatures(fs map[string]bool) {
+    featuresLock.Lock()
+    defer featuresLock.Unlock()
+    for name, enabled := range fs {
+        features[name] = enabled
+    }
+}
+
+// names of the features, sorted, only the enabled ones or all of them
+func Features(all bool) []string {
+    featuresLock.RLock()
+    defer featuresLock.RUnlock()
+    names := make([]string, 0, len(features))
+    for name, enabled := range features {
+        if enabled || all {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+func FeatureEnabled(name string) bool {
+    featuresLock.RLock()
+    defer featuresLock.RUnlock()
+    return features[name]
+}
+
+// like "0.1.0 beanseye scheduler=manual features=binary,cas", the first word
+// is still the version for the clients parsing it
+func VersionString() string {
+    return fmt.Sprintf("%s beanseye scheduler=%s features=%s", VERSION, SchedulerName,
+        strings.Join(Features(false), ","))
+}
+
+// lines of `stats features`
+func featureStats() string {
+    lines := []string{fmt.Sprintf("STAT version %s\r\n", VERSION),
+        fmt.Sprintf("STAT scheduler %s\r\n", SchedulerName)}
+    for _, name := range Features(true) {
+        v := "no"
+        if FeatureEnabled(name) {
+            v = "yes"
+        }
+        lines = append(lines, fmt.Sprintf("STAT %s %s\r\n", name, v))
+    }
+    return strings.Join(lines, "")
+}
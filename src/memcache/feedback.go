@@ -0,0 +1,85 @@
+/*
+ * feedback of requests to the schedulers, typed, so schedulers could weight
+ * every signal in their own way
+ */
+
+package memcache
+
+import (
+    "math"
+    "time"
+)
+
+type FeedbackKind int
+
+const (
+    FeedbackHit        FeedbackKind = iota // value found, Duration is the latency
+    FeedbackMiss                           // value not found
+    FeedbackSlow                           // value found slower than SlowCmdTime, Duration is the latency
+    FeedbackError                          // read failed
+    FeedbackTimeout                        // request timed out
+    FeedbackRetry                          // host is waiting to retry after failures
+    FeedbackWriteError                     // write failed
+    FeedbackListing                        // Count items in the directory listed
+    FeedbackAppendError                    // append or prepend failed
+)
+
+var feedbackKinds = []string{"hit", "miss", "slow", "error", "timeout", "retry", "write_error", "listing",
+    "append_error"}
+
+func (k FeedbackKind) String() string {
+    if k < 0 || int(k) >= len(feedbackKinds) {
+        return "unknown"
+    }
+    return feedbackKinds[k]
+}
+
+type FeedbackEvent struct {
+    Kind     FeedbackKind
+    Duration time.Duration // of hit and slow
+    Count    float64       // of listing
+}
+
+// scores of the events without latencies or counts, 0 is ignored
+var FeedbackScores = map[FeedbackKind]float64{
+    FeedbackMiss:       0,
+    FeedbackError:      -5,
+    FeedbackTimeout:    -5,
+    FeedbackRetry:      -2,
+    FeedbackWriteError: -10,
+    // less than other writes, as append always did
+    FeedbackAppendError: -5,
+}
+
+// the score added to the host in the bucket of the key by the manual and
+// auto schedulers, hits score less as they are slower
+func (e FeedbackEvent) Score() float64 {
+    switch e.Kind {
+    case FeedbackHit, FeedbackSlow:
+        t := e.Duration.Seconds()
+        return 1 - math.Sqrt(t)*t
+    case FeedbackListing:
+        return math.Sqrt(e.Count)
+    }
+    return FeedbackScores[e.Kind]
+}
+
+// a value found in d
+func hitFeedback(d time.Duration) FeedbackEvent {
+    if d > SlowCmdTime {
+        return FeedbackEvent{Kind: FeedbackSlow, Duration: d}
+    }
+    return FeedbackEvent{Kind: FeedbackHit, Duration: d}
+}
+
+func errorFeedback(err error) FeedbackEvent {
+    if err.Error() == "wait for retry" {
+        return FeedbackEvent{Kind: FeedbackRetry}
+    }
+    if e, ok := err.(interface {
+        Timeout() bool
+    }); ok && e.Timeout() {
+        return FeedbackEvent{Kind: FeedbackTimeout}
+    }
+    return FeedbackEvent{Kind: FeedbackError}
+}
@@ -0,0 +1,54 @@
+package memcache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFeedbackEvent(t *testing.T) {
+	if s := hitFeedback(time.Millisecond).Score(); s <= 0.99 || s > 1 {
+		t.Errorf("fast hit should score about 1: %v", s)
+	}
+	slow := hitFeedback(SlowCmdTime * 2)
+	if slow.Kind != FeedbackSlow || slow.Score() >= hitFeedback(time.Millisecond).Score() {
+		t.Errorf("slow hit should score less: %v %v", slow.Kind, slow.Score())
+	}
+	if s := (FeedbackEvent{Kind: FeedbackListing, Count: 16}).Score(); s != 4 {
+		t.Errorf("listing should score sqrt of items: %v", s)
+	}
+	cases := map[error]FeedbackKind{
+		errors.New("wait for retry"):        FeedbackRetry,
+		&timeoutError{&Request{Cmd: "get"}}: FeedbackTimeout,
+		errors.New("connection refused"):    FeedbackError,
+	}
+	for err, kind := range cases {
+		if ev := errorFeedback(err); ev.Kind != kind {
+			t.Errorf("%s should be %s, got %s", err, kind, ev.Kind)
+		}
+	}
+	if s := (FeedbackEvent{Kind: FeedbackWriteError}).Score(); s != -10 {
+		t.Errorf("write error should score -10: %v", s)
+	}
+	if s := (FeedbackEvent{Kind: FeedbackAppendError}).Score(); s != -5 {
+		t.Errorf("append error should score -5: %v", s)
+	}
+}
+
+func TestFeedbackWeighted(t *testing.T) {
+	scores := FeedbackScores
+	FeedbackScores = map[FeedbackKind]float64{FeedbackTimeout: -20}
+	defer func() { FeedbackScores = scores }()
+
+	schd := newTestManualScheduler(map[string][]string{"host1": {"0"}}, 1, 1)
+	schd.feedChan = make(chan *Feedback, 2)
+	host := schd.GetHostsByKey("key")[0]
+	schd.Feedback(host, "key", FeedbackEvent{Kind: FeedbackMiss})
+	schd.Feedback(host, "key", FeedbackEvent{Kind: FeedbackTimeout})
+	if len(schd.feedChan) != 1 {
+		t.Fatalf("events scored 0 should be ignored: %d", len(schd.feedChan))
+	}
+	if fb := <-schd.feedChan; fb.adjust != -20 {
+		t.Errorf("timeout should be weighted by FeedbackScores: %v", fb.adjust)
+	}
+}
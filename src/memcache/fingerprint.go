@@ -0,0 +1,174 @@
+/*
+ * guess the client library of connections by the way they talk, so the
+ * problematic traffic could be traced back to an application
+ */
+
+package memcache
+
+import (
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// commands of a connection observed before it's fingerprinted, 0 to disable
+var FingerprintCommands = 16
+
+// client addresses kept as samples of a fingerprint
+const fingerprintSamples = 10
+
+// traffic of the connections with the same fingerprint
+type FingerprintStats struct {
+    Connections int64
+    Commands    int64
+    Errors      int64
+    Slow        int64
+    Clients     []string // samples of client addresses
+}
+
+var (
+    fingerprintsLock sync.Mutex
+    fingerprints     = make(map[string]*FingerprintStats)
+)
+
+// traits of a connection, like the first command, multigets, noreply,
+// flags and expiries of items, and whether it sends one command only
+type clientFingerprint struct {
+    first  string
+    traits map[string]bool
+    flags  map[int]bool
+    cmds   int64
+    errors int64
+    slow   int64
+    stats  *FingerprintStats // nil until fingerprinted
+}
+
+func (f *clientFingerprint) observe(req *Request, err error, slow bool) {
+    if f.stats != nil {
+        atomic.AddInt64(&f.stats.Commands, 1)
+        if err != nil {
+            atomic.AddInt64(&f.stats.Errors, 1)
+        }
+        if slow {
+            atomic.AddInt64(&f.stats.Slow, 1)
+        }
+        return
+    }
+    if f.traits == nil {
+        f.first = req.Cmd
+        f.traits = make(map[string]bool)
+        f.flags = make(map[int]bool)
+    }
+    f.cmds++
+    if err != nil {
+        f.errors++
+    }
+    if slow {
+        f.slow++
+    }
+    switch req.Cmd {
+    case "get", "gets":
+        if len(req.Keys) > 1 {
+            f.traits["multiget"] = true
+        }
+        if req.Cmd == "gets" {
+            f.traits["cas"] = true
+        }
+    case "cas":
+        f.traits["cas"] = true
+    case "gat", "gats":
+        f.traits["gat"] = true
+    }
+    if req.NoReply {
+        f.traits["noreply"] = true
+    }
+    if req.Item != nil && req.Cmd != "incr" && req.Cmd != "decr" {
+        f.flags[req.Item.Flag] = true
+        if req.Item.Exptime != 0 {
+            f.traits["exptime"] = true
+        }
+    }
+}
+
+// the fingerprint, like "first=version multiget noreply flags=0,2"
+func (f *clientFingerprint) String() string {
+    ts := make([]string, 0, len(f.traits)+2)
+    ts = append(ts, "first="+f.first)
+    for t := range f.traits {
+        ts = append(ts, t)
+    }
+    sort.Strings(ts[1:])
+    if len(f.flags) > 0 {
+        flags := make([]int, 0, len(f.flags))
+        for flag := range f.flags {
+            flags = append(flags, flag)
+        }
+        sort.Ints(flags)
+        fs := make([]string, len(flags))
+        for i, flag := range flags {
+            fs[i] = strconv.Itoa(flag)
+        }
+        ts = append(ts, "flags="+strings.Join(fs, ","))
+    }
+    return strings.Join(ts, " ")
+}
+
+// fingerprint the connection if it's observed long enough, or closed
+func (f *clientFingerprint) settle(addr string, closed bool) {
+    if f.stats != nil || f.traits == nil || f.cmds < int64(FingerprintCommands) && !closed {
+        return
+    }
+    if closed && f.cmds == 1 {
+        f.traits["oneshot"] = true
+    }
+    name := f.String()
+    fingerprintsLock.Lock()
+    st, ok := fingerprints[name]
+    if !ok {
+        st = new(FingerprintStats)
+        fingerprints[name] = st
+    }
+    ip := addr
+    if host, _, err := net.SplitHostPort(addr); err == nil {
+        ip = host
+    }
+    if len(st.Clients) < fingerprintSamples && !contain(st.Clients, ip) {
+        st.Clients = append(st.Clients, ip)
+    }
+    fingerprintsLock.Unlock()
+
+    atomic.AddInt64(&st.Connections, 1)
+    atomic.AddInt64(&st.Commands, f.cmds)
+    atomic.AddInt64(&st.Errors, f.errors)
+    atomic.AddInt64(&st.Slow, f.slow)
+    f.stats = st
+}
+
+// traffic by the fingerprints of client libraries
+func Fingerprints() map[string]FingerprintStats {
+    fingerprintsLock.Lock()
+    defer fingerprintsLock.Unlock()
+    r := make(map[string]FingerprintStats, len(fingerprints))
+    for name, st := range fingerprints {
+        r[name] = FingerprintStats{
+            Connections: atomic.LoadInt64(&st.Connections),
+            Commands:    atomic.LoadInt64(&st.Commands),
+            Errors:      atomic.LoadInt64(&st.Errors),
+            Slow:        atomic.LoadInt64(&st.Slow),
+            Clients:     append([]string(nil), st.Clients...),
+        }
+    }
+    return r
+}
+
+func (c *ServerConn) fingerprint(req *Request, err error, dt time.Duration) {
+    if FingerprintCommands <= 0 {
+        return
+    }
+    c.fp.observe(req, err, dt > SlowCmdTime)
+    c.fp.settle(c.RemoteAddr, false)
+}
@@ -0,0 +1,42 @@
+package memcache
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClientFingerprint(t *testing.T) {
+	var f clientFingerprint
+	f.observe(&Request{Cmd: "version"}, nil, false)
+	f.observe(&Request{Cmd: "get", Keys: []string{"a", "b"}}, nil, false)
+	f.observe(&Request{Cmd: "set", Keys: []string{"a"}, Item: &Item{Flag: 2, Exptime: 60}, NoReply: true}, nil, true)
+	f.observe(&Request{Cmd: "set", Keys: []string{"b"}, Item: &Item{Flag: 0}}, errors.New("failed"), false)
+	f.settle("10.0.0.1:1234", false)
+	if f.stats != nil {
+		t.Fatalf("fingerprinted before enough commands")
+	}
+	f.settle("10.0.0.1:1234", true)
+	name := "first=version exptime multiget noreply flags=0,2"
+	if f.String() != name {
+		t.Fatalf("bad fingerprint: %q", f.String())
+	}
+	f.observe(&Request{Cmd: "get", Keys: []string{"a"}}, nil, false)
+
+	st, ok := Fingerprints()[name]
+	if !ok {
+		t.Fatalf("no stats of %s: %v", name, Fingerprints())
+	}
+	if st.Connections != 1 || st.Commands != 5 || st.Errors != 1 || st.Slow != 1 {
+		t.Errorf("bad stats of fingerprint: %+v", st)
+	}
+	if len(st.Clients) != 1 || st.Clients[0] != "10.0.0.1" {
+		t.Errorf("bad clients of fingerprint: %v", st.Clients)
+	}
+
+	var g clientFingerprint
+	g.observe(&Request{Cmd: "get", Keys: []string{"a"}}, nil, false)
+	g.settle("10.0.0.2:1234", true)
+	if g.String() != "first=get oneshot" {
+		t.Errorf("connection of one command should be oneshot: %q", g.String())
+	}
+}
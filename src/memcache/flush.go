@@ -0,0 +1,112 @@
+/*
+ * flush_all fanned out to all the backends, so operators don't flush every
+ * node by hand, refused unless enabled and from the admin clients
+ */
+
+package memcache
+
+import (
+    "errors"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+var (
+    FlushEnabled bool         // flush_all is refused if false
+    FlushAdmins  []*net.IPNet // clients allowed to flush_all
+)
+
+// networks of the clients allowed to flush_all, like 10.0.0.0/8, an IP is
+// a network of itself
+func ParseFlushAdmins(admins []string) ([]*net.IPNet, error) {
+    nets := make([]*net.IPNet, 0, len(admins))
+    for _, a := range admins {
+        if !strings.Contains(a, "/") {
+            ip := net.ParseIP(a)
+            if ip == nil {
+                return nil, errors.New("invalid ip: " + a)
+            }
+            bits := 8 * net.IPv6len
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 8*net.IPv4len
+            }
+            nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, n, err := net.ParseCIDR(a)
+        if err != nil {
+            return nil, err
+        }
+        nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+func isFlushAdmin(ip string) bool {
+    addr := net.ParseIP(ip)
+    if addr == nil {
+        return false
+    }
+    for _, n := range FlushAdmins {
+        if n.Contains(addr) {
+            return true
+        }
+    }
+    return false
+}
+
+// flush all the backends in parallel, the addresses of the flushed ones
+// are returned, with the error of a failed one
+func FlushBackends(hosts []*Host, delay int) (flushed []string, err error) {
+    var lock sync.Mutex
+    var wg sync.WaitGroup
+    for _, host := range hosts {
+        wg.Add(1)
+        go func(host *Host) {
+            defer wg.Done()
+            e := host.FlushAll(delay)
+            lock.Lock()
+            defer lock.Unlock()
+            if e != nil {
+                ErrorLog.Printf("flush_all of %s failed: %s", host.Addr, e)
+                err = e
+                return
+            }
+            flushed = append(flushed, host.Addr)
+        }(host)
+    }
+    wg.Wait()
+    return
+}
+
+// status and message of flush_all, with the backends flushed
+func flushAll(req *Request, store DistributeStorage) (string, string, []string) {
+    if !FlushEnabled {
+        return "CLIENT_ERROR", "flush_all is disabled", nil
+    }
+    if !req.admin {
+        return "CLIENT_ERROR", "flush_all is not allowed from this client", nil
+    }
+    switch store.(type) {
+    case *localStorage:
+        // an embedded store, it's not the proxy of the backends
+        return "CLIENT_ERROR", "flush_all is not supported by local storage", nil
+    case *NamespaceClient:
+        // would flush the other namespaces too
+        return "CLIENT_ERROR", "flush_all is not allowed in a namespace", nil
+    }
+    delay := 0
+    if len(req.Keys) > 0 {
+        var e error
+        if delay, e = strconv.Atoi(req.Keys[0]); e != nil || delay < 0 {
+            return "CLIENT_ERROR", "invalid exptime argument", nil
+        }
+    }
+    flushed, err := FlushBackends(currentBackends().flush, delay)
+    if err != nil {
+        return "SERVER_ERROR", err.Error(), flushed
+    }
+    return "OK", "", flushed
+}
@@ -0,0 +1,98 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+// a backend answering flush_all, the commands received are sent to cmds
+func fakeFlushBackend(t *testing.T, cmds chan string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					cmds <- line
+					conn.Write([]byte("OK\r\n"))
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestFlushAll(t *testing.T) {
+	defer func() {
+		FlushEnabled, FlushAdmins = false, nil
+		SetBackends(nil, nil, nil, 1)
+	}()
+	cmds := make(chan string, 10)
+	SetBackends(nil, nil, []string{fakeFlushBackend(t, cmds), fakeFlushBackend(t, cmds)}, 1)
+	admins, err := ParseFlushAdmins([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	FlushAdmins = admins
+	if !isFlushAdmin("10.0.0.1") || !isFlushAdmin("192.168.3.4") || isFlushAdmin("10.0.0.2") {
+		t.Errorf("bad admins: %v", admins)
+	}
+	if _, err := ParseFlushAdmins([]string{"10.0.0"}); err == nil {
+		t.Errorf("invalid ip should fail")
+	}
+
+	store := newMapDistStore()
+	stats := NewStats()
+	process := func(cmd string, admin bool, store DistributeStorage) string {
+		req := new(Request)
+		if err := req.Read(bufio.NewReader(bytes.NewBufferString(cmd))); err != nil {
+			t.Fatal(err)
+		}
+		req.admin = admin
+		resp, _, _ := req.Process(store, stats)
+		wr := new(bytes.Buffer)
+		resp.Write(wr)
+		return wr.String()
+	}
+	if r := process("flush_all\r\n", true, store); r != "CLIENT_ERROR flush_all is disabled\r\n" {
+		t.Errorf("flush_all should be disabled: %q", r)
+	}
+	FlushEnabled = true
+	if r := process("flush_all\r\n", false, store); r != "CLIENT_ERROR flush_all is not allowed from this client\r\n" {
+		t.Errorf("flush_all should be refused: %q", r)
+	}
+	if r := process("flush_all\r\n", true, NewNamespaceClient(store, "ns:", 0)); r != "CLIENT_ERROR flush_all is not allowed in a namespace\r\n" {
+		t.Errorf("flush_all should be refused in a namespace: %q", r)
+	}
+	if r := process("flush_all -1\r\n", true, store); r != "CLIENT_ERROR invalid exptime argument\r\n" {
+		t.Errorf("bad delay: %q", r)
+	}
+	if len(cmds) != 0 {
+		t.Fatalf("refused flush_all should not be sent")
+	}
+	if r := process("flush_all 5\r\n", true, store); r != "OK\r\n" {
+		t.Errorf("flush_all should succeed: %q", r)
+	}
+	for i := 0; i < 2; i++ {
+		if cmd := <-cmds; cmd != "flush_all 5\r\n" {
+			t.Errorf("backend got %q", cmd)
+		}
+	}
+	if r := process("flush_all noreply\r\n", true, store); r != "" {
+		t.Errorf("noreply: %q", r)
+	}
+}
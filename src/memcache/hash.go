@@ -2,6 +2,7 @@ package memcache
 
 import (
     "crypto/md5"
+    "encoding/binary"
     "hash/crc32"
     "hash/fnv"
 )
@@ -40,9 +41,121 @@ func fnv1a1(s []byte) uint32 {
     return h
 }
 
+// MurmurHash3 x86_32 with seed 0, like the clients using murmur3
+func murmur3(s []byte) uint32 {
+    const c1, c2 uint32 = 0xcc9e2d51, 0x1b873593
+    var h uint32
+    n := len(s) / 4 * 4
+    for i := 0; i < n; i += 4 {
+        k := binary.LittleEndian.Uint32(s[i:])
+        k *= c1
+        k = (k << 15) | (k >> 17)
+        k *= c2
+        h ^= k
+        h = (h << 13) | (h >> 19)
+        h = h*5 + 0xe6546b64
+    }
+    var k uint32
+    switch len(s) & 3 {
+    case 3:
+        k ^= uint32(s[n+2]) << 16
+        fallthrough
+    case 2:
+        k ^= uint32(s[n+1]) << 8
+        fallthrough
+    case 1:
+        k ^= uint32(s[n])
+        k *= c1
+        k = (k << 15) | (k >> 17)
+        k *= c2
+        h ^= k
+    }
+    h ^= uint32(len(s))
+    h ^= h >> 16
+    h *= 0x85ebca6b
+    h ^= h >> 13
+    h *= 0xc2b2ae35
+    h ^= h >> 16
+    return h
+}
+
+const (
+    xxPrime1 uint64 = 11400714785074694791
+    xxPrime2 uint64 = 14029467366897019727
+    xxPrime3 uint64 = 1609587929392839161
+    xxPrime4 uint64 = 9650029242287828579
+    xxPrime5 uint64 = 2870177450012600261
+)
+
+func rotl64(x uint64, r uint) uint64 {
+    return (x << r) | (x >> (64 - r))
+}
+
+func xxRound(acc, v uint64) uint64 {
+    acc += v * xxPrime2
+    return rotl64(acc, 31) * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+    acc ^= xxRound(0, v)
+    return acc*xxPrime1 + xxPrime4
+}
+
+// XXH64 with seed 0
+func xxh64(s []byte) uint64 {
+    n := len(s)
+    var h uint64
+    if n >= 32 {
+        // wrap around like the reference, constants could not overflow
+        v1, v2, v3, v4 := xxPrime1, xxPrime2, uint64(0), uint64(0)
+        v1 += xxPrime2
+        v4 -= xxPrime1
+        for ; len(s) >= 32; s = s[32:] {
+            v1 = xxRound(v1, binary.LittleEndian.Uint64(s))
+            v2 = xxRound(v2, binary.LittleEndian.Uint64(s[8:]))
+            v3 = xxRound(v3, binary.LittleEndian.Uint64(s[16:]))
+            v4 = xxRound(v4, binary.LittleEndian.Uint64(s[24:]))
+        }
+        h = rotl64(v1, 1) + rotl64(v2, 7) + rotl64(v3, 12) + rotl64(v4, 18)
+        h = xxMerge(h, v1)
+        h = xxMerge(h, v2)
+        h = xxMerge(h, v3)
+        h = xxMerge(h, v4)
+    } else {
+        h = xxPrime5
+    }
+    h += uint64(n)
+    for ; len(s) >= 8; s = s[8:] {
+        h ^= xxRound(0, binary.LittleEndian.Uint64(s))
+        h = rotl64(h, 27)*xxPrime1 + xxPrime4
+    }
+    if len(s) >= 4 {
+        h ^= uint64(binary.LittleEndian.Uint32(s)) * xxPrime1
+        h = rotl64(h, 23)*xxPrime2 + xxPrime3
+        s = s[4:]
+    }
+    for _, c := range s {
+        h ^= uint64(c) * xxPrime5
+        h = rotl64(h, 11) * xxPrime1
+    }
+    h ^= h >> 33
+    h *= xxPrime2
+    h ^= h >> 29
+    h *= xxPrime3
+    h ^= h >> 32
+    return h
+}
+
+// the lower 32 bits of XXH64, as the points on rings are 32 bits
+func xxhash64(s []byte) uint32 {
+    return uint32(xxh64(s))
+}
+
 var hashMethods = map[string]HashMethod{
-    "fnv1a":  fnv1a,
-    "fnv1a1": fnv1a1,
-    "crc32":  crc32hash,
-    "md5":    md5hash,
+    "fnv1a":    fnv1a,
+    "fnv1a1":   fnv1a1,
+    "crc32":    crc32hash,
+    "md5":      md5hash,
+    "murmur3":  murmur3,
+    "xxhash64": xxhash64,
 }
@@ -25,6 +25,10 @@ var tests []TestCase = []TestCase{
 	TestCase{"crc32", "你好", 1352841281},
 	TestCase{"fnv1a", "你好", 2257816995},
 	TestCase{"fnv1a1", "你好", 718964643},
+
+	TestCase{"murmur3", "", 0},
+	TestCase{"murmur3", "hello", 0x248bfa47},
+	TestCase{"murmur3", "The quick brown fox jumps over the lazy dog", 0x2e4ff723},
 }
 
 func Test(t *testing.T) {
@@ -35,3 +39,20 @@ func Test(t *testing.T) {
 		}
 	}
 }
+
+func TestXXH64(t *testing.T) {
+	cases := map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	}
+	for s, want := range cases {
+		if h := xxh64([]byte(s)); h != want {
+			t.Errorf("xxh64(%q) = %x, want %x", s, h, want)
+		}
+		if h := hashMethods["xxhash64"]([]byte(s)); h != uint32(want) {
+			t.Errorf("xxhash64(%q) = %x, want %x", s, h, uint32(want))
+		}
+	}
+}
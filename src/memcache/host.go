@@ -7,6 +7,8 @@ import (
     "net"
     "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
@@ -15,33 +17,147 @@ var ConnectTimeout time.Duration = time.Millisecond * 300
 var ReadTimeout time.Duration = time.Millisecond * 2000
 var WriteTimeout time.Duration = time.Millisecond * 2000
 
+// qps ceiling of backends, 0 means no limit
+var DefaultMaxQPS = 0
+var HostMaxQPS = map[string]int{}
+
+// how long a request could wait for the qps quota before it was shed
+var QPSQueueTimeout time.Duration = time.Millisecond * 100
+
+var hostShed int64
+
+// weight of the latest request in the moving average of latency
+var LatencyAlpha = 0.1
+
 type Host struct {
+    latency  int64 // moving average of response time in ns, accessed atomically
     Addr     string
+    Zone     string
+    Expiry   string // how the backend interpret expiries
     nextDial time.Time
     conns    chan net.Conn
+    closed   int32 // set by Close, accessed atomically
     offset   int
+    limiter  atomic.Value // *qpsLimiter, nil if unlimited, swapped by SetMaxQPS
+    batcher  *writeBatcher
+    counter  *hostCounter
+    node     Node // serve requests rather than the connections, see NewNodeHost
 }
 
 func NewHost(addr string) *Host {
-    host := &Host{Addr: addr}
+    host := &Host{Addr: addr, Zone: HostZones[addr], counter: counterOf(addr)}
+    if mode, ok := HostExpiry[addr]; ok && !isRedisAddr(addr) {
+        // expiries of redis are translated with the commands
+        host.Expiry = mode
+    } else {
+        host.Expiry = ExpiryMemcached
+    }
     host.conns = make(chan net.Conn, MaxFreeConns)
+    if BatchWindow > 0 && !isRedisAddr(addr) {
+        host.batcher = &writeBatcher{host: host}
+    }
+    if qps, ok := HostMaxQPS[addr]; ok {
+        host.SetMaxQPS(qps)
+    } else {
+        host.SetMaxQPS(DefaultMaxQPS)
+    }
+    if host.MaxValueSize() == 0 {
+        // not probed yet
+        if n, ok := HostMaxValueSize[addr]; ok {
+            host.SetMaxValueSize(n)
+        } else {
+            host.SetMaxValueSize(DefaultMaxValueSize)
+        }
+    }
     return host
 }
 
+// a second is divided into slices, every slice has 1/qpsSlices of the quota,
+// so a spike is queued in proxy rather than hitting the backend at once
+const qpsSlices = 10
+
+type qpsLimiter struct {
+    lock     sync.Mutex
+    perSlice int
+    slice    int64
+    used     int
+}
+
+func (l *qpsLimiter) acquire(timeout time.Duration) bool {
+    deadline := time.Now().Add(timeout)
+    for {
+        now := time.Now()
+        s := now.UnixNano() / int64(time.Second/qpsSlices)
+        l.lock.Lock()
+        if s != l.slice {
+            l.slice = s
+            l.used = 0
+        }
+        if l.used < l.perSlice {
+            l.used++
+            l.lock.Unlock()
+            return true
+        }
+        l.lock.Unlock()
+        next := time.Unix(0, (s+1)*int64(time.Second/qpsSlices))
+        if next.After(deadline) {
+            return false
+        }
+        time.Sleep(next.Sub(now))
+    }
+}
+
+func (host *Host) updateLatency(d time.Duration) {
+    for {
+        old := atomic.LoadInt64(&host.latency)
+        n := int64(d)
+        if old > 0 {
+            n = int64(float64(old)*(1-LatencyAlpha) + float64(d)*LatencyAlpha)
+        }
+        if atomic.CompareAndSwapInt64(&host.latency, old, n) {
+            return
+        }
+    }
+}
+
+// exponentially-weighted moving average of response time, 0 if unknown
+func (host *Host) Latency() time.Duration {
+    return time.Duration(atomic.LoadInt64(&host.latency))
+}
+
+func (host *Host) SetMaxQPS(qps int) {
+    if qps <= 0 {
+        host.limiter.Store((*qpsLimiter)(nil))
+        return
+    }
+    host.limiter.Store(&qpsLimiter{perSlice: (qps + qpsSlices - 1) / qpsSlices})
+}
+
 // Given a string of the form "host", "host:port", or "[ipv6::address]:port",
 // return true if the string includes a port.
 func hasPort(s string) bool { return strings.LastIndex(s, ":") > strings.LastIndex(s, "]") }
 
 func (host *Host) Close() {
-    if host.conns == nil {
+    if !atomic.CompareAndSwapInt32(&host.closed, 0, 1) {
         return
     }
-    ch := host.conns
-    host.conns = nil
-    close(ch)
+    host.drainConns()
+}
 
-    for c, closed := <-ch; closed; {
-        c.Close()
+func (host *Host) isClosed() bool {
+    return atomic.LoadInt32(&host.closed) != 0
+}
+
+// close the idle connections, the channel is not closed, as connections in
+// use may still be released to it
+func (host *Host) drainConns() {
+    for {
+        select {
+        case c := <-host.conns:
+            c.Close()
+        default:
+            return
+        }
     }
 }
 
@@ -52,7 +168,12 @@ func (host *Host) createConn() (net.Conn, error) {
     }
 
     addr := host.Addr
-    if !hasPort(addr) {
+    if isRedisAddr(addr) {
+        addr = addr[len(redisScheme):]
+        if !hasPort(addr) {
+            addr = addr + ":6379"
+        }
+    } else if !hasPort(addr) {
         addr = addr + ":11211"
     }
     conn, err := net.DialTimeout("tcp", addr, ConnectTimeout)
@@ -64,7 +185,7 @@ func (host *Host) createConn() (net.Conn, error) {
 }
 
 func (host *Host) getConn() (c net.Conn, err error) {
-    if host.conns == nil {
+    if host.isClosed() {
         return nil, errors.New("host closed")
     }
     select {
@@ -76,24 +197,70 @@ func (host *Host) getConn() (c net.Conn, err error) {
 }
 
 func (host *Host) releaseConn(conn net.Conn) {
-    if host.conns == nil {
+    if host.isClosed() {
         conn.Close()
         return
     }
     select {
     case host.conns <- conn:
+        if host.isClosed() {
+            // closed while it was released
+            host.drainConns()
+        }
     default:
         conn.Close()
     }
 }
 
 func (host *Host) execute(req *Request) (resp *Response, err error) {
+    if l, _ := host.limiter.Load().(*qpsLimiter); l != nil && !l.acquire(QPSQueueTimeout) {
+        atomic.AddInt64(&hostShed, 1)
+        return nil, errors.New("host overloaded")
+    }
+    if err = injectFault(host.Addr, req); err != nil {
+        return
+    }
+    // injected delay is not counted, or the advised timeouts would be misled by drills
+    t := time.Now()
+    defer func() {
+        if err == nil {
+            d := time.Since(t)
+            RecordLatency(req.Cmd, d)
+            host.updateLatency(d)
+            host.counter.done(d)
+        } else {
+            host.counter.fail()
+        }
+    }()
+
+    if host.node != nil {
+        return host.executeNode(req)
+    }
+    if host.batcher != nil && batchable(req) {
+        return host.batcher.submit(req)
+    }
+
     var conn net.Conn
     conn, err = host.getConn()
     if err != nil {
         return
     }
 
+    if isRedisAddr(host.Addr) {
+        resp, err = host.executeRedis(conn, req)
+        if err != nil {
+            ErrorLog.Print(host.Addr, " redis request failed:", err)
+            if _, ok := err.(redisError); ok {
+                host.releaseConn(conn)
+            } else {
+                conn.Close()
+            }
+            return nil, err
+        }
+        host.releaseConn(conn)
+        return
+    }
+
     err = req.Write(conn)
     if err != nil {
         ErrorLog.Print(host.Addr, " write request failed:", err)
@@ -126,6 +293,18 @@ func (host *Host) execute(req *Request) (resp *Response, err error) {
     return
 }
 
+type timeoutError struct {
+    req *Request
+}
+
+func (e *timeoutError) Error() string {
+    return fmt.Sprintf("request %v timeout", e.req)
+}
+
+func (e *timeoutError) Timeout() bool {
+    return true
+}
+
 func (host *Host) executeWithTimeout(req *Request, timeout time.Duration) (resp *Response, err error) {
     done := make(chan bool, 1)
     go func() {
@@ -136,7 +315,7 @@ func (host *Host) executeWithTimeout(req *Request, timeout time.Duration) (resp
     select {
     case <-done:
     case <-time.After(timeout):
-        err = fmt.Errorf("request %v timeout", req)
+        err = &timeoutError{req}
         ErrorLog.Print(host.Addr, " request to host timeout")
     }
     return
@@ -162,27 +341,62 @@ func (host *Host) GetMulti(keys []string) (map[string]*Item, error) {
 }
 
 func (host *Host) store(cmd string, key string, item *Item, noreply bool) (bool, error) {
+    if host.Expiry != ExpiryMemcached && item.Exptime != 0 {
+        // the item is shared by all the hosts of the key
+        it := *item
+        it.Exptime = normalizeExpiry(item.Exptime, host.Expiry, time.Now())
+        item = &it
+    }
     req := &Request{Cmd: cmd, Keys: []string{key}, Item: item, NoReply: noreply}
     resp, err := host.executeWithTimeout(req, WriteTimeout)
     return err == nil && resp.status == "STORED", err
 }
 
 func (host *Host) Set(key string, item *Item, noreply bool) (bool, error) {
+    if err := host.checkValueSize(item); err != nil {
+        return false, err
+    }
     return host.store("set", key, item, noreply)
 }
 
+func (host *Host) Add(key string, item *Item) (bool, error) {
+    if err := host.checkValueSize(item); err != nil {
+        return false, err
+    }
+    return host.store("add", key, item, false)
+}
+
 func (host *Host) Append(key string, value []byte) (bool, error) {
-    req := &Request{Cmd: "append", Keys: []string{key}, Item: &Item{Body: value}}
+    return host.concat("append", key, value)
+}
+
+func (host *Host) Prepend(key string, value []byte) (bool, error) {
+    return host.concat("prepend", key, value)
+}
+
+// append or prepend, false with no error if the key is missing
+func (host *Host) concat(cmd string, key string, value []byte) (bool, error) {
+    req := &Request{Cmd: cmd, Keys: []string{key}, Item: &Item{Body: value}}
     resp, err := host.execute(req)
     return err == nil && resp.status == "STORED", err
 }
 
 func (host *Host) Incr(key string, value int) (int, error) {
-    req := &Request{Cmd: "incr", Keys: []string{key}, Item: &Item{Body: []byte(strconv.Itoa(value))}}
+    cmd := "incr"
+    if value < 0 {
+        cmd, value = "decr", -value
+    }
+    req := &Request{Cmd: cmd, Keys: []string{key}, Item: &Item{Body: []byte(strconv.Itoa(value))}}
     resp, err := host.execute(req)
     if err != nil {
         return 0, err
     }
+    switch resp.status {
+    case "NOT_FOUND":
+        return 0, ErrNotFound
+    case "CLIENT_ERROR":
+        return 0, ErrNonNumeric
+    }
     return strconv.Atoi(resp.msg)
 }
 
@@ -192,6 +406,91 @@ func (host *Host) Delete(key string) (bool, error) {
     return err == nil && resp.status == "DELETED", err
 }
 
+// the item of key expires at exptime, see touch of memcached
+type toucher interface {
+    Touch(key string, exptime int) (bool, error)
+}
+
+var ErrTouchNotSupported = errors.New("touch is not supported")
+
+func (host *Host) Touch(key string, exptime int) (bool, error) {
+    if host.Expiry != ExpiryMemcached && exptime != 0 {
+        exptime = normalizeExpiry(exptime, host.Expiry, time.Now())
+    }
+    req := &Request{Cmd: "touch", Keys: []string{key}, Item: &Item{Exptime: exptime}}
+    resp, err := host.executeWithTimeout(req, WriteTimeout)
+    return err == nil && resp.status == "TOUCHED", err
+}
+
+// the cas unique of the host is carried by the item
+func (host *Host) Gets(key string) (*Item, error) {
+    req := &Request{Cmd: "gets", Keys: []string{key}}
+    resp, err := host.executeWithTimeout(req, ReadTimeout)
+    if err != nil {
+        return nil, err
+    }
+    item, _ := resp.items[key]
+    return item, nil
+}
+
+func (host *Host) GetsMulti(keys []string) (map[string]*Item, error) {
+    req := &Request{Cmd: "gets", Keys: keys}
+    resp, err := host.executeWithTimeout(req, ReadTimeout)
+    if err != nil {
+        return nil, err
+    }
+    return resp.items, nil
+}
+
+// the item is stored only if it was not changed since the cas unique was got
+type caser interface {
+    Cas(key string, item *Item) (string, error) // STORED, EXISTS or NOT_FOUND
+}
+
+var ErrCasNotSupported = errors.New("cas is not supported")
+
+func (host *Host) Cas(key string, item *Item) (string, error) {
+    if err := host.checkValueSize(item); err != nil {
+        return "", err
+    }
+    if host.Expiry != ExpiryMemcached && item.Exptime != 0 {
+        it := *item
+        it.Exptime = normalizeExpiry(item.Exptime, host.Expiry, time.Now())
+        item = &it
+    }
+    req := &Request{Cmd: "cas", Keys: []string{key}, Item: item}
+    resp, err := host.executeWithTimeout(req, WriteTimeout)
+    if err != nil {
+        return "", err
+    }
+    switch resp.status {
+    case "STORED", "EXISTS", "NOT_FOUND":
+        return resp.status, nil
+    }
+    return "", errors.New("unexpected status of cas: " + resp.status)
+}
+
+var ErrFlushNotSupported = errors.New("flush_all is not supported")
+
+// invalidate all the items of the host after delay seconds, at once if 0
+func (host *Host) FlushAll(delay int) error {
+    if isRedisAddr(host.Addr) {
+        return ErrFlushNotSupported
+    }
+    req := &Request{Cmd: "flush_all"}
+    if delay > 0 {
+        req.Keys = []string{strconv.Itoa(delay)}
+    }
+    resp, err := host.executeWithTimeout(req, WriteTimeout)
+    if err != nil {
+        return err
+    }
+    if resp.status != "OK" {
+        return errors.New("unexpected status of flush_all: " + resp.status)
+    }
+    return nil
+}
+
 func (host *Host) Stat(keys []string) (map[string]string, error) {
     req := &Request{Cmd: "stats", Keys: keys}
     resp, err := host.execute(req)
@@ -206,5 +505,8 @@ func (host *Host) Stat(keys []string) (map[string]string, error) {
 }
 
 func (host *Host) Len() int {
+    if host.node != nil {
+        return host.node.Len()
+    }
     return 0
 }
@@ -1,7 +1,11 @@
 package memcache
 
 import (
+	"fmt"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHost(t *testing.T) {
@@ -16,3 +20,113 @@ func TestHost(t *testing.T) {
 	}
 	testFailStore(t, NewHost("localhost:11911"))
 }
+
+func TestHostCloseReleased(t *testing.T) {
+	host := NewHost("localhost:11911")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			c1, c2 := net.Pipe()
+			c2.Close()
+			host.releaseConn(c1)
+		}
+		close(done)
+	}()
+	host.Close()
+	<-done
+	if !host.isClosed() || host.Health() != "closed" {
+		t.Error("host should be closed")
+	}
+	if len(host.conns) != 0 {
+		t.Errorf("%d connections are kept after closed", len(host.conns))
+	}
+	if _, err := host.getConn(); err == nil {
+		t.Error("no connection should be got from a closed host")
+	}
+}
+
+func TestQPSLimiter(t *testing.T) {
+	l := &qpsLimiter{perSlice: 5}
+	n := 0
+	for i := 0; i < 20; i++ {
+		if l.acquire(0) {
+			n++
+		}
+	}
+	if n < 5 || n > 10 {
+		t.Errorf("should get about 5 quotas in a slice, but got %d", n)
+	}
+	if !l.acquire(time.Second / qpsSlices) {
+		t.Errorf("should get a quota in next slice")
+	}
+}
+
+func TestSetMaxQPS(t *testing.T) {
+	defer func(timeout time.Duration) {
+		QPSQueueTimeout = timeout
+		ClearFaults()
+	}(QPSQueueTimeout)
+	QPSQueueTimeout = 0
+	InjectErrors("limited", 100) // fail requests let through without dialing
+	host := NewHost("limited")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			host.SetMaxQPS(i % 3)
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		host.Get("key")
+	}
+	<-done
+
+	host.SetMaxQPS(qpsSlices)
+	shed := atomic.LoadInt64(&hostShed)
+	for i := 0; i < 10; i++ {
+		host.Get("key")
+	}
+	if atomic.LoadInt64(&hostShed) == shed {
+		t.Errorf("requests over the limit should be shed")
+	}
+	host.SetMaxQPS(0)
+	shed = atomic.LoadInt64(&hostShed)
+	host.Get("key")
+	if atomic.LoadInt64(&hostShed) != shed {
+		t.Errorf("requests should not be shed without a limit")
+	}
+}
+
+func TestInjectFault(t *testing.T) {
+	defer ClearFaults()
+	req := &Request{Cmd: "get", Keys: []string{"key"}}
+	InjectErrors("host1", 100)
+	if injectFault("host1", req) == nil {
+		t.Error("all requests to host1 should fail")
+	}
+	if injectFault("host2", req) != nil {
+		t.Error("requests to host2 should not fail")
+	}
+	sch := newTestManualScheduler(map[string][]string{"host2": {"0", "1", "2", "3", "4", "5", "6", "7",
+		"8", "9", "a", "b", "c", "d", "e", "f"}}, 16, 1)
+	sch.hashMethod = md5hash
+	if PartitionBucket(sch, 16) == nil || PartitionBucket(NewModScheduler([]string{"host2"}, "fnv1a1"), 0) == nil {
+		t.Error("only buckets of a scheduler with buckets could be partitioned")
+	}
+	// bucketed by the hash of the scheduler
+	bucket := getBucketByKey(md5hash, 4, "key")
+	PartitionBucket(sch, bucket)
+	if injectFault("host2", req) == nil {
+		t.Error("key in partitioned bucket should fail")
+	}
+	for i := 0; i < 100; i++ {
+		other := &Request{Cmd: "get", Keys: []string{fmt.Sprintf("key%d", i)}}
+		if getBucketByKey(md5hash, 4, other.Keys[0]) != bucket && injectFault("host2", other) != nil {
+			t.Errorf("%s is not in the partitioned bucket", other.Keys[0])
+		}
+	}
+	ClearFaults()
+	if injectFault("host1", req) != nil {
+		t.Error("faults should be cleared")
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * one identity of a host in stats, logs and metrics, whether it's written as
+ * an IP or a DNS name, and names shown to operators
+ */
+
+package memcache
+
+import (
+    "net"
+    "strings"
+    "sync"
+)
+
+// the same address always looks the same: IPv6 in brackets in the shortest
+// form, host names in lower case without the trailing dot
+func NormalizeAddr(addr string) string {
+    scheme := ""
+    if isRedisAddr(addr) {
+        scheme, addr = redisScheme, addr[len(redisScheme):]
+    }
+    addr = strings.TrimSpace(addr)
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        // no port
+        host, port = strings.Trim(addr, "[]"), ""
+    }
+    if ip := net.ParseIP(host); ip != nil {
+        host = ip.String()
+    } else {
+        host = strings.TrimSuffix(strings.ToLower(host), ".")
+    }
+    if port == "" {
+        if strings.Contains(host, ":") {
+            return scheme + "[" + host + "]"
+        }
+        return scheme + host
+    }
+    return scheme + net.JoinHostPort(host, port)
+}
+
+// how hosts without aliases are shown
+const (
+    DisplayAddr = "addr" // the normalized address
+    DisplayIP   = "ip"   // host names resolved to IPs
+    DisplayName = "name" // IPs resolved to host names
+)
+
+var HostDisplay = DisplayAddr
+
+// names of hosts shown in stats and the monitor, by address
+var HostAliases = map[string]string{}
+
+var resolved sync.Map // normalized address -> shown
+
+// the name of the host shown to operators, the alias if any, resolved by
+// HostDisplay otherwise, it's the address if the resolving failed
+func DisplayHost(addr string) string {
+    if alias, ok := HostAliases[addr]; ok {
+        return alias
+    }
+    addr = NormalizeAddr(addr)
+    if alias, ok := HostAliases[addr]; ok {
+        return alias
+    }
+    if HostDisplay != DisplayIP && HostDisplay != DisplayName || isRedisAddr(addr) {
+        return addr
+    }
+    if name, ok := resolved.Load(addr); ok {
+        return name.(string)
+    }
+    name := addr
+    if host, port, err := net.SplitHostPort(addr); err == nil {
+        ip := net.ParseIP(host)
+        if HostDisplay == DisplayIP && ip == nil {
+            if ips, err := net.LookupIP(host); err == nil && len(ips) > 0 {
+                name = net.JoinHostPort(ips[0].String(), port)
+            }
+        } else if HostDisplay == DisplayName && ip != nil {
+            if names, err := net.LookupAddr(host); err == nil && len(names) > 0 {
+                name = net.JoinHostPort(strings.TrimSuffix(names[0], "."), port)
+            }
+        }
+    }
+    resolved.Store(addr, name)
+    return name
+}
@@ -0,0 +1,42 @@
+package memcache
+
+import (
+	"testing"
+)
+
+func TestNormalizeAddr(t *testing.T) {
+	cases := map[string]string{
+		"10.0.0.1:7900":               "10.0.0.1:7900",
+		" Beansdb1.Example.COM.:7900": "beansdb1.example.com:7900",
+		"[0:0:0:0:0:0:0:1]:7900":      "[::1]:7900",
+		"[::FFFF:10.0.0.1]:7900":      "10.0.0.1:7900",
+		"2001:db8::1":                 "[2001:db8::1]",
+		"Host1":                       "host1",
+		"redis://[::1]:6379":          "redis://[::1]:6379",
+	}
+	for addr, want := range cases {
+		if got := NormalizeAddr(addr); got != want {
+			t.Errorf("%q should be normalized to %q, got %q", addr, want, got)
+		}
+	}
+	if counterOf("[0::1]:7911") != counterOf("[::1]:7911") {
+		t.Errorf("counters should be shared by the same address written differently")
+	}
+}
+
+func TestDisplayHost(t *testing.T) {
+	aliases := HostAliases
+	HostAliases = map[string]string{"[::1]:7912": "local"}
+	defer func() { HostAliases = aliases }()
+	if name := DisplayHost("[0::1]:7912"); name != "local" {
+		t.Errorf("alias should be shown: %s", name)
+	}
+	if name := DisplayHost("Other:7912"); name != "other:7912" {
+		t.Errorf("normalized address should be shown without alias: %s", name)
+	}
+	SetMaintenance("[0::1]:7912", true)
+	defer SetMaintenance("[::1]:7912", false)
+	if hs := MaintenanceHosts(); !contain(hs, "[::1]:7912") {
+		t.Errorf("normalized address should be reported: %v", hs)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * operational health of hosts, besides the bucket weights of schedulers
+ */
+
+package memcache
+
+import (
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// counters are kept by address, shared by all the Host of the same address
+type hostCounter struct {
+    addr        string
+    requests    int64
+    errors      int64
+    lastFail    int64 // unix nano
+    maintenance int32 // skipped by the schedulers if not 0
+    failures    int32 // errors in a row
+    ejected     int32 // skipped by the schedulers until it recovers, see eject.go
+    drainUntil  int64 // unix nano, no writes to it, and no requests after it, see drain.go
+    maxValue    int64 // bytes of the largest value stored, 0 if no limit, see valuesize.go
+    latency     *LatencyHistogram
+}
+
+var hostCounters sync.Map // normalized addr -> *hostCounter
+
+func counterOf(addr string) *hostCounter {
+    addr = NormalizeAddr(addr)
+    if c, ok := hostCounters.Load(addr); ok {
+        return c.(*hostCounter)
+    }
+    c, _ := hostCounters.LoadOrStore(addr, &hostCounter{addr: addr, latency: NewLatencyHistogram()})
+    return c.(*hostCounter)
+}
+
+func (c *hostCounter) done(d time.Duration) {
+    atomic.AddInt64(&c.requests, 1)
+    atomic.StoreInt32(&c.failures, 0)
+    c.latency.Add(d)
+}
+
+func (c *hostCounter) fail() {
+    atomic.AddInt64(&c.requests, 1)
+    atomic.AddInt64(&c.errors, 1)
+    atomic.StoreInt64(&c.lastFail, time.Now().UnixNano())
+    if n := atomic.AddInt32(&c.failures, 1); EjectErrors > 0 && int(n) >= EjectErrors {
+        c.eject()
+    }
+}
+
+type HostStats struct {
+    Requests    int64
+    Errors      int64
+    P50         time.Duration
+    P99         time.Duration
+    LastFailure time.Time // zero if never failed
+    Buckets     []float64 // weights of buckets in Scheduler.Stats()
+    Annotation  string    // note of operators
+    Maintenance bool
+    Ejected     bool
+    Draining    bool
+    Name        string // shown to operators, see DisplayHost
+    MaxValue    int    // bytes, 0 if no limit
+}
+
+func (c *hostCounter) stats() *HostStats {
+    st := &HostStats{
+        Requests:    atomic.LoadInt64(&c.requests),
+        Errors:      atomic.LoadInt64(&c.errors),
+        P50:         c.latency.Quantile(0.5),
+        P99:         c.latency.Quantile(0.99),
+        Maintenance: atomic.LoadInt32(&c.maintenance) != 0,
+        Ejected:     atomic.LoadInt32(&c.ejected) != 0,
+        Draining:    atomic.LoadInt64(&c.drainUntil) != 0,
+        MaxValue:    int(atomic.LoadInt64(&c.maxValue)),
+    }
+    if t := atomic.LoadInt64(&c.lastFail); t > 0 {
+        st.LastFailure = time.Unix(0, t)
+    }
+    return st
+}
+
+// StatsV2 is Scheduler.Stats() with counters and latencies of the hosts,
+// all the hosts known are included if the scheduler has no stats
+func StatsV2(sch Scheduler) map[string]*HostStats {
+    r := make(map[string]*HostStats)
+    weights := sch.Stats()
+    if len(weights) == 0 {
+        hostCounters.Range(func(addr, c interface{}) bool {
+            st := c.(*hostCounter).stats()
+            st.Annotation = HostAnnotation(addr.(string))
+            st.Name = DisplayHost(addr.(string))
+            r[addr.(string)] = st
+            return true
+        })
+        return r
+    }
+    for addr, ws := range weights {
+        st := counterOf(addr).stats()
+        st.Buckets = ws
+        st.Annotation = HostAnnotation(addr)
+        st.Name = DisplayHost(addr)
+        r[addr] = st
+    }
+    return r
+}
@@ -0,0 +1,34 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsV2(t *testing.T) {
+	schd := newTestManualScheduler(map[string][]string{"stats-a": {"0"}, "stats-b": {"0"}}, 1, 2)
+	a := NewHost("stats-a")
+	for i := 0; i < 100; i++ {
+		a.counter.done(time.Millisecond)
+	}
+	a.counter.fail()
+
+	st := StatsV2(schd)
+	if len(st) != 2 {
+		t.Fatalf("all the hosts of scheduler should be included: %v", st)
+	}
+	sa := st["stats-a"]
+	if sa.Requests != 101 || sa.Errors != 1 || sa.LastFailure.IsZero() || len(sa.Buckets) != 1 {
+		t.Errorf("bad stats of a: %+v", sa)
+	}
+	if sa.P50 <= 0 || sa.P50 > time.Millisecond || sa.P99 < sa.P50 {
+		t.Errorf("bad latency of a: %v %v", sa.P50, sa.P99)
+	}
+	if sb := st["stats-b"]; sb.Requests != 0 || !sb.LastFailure.IsZero() {
+		t.Errorf("b has no requests: %+v", sb)
+	}
+
+	if st := StatsV2(&staticScheduler{}); st["stats-a"] == nil {
+		t.Errorf("known hosts should be included without weights: %v", st)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * spread very hot keys over several shard keys
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "math/rand"
+    "sync"
+    "time"
+)
+
+// how long a key stay hot after it's qps dropped below threshold
+var HotKeyCoolDown = time.Second * 60
+
+// HotKeyClient count requests per key, a key with more than threshold
+// requests in a second is replicated to shards-1 derived keys which
+// are routed to other hosts, reads are spread over them and writes fan out.
+type HotKeyClient struct {
+    store     DistributeStorage
+    threshold int
+    shards    int
+    lock      sync.Mutex
+    counts    map[string]int
+    hot       map[string]time.Time // hot key -> cool down time
+    done      chan struct{}        // closed by Close to stop counting
+    closeOnce sync.Once
+}
+
+func NewHotKeyClient(store DistributeStorage, threshold, shards int) *HotKeyClient {
+    c := new(HotKeyClient)
+    c.store = store
+    c.threshold = threshold
+    c.shards = shards
+    c.counts = make(map[string]int)
+    c.hot = make(map[string]time.Time)
+    c.done = make(chan struct{})
+    go func() {
+        for {
+            select {
+            case <-time.After(time.Second):
+            case <-c.done:
+                return
+            }
+            c.tick()
+        }
+    }()
+    return c
+}
+
+func (c *HotKeyClient) Close() {
+    c.closeOnce.Do(func() {
+        close(c.done)
+        CloseStorage(c.store)
+    })
+}
+
+func shardKey(key string, i int) string {
+    return fmt.Sprintf("%s:hotshard:%d", key, i)
+}
+
+// reset the counters of last second, and cool down keys
+func (c *HotKeyClient) tick() {
+    now := time.Now()
+    var cooled []string
+    c.lock.Lock()
+    for key, n := range c.counts {
+        if n > c.threshold {
+            if _, ok := c.hot[key]; !ok {
+                ErrorLog.Printf("hot key %s: %d qps, spread to %d shards", key, n, c.shards)
+            }
+            c.hot[key] = now.Add(HotKeyCoolDown)
+        }
+    }
+    for key, t := range c.hot {
+        if t.Before(now) {
+            delete(c.hot, key)
+            cooled = append(cooled, key)
+        }
+    }
+    c.counts = make(map[string]int, len(c.counts))
+    c.lock.Unlock()
+
+    for _, key := range cooled {
+        c.dropShards(key)
+    }
+}
+
+// count the access, return whether the key is hot
+func (c *HotKeyClient) access(key string) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.counts[key]++
+    _, hot := c.hot[key]
+    return hot
+}
+
+func (c *HotKeyClient) HotKeys() []string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    keys := make([]string, 0, len(c.hot))
+    for key := range c.hot {
+        keys = append(keys, key)
+    }
+    return keys
+}
+
+func (c *HotKeyClient) dropShards(key string) {
+    for i := 1; i < c.shards; i++ {
+        c.store.Delete(shardKey(key, i))
+    }
+}
+
+func (c *HotKeyClient) Get(key string) (r *Item, targets []string, err error) {
+    if !c.access(key) {
+        return c.store.Get(key)
+    }
+    i := rand.Intn(c.shards)
+    if i == 0 {
+        return c.store.Get(key)
+    }
+    sk := shardKey(key, i)
+    r, targets, err = c.store.Get(sk)
+    if err == nil && r != nil {
+        return
+    }
+    // the shard was not filled yet
+    r, targets, err = c.store.Get(key)
+    if err == nil && r != nil {
+        it := &Item{Flag: r.Flag, Exptime: r.Exptime, Body: append([]byte(nil), r.Body...)}
+        c.store.Set(sk, it, true)
+    }
+    return
+}
+
+func (c *HotKeyClient) GetMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+    plain := make([]string, 0, len(keys))
+    var hot []string
+    for _, key := range keys {
+        if c.access(key) {
+            hot = append(hot, key)
+        } else {
+            plain = append(plain, key)
+        }
+    }
+    if len(plain) > 0 {
+        rs, targets, err = c.store.GetMulti(plain)
+    }
+    if rs == nil {
+        rs = make(map[string]*Item, len(hot))
+    }
+    for _, key := range hot {
+        r, t, e := c.Get(key)
+        if e != nil {
+            err = e
+        } else if r != nil {
+            rs[key] = r
+            targets = append(targets, t...)
+        }
+    }
+    return
+}
+
+func (c *HotKeyClient) Set(key string, item *Item, noreply bool) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Set(key, item, noreply)
+    if ok && c.access(key) {
+        for i := 1; i < c.shards; i++ {
+            it := &Item{Flag: item.Flag, Exptime: item.Exptime, Body: item.Body}
+            c.store.Set(shardKey(key, i), it, true)
+        }
+    }
+    return
+}
+
+func (c *HotKeyClient) Append(key string, value []byte) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Append(key, value)
+    if c.access(key) {
+        c.dropShards(key)
+    }
+    return
+}
+
+func (c *HotKeyClient) Prepend(key string, value []byte) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Prepend(key, value)
+    if c.access(key) {
+        c.dropShards(key)
+    }
+    return
+}
+
+func (c *HotKeyClient) Incr(key string, value int) (result int, targets []string, err error) {
+    result, targets, err = c.store.Incr(key, value)
+    if c.access(key) {
+        c.dropShards(key)
+    }
+    return
+}
+
+func (c *HotKeyClient) Delete(key string) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Delete(key)
+    if c.access(key) {
+        c.dropShards(key)
+    }
+    return
+}
+
+func (c *HotKeyClient) Touch(key string, exptime int) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Touch(key, exptime)
+    if c.access(key) {
+        c.dropShards(key)
+    }
+    return
+}
+
+// the cas unique is of the key, never of a shard
+func (c *HotKeyClient) Gets(key string) (*Item, []string, error) {
+    return c.store.Gets(key)
+}
+
+func (c *HotKeyClient) Cas(key string, item *Item) (status string, targets []string, err error) {
+    status, targets, err = c.store.Cas(key, item)
+    if status == "STORED" && c.access(key) {
+        c.dropShards(key)
+    }
+    return
+}
+
+func (c *HotKeyClient) Len() int {
+    return c.store.Len()
+}
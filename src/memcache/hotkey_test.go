@@ -0,0 +1,33 @@
+package memcache
+
+import "testing"
+
+func TestHotKeyClient(t *testing.T) {
+	store := newMapDistStore()
+	c := NewHotKeyClient(store, 2, 3)
+	c.Set("hot", &Item{Body: []byte("v1")}, false)
+	for i := 0; i < 5; i++ {
+		c.Get("hot")
+	}
+	c.tick()
+	if hot := c.HotKeys(); len(hot) != 1 || hot[0] != "hot" {
+		t.Fatalf("key should be hot: %v", hot)
+	}
+
+	c.Set("hot", &Item{Body: []byte("v2")}, false)
+	for i := 1; i < 3; i++ {
+		if r, _ := store.mapStore.Get(shardKey("hot", i)); r == nil || string(r.Body) != "v2" {
+			t.Errorf("write should fan out to shard %d: %v", i, r)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if r, _, _ := c.Get("hot"); r == nil || string(r.Body) != "v2" {
+			t.Errorf("read from shards: %v", r)
+		}
+	}
+
+	c.Delete("hot")
+	if r, _, _ := c.Get("hot"); r != nil {
+		t.Errorf("deleted key should not be read from shards: %v", r)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * how badly the ring or the bucket table has drifted, by the keys every host
+ * would get and the requests it got
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "math"
+    "sync/atomic"
+)
+
+// keys routed in the simulation of ImbalanceOf
+var ImbalanceKeys = 10000
+
+// 1 and 0 are perfectly balanced
+type Imbalance struct {
+    Hosts          int
+    KeysMax        float64        // max/avg of keys routed to the hosts first
+    KeysStddev     float64        // stddev/avg of them
+    RequestsMax    float64        // max/avg of requests sent to the hosts
+    RequestsStddev float64        // stddev/avg of them
+    Keys           map[string]int // keys routed to every host first
+}
+
+// max/avg and stddev/avg of vs, 0 if they are all 0
+func spread(vs []float64) (max, stddev float64) {
+    if len(vs) == 0 {
+        return 0, 0
+    }
+    sum := 0.0
+    for _, v := range vs {
+        sum += v
+        if v > max {
+            max = v
+        }
+    }
+    avg := sum / float64(len(vs))
+    if avg == 0 {
+        return 0, 0
+    }
+    variance := 0.0
+    for _, v := range vs {
+        variance += (v - avg) * (v - avg)
+    }
+    return max / avg, math.Sqrt(variance/float64(len(vs))) / avg
+}
+
+// imbalance of the hosts of addrs in sch, the hosts routed to are used if
+// addrs is empty
+func ImbalanceOf(sch Scheduler, addrs []string) *Imbalance {
+    keys := make([]string, ImbalanceKeys)
+    for i := range keys {
+        keys[i] = fmt.Sprintf("imbalance:%d", i)
+    }
+    _, hist := SimulateRouting(sch, keys, 1)
+    if len(addrs) == 0 {
+        for addr := range hist {
+            addrs = append(addrs, addr)
+        }
+    }
+    r := &Imbalance{Hosts: len(addrs), Keys: make(map[string]int, len(addrs))}
+    ks := make([]float64, len(addrs))
+    rs := make([]float64, len(addrs))
+    for i, addr := range addrs {
+        r.Keys[addr] = hist[addr]
+        ks[i] = float64(hist[addr])
+        rs[i] = float64(atomic.LoadInt64(&counterOf(addr).requests))
+    }
+    r.KeysMax, r.KeysStddev = spread(ks)
+    r.RequestsMax, r.RequestsStddev = spread(rs)
+    return r
+}
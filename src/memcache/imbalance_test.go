@@ -0,0 +1,46 @@
+package memcache
+
+import (
+	"testing"
+)
+
+func TestImbalance(t *testing.T) {
+	addrs := []string{"imb1:11211", "imb2:11211", "imb3:11211", "imb4:11211"}
+	im := ImbalanceOf(NewModScheduler(addrs, "md5"), addrs)
+	if im.Hosts != 4 || im.KeysMax > 1.1 || im.KeysStddev > 0.1 {
+		t.Errorf("mod scheduler should be balanced: %+v", im)
+	}
+	if im.RequestsMax != 0 {
+		t.Errorf("no requests were sent: %+v", im)
+	}
+
+	// imb1 is the first of 3 buckets out of 4, imb4 of none
+	sch := newTestManualScheduler(map[string][]string{
+		addrs[0]: {"0", "1", "2"}, addrs[1]: {"0", "1", "2", "3"}, addrs[2]: {"1", "2", "3"}, addrs[3]: {"0", "3"},
+	}, 4, 3)
+	sch.SetFixedOrder(addrs)
+	im = ImbalanceOf(sch, addrs)
+	if im.KeysMax < 2.5 || im.Keys[addrs[3]] != 0 {
+		t.Errorf("drifted table should be imbalanced: %+v", im)
+	}
+
+	for i := 0; i < 30; i++ {
+		counterOf(addrs[0]).done(0)
+	}
+	counterOf(addrs[1]).done(0)
+	if im = ImbalanceOf(sch, addrs); im.RequestsMax < 3 || im.RequestsStddev < 1 {
+		t.Errorf("requests should be imbalanced: %+v", im)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	if max, stddev := spread([]float64{2, 2, 2}); max != 1 || stddev != 0 {
+		t.Errorf("even values: %v %v", max, stddev)
+	}
+	if max, stddev := spread([]float64{0, 4}); max != 2 || stddev != 1 {
+		t.Errorf("uneven values: %v %v", max, stddev)
+	}
+	if max, _ := spread(nil); max != 0 {
+		t.Errorf("no values: %v", max)
+	}
+}
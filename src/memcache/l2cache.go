@@ -0,0 +1,167 @@
+/*
+ * persistent cache of values in proxy, to shield backends from cold start
+ * read storms after proxy redeploys
+ */
+
+package memcache
+
+import (
+    "strings"
+    "time"
+)
+
+// L2CacheClient cache values of keys with some prefixes in a BitcaskStore,
+// the oldest data files are dropped when it's larger than maxSize,
+// writes through the proxy invalidate the cache.
+type L2CacheClient struct {
+    store    DistributeStorage
+    cache    *BitcaskStore
+    prefixes []string // empty means all keys
+    ttl      time.Duration
+    maxSize  int64
+}
+
+var l2CacheTargets = []string{"l2cache"}
+
+func NewL2CacheClient(store DistributeStorage, cache *BitcaskStore, prefixes []string, ttl time.Duration, maxSize int64) *L2CacheClient {
+    return &L2CacheClient{store, cache, prefixes, ttl, maxSize}
+}
+
+func (c *L2CacheClient) cacheable(key string) bool {
+    if len(c.prefixes) == 0 {
+        return true
+    }
+    for _, p := range c.prefixes {
+        if strings.HasPrefix(key, p) {
+            return true
+        }
+    }
+    return false
+}
+
+// exptime of the cached item is the time it expires in cache
+func (c *L2CacheClient) cached(key string) *Item {
+    r, err := c.cache.Get(key)
+    if err != nil || r == nil {
+        return nil
+    }
+    if int64(r.Exptime) < time.Now().Unix() {
+        c.cache.Delete(key)
+        return nil
+    }
+    r.Exptime = 0
+    return r
+}
+
+func (c *L2CacheClient) remember(key string, r *Item) {
+    expire := time.Now().Add(c.ttl).Unix()
+    c.cache.Set(key, &Item{Flag: r.Flag, Exptime: int(expire), Body: r.Body}, true)
+    if c.maxSize > 0 && c.cache.Size() > c.maxSize {
+        if err := c.cache.DropOldest(); err != nil {
+            ErrorLog.Print("evict l2 cache failed: ", err)
+        }
+    }
+}
+
+func (c *L2CacheClient) Get(key string) (r *Item, targets []string, err error) {
+    if !c.cacheable(key) {
+        return c.store.Get(key)
+    }
+    if r = c.cached(key); r != nil {
+        return r, l2CacheTargets, nil
+    }
+    r, targets, err = c.store.Get(key)
+    if err == nil && r != nil {
+        c.remember(key, r)
+    }
+    return
+}
+
+func (c *L2CacheClient) GetMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+    hit := make(map[string]*Item)
+    missed := make([]string, 0, len(keys))
+    for _, key := range keys {
+        if c.cacheable(key) {
+            if r := c.cached(key); r != nil {
+                hit[key] = r
+                continue
+            }
+        }
+        missed = append(missed, key)
+    }
+    if len(missed) > 0 {
+        rs, targets, err = c.store.GetMulti(missed)
+    }
+    if rs == nil {
+        rs = make(map[string]*Item, len(hit))
+    }
+    for key, r := range rs {
+        if c.cacheable(key) {
+            c.remember(key, r)
+        }
+    }
+    for key, r := range hit {
+        rs[key] = r
+    }
+    if len(hit) > 0 {
+        targets = append(targets, l2CacheTargets...)
+    }
+    return
+}
+
+func (c *L2CacheClient) invalidate(key string) {
+    if c.cacheable(key) {
+        c.cache.Delete(key)
+    }
+}
+
+func (c *L2CacheClient) Set(key string, item *Item, noreply bool) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Set(key, item, noreply)
+    c.invalidate(key)
+    return
+}
+
+func (c *L2CacheClient) Append(key string, value []byte) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Append(key, value)
+    c.invalidate(key)
+    return
+}
+
+func (c *L2CacheClient) Prepend(key string, value []byte) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Prepend(key, value)
+    c.invalidate(key)
+    return
+}
+
+func (c *L2CacheClient) Incr(key string, value int) (result int, targets []string, err error) {
+    result, targets, err = c.store.Incr(key, value)
+    c.invalidate(key)
+    return
+}
+
+func (c *L2CacheClient) Delete(key string) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Delete(key)
+    c.invalidate(key)
+    return
+}
+
+func (c *L2CacheClient) Touch(key string, exptime int) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Touch(key, exptime)
+    c.invalidate(key)
+    return
+}
+
+// the cas unique should be fresh, never cached
+func (c *L2CacheClient) Gets(key string) (*Item, []string, error) {
+    return c.store.Gets(key)
+}
+
+func (c *L2CacheClient) Cas(key string, item *Item) (status string, targets []string, err error) {
+    status, targets, err = c.store.Cas(key, item)
+    c.invalidate(key)
+    return
+}
+
+func (c *L2CacheClient) Len() int {
+    return c.store.Len()
+}
@@ -0,0 +1,62 @@
+package memcache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestL2CacheClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l2cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := OpenBitcaskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newMapDistStore()
+	c := NewL2CacheClient(store, cache, []string{"user:"}, time.Minute, 0)
+
+	store.Set("user:1", &Item{Body: []byte("bean")}, false)
+	store.Set("other", &Item{Body: []byte("other")}, false)
+	c.Get("user:1")
+	c.Get("other")
+	store.mapStore.Delete("user:1")
+	if r, targets, _ := c.Get("user:1"); r == nil || string(r.Body) != "bean" || targets[0] != "l2cache" {
+		t.Errorf("value should be served from l2 cache: %v %v", r, targets)
+	}
+	if r, _ := cache.Get("other"); r != nil {
+		t.Errorf("keys without the prefixes should not be cached")
+	}
+
+	// survive restarts
+	cache.Close()
+	if cache, err = OpenBitcaskStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	c = NewL2CacheClient(store, cache, []string{"user:"}, time.Minute, 0)
+	if rs, _, _ := c.GetMulti([]string{"user:1", "other"}); len(rs) != 2 {
+		t.Errorf("cached value should be loaded after restart: %v", rs)
+	}
+	c.Set("user:1", &Item{Body: []byte("eye")}, false)
+	if r, _, _ := c.Get("user:1"); r == nil || string(r.Body) != "eye" {
+		t.Errorf("cache should be invalidated by set: %v", r)
+	}
+
+	cache.MaxFileSize = 1
+	c.maxSize = 100
+	for _, key := range []string{"user:2", "user:3", "user:4", "user:5"} {
+		store.Set(key, &Item{Body: make([]byte, 40)}, false)
+		c.Get(key)
+	}
+	if size := cache.Size(); size > 100 {
+		t.Errorf("cache should be evicted to less than max size: %d", size)
+	}
+	if r, _ := cache.Get("user:5"); r == nil {
+		t.Errorf("the latest cached value should be kept")
+	}
+	cache.Close()
+}
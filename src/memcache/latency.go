@@ -0,0 +1,32 @@
+/*
+ * latency of requests to backends, kept in memcache/stats
+ */
+
+package memcache
+
+import (
+    "memcache/stats"
+    "time"
+)
+
+type LatencyHistogram = stats.LatencyHistogram
+type TimeoutAdvice = stats.TimeoutAdvice
+
+func NewLatencyHistogram() *LatencyHistogram {
+    return stats.NewLatencyHistogram()
+}
+
+// record the latency of a command sent to backends
+func RecordLatency(cmd string, d time.Duration) {
+    stats.RecordLatency(cmd, d)
+}
+
+// a copy of the recorded histograms by command
+func Latencies() map[string]*LatencyHistogram {
+    return stats.Latencies()
+}
+
+// recommend timeout of every command with enough samples
+func RecommendTimeouts(hists map[string]*LatencyHistogram) []TimeoutAdvice {
+    return stats.RecommendTimeouts(hists)
+}
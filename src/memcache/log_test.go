@@ -0,0 +1,13 @@
+package memcache
+
+import (
+	"log"
+	"os"
+)
+
+// errors of every test go to stderr, as no test opens the error log
+func init() {
+	if ErrorLog == nil {
+		ErrorLog = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+	}
+}
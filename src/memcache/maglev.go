@@ -0,0 +1,145 @@
+/*
+ * maglev hashing, keys are routed by a lookup table filled by the
+ * permutations of hosts
+ */
+
+package memcache
+
+import (
+    "errors"
+    "sync"
+    "sync/atomic"
+)
+
+// route requests by maglev lookup table, it has near perfect balance and
+// minimal disruption on node changes, lookup is O(1)
+type MaglevScheduler struct {
+    state      atomic.Value // *maglevState
+    size       int
+    hashMethod HashMethod
+    lock       sync.Mutex
+    emptyScheduler
+}
+
+type maglevState struct {
+    hosts []*Host
+    table []int
+}
+
+const MAGLEV_TABLE_SIZE = 65537
+
+func isPrime(n int) bool {
+    if n < 2 {
+        return false
+    }
+    for i := 2; i*i <= n; i++ {
+        if n%i == 0 {
+            return false
+        }
+    }
+    return true
+}
+
+var ErrNoHosts = errors.New("no hosts to route keys to")
+
+// size of table should be a prime much bigger than number of hosts
+func NewMaglevScheduler(hosts []string, hashname string, size int) (Scheduler, error) {
+    if len(hosts) == 0 {
+        return nil, ErrNoHosts
+    }
+    if size <= 0 {
+        size = MAGLEV_TABLE_SIZE
+    }
+    for !isPrime(size) {
+        size++
+    }
+    c := new(MaglevScheduler)
+    c.size = size
+    c.hashMethod = hashMethods[hashname]
+    c.rebuild(hosts)
+    return c, nil
+}
+
+func (c *MaglevScheduler) rebuild(addrs []string) {
+    old := make(map[string]*Host)
+    if st, ok := c.state.Load().(*maglevState); ok {
+        for _, h := range st.hosts {
+            old[h.Addr] = h
+        }
+    }
+    st := &maglevState{hosts: make([]*Host, len(addrs))}
+    for i, addr := range addrs {
+        h, ok := old[addr]
+        if !ok {
+            h = NewHost(addr)
+        }
+        st.hosts[i] = h
+    }
+    st.table = maglevPopulate(addrs, c.size)
+    c.state.Store(st)
+}
+
+func (c *MaglevScheduler) current() *maglevState {
+    return c.state.Load().(*maglevState)
+}
+
+func maglevPopulate(hosts []string, size int) []int {
+    n := len(hosts)
+    offsets := make([]int, n)
+    skips := make([]int, n)
+    for i, h := range hosts {
+        offsets[i] = int(md5hash([]byte(h)) % uint32(size))
+        skips[i] = int(fnv1a([]byte(h))%uint32(size-1)) + 1
+    }
+    table := make([]int, size)
+    for i := range table {
+        table[i] = -1
+    }
+    if n == 0 {
+        return table
+    }
+    next := make([]int, n)
+    filled := 0
+    for {
+        for i := 0; i < n; i++ {
+            // next preferred slot of host i which is still empty
+            c := (offsets[i] + next[i]*skips[i]) % size
+            for table[c] >= 0 {
+                next[i]++
+                c = (offsets[i] + next[i]*skips[i]) % size
+            }
+            table[c] = i
+            next[i]++
+            filled++
+            if filled == size {
+                return table
+            }
+        }
+    }
+}
+
+func (c *MaglevScheduler) getHostIndex(st *maglevState, key string) int {
+    return st.table[c.hashMethod([]byte(key))%uint32(len(st.table))]
+}
+
+func (c *MaglevScheduler) Hosts() []*Host {
+    return c.current().hosts
+}
+
+func (c *MaglevScheduler) GetHostsByKey(key string) []*Host {
+    st := c.current()
+    r := make([]*Host, 1)
+    i := int(c.hashMethod([]byte(key)) % uint32(len(st.table)))
+    r[0] = firstAvailable(len(st.table), i, func(i int) *Host { return st.hosts[st.table[i]] })
+    return r
+}
+
+func (c *MaglevScheduler) DivideKeysByBucket(keys []string) [][]string {
+    st := c.current()
+    rs := make([][]string, len(st.hosts))
+    for _, key := range keys {
+        i := c.getHostIndex(st, key)
+        rs[i] = append(rs[i], key)
+    }
+    return rs
+}
@@ -0,0 +1,100 @@
+/*
+ * hosts in maintenance (or ejected, see eject.go) are skipped by the
+ * schedulers, but kept in their rings and bucket tables, so keys come back
+ * when the maintenance is over
+ */
+
+package memcache
+
+import (
+    "sort"
+    "sync/atomic"
+)
+
+// hosts in maintenance, schedulers skip nothing if it's 0
+var maintenanceCount int64
+
+// the flag is shared by all the Host of the same address
+func SetMaintenance(addr string, on bool) {
+    c := counterOf(addr)
+    var v int32
+    if on {
+        v = 1
+    }
+    if old := atomic.SwapInt32(&c.maintenance, v); old != v {
+        atomic.AddInt64(&maintenanceCount, int64(v-old))
+        if on {
+            ErrorLog.Print(c.addr, " is in maintenance")
+            RecordEvent("maintenance", addr, "on")
+        } else {
+            ErrorLog.Print(c.addr, " is back from maintenance")
+            RecordEvent("maintenance", addr, "off")
+        }
+    }
+}
+
+func (host *Host) InMaintenance() bool {
+    return host != nil && host.counter != nil && atomic.LoadInt32(&host.counter.maintenance) != 0
+}
+
+// addresses of the hosts in maintenance
+func MaintenanceHosts() []string {
+    addrs := []string{}
+    if atomic.LoadInt64(&maintenanceCount) == 0 {
+        return addrs
+    }
+    hostCounters.Range(func(addr, c interface{}) bool {
+        if atomic.LoadInt32(&c.(*hostCounter).maintenance) != 0 {
+            addrs = append(addrs, addr.(string))
+        }
+        return true
+    })
+    sort.Strings(addrs)
+    return addrs
+}
+
+// hosts in maintenance, ejected, or draining
+func unavailableHosts() int {
+    return int(atomic.LoadInt64(&maintenanceCount) + atomic.LoadInt64(&ejectedCount) + atomic.LoadInt64(&drainingCount))
+}
+
+// skipped by the schedulers, in maintenance, ejected after errors, or drained
+func (host *Host) unavailable() bool {
+    return host.InMaintenance() || host.Ejected() || host.Drained()
+}
+
+// available hosts in the same order, all of them if none is left, as the
+// key has nowhere else to go
+func skipUnavailable(hosts []*Host) []*Host {
+    if unavailableHosts() == 0 {
+        return hosts
+    }
+    r := make([]*Host, 0, len(hosts))
+    skipped := false
+    for _, h := range hosts {
+        if h.unavailable() {
+            skipped = true
+            continue
+        }
+        r = append(r, h)
+    }
+    if !skipped || len(r) == 0 {
+        return hosts
+    }
+    return r
+}
+
+// the first available one from i (in the order of n candidates), for the
+// schedulers picking a single host
+func firstAvailable(n, i int, host func(i int) *Host) *Host {
+    h := host(i)
+    if !h.unavailable() {
+        return h
+    }
+    for k := 1; k < n; k++ {
+        if c := host((i + k) % n); !c.unavailable() {
+            return c
+        }
+    }
+    return h
+}
@@ -0,0 +1,59 @@
+package memcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	addrs := []string{"maint1:11211", "maint2:11211", "maint3:11211", "maint4:11211"}
+	consistant := NewConsistantHashScheduler(addrs, "md5").(*ConsistantHashScheduler)
+	consistant.Replicas = 2
+	schds := map[string]Scheduler{
+		"manual": newTestManualScheduler(map[string][]string{
+			addrs[0]: {"0", "1"}, addrs[1]: {"0", "1"}, addrs[2]: {"0", "1"}, addrs[3]: {"-0", "-1"},
+		}, 2, 3),
+		"consistant": consistant,
+		"mod":        NewModScheduler(addrs, "md5"),
+		"rendezvous": NewRendezvousScheduler(addrs, "md5"),
+		"maglev":     newTestMaglevScheduler(addrs, 0),
+		"bounded":    NewBoundedLoadScheduler(addrs, "md5", 0.25),
+	}
+	for name, sch := range schds {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key:%d", i)
+			before := sch.GetHostsByKey(key)
+			first := before[0].Addr
+			SetMaintenance(first, true)
+			after := sch.GetHostsByKey(key)
+			if len(after) == 0 {
+				t.Errorf("%s: no host of %s in maintenance", name, key)
+			}
+			for _, h := range after {
+				if h.Addr == first {
+					t.Errorf("%s: %s in maintenance should be skipped for %s", name, first, key)
+				}
+			}
+			SetMaintenance(first, false)
+			if h := sch.GetHostsByKey(key)[0]; h.Addr != first && name != "bounded" {
+				t.Errorf("%s: %s should come back to %s after maintenance, got %s", name, key, first, h.Addr)
+			}
+		}
+	}
+
+	if hs := MaintenanceHosts(); len(hs) != 0 {
+		t.Errorf("no host should be in maintenance: %v", hs)
+	}
+	for _, addr := range addrs {
+		SetMaintenance(addr, true)
+	}
+	if hs := schds["rendezvous"].GetHostsByKey("key"); len(hs) != len(addrs) {
+		t.Errorf("all the hosts should be kept if all are in maintenance: %v", hs)
+	}
+	if hs := MaintenanceHosts(); len(hs) != len(addrs) || hs[0] != addrs[0] {
+		t.Errorf("bad hosts in maintenance: %v", hs)
+	}
+	for _, addr := range addrs {
+		SetMaintenance(addr, false)
+	}
+}
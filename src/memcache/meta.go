@@ -0,0 +1,252 @@
+/*
+ * meta commands of memcached (mg, ms, md, ma and mn), translated into the
+ * classic commands the backends know
+ */
+
+package memcache
+
+import (
+    "encoding/base64"
+    "errors"
+    "strconv"
+    "strings"
+)
+
+var errMetaFlags = errors.New("bad command line format")
+
+// the token of the flag, like "T30" of T
+func metaFlag(flags []string, f byte) (string, bool) {
+    for _, s := range flags {
+        if len(s) > 0 && s[0] == f {
+            return s[1:], true
+        }
+    }
+    return "", false
+}
+
+func metaInt(flags []string, f byte, def int) (int, error) {
+    s, ok := metaFlag(flags, f)
+    if !ok {
+        return def, nil
+    }
+    n, err := strconv.Atoi(s)
+    if err != nil {
+        return 0, errMetaFlags
+    }
+    return n, nil
+}
+
+// parse the meta command, the line is split into parts
+func (req *Request) readMeta(parts []string) error {
+    req.Meta = nil
+    if req.Cmd == "mn" {
+        return nil
+    }
+    if len(parts) < 2 {
+        return errors.New("invalid cmd")
+    }
+    req.Keys = parts[1:2]
+    req.Meta = parts[2:]
+    if req.Cmd == "ms" {
+        if len(parts) < 3 {
+            return errors.New("invalid cmd")
+        }
+        req.Meta = parts[3:]
+    }
+    if _, ok := metaFlag(req.Meta, 'b'); ok {
+        key, err := base64.StdEncoding.DecodeString(req.Keys[0])
+        if err != nil {
+            return errors.New("invalid base64 key")
+        }
+        req.Keys = []string{string(key)}
+    }
+    return nil
+}
+
+// flags echoed in every response
+func (req *Request) metaEcho() []string {
+    var r []string
+    if o, ok := metaFlag(req.Meta, 'O'); ok {
+        r = append(r, "O"+o)
+    }
+    if _, ok := metaFlag(req.Meta, 'k'); ok {
+        key := req.Keys[0]
+        if _, ok := metaFlag(req.Meta, 'b'); ok {
+            r = append(r, "k"+base64.StdEncoding.EncodeToString([]byte(key)), "b")
+        } else {
+            r = append(r, "k"+key)
+        }
+    }
+    return r
+}
+
+func (req *Request) metaQuiet() bool {
+    _, ok := metaFlag(req.Meta, 'q')
+    return ok
+}
+
+// status of meta commands by the ones of classic commands
+var metaStatus = map[string]string{
+    "STORED":     "HD",
+    "DELETED":    "HD",
+    "INCR":       "HD",
+    "DECR":       "HD",
+    "NOT_STORED": "NS",
+    "EXISTS":     "EX",
+    "NOT_FOUND":  "NF",
+}
+
+var metaSetModes = map[string]string{
+    "": "set", "S": "set", "s": "set",
+    "E": "add", "e": "add",
+    "R": "replace", "r": "replace",
+    "A": "append", "a": "append",
+    "P": "prepend", "p": "prepend",
+}
+
+func (req *Request) processMeta(store DistributeStorage, stat *Stats) (resp *Response, targets []string, err error) {
+    resp = new(Response)
+    if req.Cmd == "mn" {
+        resp.status = "MN"
+        return
+    }
+    key := req.Keys[0]
+    if len(key) > MaxKeyLength {
+        resp.status = "CLIENT_ERROR"
+        resp.msg = "key too long"
+        return
+    }
+    flags := req.Meta
+    ret := req.metaEcho()
+
+    var sub *Request
+    switch req.Cmd {
+    case "mg":
+        stat.cmd_get++
+        var item *Item
+        if _, ok := metaFlag(flags, 'c'); ok {
+            // the cas unique of the owner
+            item, targets, err = store.Gets(key)
+        } else {
+            item, targets, err = store.Get(key)
+        }
+        if err != nil {
+            resp.status = "SERVER_ERROR"
+            resp.msg = err.Error()
+            return
+        }
+        if item == nil {
+            stat.get_misses++
+            resp.status = "EN"
+            resp.noreply = req.metaQuiet()
+            return
+        }
+        stat.get_hits++
+        for _, f := range flags {
+            switch f {
+            case "f":
+                ret = append(ret, "f"+strconv.Itoa(item.Flag))
+            case "c":
+                ret = append(ret, "c"+strconv.Itoa(item.Cas))
+            case "s":
+                ret = append(ret, "s"+strconv.Itoa(len(item.Body)))
+            case "t":
+                // not known by the classic commands
+                ret = append(ret, "t-1")
+            }
+        }
+        resp.status = "HD"
+        if _, ok := metaFlag(flags, 'v'); ok {
+            resp.status = "VA"
+            resp.items = map[string]*Item{key: item}
+            stat.bytes_written += int64(len(item.Body))
+        }
+        resp.msg = strings.Join(ret, " ")
+        return
+
+    case "ms":
+        mode, _ := metaFlag(flags, 'M')
+        cmd, ok := metaSetModes[mode]
+        if !ok {
+            resp.status = "CLIENT_ERROR"
+            resp.msg = "invalid mode for ms"
+            return
+        }
+        if req.Item.Flag, err = metaInt(flags, 'F', 0); err == nil {
+            if req.Item.Exptime, err = metaInt(flags, 'T', 0); err == nil {
+                req.Item.Cas, err = metaInt(flags, 'C', 0)
+            }
+        }
+        if err != nil {
+            resp.status = "CLIENT_ERROR"
+            resp.msg = err.Error()
+            return resp, nil, nil
+        }
+        if req.Item.Cas != 0 && cmd == "set" {
+            cmd = "cas"
+        }
+        sub = &Request{Cmd: cmd, Keys: req.Keys, Item: req.Item}
+
+    case "md":
+        sub = &Request{Cmd: "delete", Keys: req.Keys}
+
+    case "ma":
+        mode, _ := metaFlag(flags, 'M')
+        cmd := "incr"
+        switch mode {
+        case "", "I", "i", "+":
+        case "D", "d", "-":
+            cmd = "decr"
+        default:
+            resp.status = "CLIENT_ERROR"
+            resp.msg = "invalid mode for ma"
+            return
+        }
+        delta, err := metaInt(flags, 'D', 1)
+        if err != nil {
+            resp.status = "CLIENT_ERROR"
+            resp.msg = err.Error()
+            return resp, nil, nil
+        }
+        sub = &Request{Cmd: cmd, Keys: req.Keys, Item: &Item{Body: []byte(strconv.Itoa(delta))}}
+    }
+
+    var r *Response
+    r, targets, err = sub.Process(store, stat)
+    if r == nil {
+        resp.status = "CLIENT_ERROR"
+        resp.msg = sub.Cmd + " is not supported"
+        return
+    }
+    if req.Cmd == "ma" && r.status == "NOT_FOUND" {
+        // created with the initial value if N (the ttl) is given
+        if ttl, ok := metaFlag(flags, 'N'); ok {
+            exptime, e1 := strconv.Atoi(ttl)
+            initial, e2 := metaInt(flags, 'J', 0)
+            if e1 != nil || e2 != nil {
+                resp.status = "CLIENT_ERROR"
+                resp.msg = errMetaFlags.Error()
+                return
+            }
+            add := &Request{Cmd: "add", Keys: req.Keys, Item: &Item{Exptime: exptime, Body: []byte(strconv.Itoa(initial))}}
+            if a, t, _ := add.Process(store, stat); a != nil && a.status == "STORED" {
+                r, targets = &Response{status: "INCR", msg: strconv.Itoa(initial)}, t
+            }
+        }
+    }
+    status, ok := metaStatus[r.status]
+    if !ok {
+        // errors
+        return r, targets, err
+    }
+    resp.status = status
+    if req.Cmd == "ma" && status == "HD" {
+        if _, ok := metaFlag(flags, 'v'); ok {
+            resp.status = "VA"
+            resp.items = map[string]*Item{key: &Item{Body: []byte(r.msg)}}
+        }
+    }
+    resp.msg = strings.Join(ret, " ")
+    resp.noreply = status == "HD" && req.metaQuiet()
+    return
+}
@@ -0,0 +1,50 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestMetaCommands(t *testing.T) {
+	store := newMapDistStore()
+	stats := NewStats()
+
+	cases := []reqTest{
+		reqTest{"ms k 2 F5 T0\r\nhi\r\n", "HD\r\n"},
+		reqTest{"mg k v f k\r\n", "VA 2 kk f5\r\nhi\r\n"},
+		reqTest{"mg k s Oab\r\n", "HD Oab s2\r\n"},
+		reqTest{"mg nokey v\r\n", "EN\r\n"},
+		reqTest{"mg nokey v q\r\n", ""},
+		reqTest{"ms a 1\r\nx\r\n", "HD\r\n"},
+		reqTest{"ms a 1 MA q\r\n!\r\n", ""},
+		reqTest{"mg a v\r\n", "VA 2\r\nx!\r\n"},
+		reqTest{"ms a 1 MX\r\nx\r\n", "CLIENT_ERROR invalid mode for ms\r\n"},
+		reqTest{"ma n\r\n", "NF\r\n"},
+		reqTest{"ma n N0 J10 v\r\n", "VA 2\r\n10\r\n"},
+		reqTest{"ma n D5 v Oz\r\n", "VA 2 Oz\r\n15\r\n"},
+		reqTest{"ma n q\r\n", ""},
+		reqTest{"mg n v\r\n", "VA 2\r\n16\r\n"},
+		reqTest{"md n q\r\n", ""},
+		reqTest{"md n\r\n", "NF\r\n"},
+		reqTest{"ms a2V5 1 b\r\nz\r\n", "HD\r\n"},
+		reqTest{"mg a2V5 b k v\r\n", "VA 1 ka2V5 b\r\nz\r\n"},
+		reqTest{"mg key v\r\n", "VA 1\r\nz\r\n"},
+		reqTest{"mn\r\n", "MN\r\n"},
+		reqTest{"mg\r\n", "CLIENT_ERROR invalid cmd\r\n"},
+	}
+	for i, test := range cases {
+		req := new(Request)
+		var resp *Response
+		if e := req.Read(bufio.NewReader(bytes.NewBufferString(test.cmd))); e != nil {
+			resp = &Response{status: "CLIENT_ERROR", msg: e.Error()}
+		} else {
+			resp, _, _ = req.Process(store, stats)
+		}
+		wr := new(bytes.Buffer)
+		resp.Write(wr)
+		if wr.String() != test.anwser {
+			t.Errorf("test %d %q: expect %q, but got %q", i, test.cmd, test.anwser, wr.String())
+		}
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * the stats of the schema in the text format of prometheus, and a grafana
+ * dashboard of them, both named by the schema so they can't drift apart
+ */
+
+package memcache
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+const MetricPrefix = "beanseye_"
+
+// the exported name of a stat of the proxy, or of a server, counters end
+// with _total
+func MetricName(f StatField, server bool) string {
+    name := MetricPrefix
+    if server {
+        name += "server_"
+    }
+    name += f.Key
+    if !f.Gauge {
+        name += "_total"
+    }
+    return name
+}
+
+// text and weights are in /api/stats only
+func exported(f StatField) bool {
+    return f.Unit != "text" && f.Unit != "weights"
+}
+
+func metricValue(v interface{}) float64 {
+    switch v := v.(type) {
+    case int64:
+        return float64(v)
+    case int:
+        return float64(v)
+    case float64:
+        return v
+    case bool:
+        if v {
+            return 1
+        }
+    }
+    return 0
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetricHeader(b *bytes.Buffer, name string, f StatField) {
+    typ := "counter"
+    if f.Gauge {
+        typ = "gauge"
+    }
+    fmt.Fprintf(b, "# HELP %s %s, in %s\n# TYPE %s %s\n", name, f.Help, f.Unit, name, typ)
+}
+
+// write the stats of VersionedStats and VersionedHostStats for prometheus,
+// the stats of servers are labeled by server and name, proxy could be nil
+func WriteMetrics(w io.Writer, proxy map[string]int64, hosts map[string]map[string]interface{}) error {
+    var b bytes.Buffer
+    if proxy != nil {
+        for _, f := range StatsSchema {
+            if !exported(f) {
+                continue
+            }
+            name := MetricName(f, false)
+            writeMetricHeader(&b, name, f)
+            fmt.Fprintf(&b, "%s %d\n", name, proxy[f.Key])
+        }
+    }
+    addrs := make([]string, 0, len(hosts))
+    for addr := range hosts {
+        addrs = append(addrs, addr)
+    }
+    sort.Strings(addrs)
+    for _, f := range HostStatsSchema {
+        if !exported(f) || len(addrs) == 0 {
+            continue
+        }
+        name := MetricName(f, true)
+        writeMetricHeader(&b, name, f)
+        for _, addr := range addrs {
+            h := hosts[addr]
+            alias, _ := h["name"].(string)
+            fmt.Fprintf(&b, "%s{server=\"%s\",name=\"%s\"} %g\n", name,
+                labelEscaper.Replace(addr), labelEscaper.Replace(alias), metricValue(h[f.Key]))
+        }
+    }
+    _, err := w.Write(b.Bytes())
+    return err
+}
+
+// units of grafana for the units of the schema, of the rates for counters
+var grafanaUnits = map[string][2]string{
+    // unit: {gauge, rate of counter}
+    "count":        {"short", "ops"},
+    "bytes":        {"bytes", "Bps"},
+    "kilobytes":    {"deckbytes", "KBs"},
+    "seconds":      {"s", "percentunit"},
+    "milliseconds": {"ms", "ms"},
+    "unix seconds": {"dateTimeFromNow", "short"},
+    "bool":         {"bool", "short"},
+    "id":           {"none", "none"},
+}
+
+var invalidUID = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// a grafana dashboard of the metrics of WriteMetrics for a cluster, which is
+// the cluster label added to the proxies by the scrape config of prometheus
+func GrafanaDashboard(cluster string) map[string]interface{} {
+    panels := []interface{}{}
+    id, y := 0, 0
+    row := func(title string) {
+        id++
+        panels = append(panels, map[string]interface{}{
+            "id": id, "type": "row", "title": title, "collapsed": false,
+            "gridPos": map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+            "panels":  []interface{}{},
+        })
+        y++
+    }
+    add := func(f StatField, server bool, i int) {
+        name := MetricName(f, server)
+        by := "instance"
+        if server {
+            by = "name"
+        }
+        selector := fmt.Sprintf(`%s{cluster="$cluster"}`, name)
+        var expr, unit string
+        if f.Gauge {
+            expr = fmt.Sprintf("max by (%s) (%s)", by, selector)
+            if f.Unit == "unix seconds" {
+                // grafana takes milliseconds, and 0 is never
+                expr = fmt.Sprintf("(%s > 0) * 1000", expr)
+            }
+            unit = grafanaUnits[f.Unit][0]
+        } else {
+            expr = fmt.Sprintf("sum by (%s) (rate(%s[$__rate_interval]))", by, selector)
+            unit = grafanaUnits[f.Unit][1]
+        }
+        id++
+        panels = append(panels, map[string]interface{}{
+            "id": id, "type": "timeseries", "title": f.Key, "description": f.Help,
+            "datasource": map[string]string{"type": "prometheus", "uid": "${datasource}"},
+            "gridPos":    map[string]int{"h": 8, "w": 12, "x": 12 * (i % 2), "y": y + 8*(i/2)},
+            "fieldConfig": map[string]interface{}{
+                "defaults":  map[string]interface{}{"unit": unit},
+                "overrides": []interface{}{},
+            },
+            "targets": []interface{}{map[string]interface{}{
+                "refId": "A", "expr": expr, "legendFormat": "{{" + by + "}}",
+            }},
+        })
+    }
+    section := func(title string, schema []StatField, server bool) {
+        row(title)
+        i := 0
+        for _, f := range schema {
+            if !exported(f) || f.Unit == "id" {
+                continue
+            }
+            add(f, server, i)
+            i++
+        }
+        y += 8 * ((i + 1) / 2)
+    }
+    section("proxy", StatsSchema, false)
+    section("servers", HostStatsSchema, true)
+
+    uid := invalidUID.ReplaceAllString("beanseye-"+cluster, "-")
+    if len(uid) > 40 {
+        uid = uid[:40]
+    }
+    return map[string]interface{}{
+        "uid":           uid,
+        "title":         "beanseye " + cluster,
+        "description":   fmt.Sprintf("generated from stats schema version %d", StatsSchemaVersion),
+        "tags":          []string{"beanseye", cluster},
+        "timezone":      "browser",
+        "schemaVersion": 36,
+        "refresh":       "30s",
+        "time":          map[string]string{"from": "now-6h", "to": "now"},
+        "templating": map[string]interface{}{"list": []interface{}{
+            map[string]interface{}{"name": "datasource", "label": "Prometheus",
+                "type": "datasource", "query": "prometheus"},
+            map[string]interface{}{"name": "cluster", "type": "constant", "hide": 2,
+                "query": cluster, "current": map[string]string{"text": cluster, "value": cluster}},
+        }},
+        "panels": panels,
+    }
+}
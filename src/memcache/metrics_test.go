@@ -0,0 +1,75 @@
+package memcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	st := NewStats()
+	st.cmd_get = 3
+	proxy, _ := VersionedStats(st.Stats(), StatsSchemaVersion)
+	hosts, _ := VersionedHostStats(map[string]*HostStats{
+		"a:1": {Requests: 10, P99: 1500 * time.Microsecond, Ejected: true, Name: `a"1`},
+	}, StatsSchemaVersion)
+	var b bytes.Buffer
+	if err := WriteMetrics(&b, proxy, hosts); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE beanseye_cmd_get_total counter",
+		"beanseye_cmd_get_total 3",
+		"# TYPE beanseye_curr_connections gauge",
+		`beanseye_server_requests_total{server="a:1",name="a\"1"} 10`,
+		`beanseye_server_p99{server="a:1",name="a\"1"} 1.5`,
+		`beanseye_server_ejected{server="a:1",name="a\"1"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("%q not in metrics:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "annotation") || strings.Contains(out, "buckets") {
+		t.Errorf("text should not be exported:\n%s", out)
+	}
+}
+
+func TestGrafanaDashboard(t *testing.T) {
+	proxy, _ := VersionedStats(NewStats().Stats(), StatsSchemaVersion)
+	hosts, _ := VersionedHostStats(map[string]*HostStats{"a:1": {}}, StatsSchemaVersion)
+	var b bytes.Buffer
+	WriteMetrics(&b, proxy, hosts)
+	exported := b.String()
+
+	d := GrafanaDashboard("web/prod")
+	if d["uid"] != "beanseye-web-prod" || d["title"] != "beanseye web/prod" {
+		t.Errorf("bad dashboard: %v %v", d["uid"], d["title"])
+	}
+	if _, err := json.Marshal(d); err != nil {
+		t.Fatal(err)
+	}
+	name := regexp.MustCompile(`beanseye_\w+`)
+	panels := 0
+	for _, p := range d["panels"].([]interface{}) {
+		p := p.(map[string]interface{})
+		if p["type"] == "row" {
+			continue
+		}
+		panels++
+		expr := p["targets"].([]interface{})[0].(map[string]interface{})["expr"].(string)
+		m := name.FindString(expr)
+		if m == "" || !strings.Contains(exported, "# TYPE "+m+" ") {
+			t.Errorf("%s of panel %s is not exported", m, p["title"])
+		}
+		if !strings.Contains(expr, `cluster="$cluster"`) {
+			t.Errorf("panel %s is not of the cluster: %s", p["title"], expr)
+		}
+	}
+	if panels == 0 {
+		t.Errorf("no panels")
+	}
+}
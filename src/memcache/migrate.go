@@ -0,0 +1,308 @@
+/*
+ * verify migrated keys by reading them from both the source and destination
+ */
+
+package memcache
+
+import (
+    "bytes"
+    "fmt"
+    "math/rand"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// at most this many mismatches are kept in a report
+var MaxMigrationMismatches = 100
+
+type MigrationMismatch struct {
+    Key    string
+    Reason string // missing, extra, flag, value, version or the error
+}
+
+type MigrationReport struct {
+    Sampled    int
+    Missing    int // in source but not in destination
+    Mismatched int // different in source and destination, including missing ones
+    Errors     int
+    Mismatches []MigrationMismatch
+}
+
+// fraction of the sampled keys which are not the same in destination
+func (r *MigrationReport) MismatchRate() float64 {
+    if r.Sampled == 0 {
+        return 0
+    }
+    return float64(r.Mismatched) / float64(r.Sampled)
+}
+
+func (r *MigrationReport) add(key, reason string) {
+    if len(r.Mismatches) < MaxMigrationMismatches {
+        r.Mismatches = append(r.Mismatches, MigrationMismatch{key, reason})
+    }
+}
+
+// why two copies of a key differ, empty if they are the same
+func diffMigrated(src, dst *Item, versions bool) string {
+    switch {
+    case src == nil && dst == nil:
+        return ""
+    case dst == nil:
+        return "missing"
+    case src == nil:
+        return "extra"
+    case src.Flag != dst.Flag:
+        return "flag"
+    case !sameItem(src, dst):
+        return "value"
+    case versions && src.Cas != dst.Cas:
+        return "version"
+    }
+    return ""
+}
+
+// VerifyMigration read a sample (by rate) of migrated keys from both source
+// and destination, the report tells whether the source could be retired.
+// Versions are compared only if the migration keeps them, like beansdb sync.
+func VerifyMigration(source, dest DistributeStorage, keys []string, rate float64, versions bool) *MigrationReport {
+    r := new(MigrationReport)
+    for _, key := range keys {
+        if rate < 1 && rand.Float64() >= rate {
+            continue
+        }
+        r.Sampled++
+        src, _, err := source.Get(key)
+        if err == nil {
+            var dst *Item
+            dst, _, err = dest.Get(key)
+            if err == nil {
+                if reason := diffMigrated(src, dst, versions); reason != "" {
+                    r.Mismatched++
+                    if reason == "missing" {
+                        r.Missing++
+                    }
+                    r.add(key, reason)
+                }
+                continue
+            }
+        }
+        r.Errors++
+        r.add(key, err.Error())
+    }
+    return r
+}
+
+// config of AutoScheduler in the format of ManualScheduler, every host has
+// all the buckets
+func AutoConfig(addrs []string, bs int) map[string][]string {
+    config := make(map[string][]string, len(addrs))
+    for _, addr := range addrs {
+        buckets := make([]string, bs)
+        for b := range buckets {
+            buckets[b] = strconv.FormatInt(int64(b), 16)
+        }
+        config[addr] = buckets
+    }
+    return config
+}
+
+// addresses of the hosts serving every bucket, backups are not included
+func bucketAddrs(config map[string][]string, bs int) ([][]string, error) {
+    hosts, buckets, _, err := parseManualConfig(config, bs, nil)
+    if err != nil {
+        return nil, err
+    }
+    addrs := make([][]string, bs)
+    for b, ids := range buckets {
+        for _, i := range ids {
+            addrs[b] = append(addrs[b], hosts[i].Addr)
+        }
+        sort.Strings(addrs[b])
+    }
+    return addrs, nil
+}
+
+// BucketMove copy a bucket to a host which does not have it
+type BucketMove struct {
+    Bucket int
+    From   []string // hosts having the bucket in old config
+    To     string
+    Keys   int // estimated by the listing of From, -1 if unknown
+}
+
+// PlanMigration diff two configs in the format of ManualScheduler, a bucket
+// should be copied to the hosts which serve it only in the new config
+func PlanMigration(oldConfig, newConfig map[string][]string, bs int) ([]*BucketMove, error) {
+    olds, err := bucketAddrs(oldConfig, bs)
+    if err != nil {
+        return nil, fmt.Errorf("old config: %s", err)
+    }
+    news, err := bucketAddrs(newConfig, bs)
+    if err != nil {
+        return nil, fmt.Errorf("new config: %s", err)
+    }
+    var moves []*BucketMove
+    for b := 0; b < bs; b++ {
+        if len(olds[b]) == 0 {
+            continue
+        }
+        for _, addr := range news[b] {
+            if !contain(olds[b], addr) {
+                moves = append(moves, &BucketMove{Bucket: b, From: olds[b], To: addr, Keys: -1})
+            }
+        }
+    }
+    return moves, nil
+}
+
+// directory of bucket in the listing of beansdb, like @0a for 256 buckets,
+// only a power of 16 buckets could be listed
+func bucketDir(bucket, bs int) (string, error) {
+    width := calBitWidth(bs)
+    if 1<<uint(width) != bs || width%4 != 0 {
+        return "", fmt.Errorf("%d buckets could not be listed", bs)
+    }
+    if width == 0 {
+        return "@", nil
+    }
+    return fmt.Sprintf("@%0*x", width/4, bucket), nil
+}
+
+// lines of a listing: "sub/ hash count" for directories, "key hash version" for keys
+func listDir(host *Host, dir string) ([][][]byte, error) {
+    r, err := host.Get(dir)
+    if err != nil || r == nil {
+        return nil, err
+    }
+    var lines [][][]byte
+    for _, line := range bytes.Split(r.Body, []byte("\n")) {
+        if fields := bytes.Fields(line); len(fields) >= 3 {
+            lines = append(lines, fields)
+        }
+    }
+    return lines, nil
+}
+
+// number of keys in the bucket, from the listing of its parent directory
+func bucketKeyCount(host *Host, bucket, bs int) (int, error) {
+    dir, err := bucketDir(bucket, bs)
+    if err != nil {
+        return 0, err
+    }
+    if dir == "@" {
+        return 0, fmt.Errorf("%d buckets could not be counted by listing", bs)
+    }
+    parent, name := dir[:len(dir)-1], dir[len(dir)-1:]+"/"
+    lines, err := listDir(host, parent)
+    if err != nil {
+        return 0, err
+    }
+    for _, fields := range lines {
+        if string(fields[0]) == name {
+            return strconv.Atoi(string(fields[2]))
+        }
+    }
+    return 0, nil
+}
+
+// estimate the number of keys of the moves by the first source answering,
+// with a host per address, closed after all
+func EstimateMoves(moves []*BucketMove, bs int) {
+    hosts := make(map[string]*Host)
+    defer func() {
+        for _, h := range hosts {
+            h.Close()
+        }
+    }()
+    for _, m := range moves {
+        for _, addr := range m.From {
+            host, ok := hosts[addr]
+            if !ok {
+                host = NewHost(addr)
+                hosts[addr] = host
+            }
+            if n, err := bucketKeyCount(host, m.Bucket, bs); err == nil {
+                m.Keys = n
+                break
+            }
+        }
+    }
+}
+
+// call fn with the keys in dir and its sub directories, keys ending with /
+// could not be told from directories
+func walkKeys(host *Host, dir string, fn func(key string) error) error {
+    lines, err := listDir(host, dir)
+    if err != nil {
+        return err
+    }
+    for _, fields := range lines {
+        name := string(fields[0])
+        if strings.HasSuffix(name, "/") {
+            if err := walkKeys(host, dir+name[:len(name)-1], fn); err != nil {
+                return err
+            }
+        } else if err := fn(name); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// MigrationBatch is the number of keys copied by a GetMulti
+var MigrationBatch = 100
+
+// a bucket is locked for this long by a move, renewed after every batch
+var MigrationLockTTL = time.Minute
+
+// copy the keys of the bucket from the first source to the destination,
+// return the number of keys copied. The bucket is locked by owner in locker
+// while copying, so two jobs could not move it concurrently.
+func (m *BucketMove) Execute(bs int, locker BucketLocker, owner string) (copied int, err error) {
+    if len(m.From) == 0 {
+        return 0, fmt.Errorf("bucket %X has no source", m.Bucket)
+    }
+    dir, err := bucketDir(m.Bucket, bs)
+    if err != nil {
+        return 0, err
+    }
+    if err = locker.Lock(m.Bucket, owner, MigrationLockTTL); err != nil {
+        return 0, err
+    }
+    defer func() {
+        if e := locker.Unlock(m.Bucket, owner); e != nil && err == nil {
+            err = e
+        }
+    }()
+    src, dst := NewHost(m.From[0]), NewHost(m.To)
+    defer src.Close()
+    defer dst.Close()
+    var keys []string
+    flush := func() error {
+        rs, err := src.GetMulti(keys)
+        if err != nil {
+            return err
+        }
+        for key, item := range rs {
+            if ok, err := dst.Set(key, item, false); !ok {
+                return fmt.Errorf("copy %s to %s failed: %v", key, m.To, err)
+            }
+            copied++
+        }
+        keys = keys[:0]
+        return locker.Lock(m.Bucket, owner, MigrationLockTTL)
+    }
+    err = walkKeys(src, dir, func(key string) error {
+        keys = append(keys, key)
+        if len(keys) >= MigrationBatch {
+            return flush()
+        }
+        return nil
+    })
+    if err == nil && len(keys) > 0 {
+        err = flush()
+    }
+    return
+}
@@ -0,0 +1,158 @@
+package memcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failStorage struct {
+	DistributeStorage
+}
+
+func (s failStorage) Get(key string) (*Item, []string, error) {
+	return nil, nil, errors.New("down")
+}
+
+func TestVerifyMigration(t *testing.T) {
+	src := NewLocalStorage(NewMapStore(), "src")
+	dst := NewLocalStorage(NewMapStore(), "dst")
+	for _, key := range []string{"a", "b", "c", "d"} {
+		src.Set(key, &Item{Body: []byte(key)}, false)
+	}
+	dst.Set("a", &Item{Body: []byte("a")}, false)
+	dst.Set("b", &Item{Body: []byte("x")}, false)
+	dst.Set("c", &Item{Flag: 1, Body: []byte("c")}, false)
+	dst.Set("e", &Item{Body: []byte("e")}, false)
+
+	r := VerifyMigration(src, dst, []string{"a", "b", "c", "d", "e", "f"}, 1, false)
+	if r.Sampled != 6 || r.Mismatched != 4 || r.Missing != 1 || r.Errors != 0 {
+		t.Errorf("bad report: %+v", r)
+	}
+	reasons := map[string]string{"b": "value", "c": "flag", "d": "missing", "e": "extra"}
+	for _, m := range r.Mismatches {
+		if reasons[m.Key] != m.Reason {
+			t.Errorf("%s should be %s: %s", m.Key, reasons[m.Key], m.Reason)
+		}
+	}
+	if rate := r.MismatchRate(); rate < 0.66 || rate > 0.67 {
+		t.Errorf("bad mismatch rate: %f", rate)
+	}
+
+	if r := VerifyMigration(src, dst, []string{"a", "b"}, 0, false); r.Sampled != 0 || r.MismatchRate() != 0 {
+		t.Errorf("no keys should be sampled: %+v", r)
+	}
+	if r := VerifyMigration(failStorage{src}, dst, []string{"a"}, 1, false); r.Errors != 1 || r.Mismatches[0].Reason != "down" {
+		t.Errorf("errors should be reported: %+v", r)
+	}
+	if reason := diffMigrated(&Item{Cas: 1}, &Item{Cas: 2}, true); reason != "version" {
+		t.Errorf("versions should be compared: %s", reason)
+	}
+	if reason := diffMigrated(&Item{Cas: 1}, &Item{Cas: 2}, false); reason != "" {
+		t.Errorf("versions should not be compared: %s", reason)
+	}
+}
+
+func TestPlanMigration(t *testing.T) {
+	old := map[string][]string{"a": {"0", "1"}, "b": {"0", "1"}, "c": {"2"}}
+	new := map[string][]string{"a": {"0", "1"}, "c": {"0", "2"}, "d": {"1", "2", "3"}}
+	moves, err := PlanMigration(old, new, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"0 a,b c", "1 a,b d", "2 c d"}
+	if len(moves) != len(expected) {
+		t.Fatalf("bad moves: %d", len(moves))
+	}
+	for i, m := range moves {
+		if s := fmt.Sprintf("%X %s %s", m.Bucket, strings.Join(m.From, ","), m.To); s != expected[i] {
+			t.Errorf("move %d should be %s: %s", i, expected[i], s)
+		}
+	}
+	if _, err := PlanMigration(old, map[string][]string{"a": {"9"}}, 4); err == nil {
+		t.Error("bucket out of range should fail")
+	}
+	if moves, _ := PlanMigration(AutoConfig([]string{"a"}, 4), AutoConfig([]string{"a", "b"}, 4), 4); len(moves) != 4 {
+		t.Errorf("every bucket should be copied to the new host: %d", len(moves))
+	}
+}
+
+// mapStore with the listing of beansdb for 16 buckets
+type listingStore struct {
+	*mapStore
+}
+
+func (s listingStore) Get(key string) (*Item, error) {
+	if !strings.HasPrefix(key, "@") {
+		return s.mapStore.Get(key)
+	}
+	var counts [16]int
+	var buf bytes.Buffer
+	for k := range s.data {
+		b := getBucketByKey(fnv1a1, 4, k)
+		counts[b]++
+		if len(key) == 2 && fmt.Sprintf("@%x", b) == key {
+			fmt.Fprintf(&buf, "%s 0 1\n", k)
+		}
+	}
+	if key == "@" {
+		for b, n := range counts {
+			fmt.Fprintf(&buf, "%x/ 0 %d\n", b, n)
+		}
+	}
+	return &Item{Body: buf.Bytes()}, nil
+}
+
+func TestExecuteMove(t *testing.T) {
+	srcStore := listingStore{NewMapStore()}
+	dstStore := NewMapStore()
+	var addrs []string
+	var src *Server
+	for _, store := range []Storage{srcStore, dstStore} {
+		s := NewServer(NewLocalStorage(store, ""))
+		if err := s.Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve()
+		addrs = append(addrs, s.l.Addr().String())
+		if src == nil {
+			src = s
+		}
+	}
+	for i := 0; i < 300; i++ {
+		srcStore.Set(fmt.Sprintf("key%d", i), &Item{Body: []byte("v")}, false)
+	}
+
+	bucket := getBucketByKey(fnv1a1, 4, "key0")
+	moves := []*BucketMove{{Bucket: bucket, From: addrs[:1], To: addrs[1], Keys: -1},
+		{Bucket: (bucket + 1) % 16, From: addrs[:1], To: addrs[1], Keys: -1}}
+	EstimateMoves(moves, 16)
+	if moves[0].Keys <= 0 || moves[1].Keys <= 0 {
+		t.Errorf("keys of the buckets should be counted: %d %d", moves[0].Keys, moves[1].Keys)
+	}
+	if n := src.stats.total_connections; n != 1 {
+		t.Errorf("a source should be counted on one connection: %d", n)
+	}
+	locker := NewLocalBucketLocker()
+	locker.Lock(bucket, "other", time.Minute)
+	if copied, err := moves[0].Execute(16, locker, "job"); err == nil || copied != 0 || dstStore.Len() != 0 {
+		t.Errorf("the bucket locked by others should not be copied: %d %v", copied, err)
+	}
+	locker.Unlock(bucket, "other")
+	copied, err := moves[0].Execute(16, locker, "job")
+	if err != nil || copied != moves[0].Keys || dstStore.Len() != copied {
+		t.Errorf("the bucket should be copied: %d %d %v", copied, dstStore.Len(), err)
+	}
+	if r, _ := dstStore.Get("key0"); r == nil {
+		t.Error("key0 should be copied")
+	}
+	if err := locker.Lock(bucket, "other", time.Minute); err != nil {
+		t.Error("the bucket should be unlocked after copied: ", err)
+	}
+	if _, err := moves[0].Execute(8, locker, "job"); err == nil {
+		t.Error("8 buckets could not be listed")
+	}
+}
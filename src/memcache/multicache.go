@@ -0,0 +1,197 @@
+/*
+ * cache the results of large multigets briefly, for the same multigets
+ * issued again and again, like hot dashboards
+ */
+
+package memcache
+
+import (
+    "hash/fnv"
+    "sort"
+    "sync"
+    "time"
+)
+
+// MultiGetCacheClient cache the results of multigets with at least minKeys
+// keys for ttl, by the set of keys. Writes through the proxy invalidate
+// the results with the key, writes through other proxies are seen after ttl.
+type MultiGetCacheClient struct {
+    store      DistributeStorage
+    ttl        time.Duration
+    minKeys    int
+    maxEntries int
+    lock       sync.Mutex
+    entries    map[uint64]*multiGetEntry
+    byKey      map[string]map[uint64]bool // key -> entries with it
+}
+
+type multiGetEntry struct {
+    keys   []string // sorted
+    items  map[string]*Item
+    expire time.Time
+}
+
+var multiGetCacheTargets = []string{"multicache"}
+
+func NewMultiGetCacheClient(store DistributeStorage, ttl time.Duration, minKeys, maxEntries int) *MultiGetCacheClient {
+    return &MultiGetCacheClient{store: store, ttl: ttl, minKeys: minKeys, maxEntries: maxEntries,
+        entries: make(map[uint64]*multiGetEntry), byKey: make(map[string]map[uint64]bool)}
+}
+
+func keySetHash(keys []string) uint64 {
+    h := fnv.New64a()
+    for _, key := range keys {
+        h.Write([]byte(key))
+        h.Write([]byte{0})
+    }
+    return h.Sum64()
+}
+
+func sameKeys(a, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func (c *MultiGetCacheClient) lookup(h uint64, keys []string) map[string]*Item {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    e, ok := c.entries[h]
+    if !ok || !sameKeys(e.keys, keys) {
+        return nil
+    }
+    if time.Now().After(e.expire) {
+        c.remove(h)
+        return nil
+    }
+    rs := make(map[string]*Item, len(e.items))
+    for key, r := range e.items {
+        rs[key] = r
+    }
+    return rs
+}
+
+// items are copied out of cmem, they are freed with the response
+func (c *MultiGetCacheClient) remember(h uint64, keys []string, rs map[string]*Item) {
+    items := make(map[string]*Item, len(rs))
+    for key, r := range rs {
+        items[key] = &Item{Flag: r.Flag, Exptime: r.Exptime, Cas: r.Cas, Body: append([]byte(nil), r.Body...)}
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.remove(h)
+    if len(c.entries) >= c.maxEntries {
+        now := time.Now()
+        for old, e := range c.entries {
+            if now.After(e.expire) || len(c.entries) >= c.maxEntries {
+                c.remove(old)
+            }
+        }
+    }
+    c.entries[h] = &multiGetEntry{keys: keys, items: items, expire: time.Now().Add(c.ttl)}
+    for _, key := range keys {
+        if c.byKey[key] == nil {
+            c.byKey[key] = make(map[uint64]bool)
+        }
+        c.byKey[key][h] = true
+    }
+}
+
+func (c *MultiGetCacheClient) remove(h uint64) {
+    e, ok := c.entries[h]
+    if !ok {
+        return
+    }
+    delete(c.entries, h)
+    for _, key := range e.keys {
+        delete(c.byKey[key], h)
+        if len(c.byKey[key]) == 0 {
+            delete(c.byKey, key)
+        }
+    }
+}
+
+func (c *MultiGetCacheClient) invalidate(key string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    for h := range c.byKey[key] {
+        c.remove(h)
+    }
+}
+
+func (c *MultiGetCacheClient) Get(key string) (*Item, []string, error) {
+    return c.store.Get(key)
+}
+
+func (c *MultiGetCacheClient) GetMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+    if len(keys) < c.minKeys {
+        return c.store.GetMulti(keys)
+    }
+    sorted := append([]string(nil), keys...)
+    sort.Strings(sorted)
+    h := keySetHash(sorted)
+    if rs = c.lookup(h, sorted); rs != nil {
+        return rs, multiGetCacheTargets, nil
+    }
+    rs, targets, err = c.store.GetMulti(keys)
+    if err == nil {
+        c.remember(h, sorted, rs)
+    }
+    return
+}
+
+func (c *MultiGetCacheClient) Set(key string, item *Item, noreply bool) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Set(key, item, noreply)
+    c.invalidate(key)
+    return
+}
+
+func (c *MultiGetCacheClient) Append(key string, value []byte) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Append(key, value)
+    c.invalidate(key)
+    return
+}
+
+func (c *MultiGetCacheClient) Prepend(key string, value []byte) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Prepend(key, value)
+    c.invalidate(key)
+    return
+}
+
+func (c *MultiGetCacheClient) Incr(key string, value int) (result int, targets []string, err error) {
+    result, targets, err = c.store.Incr(key, value)
+    c.invalidate(key)
+    return
+}
+
+func (c *MultiGetCacheClient) Delete(key string) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Delete(key)
+    c.invalidate(key)
+    return
+}
+
+func (c *MultiGetCacheClient) Touch(key string, exptime int) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Touch(key, exptime)
+    c.invalidate(key)
+    return
+}
+
+func (c *MultiGetCacheClient) Gets(key string) (*Item, []string, error) {
+    return c.store.Gets(key)
+}
+
+func (c *MultiGetCacheClient) Cas(key string, item *Item) (status string, targets []string, err error) {
+    status, targets, err = c.store.Cas(key, item)
+    c.invalidate(key)
+    return
+}
+
+func (c *MultiGetCacheClient) Len() int {
+    return c.store.Len()
+}
@@ -0,0 +1,51 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMultiGetCacheClient(t *testing.T) {
+	store := newMapDistStore()
+	c := NewMultiGetCacheClient(store, time.Minute, 2, 2)
+	c.Set("a", &Item{Body: []byte("1")}, false)
+	c.Set("b", &Item{Body: []byte("2")}, false)
+
+	if _, targets, _ := c.GetMulti([]string{"a", "b"}); targets[0] == "multicache" {
+		t.Errorf("the first multiget should miss: %v", targets)
+	}
+	rs, targets, err := c.GetMulti([]string{"b", "a"})
+	if err != nil || targets[0] != "multicache" || string(rs["a"].Body) != "1" || len(rs) != 2 {
+		t.Errorf("the same set of keys should hit: %v %v %v", rs, targets, err)
+	}
+	if _, targets, _ := c.GetMulti([]string{"a"}); targets[0] == "multicache" {
+		t.Errorf("small multigets should not be cached: %v", targets)
+	}
+
+	store.Set("a", &Item{Body: []byte("x")}, false)
+	if rs, _, _ := c.GetMulti([]string{"a", "b"}); string(rs["a"].Body) != "1" {
+		t.Errorf("writes to backends are seen after ttl: %v", rs)
+	}
+	c.Set("a", &Item{Body: []byte("3")}, false)
+	rs, targets, _ = c.GetMulti([]string{"a", "b"})
+	if targets[0] == "multicache" || string(rs["a"].Body) != "3" {
+		t.Errorf("writes should invalidate the results: %v %v", rs, targets)
+	}
+
+	c.GetMulti([]string{"a", "c"})
+	c.GetMulti([]string{"b", "c"})
+	if len(c.entries) > 2 {
+		t.Errorf("entries should be evicted: %d", len(c.entries))
+	}
+	c.Delete("c")
+	for _, e := range c.entries {
+		for _, key := range e.keys {
+			if key == "c" {
+				t.Errorf("all the results with c should be invalidated: %v", e.keys)
+			}
+		}
+	}
+	if _, ok := c.byKey["c"]; ok {
+		t.Errorf("c should not be indexed: %v", c.byKey)
+	}
+}
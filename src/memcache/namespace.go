@@ -0,0 +1,90 @@
+/*
+ * policy of a listener, keys of its clients live in a namespace and writes
+ * without exptime get a default one, for legacy applications
+ */
+
+package memcache
+
+import "strings"
+
+// NamespaceClient prefix the keys of clients by the namespace, and set the
+// exptime of writes to ttl if they never expire
+type NamespaceClient struct {
+    store     DistributeStorage
+    namespace string
+    ttl       int
+}
+
+func NewNamespaceClient(store DistributeStorage, namespace string, ttl int) *NamespaceClient {
+    return &NamespaceClient{store: store, namespace: namespace, ttl: ttl}
+}
+
+func (c *NamespaceClient) key(key string) string {
+    return c.namespace + key
+}
+
+// the item shared with other hosts is not changed
+func (c *NamespaceClient) item(item *Item) *Item {
+    if c.ttl == 0 || item.Exptime != 0 {
+        return item
+    }
+    it := *item
+    it.Exptime = c.ttl
+    return &it
+}
+
+func (c *NamespaceClient) Get(key string) (*Item, []string, error) {
+    return c.store.Get(c.key(key))
+}
+
+func (c *NamespaceClient) GetMulti(keys []string) (map[string]*Item, []string, error) {
+    if c.namespace == "" {
+        return c.store.GetMulti(keys)
+    }
+    ks := make([]string, len(keys))
+    for i, key := range keys {
+        ks[i] = c.key(key)
+    }
+    r, targets, err := c.store.GetMulti(ks)
+    rs := make(map[string]*Item, len(r))
+    for key, item := range r {
+        rs[strings.TrimPrefix(key, c.namespace)] = item
+    }
+    return rs, targets, err
+}
+
+func (c *NamespaceClient) Set(key string, item *Item, noreply bool) (bool, []string, error) {
+    return c.store.Set(c.key(key), c.item(item), noreply)
+}
+
+func (c *NamespaceClient) Append(key string, value []byte) (bool, []string, error) {
+    return c.store.Append(c.key(key), value)
+}
+
+func (c *NamespaceClient) Prepend(key string, value []byte) (bool, []string, error) {
+    return c.store.Prepend(c.key(key), value)
+}
+
+func (c *NamespaceClient) Incr(key string, value int) (int, []string, error) {
+    return c.store.Incr(c.key(key), value)
+}
+
+func (c *NamespaceClient) Delete(key string) (bool, []string, error) {
+    return c.store.Delete(c.key(key))
+}
+
+func (c *NamespaceClient) Touch(key string, exptime int) (bool, []string, error) {
+    return c.store.Touch(c.key(key), exptime)
+}
+
+func (c *NamespaceClient) Gets(key string) (*Item, []string, error) {
+    return c.store.Gets(c.key(key))
+}
+
+func (c *NamespaceClient) Cas(key string, item *Item) (string, []string, error) {
+    return c.store.Cas(c.key(key), c.item(item))
+}
+
+func (c *NamespaceClient) Len() int {
+    return c.store.Len()
+}
@@ -0,0 +1,36 @@
+package memcache
+
+import "testing"
+
+func TestNamespaceClient(t *testing.T) {
+	store := NewMapStore()
+	c := NewNamespaceClient(NewLocalStorage(store, "main"), "app1:", 300)
+
+	item := &Item{Body: []byte("v")}
+	c.Set("k", item, false)
+	if item.Exptime != 0 {
+		t.Errorf("item of client should not be changed: %d", item.Exptime)
+	}
+	r, _ := store.Get("app1:k")
+	if r == nil || r.Exptime != 300 {
+		t.Fatalf("key should be in the namespace with the default ttl: %v", r)
+	}
+	c.Set("k2", &Item{Exptime: 60, Body: []byte("v2")}, false)
+	if r, _ := store.Get("app1:k2"); r == nil || r.Exptime != 60 {
+		t.Errorf("exptime of client should be kept: %v", r)
+	}
+
+	if r, _, _ := c.Get("k"); r == nil || string(r.Body) != "v" {
+		t.Errorf("key should be read from the namespace: %v", r)
+	}
+	rs, _, _ := c.GetMulti([]string{"k", "k2", "k3"})
+	if len(rs) != 2 || rs["k"] == nil || rs["k2"] == nil {
+		t.Errorf("keys of multiget should be out of the namespace: %v", rs)
+	}
+	if ok, _, _ := c.Delete("k"); !ok {
+		t.Errorf("key should be deleted from the namespace")
+	}
+	if r, _ := store.Get("app1:k"); r != nil {
+		t.Errorf("key should be deleted: %v", r)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * backends behind Host, so schedulers and clients could be tested against
+ * scripted nodes rather than live servers
+ *
+ * Schedulers still route keys to *Host, a Node is plugged in under a Host by
+ * NewNodeHost, requests to it go through Host.execute like the ones sent over
+ * TCP, so the QPS limit, injected faults, counters and ejection of the host
+ * apply to it, and everything above routing (failover, feedback, stats) runs
+ * as in production. Mocks of Node could be generated by go generate into
+ * memcache/mock, with gomock and mockgen installed.
+ */
+
+package memcache
+
+import (
+    "errors"
+    "strconv"
+)
+
+//go:generate mockgen -destination=mock/node.go -package=mock memcache Node
+
+// Node is a backend serving keys, Host talks to one over TCP by default
+type Node interface {
+    Storage
+    Add(key string, item *Item) (bool, error)
+    Touch(key string, exptime int) (bool, error)
+    Gets(key string) (*Item, error) // the cas unique is carried by the item
+    GetsMulti(keys []string) (map[string]*Item, error)
+    Cas(key string, item *Item) (string, error) // STORED, EXISTS or NOT_FOUND
+    FlushAll(delay int) error
+    Stat(keys []string) (map[string]string, error)
+}
+
+var _ Node = (*Host)(nil)
+
+// a Host served by node rather than TCP, routed as any other host
+func NewNodeHost(addr string, node Node) *Host {
+    host := NewHost(addr)
+    host.node = node
+    host.batcher = nil
+    return host
+}
+
+func storedStatus(ok bool) string {
+    if ok {
+        return "STORED"
+    }
+    return "NOT_STORED"
+}
+
+// serve req by the node of host, into a response like the one read from TCP
+func (host *Host) executeNode(req *Request) (resp *Response, err error) {
+    node := host.node
+    resp = &Response{items: make(map[string]*Item, len(req.Keys))}
+    var key string
+    if len(req.Keys) > 0 {
+        key = req.Keys[0]
+    }
+    switch req.Cmd {
+    case "get", "gets":
+        var items map[string]*Item
+        var item *Item
+        switch {
+        case req.Cmd == "gets" && len(req.Keys) > 1:
+            items, err = node.GetsMulti(req.Keys)
+        case req.Cmd == "gets":
+            item, err = node.Gets(key)
+        case len(req.Keys) > 1:
+            items, err = node.GetMulti(req.Keys)
+        default:
+            item, err = node.Get(key)
+        }
+        if item != nil {
+            items = map[string]*Item{key: item}
+        }
+        if items != nil {
+            resp.items = items
+        }
+        resp.status = "END"
+    case "set", "add":
+        var ok bool
+        if req.Cmd == "set" {
+            ok, err = node.Set(key, req.Item, req.NoReply)
+        } else {
+            ok, err = node.Add(key, req.Item)
+        }
+        resp.status = storedStatus(ok)
+    case "append", "prepend":
+        var ok bool
+        if req.Cmd == "append" {
+            ok, err = node.Append(key, req.Item.Body)
+        } else {
+            ok, err = node.Prepend(key, req.Item.Body)
+        }
+        resp.status = storedStatus(ok)
+    case "incr", "decr":
+        v, e := strconv.Atoi(string(req.Item.Body))
+        if e != nil {
+            return nil, e
+        }
+        if req.Cmd == "decr" {
+            v = -v
+        }
+        var n int
+        n, err = node.Incr(key, v)
+        switch err {
+        case nil:
+            resp.status, resp.msg = "INCR", strconv.Itoa(n)
+        case ErrNotFound:
+            resp.status, err = "NOT_FOUND", nil
+        case ErrNonNumeric:
+            resp.status, err = "CLIENT_ERROR", nil
+        }
+    case "delete":
+        var ok bool
+        if ok, err = node.Delete(key); ok {
+            resp.status = "DELETED"
+        } else {
+            resp.status = "NOT_FOUND"
+        }
+    case "touch":
+        var ok bool
+        if ok, err = node.Touch(key, req.Item.Exptime); ok {
+            resp.status = "TOUCHED"
+        } else {
+            resp.status = "NOT_FOUND"
+        }
+    case "cas":
+        resp.status, err = node.Cas(key, req.Item)
+    case "flush_all":
+        delay := 0
+        if key != "" {
+            if delay, err = strconv.Atoi(key); err != nil {
+                return nil, err
+            }
+        }
+        err = node.FlushAll(delay)
+        resp.status = "OK"
+    case "stats":
+        var st map[string]string
+        st, err = node.Stat(req.Keys)
+        for k, v := range st {
+            resp.items[k] = &Item{Body: []byte(v)}
+        }
+    default:
+        return nil, errors.New("unsupported command of node: " + req.Cmd)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return resp, nil
+}
@@ -0,0 +1,178 @@
+package memcache
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a Node with items in memory, failing every request if err is set
+type mockNode struct {
+	*mapStore
+	err   error
+	calls int
+}
+
+func newMockNode() *mockNode {
+	return &mockNode{mapStore: NewMapStore()}
+}
+
+func (n *mockNode) Get(key string) (*Item, error) {
+	n.calls++
+	if n.err != nil {
+		return nil, n.err
+	}
+	return n.mapStore.Get(key)
+}
+
+func (n *mockNode) GetMulti(keys []string) (map[string]*Item, error) {
+	n.calls++
+	if n.err != nil {
+		return nil, n.err
+	}
+	return n.mapStore.GetMulti(keys)
+}
+
+// the items of mapStore carry their cas uniques
+func (n *mockNode) Gets(key string) (*Item, error) {
+	return n.Get(key)
+}
+
+func (n *mockNode) GetsMulti(keys []string) (map[string]*Item, error) {
+	return n.GetMulti(keys)
+}
+
+func (n *mockNode) FlushAll(delay int) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.mapStore.lock.Lock()
+	n.mapStore.data = make(map[string]*Item)
+	n.mapStore.lock.Unlock()
+	return nil
+}
+
+func (n *mockNode) Cas(key string, item *Item) (string, error) {
+	n.calls++
+	if n.err != nil {
+		return "", n.err
+	}
+	return n.mapStore.Cas(key, item)
+}
+
+func (n *mockNode) Set(key string, item *Item, noreply bool) (bool, error) {
+	n.calls++
+	if n.err != nil {
+		return false, n.err
+	}
+	return n.mapStore.Set(key, item, noreply)
+}
+
+func (n *mockNode) Add(key string, item *Item) (bool, error) {
+	if it, _ := n.Get(key); it != nil || n.err != nil {
+		return false, n.err
+	}
+	return n.Set(key, item, false)
+}
+
+func (n *mockNode) Stat(keys []string) (map[string]string, error) {
+	return map[string]string{}, n.err
+}
+
+func TestNodeHost(t *testing.T) {
+	down, up := newMockNode(), newMockNode()
+	schd := &staticScheduler{hosts: []*Host{NewNodeHost("down", down), NewNodeHost("up", up)}}
+	client := NewClient(schd, 2, 1, 1)
+
+	down.err = errors.New("connection refused")
+	if ok, targets, _ := client.Set("key", &Item{Body: []byte("v")}, false); !ok || len(targets) != 1 || targets[0] != "up" {
+		t.Errorf("set should succeed on up only: %v %v", ok, targets)
+	}
+	item, targets, err := client.Get("key")
+	if err != nil || item == nil || string(item.Body) != "v" || targets[0] != "up" {
+		t.Errorf("get should fail over to up: %v %v %v", item, targets, err)
+	}
+	if down.calls != 2 {
+		t.Errorf("down should be tried for every request: %d", down.calls)
+	}
+}
+
+func TestNodeHostExecute(t *testing.T) {
+	defer ClearFaults()
+	n := newMockNode()
+	host := NewNodeHost("node-exec", n)
+	host.Set("k", &Item{Body: []byte("v")}, false)
+	stored, _ := n.mapStore.Get("k")
+	if r, err := host.Gets("k"); err != nil || r == nil || r.Cas != stored.Cas {
+		t.Errorf("gets should carry the cas unique of the node: %v %v", r, err)
+	}
+	if status, _ := host.Cas("k", &Item{Body: []byte("v2"), Cas: stored.Cas}); status != "STORED" {
+		t.Errorf("cas should be stored: %s", status)
+	}
+	if ok, _ := host.Touch("k", 10); !ok {
+		t.Errorf("touch should succeed")
+	}
+	if n, err := host.Incr("nokey", 1); err != ErrNotFound {
+		t.Errorf("incr of missing key should be not found: %d %v", n, err)
+	}
+	if err := host.FlushAll(0); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := host.Get("k"); r != nil {
+		t.Errorf("keys should be flushed: %v", r)
+	}
+
+	// faults are injected before the node
+	calls := n.calls
+	InjectErrors("node-exec", 100)
+	if _, err := host.Get("k"); err == nil || n.calls != calls {
+		t.Errorf("injected faults should fail requests before the node: %v %d", err, n.calls-calls)
+	}
+	ClearFaults()
+	failed := atomic.LoadInt64(&host.counter.errors)
+	n.err = errors.New("connection refused")
+	if _, err := host.Get("k"); err == nil || atomic.LoadInt64(&host.counter.errors) != failed+1 {
+		t.Errorf("failures of node hosts should be counted: %v", err)
+	}
+}
+
+// a mockNode answering gets after delay
+type slowNode struct {
+	*mockNode
+	delay time.Duration
+}
+
+func (n *slowNode) Get(key string) (*Item, error) {
+	time.Sleep(n.delay)
+	return n.mockNode.Get(key)
+}
+
+func TestGraySampling(t *testing.T) {
+	saved := SlowCmdTime
+	SlowCmdTime = 10 * time.Millisecond
+	defer func() { SlowCmdTime = saved }()
+
+	fast, slow := newMockNode(), &slowNode{newMockNode(), 100 * time.Millisecond}
+	fast.Set("key", &Item{Body: []byte("a")}, false)
+	slow.mockNode.Set("key", &Item{Body: []byte("b")}, false)
+	schd := &staticScheduler{hosts: []*Host{NewNodeHost("fast", fast), NewNodeHost("slow", slow)}}
+	client := NewClient(schd, 2, 1, 1)
+	client.GraySampleRate = 1
+
+	mismatches, slows := atomic.LoadInt64(&grayMismatches), atomic.LoadInt64(&graySlow)
+	if r, _, _ := client.Get("key"); r == nil || string(r.Body) != "a" {
+		t.Fatalf("get should be answered by the first replica: %v", r)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&graySlow) == slows && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := (&Stats{}).Stats()
+	if st["gray_mismatches"] != mismatches+1 {
+		t.Errorf("replicas with different bodies should be counted in gray_mismatches: %d", st["gray_mismatches"]-mismatches)
+	}
+	if st["gray_slow"] != slows+1 {
+		t.Errorf("a much slower replica should be counted in gray_slow: %d", st["gray_slow"]-slows)
+	}
+}
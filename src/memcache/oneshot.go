@@ -0,0 +1,64 @@
+/*
+ * fast path for clients opening a connection for every command,
+ * a common pattern of legacy (php) clients
+ */
+
+package memcache
+
+import (
+    "net"
+    "sync"
+)
+
+// a client is one-shot after this many consecutive connections with
+// only one command, its connections get small buffers, 0 to disable
+var OneShotThreshold = 0
+
+// buffers of one-shot connections, enough for the command line,
+// values larger than it are read through
+const oneShotBufSize = 512
+
+// remember at most this many clients
+const maxOneShotClients = 10000
+
+type oneShotTracker struct {
+    lock    sync.Mutex
+    clients map[string]int // ip -> consecutive single-command connections
+}
+
+func newOneShotTracker() *oneShotTracker {
+    return &oneShotTracker{clients: make(map[string]int)}
+}
+
+func clientIP(addr net.Addr) string {
+    if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+        return host
+    }
+    return addr.String()
+}
+
+func (t *oneShotTracker) isOneShot(ip string) bool {
+    if OneShotThreshold <= 0 {
+        return false
+    }
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    return t.clients[ip] >= OneShotThreshold
+}
+
+// a connection from ip was closed after cmds commands
+func (t *oneShotTracker) done(ip string, cmds int) {
+    if OneShotThreshold <= 0 {
+        return
+    }
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    if cmds != 1 {
+        delete(t.clients, ip)
+        return
+    }
+    if _, ok := t.clients[ip]; !ok && len(t.clients) >= maxOneShotClients {
+        t.clients = make(map[string]int)
+    }
+    t.clients[ip]++
+}
@@ -0,0 +1,79 @@
+package memcache
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOneShotTracker(t *testing.T) {
+	tr := newOneShotTracker()
+	tr.done("10.0.0.1", 1)
+	if tr.isOneShot("10.0.0.1") {
+		t.Fatal("one-shot is disabled by default")
+	}
+	OneShotThreshold = 3
+	defer func() { OneShotThreshold = 0 }()
+	for i := 0; i < OneShotThreshold; i++ {
+		if tr.isOneShot("10.0.0.1") {
+			t.Fatalf("one-shot after %d connections", i)
+		}
+		tr.done("10.0.0.1", 1)
+	}
+	if !tr.isOneShot("10.0.0.1") {
+		t.Errorf("should be one-shot after %d connections", OneShotThreshold)
+	}
+	tr.done("10.0.0.1", 2)
+	if tr.isOneShot("10.0.0.1") {
+		t.Errorf("should not be one-shot after a connection with more commands")
+	}
+}
+
+func TestOneShotConnection(t *testing.T) {
+	OneShotThreshold = 3
+	defer func() { OneShotThreshold = 0 }()
+	s := NewServer(newMapDistStore())
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	command := func(conn net.Conn, rbuf *bufio.Reader, cmd string) string {
+		conn.Write([]byte(cmd))
+		line, err := rbuf.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	for i := 0; i <= OneShotThreshold; i++ {
+		conn, err := net.Dial("tcp", s.l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rbuf := bufio.NewReader(conn)
+		if r := command(conn, rbuf, "set k 0 0 1\r\nv\r\n"); r != "STORED\r\n" {
+			t.Errorf("bad reply: %q", r)
+		}
+		if i == OneShotThreshold {
+			// the connection is not cut after the first reply
+			if r := command(conn, rbuf, "get k\r\n"); r != "VALUE k 0 1\r\n" {
+				t.Errorf("bad reply: %q", r)
+			}
+			rbuf.ReadString('\n') // value
+			rbuf.ReadString('\n') // END
+			time.Sleep(100 * time.Millisecond)
+			if r := command(conn, rbuf, "delete k\r\n"); r != "DELETED\r\n" {
+				t.Errorf("bad reply: %q", r)
+			}
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if n := s.stats.stat["oneshot_connections"]; n != 1 {
+		t.Errorf("one-shot connections: %d", n)
+	}
+}
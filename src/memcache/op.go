@@ -0,0 +1,49 @@
+/*
+ * route keys by the operation on them, so schedulers could return all the
+ * replicas for writes but only the best ones for reads
+ */
+
+package memcache
+
+type Operation int
+
+const (
+    OpRead Operation = iota
+    OpWrite
+    OpDelete
+)
+
+func (op Operation) String() string {
+    switch op {
+    case OpRead:
+        return "read"
+    case OpWrite:
+        return "write"
+    case OpDelete:
+        return "delete"
+    }
+    return "unknown"
+}
+
+// OperationScheduler route a key to hosts by the operation on it,
+// GetHostsByKey should return the hosts to write
+type OperationScheduler interface {
+    Scheduler
+    GetHostsByOp(key string, op Operation) []*Host
+}
+
+// hosts for the operation on key, schedulers unaware of operations read
+// from the first n hosts (or the read hosts), and write to all of them
+// draining hosts are skipped for writes
+func hostsByOp(sch Scheduler, key string, op Operation, n int) []*Host {
+    if os, ok := sch.(OperationScheduler); ok {
+        if op == OpRead {
+            return os.GetHostsByOp(key, op)
+        }
+        return skipDraining(os.GetHostsByOp(key, op))
+    }
+    if op == OpRead {
+        return readHostsByKey(sch, key, n)
+    }
+    return skipDraining(sch.GetHostsByKey(key))
+}
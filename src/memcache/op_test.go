@@ -0,0 +1,49 @@
+package memcache
+
+import "testing"
+
+// reads from the first host only, deletes from all the hosts
+type opScheduler struct {
+	staticScheduler
+	ops []Operation
+}
+
+func (c *opScheduler) GetHostsByOp(key string, op Operation) []*Host {
+	c.ops = append(c.ops, op)
+	switch op {
+	case OpRead:
+		return c.hosts[:1]
+	case OpWrite:
+		return c.hosts[:2]
+	}
+	return c.hosts
+}
+
+func TestOperationScheduler(t *testing.T) {
+	nodes := []*mockNode{newMockNode(), newMockNode(), newMockNode()}
+	schd := &opScheduler{}
+	for i, n := range nodes {
+		schd.hosts = append(schd.hosts, NewNodeHost(string(rune('a'+i)), n))
+	}
+	client := NewClient(NewPrefixScheduler(map[string]Scheduler{}, schd, 3), 3, 1, 1)
+
+	if ok, targets, _ := client.Set("key", &Item{Body: []byte("v")}, false); !ok || len(targets) != 2 {
+		t.Errorf("writes should go to 2 hosts: %v", targets)
+	}
+	nodes[2].Set("key", &Item{Body: []byte("stale")}, false)
+	if _, targets, _ := client.Get("key"); len(targets) != 1 || targets[0] != "a" {
+		t.Errorf("reads should go to the first host: %v", targets)
+	}
+	if _, targets, _ := client.Delete("key"); len(targets) != 3 {
+		t.Errorf("deletes should go to all the hosts: %v", targets)
+	}
+	want := []Operation{OpWrite, OpRead, OpDelete}
+	if len(schd.ops) != len(want) {
+		t.Fatalf("bad operations: %v", schd.ops)
+	}
+	for i, op := range want {
+		if schd.ops[i] != op {
+			t.Errorf("operation %d should be %s: %s", i, op, schd.ops[i])
+		}
+	}
+}
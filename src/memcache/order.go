@@ -0,0 +1,44 @@
+/*
+ * keep the configured order of hosts in buckets of ManualScheduler,
+ * so reads go to the primary written first, rather than the best scored one
+ */
+
+package memcache
+
+import "sort"
+
+// keep hosts of buckets in the order of addrs, hosts not in addrs go last
+// by address, feedback no longer reorders them
+func (c *ManualScheduler) SetFixedOrder(addrs []string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.order = addrs
+    c.fixed = true
+    c.sortByOrder()
+}
+
+func (c *ManualScheduler) sortByOrder() {
+    rank := make(map[string]int, len(c.order))
+    for i, addr := range c.order {
+        rank[addr] = i
+    }
+    less := func(a, b *Host) bool {
+        ra, oka := rank[a.Addr]
+        rb, okb := rank[b.Addr]
+        switch {
+        case oka && okb:
+            return ra < rb
+        case oka != okb:
+            return oka
+        }
+        return a.Addr < b.Addr
+    }
+    for b, bucket := range c.buckets {
+        // a new slice, readers may hold the old one
+        sorted := append([]int(nil), bucket...)
+        sort.SliceStable(sorted, func(i, j int) bool {
+            return less(c.hosts[sorted[i]], c.hosts[sorted[j]])
+        })
+        c.buckets[b] = sorted
+    }
+}
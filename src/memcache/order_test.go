@@ -0,0 +1,30 @@
+package memcache
+
+import "testing"
+
+func TestManualSchedulerFixedOrder(t *testing.T) {
+	schd := newTestManualScheduler(map[string][]string{
+		"a": {"0"}, "b": {"0"}, "c": {"0"}, "d": {"-0"},
+	}, 1, 3)
+	schd.SetFixedOrder([]string{"c", "a", "b"})
+	check := func(when string) {
+		hosts := schd.GetHostsByKey("key")
+		addrs := []string{hosts[0].Addr, hosts[1].Addr, hosts[2].Addr}
+		if addrs[0] != "c" || addrs[1] != "a" || addrs[2] != "b" {
+			t.Errorf("hosts should be in the order of config %s: %v", when, addrs)
+		}
+	}
+	check("")
+
+	c := schd.GetHostsByKey("key")[0]
+	schd.feedback(c.offset, 0, -10)
+	check("after feedback")
+	if schd.stats[0][c.offset] != -10 {
+		t.Errorf("scores should be kept: %v", schd.stats[0])
+	}
+
+	st := schd.ExportState()
+	st.Buckets[0] = []string{"b", "a", "c"}
+	schd.ImportState(st)
+	check("after import")
+}
@@ -0,0 +1,225 @@
+/*
+ * pin keys onto explicit hosts, before the scheduler, to isolate a few
+ * pathological hot keys onto dedicated hosts
+ */
+
+package memcache
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// PinScheduler route pinned keys to their hosts, a pin ending with * is a
+// prefix, the exact key wins, then the longest prefix. Other keys go to the
+// scheduler.
+type PinScheduler struct {
+    Scheduler
+    n        int
+    lock     sync.RWMutex
+    pins     map[string][]*Host
+    prefixes []string // without *, longest first
+}
+
+func NewPinScheduler(sch Scheduler, n int) *PinScheduler {
+    return &PinScheduler{Scheduler: sch, n: n, pins: make(map[string][]*Host)}
+}
+
+// pin the key (or prefix*) onto hosts, replace the old pin if any. The
+// hosts of the scheduler and of other pins are shared, with their
+// connections.
+func (c *PinScheduler) Pin(pattern string, addrs []string) error {
+    if pattern == "" || pattern == "*" {
+        return errors.New("empty pin")
+    }
+    if len(addrs) == 0 {
+        return errors.New("no hosts to pin " + pattern)
+    }
+    for _, addr := range addrs {
+        if addr == "" {
+            return errors.New("empty host to pin " + pattern)
+        }
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    shared := c.sharedHosts()
+    hosts := make([]*Host, len(addrs))
+    for i, addr := range addrs {
+        if hosts[i] = shared[addr]; hosts[i] == nil {
+            hosts[i] = NewHost(addr)
+            shared[addr] = hosts[i]
+        }
+    }
+    old := c.pins[pattern]
+    c.pins[pattern] = hosts
+    c.sortPrefixes()
+    c.closeUnused(old)
+    RecordEvent("pin", "", fmt.Sprintf("%s onto %v", pattern, addrs))
+    return nil
+}
+
+// remove the pin, return false if it was not pinned
+func (c *PinScheduler) Unpin(pattern string) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    old, ok := c.pins[pattern]
+    if !ok {
+        return false
+    }
+    delete(c.pins, pattern)
+    c.sortPrefixes()
+    c.closeUnused(old)
+    RecordEvent("unpin", "", pattern)
+    return true
+}
+
+// address -> host of the scheduler or of a pin, with c.lock held
+func (c *PinScheduler) sharedHosts() map[string]*Host {
+    r := make(map[string]*Host)
+    for _, hosts := range c.pins {
+        for _, h := range hosts {
+            r[h.Addr] = h
+        }
+    }
+    for _, h := range SchedulerHosts(c.Scheduler) {
+        r[h.Addr] = h
+    }
+    return r
+}
+
+// close the hosts of a replaced pin, unless they are still used by the
+// scheduler or another pin, with c.lock held
+func (c *PinScheduler) closeUnused(hosts []*Host) {
+    if len(hosts) == 0 {
+        return
+    }
+    used := c.sharedHosts()
+    for _, h := range hosts {
+        if used[h.Addr] != h {
+            h.Close()
+        }
+    }
+}
+
+// pin -> addresses of hosts
+func (c *PinScheduler) Pins() map[string][]string {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    r := make(map[string][]string, len(c.pins))
+    for pattern, hosts := range c.pins {
+        addrs := make([]string, len(hosts))
+        for i, h := range hosts {
+            addrs[i] = h.Addr
+        }
+        r[pattern] = addrs
+    }
+    return r
+}
+
+func (c *PinScheduler) sortPrefixes() {
+    c.prefixes = c.prefixes[:0]
+    for pattern := range c.pins {
+        if strings.HasSuffix(pattern, "*") {
+            c.prefixes = append(c.prefixes, pattern[:len(pattern)-1])
+        }
+    }
+    sort.Slice(c.prefixes, func(i, j int) bool {
+        if len(c.prefixes[i]) != len(c.prefixes[j]) {
+            return len(c.prefixes[i]) > len(c.prefixes[j])
+        }
+        return c.prefixes[i] < c.prefixes[j]
+    })
+}
+
+// the pin of key, empty if not pinned
+func (c *PinScheduler) pinOf(key string) (string, []*Host) {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    if hosts, ok := c.pins[key]; ok {
+        return key, hosts
+    }
+    for _, p := range c.prefixes {
+        if strings.HasPrefix(key, p) {
+            return p + "*", c.pins[p+"*"]
+        }
+    }
+    return "", nil
+}
+
+// hosts of the scheduler, then the pinned ones
+func (c *PinScheduler) Hosts() []*Host {
+    r := SchedulerHosts(c.Scheduler)
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    patterns := make([]string, 0, len(c.pins))
+    for pattern := range c.pins {
+        patterns = append(patterns, pattern)
+    }
+    sort.Strings(patterns)
+    for _, pattern := range patterns {
+        r = appendHosts(r, c.pins[pattern])
+    }
+    return r
+}
+
+func (c *PinScheduler) GetHostsByKey(key string) []*Host {
+    if _, hosts := c.pinOf(key); hosts != nil {
+        return skipUnavailable(append([]*Host(nil), hosts...))
+    }
+    return c.Scheduler.GetHostsByKey(key)
+}
+
+func (c *PinScheduler) GetReadHostsByKey(key string) []*Host {
+    if _, hosts := c.pinOf(key); hosts != nil {
+        return skipUnavailable(append([]*Host(nil), hosts...))
+    }
+    return readHostsByKey(c.Scheduler, key, c.n)
+}
+
+func (c *PinScheduler) GetHostsByOp(key string, op Operation) []*Host {
+    if _, hosts := c.pinOf(key); hosts != nil {
+        return skipUnavailable(append([]*Host(nil), hosts...))
+    }
+    return hostsByOp(c.Scheduler, key, op, c.n)
+}
+
+// pinned hosts are not scored
+func (c *PinScheduler) Feedback(host *Host, key string, ev FeedbackEvent) {
+    if _, hosts := c.pinOf(key); hosts == nil {
+        c.Scheduler.Feedback(host, key, ev)
+    }
+}
+
+// keys of a pin never share a group with others
+func (c *PinScheduler) DivideKeysByBucket(keys []string) [][]string {
+    byPin := make(map[string][]string)
+    var order []string
+    others := make([]string, 0, len(keys))
+    for _, key := range keys {
+        pin, hosts := c.pinOf(key)
+        if hosts == nil {
+            others = append(others, key)
+            continue
+        }
+        if _, ok := byPin[pin]; !ok {
+            order = append(order, pin)
+        }
+        byPin[pin] = append(byPin[pin], key)
+    }
+    if len(order) == 0 {
+        return c.Scheduler.DivideKeysByBucket(keys)
+    }
+    var rs [][]string
+    for _, g := range c.Scheduler.DivideKeysByBucket(others) {
+        if len(g) > 0 {
+            rs = append(rs, g)
+        }
+    }
+    for _, pin := range order {
+        rs = append(rs, byPin[pin])
+    }
+    return rs
+}
@@ -0,0 +1,76 @@
+package memcache
+
+import "testing"
+
+func TestPinScheduler(t *testing.T) {
+	def := newTestManualScheduler(map[string][]string{"d1": {"0"}, "d2": {"0"}}, 1, 2)
+	schd := NewPinScheduler(def, 2)
+	if err := schd.Pin("hot", []string{""}); err == nil {
+		t.Errorf("pin without hosts should fail")
+	}
+	schd.Pin("hot", []string{"h1", "h2"})
+	schd.Pin("user:*", []string{"u1"})
+	schd.Pin("user:vip:*", []string{"v1"})
+
+	for key, addr := range map[string]string{
+		"hot": "h1", "hot2": "d", "user:1": "u1", "user:vip:1": "v1", "other": "d",
+	} {
+		if a := schd.GetHostsByKey(key)[0].Addr; a[:len(addr)] != addr {
+			t.Errorf("%s should go to %s: %s", key, addr, a)
+		}
+	}
+	if hosts := schd.GetReadHostsByKey("hot"); len(hosts) != 2 {
+		t.Errorf("all the pinned hosts should be read: %v", hosts)
+	}
+
+	groups := schd.DivideKeysByBucket([]string{"a", "hot", "user:1", "b", "user:2"})
+	if len(groups) != 3 {
+		t.Errorf("pinned keys should be divided by pin: %v", groups)
+	}
+
+	if !schd.Unpin("user:*") || schd.Unpin("user:*") {
+		t.Errorf("unpin should remove the pin once")
+	}
+	if a := schd.GetHostsByKey("user:1")[0].Addr; a[0] != 'd' {
+		t.Errorf("unpinned key should go to the scheduler: %s", a)
+	}
+	if len(schd.Pins()) != 2 {
+		t.Errorf("bad pins: %v", schd.Pins())
+	}
+}
+
+func TestPinHosts(t *testing.T) {
+	def := newTestManualScheduler(map[string][]string{"d1": {"0"}, "d2": {"0"}}, 1, 2)
+	schd := NewPinScheduler(def, 2)
+	schd.Pin("hot", []string{"d1", "h1"})
+	schd.Pin("user:*", []string{"h1"})
+
+	d1 := def.hosts[0]
+	if d1.Addr != "d1" {
+		d1 = def.hosts[1]
+	}
+	hosts := schd.GetHostsByKey("hot")
+	if hosts[0] != d1 {
+		t.Errorf("the host of the scheduler should be pinned: %v", hosts[0])
+	}
+	if u := schd.GetHostsByKey("user:1"); u[0] != hosts[1] {
+		t.Errorf("a host should be shared by the pins")
+	}
+	var addrs []string
+	for _, h := range schd.Hosts() {
+		addrs = append(addrs, h.Addr)
+	}
+	if len(addrs) != 3 || addrs[2] != "h1" {
+		t.Errorf("pinned hosts should be listed after the scheduler's: %v", addrs)
+	}
+
+	h1 := hosts[1]
+	schd.Pin("hot", []string{"h2"})
+	if d1.isClosed() || h1.isClosed() {
+		t.Errorf("hosts still used should not be closed by a new pin")
+	}
+	schd.Unpin("user:*")
+	if !h1.isClosed() {
+		t.Errorf("hosts of a removed pin should be closed")
+	}
+}
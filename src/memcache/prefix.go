@@ -0,0 +1,101 @@
+/*
+ * route keys to pools of hosts by the prefix of key
+ */
+
+package memcache
+
+import (
+    "sort"
+    "strings"
+)
+
+// PrefixScheduler route keys with the configured prefixes (like img:) to
+// their pools, the longest matching prefix wins, others go to the default
+// scheduler. Every pool route its keys by its own scheduler.
+type PrefixScheduler struct {
+    prefixes []string // longest first
+    pools    map[string]Scheduler
+    def      Scheduler
+    n        int
+}
+
+func NewPrefixScheduler(pools map[string]Scheduler, def Scheduler, n int) *PrefixScheduler {
+    c := &PrefixScheduler{pools: pools, def: def, n: n}
+    for p := range pools {
+        c.prefixes = append(c.prefixes, p)
+    }
+    sort.Slice(c.prefixes, func(i, j int) bool {
+        if len(c.prefixes[i]) != len(c.prefixes[j]) {
+            return len(c.prefixes[i]) > len(c.prefixes[j])
+        }
+        return c.prefixes[i] < c.prefixes[j]
+    })
+    return c
+}
+
+func (c *PrefixScheduler) pool(key string) Scheduler {
+    for _, p := range c.prefixes {
+        if strings.HasPrefix(key, p) {
+            return c.pools[p]
+        }
+    }
+    return c.def
+}
+
+func (c *PrefixScheduler) Hosts() []*Host {
+    hosts := SchedulerHosts(c.def)
+    for _, p := range c.prefixes {
+        hosts = appendHosts(hosts, SchedulerHosts(c.pools[p]))
+    }
+    return hosts
+}
+
+func (c *PrefixScheduler) GetHostsByKey(key string) []*Host {
+    return c.pool(key).GetHostsByKey(key)
+}
+
+func (c *PrefixScheduler) GetReadHostsByKey(key string) []*Host {
+    return readHostsByKey(c.pool(key), key, c.n)
+}
+
+func (c *PrefixScheduler) GetHostsByOp(key string, op Operation) []*Host {
+    return hostsByOp(c.pool(key), key, op, c.n)
+}
+
+func (c *PrefixScheduler) Feedback(host *Host, key string, ev FeedbackEvent) {
+    c.pool(key).Feedback(host, key, ev)
+}
+
+// keys of different pools never share a group
+func (c *PrefixScheduler) DivideKeysByBucket(keys []string) [][]string {
+    byPool := make(map[Scheduler][]string)
+    var order []Scheduler
+    for _, key := range keys {
+        p := c.pool(key)
+        if _, ok := byPool[p]; !ok {
+            order = append(order, p)
+        }
+        byPool[p] = append(byPool[p], key)
+    }
+    var rs [][]string
+    for _, p := range order {
+        for _, g := range p.DivideKeysByBucket(byPool[p]) {
+            if len(g) > 0 {
+                rs = append(rs, g)
+            }
+        }
+    }
+    return rs
+}
+
+func (c *PrefixScheduler) Stats() map[string][]float64 {
+    r := c.def.Stats()
+    for _, p := range c.prefixes {
+        for addr, st := range c.pools[p].Stats() {
+            if _, ok := r[addr]; !ok {
+                r[addr] = st
+            }
+        }
+    }
+    return r
+}
@@ -0,0 +1,27 @@
+package memcache
+
+import "testing"
+
+func TestPrefixScheduler(t *testing.T) {
+	def := newTestManualScheduler(map[string][]string{"d1": {"0"}}, 1, 1)
+	img := newTestManualScheduler(map[string][]string{"i1": {"0"}}, 1, 1)
+	thumb := newTestManualScheduler(map[string][]string{"t1": {"0"}}, 1, 1)
+	schd := NewPrefixScheduler(map[string]Scheduler{"img:": img, "img:thumb:": thumb}, def, 1)
+
+	for key, addr := range map[string]string{"img:1": "i1", "img:thumb:1": "t1", "user:1": "d1", "im": "d1"} {
+		if hosts := schd.GetHostsByKey(key); len(hosts) != 1 || hosts[0].Addr != addr {
+			t.Errorf("%s should be routed to %s: %v", key, addr, hosts)
+		}
+		if hosts := schd.GetReadHostsByKey(key); len(hosts) != 1 || hosts[0].Addr != addr {
+			t.Errorf("%s should be read from %s: %v", key, addr, hosts)
+		}
+	}
+
+	gs := schd.DivideKeysByBucket([]string{"img:1", "user:1", "img:2", "img:thumb:1"})
+	if len(gs) != 3 || len(gs[0]) != 2 || gs[1][0] != "user:1" || gs[2][0] != "img:thumb:1" {
+		t.Errorf("keys should be divided by pool: %v", gs)
+	}
+	if st := schd.Stats(); len(st) != 3 {
+		t.Errorf("stats should include all the pools: %v", st)
+	}
+}
@@ -10,6 +10,7 @@ import (
     "runtime"
     "strconv"
     "strings"
+    "time"
     "unsafe"
 )
 
@@ -40,6 +41,8 @@ type Request struct {
     Keys    []string // keys
     Item    *Item
     NoReply bool
+    Meta    []string // flags of meta commands
+    admin   bool     // from a client allowed to flush_all, see FlushAdmins
 }
 
 func (req *Request) String() (s string) {
@@ -106,6 +109,20 @@ func (req *Request) Write(w io.Writer) (e error) {
         }
         _, e = io.WriteString(w, "\r\n")
 
+    case "touch":
+        fmt.Fprintf(w, "touch %s %d", req.Keys[0], req.Item.Exptime)
+        if req.NoReply {
+            io.WriteString(w, " noreply")
+        }
+        _, e = io.WriteString(w, "\r\n")
+
+    case "gat", "gats":
+        fmt.Fprintf(w, "%s %d", req.Cmd, req.Item.Exptime)
+        for _, key := range req.Keys {
+            io.WriteString(w, " "+key)
+        }
+        _, e = io.WriteString(w, "\r\n")
+
     default:
         ErrorLog.Printf("unkown request cmd:", req.Cmd)
         return errors.New("unknown cmd: " + req.Cmd)
@@ -211,14 +228,83 @@ func (req *Request) Read(b *bufio.Reader) (e error) {
         req.Item = &Item{Body: []byte(parts[2])}
         req.NoReply = len(parts) > 3 && parts[3] == "noreply"
 
+    case "touch":
+        if len(parts) < 3 || len(parts) > 4 {
+            return errors.New("invalid cmd")
+        }
+        req.Keys = parts[1:2]
+        req.Item = &Item{}
+        if req.Item.Exptime, e = strconv.Atoi(parts[2]); e != nil {
+            return e
+        }
+        req.NoReply = len(parts) > 3 && parts[3] == "noreply"
+
+    case "gat", "gats":
+        // gat <exptime> <key>*
+        if len(parts) < 3 {
+            return errors.New("invalid cmd")
+        }
+        req.Keys = parts[2:]
+        req.Item = &Item{}
+        if req.Item.Exptime, e = strconv.Atoi(parts[1]); e != nil {
+            return e
+        }
+
+    case "getif":
+        // getif <key> <version>, version is what the last VALUE carried
+        if len(parts) != 3 {
+            return errors.New("invalid cmd")
+        }
+        req.Keys = parts[1:2]
+        req.Item = &Item{}
+        req.Item.Cas, e = strconv.Atoi(parts[2])
+        if e != nil {
+            return e
+        }
+
+    case "mg", "md", "ma", "mn":
+        return req.readMeta(parts)
+
+    case "ms":
+        if e = req.readMeta(parts); e != nil {
+            return e
+        }
+        length, e := strconv.Atoi(parts[2])
+        if e != nil || length < 0 {
+            return errors.New("invalid cmd")
+        }
+        if length > MaxBodyLength {
+            return errors.New("body too large")
+        }
+        req.Item = &Item{Body: make([]byte, length)}
+        if _, e = io.ReadFull(b, req.Item.Body); e != nil {
+            return e
+        }
+        b.ReadByte() // \r
+        b.ReadByte() // \n
+
     case "stats":
         req.Keys = parts[1:]
 
-    case "quit", "version", "flush_all":
+    case "flush_all":
+        // flush_all [delay] [noreply]
+        if len(parts) > 3 {
+            return errors.New("invalid cmd")
+        }
+        req.NoReply = parts[len(parts)-1] == "noreply"
+        if len(parts) > 1 && parts[1] != "noreply" {
+            req.Keys = parts[1:2]
+        }
+
+    case "quit", "version":
     case "verbosity":
         if len(parts) >= 2 {
             req.Keys = parts[1:]
         }
+    case "deadline":
+        req.Keys = parts[1:]
+    case "compression":
+        req.Keys = parts[1:]
 
     default:
         ErrorLog.Print("unknown command", req.Cmd)
@@ -319,7 +405,7 @@ func (resp *Response) Read(b *bufio.Reader) error {
             continue
 
         case "END":
-        case "STORED", "NOT_STORED", "DELETED", "NOT_FOUND":
+        case "STORED", "NOT_STORED", "EXISTS", "DELETED", "NOT_FOUND", "NOT_MODIFIED", "TOUCHED":
         case "OK":
 
         case "ERROR", "SERVER_ERROR", "CLIENT_ERROR":
@@ -371,6 +457,19 @@ func (resp *Response) Write(w io.Writer) error {
         io.WriteString(w, resp.msg)
         io.WriteString(w, "END\r\n")
 
+    case "VA":
+        for _, item := range resp.items {
+            if resp.msg != "" {
+                fmt.Fprintf(w, "VA %d %s\r\n", len(item.Body), resp.msg)
+            } else {
+                fmt.Fprintf(w, "VA %d\r\n", len(item.Body))
+            }
+            if e := WriteFull(w, item.Body); e != nil {
+                return e
+            }
+            io.WriteString(w, "\r\n")
+        }
+
     case "INCR", "DECR":
         fmt.Fprintf(w, resp.msg)
         fmt.Fprintf(w, "\r\n")
@@ -401,6 +500,11 @@ func writeLine(w io.Writer, s string) {
     io.WriteString(w, "\r\n")
 }
 
+// stores reading the cas uniques of many keys at once
+type getsMultier interface {
+    GetsMulti(keys []string) (map[string]*Item, []string, error)
+}
+
 func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Response, targets []string, err error) {
     resp = new(Response)
     resp.noreply = req.NoReply
@@ -419,7 +523,36 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
 
         resp.status = "VALUE"
         resp.cas = req.Cmd == "gets"
-        if len(req.Keys) > 1 {
+        if resp.cas {
+            // from the owners of keys, who issued the cas uniques, batched
+            // by owners if the store could, otherwise one by one
+            if gm, ok := store.(getsMultier); ok && len(req.Keys) > 1 {
+                resp.items, targets, err = gm.GetsMulti(req.Keys)
+            } else {
+                resp.items = make(map[string]*Item, len(req.Keys))
+                for _, key := range req.Keys {
+                    item, t, e := store.Gets(key)
+                    targets = append(targets, t...)
+                    if e != nil {
+                        err = e
+                    } else if item != nil {
+                        resp.items[key] = item
+                    }
+                }
+            }
+            // keys of failed replicas are missed, unless none is got
+            if err != nil && len(resp.items) == 0 {
+                resp.status = "SERVER_ERROR"
+                resp.msg = err.Error()
+                return
+            }
+            stat.cmd_get += int64(len(req.Keys))
+            stat.get_hits += int64(len(resp.items))
+            stat.get_misses += int64(len(req.Keys) - len(resp.items))
+            for _, item := range resp.items {
+                stat.bytes_written += int64(len(item.Body))
+            }
+        } else if len(req.Keys) > 1 {
             resp.items, targets, err = store.GetMulti(req.Keys)
             if err != nil {
                 resp.status = "SERVER_ERROR"
@@ -454,8 +587,58 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
             }
         }
 
-    case "set", "add", "replace", "cas":
+    case "getif":
+        key := req.Keys[0]
+        if len(key) > MaxKeyLength {
+            resp.status = "CLIENT_ERROR"
+            resp.msg = "key too long"
+            return
+        }
+        stat.cmd_get++
+        var item *Item
+        item, targets, err = store.Get(key)
+        if err != nil {
+            resp.status = "SERVER_ERROR"
+            resp.msg = err.Error()
+            return
+        }
+        if item == nil {
+            stat.get_misses++
+            resp.status = "VALUE"
+            break
+        }
+        stat.get_hits++
+        item.Cas = itemVersion(item)
+        if item.Cas == req.Item.Cas {
+            stat.get_not_modified++
+            resp.status = "NOT_MODIFIED"
+            break
+        }
+        resp.status = "VALUE"
+        resp.cas = true
+        resp.items = map[string]*Item{key: item}
+        stat.bytes_written += int64(len(item.Body))
+
+    case "cas":
         key := req.Keys[0]
+        req.Item.Exptime = checkClockSkew(key, req.Item.Exptime, time.Now())
+        var status string
+        status, targets, err = store.Cas(key, req.Item)
+        if err != nil {
+            resp.status = "SERVER_ERROR"
+            resp.msg = err.Error()
+            break
+        }
+        stat.cmd_set++
+        stat.bytes_read += int64(len(req.Item.Body))
+        resp.status = status
+        if status == "STORED" {
+            stampWrite(key, targets)
+        }
+
+    case "set", "add", "replace":
+        key := req.Keys[0]
+        req.Item.Exptime = checkClockSkew(key, req.Item.Exptime, time.Now())
         var suc bool
         suc, targets, err = store.Set(key, req.Item, req.NoReply)
         if err != nil {
@@ -468,14 +651,19 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
         stat.bytes_read += int64(len(req.Item.Body))
         if suc {
             resp.status = "STORED"
+            stampWrite(key, targets)
         } else {
             resp.status = "NOT_STORED"
         }
 
-    case "append":
+    case "append", "prepend":
         key := req.Keys[0]
         var suc bool
-        suc, targets, err = store.Append(key, req.Item.Body)
+        if req.Cmd == "append" {
+            suc, targets, err = store.Append(key, req.Item.Body)
+        } else {
+            suc, targets, err = store.Prepend(key, req.Item.Body)
+        }
         if err != nil {
             resp.status = "SERVER_ERROR"
             resp.msg = err.Error()
@@ -486,34 +674,42 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
         stat.bytes_read += int64(len(req.Item.Body))
         if suc {
             resp.status = "STORED"
+            stampWrite(key, targets)
         } else {
             resp.status = "NOT_STORED"
         }
 
-    case "incr":
+    case "incr", "decr":
         stat.cmd_set++
         stat.bytes_read += int64(len(req.Item.Body))
         resp.noreply = req.NoReply
         key := req.Keys[0]
-        add, err := strconv.Atoi(string(req.Item.Body))
-        if err != nil {
+        delta, e := strconv.Atoi(string(req.Item.Body))
+        if e != nil || delta < 0 {
             resp.status = "CLIENT_ERROR"
-            resp.msg = "invalid number"
+            resp.msg = "invalid numeric delta argument"
             break
         }
-        var result int
-        result, targets, err = store.Incr(key, add)
-        if err != nil {
-            resp.status = "SERVER_ERROR"
-            resp.msg = err.Error()
-            break
+        if req.Cmd == "decr" {
+            delta = -delta
         }
-
-        if result > 0 {
+        var result int
+        result, targets, err = store.Incr(key, delta)
+        switch err {
+        case nil:
             resp.status = "INCR"
             resp.msg = strconv.Itoa(result)
-        } else {
+            stampWrite(key, targets)
+        case ErrNotFound:
             resp.status = "NOT_FOUND"
+            err = nil
+        case ErrNonNumeric:
+            resp.status = "CLIENT_ERROR"
+            resp.msg = err.Error()
+            err = nil
+        default:
+            resp.status = "SERVER_ERROR"
+            resp.msg = err.Error()
         }
 
     case "delete":
@@ -525,6 +721,7 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
             resp.msg = err.Error()
             break
         }
+        forgetWrite(key)
         if suc {
             resp.status = "DELETED"
         } else {
@@ -532,37 +729,124 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
         }
         stat.cmd_delete++
 
+    case "touch":
+        key := req.Keys[0]
+        req.Item.Exptime = checkClockSkew(key, req.Item.Exptime, time.Now())
+        var suc bool
+        suc, targets, err = store.Touch(key, req.Item.Exptime)
+        if err != nil {
+            resp.status = "SERVER_ERROR"
+            resp.msg = err.Error()
+            break
+        }
+        if suc {
+            resp.status = "TOUCHED"
+        } else {
+            resp.status = "NOT_FOUND"
+        }
+        stat.cmd_touch++
+
+    case "gat", "gats":
+        // touched on all the replicas, then read like get
+        for _, k := range req.Keys {
+            if len(k) > MaxKeyLength {
+                resp.status = "CLIENT_ERROR"
+                resp.msg = "key too long"
+                return
+            }
+        }
+        resp.status = "VALUE"
+        resp.cas = req.Cmd == "gats"
+        now := time.Now()
+        var touched []string
+        for _, key := range req.Keys {
+            suc, t, e := store.Touch(key, checkClockSkew(key, req.Item.Exptime, now))
+            if e != nil {
+                resp.status = "SERVER_ERROR"
+                resp.msg = e.Error()
+                return resp, targets, e
+            }
+            targets = append(targets, t...)
+            stat.cmd_touch++
+            if suc {
+                touched = append(touched, key)
+            }
+        }
+        stat.cmd_get += int64(len(req.Keys))
+        if len(touched) > 0 {
+            var t []string
+            resp.items, t, err = store.GetMulti(touched)
+            targets = append(targets, t...)
+            if err != nil {
+                resp.status = "SERVER_ERROR"
+                resp.msg = err.Error()
+                return
+            }
+        }
+        stat.get_hits += int64(len(resp.items))
+        stat.get_misses += int64(len(req.Keys) - len(resp.items))
+        for _, item := range resp.items {
+            stat.bytes_written += int64(len(item.Body))
+        }
+
     case "stats":
+        resp.status = "STAT"
+        if len(req.Keys) == 1 && req.Keys[0] == "features" {
+            resp.msg = featureStats()
+            break
+        }
+        if len(req.Keys) == 1 && req.Keys[0] == "conns" {
+            resp.msg = connStats()
+            break
+        }
+        if len(req.Keys) == 1 && (req.Keys[0] == "items" || req.Keys[0] == "slabs") {
+            resp.msg = statLines(backendSubStats(store, req.Keys[0]))
+            break
+        }
         st := stat.Stats()
         n := int64(store.Len())
         st["curr_items"] = n
         st["total_items"] = n
-        resp.status = "STAT"
-        var ss []string
-        if len(req.Keys) > 0 {
-            ss = make([]string, len(req.Keys))
-            for i, k := range req.Keys {
-                v, _ := st[k]
-                ss[i] = fmt.Sprintf("STAT %s %d\r\n", k, v)
-            }
-            resp.msg = strings.Join(ss, "")
-        } else {
-            ss = make([]string, len(st))
-            cnt := 0
-            for k, v := range st {
-                ss[cnt] = fmt.Sprintf("STAT %s %d\r\n", k, v)
-                cnt += 1
-            }
+        if len(req.Keys) == 0 {
+            resp.msg = statLines(generalStats(st, store))
+            break
+        }
+        ss := make([]string, len(req.Keys))
+        for i, k := range req.Keys {
+            v, _ := st[k]
+            ss[i] = fmt.Sprintf("STAT %s %d\r\n", k, v)
         }
         resp.msg = strings.Join(ss, "")
 
+    case "mg", "ms", "md", "ma", "mn":
+        return req.processMeta(store, stat)
+
     case "version":
         resp.status = "VERSION"
-        resp.msg = VERSION
+        resp.msg = VersionString()
+
+    case "flush_all":
+        resp.status, resp.msg, targets = flushAll(req, store)
 
-    case "verbosity", "flush_all":
+    case "verbosity":
         resp.status = "OK"
 
+    case "deadline":
+        if _, e := parseDeadline(req.Keys); e != nil {
+            resp.status = "CLIENT_ERROR"
+            resp.msg = e.Error()
+        } else {
+            resp.status = "OK"
+        }
+
+    case "compression":
+        if _, e := parseCompression(req.Keys); e != nil {
+            resp.status = "CLIENT_ERROR"
+            resp.msg = e.Error()
+        } else {
+            resp.status = "OK"
+        }
+
     case "quit":
         resp = nil
         return
@@ -577,6 +861,11 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
     return
 }
 
+// version of a value for conditional get
+func itemVersion(item *Item) int {
+    return int(fnv1a(item.Body))
+}
+
 func contain(vs []string, v string) bool {
     for _, i := range vs {
         if i == v {
@@ -588,7 +877,7 @@ func contain(vs []string, v string) bool {
 
 func (req *Request) Check(resp *Response) error {
     switch req.Cmd {
-    case "get", "gets":
+    case "get", "gets", "gat", "gats":
         if resp.items != nil {
             for key, _ := range resp.items {
                 if !contain(req.Keys, key) {
@@ -599,15 +888,21 @@ func (req *Request) Check(resp *Response) error {
         }
 
     case "incr", "decr":
-        if !contain([]string{"INCR", "DECR", "NOT_FOUND"}, resp.status) {
+        // CLIENT_ERROR of a non-numeric value
+        if !contain([]string{"INCR", "DECR", "NOT_FOUND", "CLIENT_ERROR"}, resp.status) {
             return errors.New("unexpected status: " + resp.status)
         }
 
-    case "set", "add", "replace", "append", "prepend":
+    case "set", "add", "replace", "cas", "append", "prepend":
         if !contain([]string{"STORED", "NOT_STORED", "EXISTS", "NOT_FOUND"},
             resp.status) {
             return errors.New("unexpected status: " + resp.status)
         }
+
+    case "touch":
+        if !contain([]string{"TOUCHED", "NOT_FOUND"}, resp.status) {
+            return errors.New("unexpected status: " + resp.status)
+        }
     }
     return nil
 }
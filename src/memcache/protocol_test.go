@@ -3,6 +3,7 @@ package memcache
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
@@ -115,7 +116,7 @@ var reqTests = []reqTest{
 	},
 	reqTest{
 		"flush_all\r\n",
-		"OK\r\n",
+		"CLIENT_ERROR flush_all is disabled\r\n",
 	},
 	reqTest{
 		"verbosity 1\r\n",
@@ -123,7 +124,7 @@ var reqTests = []reqTest{
 	},
 	reqTest{
 		"version\r\n",
-		"VERSION " + VERSION + "\r\n",
+		"VERSION " + VersionString() + "\r\n",
 	},
 
 	reqTest{
@@ -164,3 +165,351 @@ func TestRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestConditionalGet(t *testing.T) {
+	store := newMapDistStore()
+	stats := NewStats()
+	store.Set("cg", &Item{Body: []byte("large value")}, false)
+	version := itemVersion(&Item{Body: []byte("large value")})
+
+	cases := []reqTest{
+		reqTest{"getif cg 1\r\n", fmt.Sprintf("VALUE cg 0 11 %d\r\nlarge value\r\nEND\r\n", version)},
+		reqTest{fmt.Sprintf("getif cg %d\r\n", version), "NOT_MODIFIED\r\n"},
+		reqTest{"getif nokey 1\r\n", "END\r\n"},
+		reqTest{"getif cg\r\n", "CLIENT_ERROR invalid cmd\r\n"},
+	}
+	for i, test := range cases {
+		req := new(Request)
+		var resp *Response
+		if e := req.Read(bufio.NewReader(bytes.NewBufferString(test.cmd))); e != nil {
+			resp = &Response{status: "CLIENT_ERROR", msg: e.Error()}
+		} else {
+			resp, _, _ = req.Process(store, stats)
+		}
+		wr := new(bytes.Buffer)
+		resp.Write(wr)
+		if wr.String() != test.anwser {
+			t.Errorf("test %d: expect %q, but got %q", i, test.anwser, wr.String())
+		}
+	}
+}
+
+func TestTouch(t *testing.T) {
+	store := newMapDistStore()
+	stats := NewStats()
+	store.Set("k", &Item{Body: []byte("v")}, false)
+
+	cases := []reqTest{
+		reqTest{"touch k 100\r\n", "TOUCHED\r\n"},
+		reqTest{"touch nokey 100\r\n", "NOT_FOUND\r\n"},
+		reqTest{"touch k 100 noreply\r\n", ""},
+		reqTest{"touch k\r\n", "CLIENT_ERROR invalid cmd\r\n"},
+	}
+	for i, test := range cases {
+		req := new(Request)
+		var resp *Response
+		if e := req.Read(bufio.NewReader(bytes.NewBufferString(test.cmd))); e != nil {
+			resp = &Response{status: "CLIENT_ERROR", msg: e.Error()}
+		} else {
+			resp, _, _ = req.Process(store, stats)
+		}
+		wr := new(bytes.Buffer)
+		resp.Write(wr)
+		if wr.String() != test.anwser {
+			t.Errorf("test %d: expect %q, but got %q", i, test.anwser, wr.String())
+		}
+	}
+	if r, _, _ := store.Get("k"); r.Exptime != 100 {
+		t.Errorf("exptime should be touched: %d", r.Exptime)
+	}
+
+	wr := new(bytes.Buffer)
+	(&Request{Cmd: "touch", Keys: []string{"k"}, Item: &Item{Exptime: 30}}).Write(wr)
+	if wr.String() != "touch k 30\r\n" {
+		t.Errorf("touch should be sent as %q", wr.String())
+	}
+
+	a, b := newMockNode(), newMockNode()
+	b.Set("k", &Item{Body: []byte("v")}, false)
+	client := NewClient(&staticScheduler{hosts: []*Host{NewNodeHost("touch-a", a), NewNodeHost("touch-b", b)}}, 2, 1, 1)
+	if ok, targets, err := client.Touch("k", 10); !ok || len(targets) != 1 || targets[0] != "touch-b" || err != nil {
+		t.Errorf("touch should succeed on the replica with the key: %v %v %v", ok, targets, err)
+	}
+	if ok, _, _ := client.Touch("nokey", 10); ok {
+		t.Errorf("touch of missing key should fail")
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	store := newMapDistStore()
+	stats := NewStats()
+	store.Set("n", &Item{Body: []byte("5")}, false)
+	store.Set("s", &Item{Body: []byte("abc")}, false)
+
+	cases := []reqTest{
+		reqTest{"incr n 3\r\n", "8\r\n"},
+		reqTest{"decr n 2\r\n", "6\r\n"},
+		reqTest{"decr n 10\r\n", "0\r\n"},
+		reqTest{"incr n 1\r\n", "1\r\n"},
+		reqTest{"decr nokey 1\r\n", "NOT_FOUND\r\n"},
+		reqTest{"incr s 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		reqTest{"incr n -1\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n"},
+		reqTest{"decr n x\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n"},
+		reqTest{"decr n 1 noreply\r\n", ""},
+	}
+	for i, test := range cases {
+		req := new(Request)
+		req.Read(bufio.NewReader(bytes.NewBufferString(test.cmd)))
+		resp, _, _ := req.Process(store, stats)
+		wr := new(bytes.Buffer)
+		resp.Write(wr)
+		if wr.String() != test.anwser {
+			t.Errorf("test %d: expect %q, but got %q", i, test.anwser, wr.String())
+		}
+	}
+
+	// decremented to 0 on the replicas is not a miss
+	a, b := newMockNode(), newMockNode()
+	a.Set("n", &Item{Body: []byte("1")}, false)
+	b.Set("n", &Item{Body: []byte("1")}, false)
+	client := NewClient(&staticScheduler{hosts: []*Host{NewNodeHost("decr-a", a), NewNodeHost("decr-b", b)}}, 2, 2, 1)
+	if n, targets, err := client.Incr("n", -3); n != 0 || len(targets) != 2 || err != nil {
+		t.Errorf("decr should succeed on both replicas: %d %v %v", n, targets, err)
+	}
+	if _, _, err := client.Incr("nokey", 1); err != ErrNotFound {
+		t.Errorf("incr of missing key should be not found: %v", err)
+	}
+
+	wr := new(bytes.Buffer)
+	(&Request{Cmd: "decr", Keys: []string{"n"}, Item: &Item{Body: []byte("3")}}).Write(wr)
+	if wr.String() != "decr n 3\r\n" {
+		t.Errorf("decr should be sent as %q", wr.String())
+	}
+}
+
+func TestCas(t *testing.T) {
+	store := newMapDistStore()
+	stats := NewStats()
+	store.Set("k", &Item{Body: []byte("v")}, false)
+	item, _, _ := store.Get("k")
+
+	cases := []reqTest{
+		reqTest{fmt.Sprintf("cas k 0 0 2 %d\r\nv2\r\n", item.Cas), "STORED\r\n"},
+		reqTest{fmt.Sprintf("cas k 0 0 2 %d\r\nv3\r\n", item.Cas), "EXISTS\r\n"},
+		reqTest{"cas nokey 0 0 2 1\r\nv3\r\n", "NOT_FOUND\r\n"},
+		reqTest{"get k\r\n", "VALUE k 0 2\r\nv2\r\nEND\r\n"},
+	}
+	for i, test := range cases {
+		req := new(Request)
+		req.Read(bufio.NewReader(bytes.NewBufferString(test.cmd)))
+		resp, _, _ := req.Process(store, stats)
+		wr := new(bytes.Buffer)
+		resp.Write(wr)
+		if wr.String() != test.anwser {
+			t.Errorf("test %d: expect %q, but got %q", i, test.anwser, wr.String())
+		}
+	}
+
+	// the cas unique of the owner goes back to it, the replica gets the value
+	a, b := newMockNode(), newMockNode()
+	a.Set("k", &Item{Body: []byte("v")}, false)
+	b.Set("k", &Item{Body: []byte("v")}, false)
+	client := NewClient(&staticScheduler{hosts: []*Host{NewNodeHost("cas-a", a), NewNodeHost("cas-b", b)}}, 2, 1, 1)
+	item, targets, err := client.Gets("k")
+	if err != nil || item == nil || len(targets) != 1 || targets[0] != "cas-a" {
+		t.Fatalf("gets should read from the owner: %v %v %v", item, targets, err)
+	}
+	req := new(Request)
+	req.Read(bufio.NewReader(bytes.NewBufferString("gets k\r\n")))
+	resp, _, _ := req.Process(client, stats)
+	wr := new(bytes.Buffer)
+	resp.Write(wr)
+	if want := fmt.Sprintf("VALUE k 0 1 %d\r\nv\r\nEND\r\n", item.Cas); wr.String() != want {
+		t.Errorf("gets should return the cas unique of the owner: %q", wr.String())
+	}
+	status, targets, err := client.Cas("k", &Item{Body: []byte("v2"), Cas: item.Cas})
+	if status != "STORED" || len(targets) != 2 || err != nil {
+		t.Errorf("cas should be stored on the owner and the replica: %v %v %v", status, targets, err)
+	}
+	if r, _ := b.mapStore.Get("k"); string(r.Body) != "v2" {
+		t.Errorf("replica should be set: %q", r.Body)
+	}
+	if status, targets, _ := client.Cas("k", &Item{Body: []byte("v3"), Cas: item.Cas}); status != "EXISTS" || len(targets) != 1 {
+		t.Errorf("stale cas should not be stored: %v %v", status, targets)
+	}
+
+	wr.Reset()
+	(&Request{Cmd: "cas", Keys: []string{"k"}, Item: &Item{Body: []byte("v"), Cas: 7}}).Write(wr)
+	if wr.String() != "cas k 0 0 7 1\r\nv\r\n" {
+		t.Errorf("cas should be sent as %q", wr.String())
+	}
+	var r Response
+	if err := r.Read(bufio.NewReader(bytes.NewBufferString("EXISTS\r\n"))); err != nil || r.status != "EXISTS" {
+		t.Errorf("EXISTS should be read: %v %v", r.status, err)
+	}
+}
+
+func TestGetsFailover(t *testing.T) {
+	a, b, c := newMockNode(), newMockNode(), newMockNode()
+	for _, n := range []*mockNode{a, b} {
+		n.Set("x:1", &Item{Body: []byte("x1")}, false)
+		n.Set("x:2", &Item{Body: []byte("x2")}, false)
+	}
+	c.Set("y:1", &Item{Body: []byte("y1")}, false)
+	c.Set("y:2", &Item{Body: []byte("y2")}, false)
+	x := &staticScheduler{hosts: []*Host{NewNodeHost("gets-a", a), NewNodeHost("gets-b", b)}}
+	y := &staticScheduler{hosts: []*Host{NewNodeHost("gets-c", c)}}
+	client := NewClient(NewPrefixScheduler(map[string]Scheduler{"x:": x}, y, 2), 2, 1, 1)
+	stats := NewStats()
+
+	// the owner down, the replica issues the cas unique and takes the cas
+	a.err = errors.New("connection refused")
+	item, targets, err := client.Gets("x:1")
+	if err != nil || item == nil || len(targets) != 1 || targets[0] != "gets-b" {
+		t.Fatalf("gets should fail over to the replica: %v %v %v", item, targets, err)
+	}
+	status, targets, err := client.Cas("x:1", &Item{Body: []byte("x1'"), Cas: item.Cas})
+	if status != "STORED" || len(targets) != 1 || targets[0] != "gets-b" || err != nil {
+		t.Errorf("cas should fail over to the replica: %v %v %v", status, targets, err)
+	}
+
+	// batched by owners, the keys of the failed owner from the replica
+	c.calls = 0
+	req := new(Request)
+	req.Read(bufio.NewReader(bytes.NewBufferString("gets x:1 x:2 y:1 y:2\r\n")))
+	resp, _, err := req.Process(client, stats)
+	if err != nil || resp.status != "VALUE" || len(resp.items) != 4 || string(resp.items["x:1"].Body) != "x1'" {
+		t.Errorf("gets should not fail with an owner down: %v %v %v", resp.status, resp.items, err)
+	}
+	if c.calls != 1 {
+		t.Errorf("keys of an owner should be read at once: %d", c.calls)
+	}
+
+	// some keys with no replica answering
+	b.err = a.err
+	resp, _, err = req.Process(client, stats)
+	if err == nil || resp.status != "VALUE" || len(resp.items) != 2 || resp.items["y:1"] == nil {
+		t.Errorf("keys of other owners should be returned: %v %v %v", resp.status, resp.items, err)
+	}
+	c.err = a.err
+	if resp, _, _ = req.Process(client, stats); resp.status != "SERVER_ERROR" {
+		t.Errorf("gets should fail with all the replicas down: %v", resp.status)
+	}
+}
+
+func TestGat(t *testing.T) {
+	store := newMapDistStore()
+	stats := NewStats()
+	store.Set("k", &Item{Flag: 2, Body: []byte("v")}, false)
+	store.Set("k2", &Item{Body: []byte("v2")}, false)
+
+	cases := []reqTest{
+		reqTest{"gat 100 k\r\n", "VALUE k 2 1\r\nv\r\nEND\r\n"},
+		reqTest{"gat 100 nokey\r\n", "END\r\n"},
+		reqTest{"gat 200 nokey k2\r\n", "VALUE k2 0 2\r\nv2\r\nEND\r\n"},
+		reqTest{"gat k\r\n", "CLIENT_ERROR invalid cmd\r\n"},
+	}
+	for i, test := range cases {
+		req := new(Request)
+		var resp *Response
+		if e := req.Read(bufio.NewReader(bytes.NewBufferString(test.cmd))); e != nil {
+			resp = &Response{status: "CLIENT_ERROR", msg: e.Error()}
+		} else {
+			resp, _, _ = req.Process(store, stats)
+		}
+		wr := new(bytes.Buffer)
+		resp.Write(wr)
+		if wr.String() != test.anwser {
+			t.Errorf("test %d: expect %q, but got %q", i, test.anwser, wr.String())
+		}
+	}
+	if r, _, _ := store.Get("k"); r.Exptime != 100 {
+		t.Errorf("exptime should be touched: %d", r.Exptime)
+	}
+	if r, _, _ := store.Get("k2"); r.Exptime != 200 {
+		t.Errorf("exptime should be touched: %d", r.Exptime)
+	}
+
+	req := new(Request)
+	req.Read(bufio.NewReader(bytes.NewBufferString("gats 10 k\r\n")))
+	resp, _, _ := req.Process(store, stats)
+	wr := new(bytes.Buffer)
+	resp.Write(wr)
+	if !strings.HasPrefix(wr.String(), "VALUE k 2 1 ") {
+		t.Errorf("gats should return the cas: %q", wr.String())
+	}
+
+	wr.Reset()
+	req.Write(wr)
+	if wr.String() != "gats 10 k\r\n" {
+		t.Errorf("gats should be sent as %q", wr.String())
+	}
+}
+
+func TestAppendPrepend(t *testing.T) {
+	store := newMapDistStore()
+	stats := NewStats()
+	store.Set("k", &Item{Body: []byte("b")}, false)
+
+	cases := []reqTest{
+		reqTest{"append k 0 0 1\r\nc\r\n", "STORED\r\n"},
+		reqTest{"prepend k 0 0 1\r\na\r\n", "STORED\r\n"},
+		reqTest{"prepend nokey 0 0 1\r\na\r\n", "NOT_STORED\r\n"},
+		reqTest{"append nokey 0 0 1\r\na\r\n", "NOT_STORED\r\n"},
+		reqTest{"get k\r\n", "VALUE k 0 3\r\nabc\r\nEND\r\n"},
+	}
+	for i, test := range cases {
+		req := new(Request)
+		req.Read(bufio.NewReader(bytes.NewBufferString(test.cmd)))
+		resp, _, _ := req.Process(store, stats)
+		wr := new(bytes.Buffer)
+		resp.Write(wr)
+		if wr.String() != test.anwser {
+			t.Errorf("test %d: expect %q, but got %q", i, test.anwser, wr.String())
+		}
+	}
+
+	// stored on the replicas having the key, not stored if none of them has it
+	a, b := newMockNode(), newMockNode()
+	a.Set("k", &Item{Body: []byte("b")}, false)
+	client := NewClient(&staticScheduler{hosts: []*Host{NewNodeHost("concat-a", a), NewNodeHost("concat-b", b)}}, 2, 2, 1)
+	if ok, targets, err := client.Prepend("k", []byte("a")); !ok || len(targets) != 1 || err != nil {
+		t.Errorf("prepend should be stored on the replica having the key: %v %v %v", ok, targets, err)
+	}
+	if r, _ := a.mapStore.Get("k"); string(r.Body) != "ab" {
+		t.Errorf("bad prepended value: %q", r.Body)
+	}
+	if ok, _, err := client.Append("nokey", []byte("a")); ok || err != nil {
+		t.Errorf("append of missing key should be not stored: %v %v", ok, err)
+	}
+
+	wr := new(bytes.Buffer)
+	(&Request{Cmd: "prepend", Keys: []string{"k"}, Item: &Item{Body: []byte("a")}}).Write(wr)
+	if wr.String() != "prepend k 0 0 1\r\na\r\n" {
+		t.Errorf("prepend should be sent as %q", wr.String())
+	}
+}
+
+func TestVersionFeatures(t *testing.T) {
+	SetFeatures(map[string]bool{"shadow": true, "dryrun": false})
+	defer SetFeatures(map[string]bool{"shadow": false})
+	store := newMapDistStore()
+	stats := NewStats()
+
+	for i, test := range []reqTest{
+		reqTest{"version\r\n", "VERSION " + VERSION + " beanseye scheduler=manual " +
+			"features=append,binary,cas,gat,incr,meta,prepend,shadow,touch\r\n"},
+		reqTest{"stats features\r\n", "STAT version " + VERSION + "\r\nSTAT scheduler manual\r\n" +
+			"STAT append yes\r\nSTAT binary yes\r\nSTAT cas yes\r\nSTAT dryrun no\r\nSTAT gat yes\r\n" +
+			"STAT incr yes\r\nSTAT meta yes\r\nSTAT prepend yes\r\nSTAT shadow yes\r\nSTAT touch yes\r\nEND\r\n"},
+	} {
+		req := new(Request)
+		req.Read(bufio.NewReader(bytes.NewBufferString(test.cmd)))
+		resp, _, _ := req.Process(store, stats)
+		wr := new(bytes.Buffer)
+		resp.Write(wr)
+		if wr.String() != test.anwser {
+			t.Errorf("test %d: expect %q, but got %q", i, test.anwser, wr.String())
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * a listing of AutoScheduler changes the scores only if the replicas agree,
+ * so one beansdb node returning a wrong @ listing once could not flap the
+ * order of hosts in buckets
+ */
+
+package memcache
+
+import (
+    "math"
+    "sync/atomic"
+)
+
+// a count of items listed by a host is taken only if a majority of hosts
+// listed about the same count of the bucket, or the host listed about the
+// same count last time, it's held until then otherwise
+var AutoCheckQuorum = false
+
+// counts differ by less than this ratio of the larger are about the same
+var AutoQuorumThreshold = 0.1
+
+var listingsHeld int64
+
+func nearCount(a, b float64) bool {
+    return math.Abs(a-b) <= AutoQuorumThreshold*math.Max(a, b)
+}
+
+// the last count of the bucket listed by the host is cnt, whether it's taken
+func (c *AutoScheduler) agreed(host *Host, key string, cnt float64) bool {
+    i := c.hostIndex(host)
+    if i < 0 {
+        return false
+    }
+    if c.listed == nil {
+        c.listed = make([][]float64, len(c.buckets))
+        for b := range c.listed {
+            c.listed[b] = make([]float64, len(c.hosts))
+            for j := range c.listed[b] {
+                c.listed[b][j] = -1
+            }
+        }
+    }
+    counts := c.listed[getBucketByKey(c.hashMethod, c.bucketWidth, key)]
+    last := counts[i]
+    counts[i] = cnt
+    // nothing learned yet, or confirmed
+    if last < 0 || nearCount(last, cnt) {
+        return true
+    }
+    votes := 0
+    for _, other := range counts {
+        if other >= 0 && nearCount(other, cnt) {
+            votes++
+        }
+    }
+    if votes*2 > len(counts) {
+        return true
+    }
+    atomic.AddInt64(&listingsHeld, 1)
+    return false
+}
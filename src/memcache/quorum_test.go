@@ -0,0 +1,30 @@
+package memcache
+
+import (
+	"testing"
+)
+
+func TestAutoCheckQuorum(t *testing.T) {
+	c := newTestAutoScheduler([]string{"a", "b", "c"}, 16)
+	a, b, d := c.hosts[0], c.hosts[1], c.hosts[2]
+	for _, h := range c.hosts {
+		if !c.agreed(h, "@0", 1000) {
+			t.Errorf("the first listing of %s should be taken", h.Addr)
+		}
+	}
+	if !c.agreed(a, "@0", 1050) {
+		t.Errorf("about the same count should be taken")
+	}
+	if c.agreed(a, "@0", 0) {
+		t.Errorf("a wrong listing once should be held")
+	}
+	if !c.agreed(a, "@0", 1000) {
+		t.Errorf("listing agreed by the majority should be taken")
+	}
+	if c.agreed(a, "@0", 5000) || !c.agreed(a, "@0", 5000) {
+		t.Errorf("a new count should be taken once it's listed twice")
+	}
+	if !c.agreed(b, "@1", 10) || !c.agreed(d, "@1", 10) {
+		t.Errorf("other buckets are not affected")
+	}
+}
@@ -6,7 +6,6 @@ package memcache
 
 import (
     "errors"
-    "math"
     "sync"
     "time"
 )
@@ -26,7 +25,7 @@ func NewRClient(sch Scheduler, N, W, R int) (c *RClient) {
 }
 
 func (c *RClient) Get(key string) (r *Item, targets []string, err error) {
-    hosts := c.scheduler.GetHostsByKey(key)
+    hosts := hostsByOp(c.scheduler, key, OpRead, 0)
     cnt := 0
     for _, host := range hosts {
         st := time.Now()
@@ -34,18 +33,16 @@ func (c *RClient) Get(key string) (r *Item, targets []string, err error) {
         if err == nil {
             cnt++
             if r != nil {
-                t := float64(time.Now().Sub(st)) / 1e9
-                c.scheduler.Feedback(host, key, 1 - float64(math.Sqrt(t)*t))
+                c.scheduler.Feedback(host, key, hitFeedback(time.Now().Sub(st)))
                 // got the right rval
                 targets = []string{host.Addr}
                 err = nil
                 //return r, nil
                 return
             }
-        } else if err.Error() != "wait for retry" {
-            c.scheduler.Feedback(host, key, -5)
+            c.scheduler.Feedback(host, key, FeedbackEvent{Kind: FeedbackMiss})
         } else {
-            c.scheduler.Feedback(host, key, -2)
+            c.scheduler.Feedback(host, key, errorFeedback(err))
         }
 
         if cnt >= c.R {
@@ -60,7 +57,7 @@ func (c *RClient) Get(key string) (r *Item, targets []string, err error) {
 func (c *RClient) getMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
     need := len(keys)
     rs = make(map[string]*Item, need)
-    hosts := c.scheduler.GetHostsByKey(keys[0])
+    hosts := hostsByOp(c.scheduler, keys[0], OpRead, 0)
     suc := 0
     for _, host := range hosts {
         st := time.Now()
@@ -69,13 +66,10 @@ func (c *RClient) getMulti(keys []string) (rs map[string]*Item, targets []string
             suc += 1
             if r != nil {
                 targets = append(targets, host.Addr)
-                t := float64(time.Now().Sub(st)) / 1e9
-                c.scheduler.Feedback(host, keys[0], 1 - float64(math.Sqrt(t)*t))
+                c.scheduler.Feedback(host, keys[0], hitFeedback(time.Now().Sub(st)))
             }
-        } else if er.Error() != "wait for retry" { // failed
-            c.scheduler.Feedback(host, keys[0], -5)
         } else {
-            c.scheduler.Feedback(host, keys[0], -2)
+            c.scheduler.Feedback(host, keys[0], errorFeedback(er))
         }
         err = er
         if er != nil {
@@ -153,6 +147,12 @@ func (c *RClient) Append(key string, value []byte) (ok bool, targets []string, f
     return
 }
 
+func (c *RClient) Prepend(key string, value []byte) (ok bool, targets []string, final_err error) {
+    ok = false
+    final_err = errors.New("Access Denied for ReadOnly")
+    return
+}
+
 func (c *RClient) Incr(key string, value int) (result int, target []string, err error) {
     result = 0
     err = errors.New("Access Denied for ReadOnly")
@@ -165,6 +165,21 @@ func (c *RClient) Delete(key string) (r bool, targets []string, err error) {
     return
 }
 
+func (c *RClient) Touch(key string, exptime int) (r bool, targets []string, err error) {
+    r = false
+    err = errors.New("Access Denied for ReadOnly")
+    return
+}
+
+func (c *RClient) Gets(key string) (r *Item, targets []string, err error) {
+    return c.Get(key)
+}
+
+func (c *RClient) Cas(key string, item *Item) (status string, targets []string, err error) {
+    err = errors.New("Access Denied for ReadOnly")
+    return
+}
+
 func (c *RClient) Len() int {
     return 0
 }
@@ -0,0 +1,288 @@
+/*
+ * talk to redis shards as backends, hosts like redis://host:port
+ */
+
+package memcache
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const redisScheme = "redis://"
+
+// redis has no flags, non-zero flags of items are stored in the values,
+// after this marker as 10 digits
+const redisFlagsMarker = "\x00beanseye-flags\x00"
+
+const redisFlagsHeader = len(redisFlagsMarker) + 10
+
+// flags of values stored by older versions are in this hash, read for the
+// values without flags in them, and removed once the keys are written or
+// deleted. It could be dropped after all the keys are written again.
+var RedisFlagsKey = "beanseye:flags"
+
+// the value with the flags in it, the ones starting with the marker have
+// the flags even if they are 0, so they are not taken as the flags
+func redisValue(flag int, body []byte) []byte {
+    if flag == 0 && !bytes.HasPrefix(body, []byte(redisFlagsMarker)) {
+        return body
+    }
+    v := make([]byte, 0, redisFlagsHeader+len(body))
+    v = append(v, redisFlagsMarker...)
+    v = append(v, fmt.Sprintf("%010d", uint32(flag))...)
+    return append(v, body...)
+}
+
+// the flags and the body of a value, ok is false if it has no flags
+func parseRedisValue(v []byte) (flag int, body []byte, ok bool) {
+    if len(v) < redisFlagsHeader || !bytes.HasPrefix(v, []byte(redisFlagsMarker)) {
+        return 0, v, false
+    }
+    flag, err := strconv.Atoi(string(v[len(redisFlagsMarker):redisFlagsHeader]))
+    if err != nil {
+        return 0, v, false
+    }
+    return flag, v[redisFlagsHeader:], true
+}
+
+// the scripts are given the marker as ARGV[2], the flags are kept before
+// the body, append and incr of memcache fail if the key does not exist
+const redisAppendScript = "if redis.call('EXISTS', KEYS[1]) == 1 then return redis.call('APPEND', KEYS[1], ARGV[1]) end return -1"
+const redisPrependScript = "local v = redis.call('GET', KEYS[1]) if not v then return -1 end " +
+    "local h = 0 if string.sub(v, 1, #ARGV[2]) == ARGV[2] then h = #ARGV[2] + 10 end " +
+    "redis.call('SET', KEYS[1], string.sub(v, 1, h) .. ARGV[1] .. string.sub(v, h + 1), 'KEEPTTL') " +
+    "return string.len(ARGV[1]) + string.len(v)"
+const redisIncrScript = "local v = redis.call('GET', KEYS[1]) if not v then return false end " +
+    "if string.sub(v, 1, #ARGV[2]) ~= ARGV[2] then return redis.call('INCRBY', KEYS[1], ARGV[1]) end " +
+    "local h = #ARGV[2] + 10 local n = tonumber(string.sub(v, h + 1)) " +
+    "if not n then return redis.error_reply('ERR value is not an integer or out of range') end " +
+    "n = n + tonumber(ARGV[1]) redis.call('SET', KEYS[1], string.sub(v, 1, h) .. string.format('%d', n), 'KEEPTTL') return n"
+
+// not below 0, like decr of memcached
+const redisDecrScript = "local v = redis.call('GET', KEYS[1]) if not v then return false end " +
+    "if string.sub(v, 1, #ARGV[2]) ~= ARGV[2] then " +
+    "local n = redis.call('DECRBY', KEYS[1], ARGV[1]) " +
+    "if n < 0 then redis.call('SET', KEYS[1], 0, 'KEEPTTL') return 0 end return n end " +
+    "local h = #ARGV[2] + 10 local n = tonumber(string.sub(v, h + 1)) " +
+    "if not n then return redis.error_reply('ERR value is not an integer or out of range') end " +
+    "n = n - tonumber(ARGV[1]) if n < 0 then n = 0 end " +
+    "redis.call('SET', KEYS[1], string.sub(v, 1, h) .. string.format('%d', n), 'KEEPTTL') return n"
+
+type redisError string
+
+func (e redisError) Error() string {
+    return "redis: " + string(e)
+}
+
+func isRedisAddr(addr string) bool {
+    return strings.HasPrefix(addr, redisScheme)
+}
+
+func writeRedisCommand(w *bufio.Writer, args ...[]byte) {
+    fmt.Fprintf(w, "*%d\r\n", len(args))
+    for _, a := range args {
+        fmt.Fprintf(w, "$%d\r\n", len(a))
+        w.Write(a)
+        w.WriteString("\r\n")
+    }
+}
+
+func redisArgs(args ...string) [][]byte {
+    r := make([][]byte, len(args))
+    for i, a := range args {
+        r[i] = []byte(a)
+    }
+    return r
+}
+
+// read a reply, errors from redis are returned as redisError values
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    line = strings.TrimRight(line, "\r\n")
+    if len(line) == 0 {
+        return nil, errors.New("empty redis reply")
+    }
+    switch line[0] {
+    case '+':
+        return line[1:], nil
+    case '-':
+        return redisError(line[1:]), nil
+    case ':':
+        return strconv.ParseInt(line[1:], 10, 64)
+    case '$':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil || n < 0 {
+            return nil, err
+        }
+        buf := make([]byte, n+2)
+        if _, err := io.ReadFull(r, buf); err != nil {
+            return nil, err
+        }
+        return buf[:n], nil
+    case '*':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil || n < 0 {
+            return nil, err
+        }
+        rs := make([]interface{}, n)
+        for i := range rs {
+            if rs[i], err = readRedisReply(r); err != nil {
+                return nil, err
+            }
+        }
+        return rs, nil
+    }
+    return nil, errors.New("invalid redis reply: " + line)
+}
+
+// seconds to live of the memcache exptime, 0 means never expire
+func redisTTL(exptime int) int {
+    if exptime <= 0 {
+        return 0
+    }
+    if exptime > RelativeExpiryLimit {
+        // unix time
+        ttl := exptime - int(time.Now().Unix())
+        if ttl <= 0 {
+            ttl = 1
+        }
+        return ttl
+    }
+    return exptime
+}
+
+
+// send the commands at once, then read all the replies
+func redisPipeline(conn net.Conn, reader *bufio.Reader, cmds [][][]byte) ([]interface{}, error) {
+    w := bufio.NewWriter(conn)
+    for _, args := range cmds {
+        writeRedisCommand(w, args...)
+    }
+    if err := w.Flush(); err != nil {
+        return nil, err
+    }
+    replies := make([]interface{}, len(cmds))
+    for i := range replies {
+        r, err := readRedisReply(reader)
+        if err != nil {
+            return nil, err
+        }
+        replies[i] = r
+    }
+    for _, r := range replies {
+        if e, ok := r.(redisError); ok {
+            return nil, e
+        }
+    }
+    return replies, nil
+}
+
+// translate the request into redis commands, send them in a pipeline
+func (host *Host) executeRedis(conn net.Conn, req *Request) (resp *Response, err error) {
+    if len(req.Keys) == 0 {
+        return nil, errors.New("no keys")
+    }
+    key := req.Keys[0]
+    var cmds [][][]byte
+    switch req.Cmd {
+    case "get", "gets":
+        cmds = append(cmds, redisArgs(append([]string{"MGET"}, req.Keys...)...),
+            redisArgs(append([]string{"HMGET", RedisFlagsKey}, req.Keys...)...))
+    case "set", "add", "replace":
+        set := [][]byte{[]byte("SET"), []byte(key), redisValue(req.Item.Flag, req.Item.Body)}
+        if ttl := redisTTL(req.Item.Exptime); ttl > 0 {
+            set = append(set, redisArgs("EX", strconv.Itoa(ttl))...)
+        }
+        if req.Cmd == "add" {
+            set = append(set, []byte("NX"))
+        } else if req.Cmd == "replace" {
+            set = append(set, []byte("XX"))
+        }
+        cmds = append(cmds, set)
+        if req.Cmd == "set" {
+            cmds = append(cmds, redisArgs("HDEL", RedisFlagsKey, key))
+        }
+    case "append":
+        cmds = append(cmds, [][]byte{[]byte("EVAL"), []byte(redisAppendScript), []byte("1"), []byte(key), req.Item.Body})
+    case "prepend":
+        cmds = append(cmds, [][]byte{[]byte("EVAL"), []byte(redisPrependScript), []byte("1"), []byte(key),
+            req.Item.Body, []byte(redisFlagsMarker)})
+    case "incr":
+        cmds = append(cmds, redisArgs("EVAL", redisIncrScript, "1", key, string(req.Item.Body), redisFlagsMarker))
+    case "decr":
+        cmds = append(cmds, redisArgs("EVAL", redisDecrScript, "1", key, string(req.Item.Body), redisFlagsMarker))
+    case "delete":
+        cmds = append(cmds, redisArgs("DEL", key), redisArgs("HDEL", RedisFlagsKey, key))
+    default:
+        return nil, errors.New(req.Cmd + " is not supported by redis")
+    }
+
+    conn.SetDeadline(time.Now().Add(ReadTimeout))
+    defer conn.SetDeadline(time.Time{})
+    reader := bufio.NewReader(conn)
+    replies, err := redisPipeline(conn, reader, cmds)
+    if err != nil {
+        return
+    }
+    if (req.Cmd == "add" || req.Cmd == "replace") && replies[0] == "OK" {
+        // the old flags are dropped only if the value was stored
+        if _, err = redisPipeline(conn, reader, [][][]byte{redisArgs("HDEL", RedisFlagsKey, key)}); err != nil {
+            return
+        }
+    }
+
+    resp = new(Response)
+    switch req.Cmd {
+    case "get", "gets":
+        values, _ := replies[0].([]interface{})
+        flags, _ := replies[1].([]interface{})
+        resp.items = make(map[string]*Item, len(values))
+        for i, v := range values {
+            body, ok := v.([]byte)
+            if !ok || i >= len(req.Keys) {
+                continue
+            }
+            item := new(Item)
+            if item.Flag, item.Body, ok = parseRedisValue(body); !ok && i < len(flags) {
+                if f, ok := flags[i].([]byte); ok {
+                    item.Flag, _ = strconv.Atoi(string(f))
+                }
+            }
+            resp.items[req.Keys[i]] = item
+        }
+        resp.status = "END"
+    case "set", "add", "replace":
+        resp.status = "NOT_STORED"
+        if replies[0] == "OK" {
+            resp.status = "STORED"
+        }
+    case "append", "prepend":
+        resp.status = "NOT_STORED"
+        if n, ok := replies[0].(int64); ok && n >= 0 {
+            resp.status = "STORED"
+        }
+    case "incr", "decr":
+        resp.status = "NOT_FOUND"
+        if n, ok := replies[0].(int64); ok {
+            resp.status = "INCR"
+            resp.msg = strconv.FormatInt(n, 10)
+        }
+    case "delete":
+        resp.status = "NOT_FOUND"
+        if n, ok := replies[0].(int64); ok && n > 0 {
+            resp.status = "DELETED"
+        }
+    }
+    return
+}
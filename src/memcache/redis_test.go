@@ -0,0 +1,188 @@
+package memcache
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// a fake redis server supports the commands sent by executeRedis
+func serveFakeRedis(t *testing.T, l net.Listener) {
+	data := make(map[string]string)
+	flags := make(map[string]string)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			w := bufio.NewWriter(conn)
+			for {
+				v, err := readRedisReply(r)
+				if err != nil {
+					return
+				}
+				var args []string
+				for _, a := range v.([]interface{}) {
+					args = append(args, string(a.([]byte)))
+				}
+				switch args[0] {
+				case "MGET":
+					var vs [][]byte
+					for _, k := range args[1:] {
+						if v, ok := data[k]; ok {
+							vs = append(vs, []byte(v))
+						} else {
+							vs = append(vs, nil)
+						}
+					}
+					writeFakeArray(w, vs)
+				case "HMGET":
+					var vs [][]byte
+					for _, k := range args[2:] {
+						if v, ok := flags[k]; ok {
+							vs = append(vs, []byte(v))
+						} else {
+							vs = append(vs, nil)
+						}
+					}
+					writeFakeArray(w, vs)
+				case "SET":
+					_, exists := data[args[1]]
+					if len(args) > 3 && (args[3] == "NX" && exists || args[3] == "XX" && !exists) {
+						w.WriteString("$-1\r\n")
+					} else {
+						data[args[1]] = args[2]
+						w.WriteString("+OK\r\n")
+					}
+				case "HSET":
+					flags[args[2]] = args[3]
+					w.WriteString(":1\r\n")
+				case "HDEL":
+					delete(flags, args[2])
+					w.WriteString(":1\r\n")
+				case "DEL":
+					_, ok := data[args[1]]
+					delete(data, args[1])
+					if ok {
+						w.WriteString(":1\r\n")
+					} else {
+						w.WriteString(":0\r\n")
+					}
+				case "EVAL":
+					key := args[3]
+					v, ok := data[key]
+					flag, body, withFlag := parseRedisValue([]byte(v))
+					switch {
+					case !ok && (args[1] == redisIncrScript || args[1] == redisDecrScript):
+						w.WriteString("$-1\r\n")
+					case !ok:
+						w.WriteString(":-1\r\n")
+					case args[1] == redisIncrScript || args[1] == redisDecrScript:
+						n, _ := strconv.Atoi(string(body))
+						d, _ := strconv.Atoi(args[4])
+						if args[1] == redisIncrScript {
+							n += d
+						} else if n -= d; n < 0 {
+							n = 0
+						}
+						data[key] = strconv.Itoa(n)
+						if withFlag {
+							data[key] = string(redisValue(flag, []byte(data[key])))
+						}
+						w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+					default:
+						if args[1] == redisAppendScript {
+							data[key] = v + args[4]
+						} else if withFlag {
+							data[key] = string(redisValue(flag, append([]byte(args[4]), body...)))
+						} else {
+							data[key] = args[4] + v
+						}
+						w.WriteString(":" + strconv.Itoa(len(data[key])) + "\r\n")
+					}
+				default:
+					w.WriteString("-ERR unknown command\r\n")
+				}
+				w.Flush()
+			}
+		}(conn)
+	}
+}
+
+func writeFakeArray(w *bufio.Writer, vs [][]byte) {
+	w.WriteString("*" + strconv.Itoa(len(vs)) + "\r\n")
+	for _, v := range vs {
+		if v == nil {
+			w.WriteString("$-1\r\n")
+		} else {
+			w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + string(v) + "\r\n")
+		}
+	}
+}
+
+func TestRedisHost(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveFakeRedis(t, l)
+
+	host := NewHost(redisScheme + l.Addr().String())
+	if ok, err := host.Set("a", &Item{Flag: 2, Body: []byte("1")}, false); !ok {
+		t.Fatal("set failed", err)
+	}
+	if ok, _ := host.Add("a", &Item{Body: []byte("x")}); ok {
+		t.Errorf("add an existing key should fail")
+	}
+	if n, err := host.Incr("a", 2); n != 3 {
+		t.Errorf("incr should be 3: %d %v", n, err)
+	}
+	if _, err := host.Incr("b", 2); err == nil {
+		t.Errorf("incr a missing key should fail")
+	}
+	if ok, _ := host.Append("b", []byte("x")); ok {
+		t.Errorf("append to a missing key should fail")
+	}
+	if ok, _ := host.Prepend("a", []byte("1")); !ok {
+		t.Errorf("prepend failed")
+	}
+	rs, err := host.GetMulti([]string{"a", "b"})
+	if err != nil || len(rs) != 1 || string(rs["a"].Body) != "13" || rs["a"].Flag != 2 {
+		t.Errorf("get multi failed: %v %v", rs, err)
+	}
+
+	// values starting with the marker keep their body
+	host.Set("m", &Item{Body: []byte(redisFlagsMarker + "0000000007x")}, false)
+	if r, _ := host.Get("m"); r == nil || r.Flag != 0 || string(r.Body) != redisFlagsMarker+"0000000007x" {
+		t.Errorf("value like flags should not be parsed: %v", r)
+	}
+
+	// flags stored by older versions in the hash
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	redisPipeline(conn, bufio.NewReader(conn), [][][]byte{redisArgs("SET", "c", "v"), redisArgs("HSET", RedisFlagsKey, "c", "5")})
+	if r, _ := host.Get("c"); r == nil || r.Flag != 5 {
+		t.Errorf("flags in the hash should be read: %v", r)
+	}
+	host.Set("c", &Item{Body: []byte("v")}, false)
+	if r, _ := host.Get("c"); r == nil || r.Flag != 0 {
+		t.Errorf("flags in the hash should be removed by set: %v", r)
+	}
+	if ok, _ := host.Delete("a"); !ok {
+		t.Errorf("delete failed")
+	}
+	if r, err := host.Get("a"); r != nil || err != nil {
+		t.Errorf("deleted key should be missing: %v %v", r, err)
+	}
+	if _, err := host.Stat(nil); err == nil {
+		t.Errorf("stats is not supported by redis")
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * route keys across region-local clusters, keys pinned to a region by prefix
+ * live there only, others are cached in every region and served by the
+ * nearest one, measured by the latency of hits
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// RegionScheduler route a key to the hosts of regions, every region route
+// its keys by its own scheduler. Keys with a geo-pinned prefix (the longest
+// matching one wins) go to the hosts of their region only, other keys go to
+// all the regions, the nearest first, so reads and writes stay in the
+// nearest region and fail over to the next ones.
+type RegionScheduler struct {
+    local    string
+    names    []string // local first, then in the order of config
+    regions  map[string]Scheduler
+    prefixes []string // longest first
+    pins     map[string]string // prefix -> region
+    n        int
+
+    latencies map[string]*int64 // ewma of hits by region, in ns
+    estimates map[string]time.Duration
+    hostLock  sync.RWMutex
+    hosts     map[string]string // address -> region, learned by routing
+}
+
+func NewRegionScheduler(local string, regions map[string]Scheduler, order []string, pins map[string]string, n int) (*RegionScheduler, error) {
+    if _, ok := regions[local]; !ok {
+        return nil, fmt.Errorf("no scheduler of the local region %s", local)
+    }
+    c := &RegionScheduler{local: local, names: []string{local}, regions: regions, pins: pins, n: n,
+        latencies: make(map[string]*int64, len(regions)),
+        estimates: make(map[string]time.Duration, len(regions)),
+        hosts:     make(map[string]string)}
+    for _, name := range order {
+        if _, ok := regions[name]; ok && name != local {
+            c.names = append(c.names, name)
+        }
+    }
+    if len(c.names) != len(regions) {
+        return nil, fmt.Errorf("order of regions should list all of them")
+    }
+    for _, name := range c.names {
+        c.latencies[name] = new(int64)
+    }
+    for p, name := range pins {
+        if _, ok := regions[name]; !ok {
+            return nil, fmt.Errorf("prefix %s is pinned to unknown region %s", p, name)
+        }
+        c.prefixes = append(c.prefixes, p)
+    }
+    sort.Slice(c.prefixes, func(i, j int) bool {
+        if len(c.prefixes[i]) != len(c.prefixes[j]) {
+            return len(c.prefixes[i]) > len(c.prefixes[j])
+        }
+        return c.prefixes[i] < c.prefixes[j]
+    })
+    return c, nil
+}
+
+// the latency of a region until hits of it are measured, regions neither
+// measured nor estimated go after the others, except the local one. It
+// should be set before routing.
+func (c *RegionScheduler) SetEstimate(region string, d time.Duration) {
+    c.estimates[region] = d
+}
+
+// the region the key is pinned to, empty if it's in all of them
+func (c *RegionScheduler) pinned(key string) string {
+    for _, p := range c.prefixes {
+        if strings.HasPrefix(key, p) {
+            return c.pins[p]
+        }
+    }
+    return ""
+}
+
+func (c *RegionScheduler) latency(region string) time.Duration {
+    if d := time.Duration(atomic.LoadInt64(c.latencies[region])); d > 0 {
+        return d
+    }
+    if d, ok := c.estimates[region]; ok {
+        return d
+    }
+    if region == c.local {
+        return 0
+    }
+    return math.MaxInt64
+}
+
+// regions to route the key to, in order
+func (c *RegionScheduler) route(key string) []string {
+    if r := c.pinned(key); r != "" {
+        return []string{r}
+    }
+    return c.nearest()
+}
+
+// all the regions, the nearest first
+func (c *RegionScheduler) nearest() []string {
+    names := append([]string(nil), c.names...)
+    sort.SliceStable(names, func(i, j int) bool {
+        return c.latency(names[i]) < c.latency(names[j])
+    })
+    return names
+}
+
+func (c *RegionScheduler) learn(region string, hosts []*Host) []*Host {
+    c.hostLock.RLock()
+    known := true
+    for _, h := range hosts {
+        if h != nil && c.hosts[h.Addr] != region {
+            known = false
+            break
+        }
+    }
+    c.hostLock.RUnlock()
+    if !known {
+        c.hostLock.Lock()
+        for _, h := range hosts {
+            if h != nil {
+                c.hosts[h.Addr] = region
+            }
+        }
+        c.hostLock.Unlock()
+    }
+    return hosts
+}
+
+func (c *RegionScheduler) Hosts() (hosts []*Host) {
+    for _, name := range c.names {
+        hosts = appendHosts(hosts, SchedulerHosts(c.regions[name]))
+    }
+    return hosts
+}
+
+func (c *RegionScheduler) GetHostsByKey(key string) (hosts []*Host) {
+    for _, r := range c.route(key) {
+        hosts = append(hosts, c.learn(r, c.regions[r].GetHostsByKey(key))...)
+    }
+    return
+}
+
+func (c *RegionScheduler) GetReadHostsByKey(key string) []*Host {
+    return c.GetHostsByOp(key, OpRead)
+}
+
+// the hosts of every region for the operation, one region after another
+func (c *RegionScheduler) GetHostsByOp(key string, op Operation) (hosts []*Host) {
+    for _, r := range c.route(key) {
+        hosts = append(hosts, c.learn(r, hostsByOp(c.regions[r], key, op, c.n))...)
+    }
+    return
+}
+
+func (c *RegionScheduler) Feedback(host *Host, key string, ev FeedbackEvent) {
+    c.hostLock.RLock()
+    r, ok := c.hosts[host.Addr]
+    c.hostLock.RUnlock()
+    if !ok {
+        return
+    }
+    if (ev.Kind == FeedbackHit || ev.Kind == FeedbackSlow) && ev.Duration > 0 {
+        p := c.latencies[r]
+        for {
+            old := atomic.LoadInt64(p)
+            n := int64(ev.Duration)
+            if old > 0 {
+                n = int64(float64(old)*(1-LatencyAlpha) + float64(ev.Duration)*LatencyAlpha)
+            }
+            if atomic.CompareAndSwapInt64(p, old, n) {
+                break
+            }
+        }
+    }
+    c.regions[r].Feedback(host, key, ev)
+}
+
+// keys of different regions never share a group
+func (c *RegionScheduler) DivideKeysByBucket(keys []string) [][]string {
+    byRegion := make(map[string][]string)
+    var order []string
+    for _, key := range keys {
+        r := c.route(key)[0]
+        if _, ok := byRegion[r]; !ok {
+            order = append(order, r)
+        }
+        byRegion[r] = append(byRegion[r], key)
+    }
+    var rs [][]string
+    for _, r := range order {
+        for _, g := range c.regions[r].DivideKeysByBucket(byRegion[r]) {
+            if len(g) > 0 {
+                rs = append(rs, g)
+            }
+        }
+    }
+    return rs
+}
+
+func (c *RegionScheduler) Stats() map[string][]float64 {
+    r := make(map[string][]float64)
+    for _, name := range c.names {
+        for addr, st := range c.regions[name].Stats() {
+            if _, ok := r[addr]; !ok {
+                r[addr] = st
+            }
+        }
+    }
+    return r
+}
+
+type RegionStat struct {
+    Name     string
+    Latency  time.Duration // measured, 0 if not yet
+    Estimate time.Duration `json:",omitempty"`
+    Prefixes []string      `json:",omitempty"` // pinned to the region
+}
+
+// regions in the order keys not pinned are routed to
+func (c *RegionScheduler) Regions() []RegionStat {
+    var rs []RegionStat
+    for _, name := range c.nearest() {
+        st := RegionStat{Name: name, Latency: time.Duration(atomic.LoadInt64(c.latencies[name])),
+            Estimate: c.estimates[name]}
+        for _, p := range c.prefixes {
+            if c.pins[p] == name {
+                st.Prefixes = append(st.Prefixes, p)
+            }
+        }
+        rs = append(rs, st)
+    }
+    return rs
+}
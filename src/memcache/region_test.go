@@ -0,0 +1,60 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegionScheduler(t *testing.T) {
+	local := newTestManualScheduler(map[string][]string{"region-l1": {"0"}, "region-l2": {"0"}}, 1, 2)
+	east := newTestManualScheduler(map[string][]string{"region-e1": {"0"}}, 1, 1)
+	west := newTestManualScheduler(map[string][]string{"region-w1": {"0"}}, 1, 1)
+	if _, err := NewRegionScheduler("local", map[string]Scheduler{"local": local, "east": east},
+		[]string{"east"}, map[string]string{"geo:": "north"}, 2); err == nil {
+		t.Errorf("prefix pinned to unknown region should be rejected")
+	}
+	schd, err := NewRegionScheduler("local", map[string]Scheduler{"local": local, "east": east, "west": west},
+		[]string{"west", "east"}, map[string]string{"eu:": "east", "eu:local:": "local"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := func(hosts []*Host) (r []string) {
+		for _, h := range hosts {
+			r = append(r, h.Addr)
+		}
+		return
+	}
+
+	// not measured, local first, then in the order of config
+	if hosts := addrs(schd.GetHostsByKey("user:1")); len(hosts) != 4 || hosts[2] != "region-w1" || hosts[3] != "region-e1" {
+		t.Errorf("key should be routed to all the regions, local first: %v", hosts)
+	}
+	if hosts := addrs(schd.GetHostsByKey("eu:1")); len(hosts) != 1 || hosts[0] != "region-e1" {
+		t.Errorf("pinned key should be routed to its region only: %v", hosts)
+	}
+	if hosts := addrs(schd.GetHostsByKey("eu:local:1")); len(hosts) != 2 || hosts[0][:8] != "region-l" {
+		t.Errorf("longest prefix should win: %v", hosts)
+	}
+
+	// east is measured nearer than the local region
+	schd.SetEstimate("west", 50*time.Millisecond)
+	schd.Feedback(schd.GetHostsByKey("eu:1")[0], "eu:1", hitFeedback(time.Millisecond))
+	for _, h := range local.GetHostsByKey("user:1") {
+		schd.Feedback(h, "user:1", hitFeedback(10*time.Millisecond))
+	}
+	if hosts := addrs(schd.GetReadHostsByKey("user:1")); len(hosts) != 4 || hosts[0] != "region-e1" || hosts[3] != "region-w1" {
+		t.Errorf("key should be read from the nearest region first: %v", hosts)
+	}
+	rs := schd.Regions()
+	if len(rs) != 3 || rs[0].Name != "east" || rs[0].Latency != time.Millisecond || len(rs[0].Prefixes) != 1 {
+		t.Errorf("regions should be listed by latency: %+v", rs)
+	}
+
+	gs := schd.DivideKeysByBucket([]string{"user:1", "eu:local:1", "user:2"})
+	if len(gs) != 2 || len(gs[0]) != 2 || gs[1][0] != "eu:local:1" {
+		t.Errorf("keys should be divided by region: %v", gs)
+	}
+	if st := schd.Stats(); len(st) != 4 {
+		t.Errorf("stats should include all the regions: %v", st)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * schedulers by name, so custom routing strategies could be plugged in
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+)
+
+// everything a factory may need to build a scheduler from config
+type SchedulerConfig struct {
+    Servers map[string][]string // address -> buckets, in the format of ManualScheduler
+    Hosts   []string            // addresses in the order of config
+    Buckets int
+    N       int
+    Hash    string // name of hash method, like fnv1a1
+}
+
+type SchedulerFactory func(cfg SchedulerConfig) Scheduler
+
+var (
+    schedulersLock sync.RWMutex
+    schedulers     = make(map[string]SchedulerFactory)
+)
+
+// RegisterScheduler make a scheduler available by name, it panics if the
+// name is registered twice, like database/sql.Register
+func RegisterScheduler(name string, factory func(cfg SchedulerConfig) Scheduler) {
+    schedulersLock.Lock()
+    defer schedulersLock.Unlock()
+    if factory == nil {
+        panic("memcache: RegisterScheduler factory is nil")
+    }
+    if _, dup := schedulers[name]; dup {
+        panic("memcache: RegisterScheduler called twice for " + name)
+    }
+    schedulers[name] = factory
+}
+
+// NewSchedulerByName build a scheduler by the registered factory
+func NewSchedulerByName(name string, cfg SchedulerConfig) (Scheduler, error) {
+    schedulersLock.RLock()
+    factory, ok := schedulers[name]
+    schedulersLock.RUnlock()
+    if !ok {
+        return nil, fmt.Errorf("unknown scheduler %q, registered: %v", name, SchedulerNames())
+    }
+    if cfg.Hash == "" {
+        cfg.Hash = "fnv1a1"
+    }
+    if _, ok := hashMethods[cfg.Hash]; !ok {
+        return nil, fmt.Errorf("unknown hash method %q", cfg.Hash)
+    }
+    if name == "manual" || name == "auto" {
+        if err := CheckBuckets(cfg.Buckets); err != nil {
+            return nil, err
+        }
+    }
+    if name == "maglev" && len(cfg.Hosts) == 0 {
+        return nil, ErrNoHosts
+    }
+    return factory(cfg), nil
+}
+
+func SchedulerNames() []string {
+    schedulersLock.RLock()
+    defer schedulersLock.RUnlock()
+    names := make([]string, 0, len(schedulers))
+    for name := range schedulers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func init() {
+    RegisterScheduler("manual", func(cfg SchedulerConfig) Scheduler {
+        sch := NewManualScheduler(cfg.Servers, cfg.Buckets, cfg.N)
+        sch.hashMethod = hashMethods[cfg.Hash]
+        return sch
+    })
+    RegisterScheduler("auto", func(cfg SchedulerConfig) Scheduler {
+        return NewAutoScheduler(cfg.Hosts, cfg.Buckets)
+    })
+    RegisterScheduler("mod", func(cfg SchedulerConfig) Scheduler {
+        return NewModScheduler(cfg.Hosts, cfg.Hash)
+    })
+    RegisterScheduler("consistant", func(cfg SchedulerConfig) Scheduler {
+        sch := NewConsistantHashScheduler(cfg.Hosts, cfg.Hash).(*ConsistantHashScheduler)
+        sch.Replicas = cfg.N
+        return sch
+    })
+    RegisterScheduler("bounded", func(cfg SchedulerConfig) Scheduler {
+        return NewBoundedLoadScheduler(cfg.Hosts, cfg.Hash, BoundedLoadEpsilon)
+    })
+    RegisterScheduler("ketama", func(cfg SchedulerConfig) Scheduler {
+        return NewKetamaScheduler(cfg.Hosts)
+    })
+    RegisterScheduler("rendezvous", func(cfg SchedulerConfig) Scheduler {
+        return NewRendezvousScheduler(cfg.Hosts, cfg.Hash)
+    })
+    RegisterScheduler("maglev", func(cfg SchedulerConfig) Scheduler {
+        sch, _ := NewMaglevScheduler(cfg.Hosts, cfg.Hash, 0) // hosts are checked above
+        return sch
+    })
+}
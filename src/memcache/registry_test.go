@@ -0,0 +1,69 @@
+package memcache
+
+import "testing"
+
+type staticScheduler struct {
+	emptyScheduler
+	hosts []*Host
+}
+
+func (c *staticScheduler) GetHostsByKey(key string) []*Host {
+	return c.hosts
+}
+
+func (c *staticScheduler) DivideKeysByBucket(keys []string) [][]string {
+	return [][]string{keys}
+}
+
+func TestRegisterScheduler(t *testing.T) {
+	RegisterScheduler("static", func(cfg SchedulerConfig) Scheduler {
+		hosts := make([]*Host, len(cfg.Hosts))
+		for i, addr := range cfg.Hosts {
+			hosts[i] = NewHost(addr)
+		}
+		return &staticScheduler{hosts: hosts}
+	})
+	defer func() {
+		schedulersLock.Lock()
+		delete(schedulers, "static")
+		schedulersLock.Unlock()
+	}()
+
+	schd, err := NewSchedulerByName("static", SchedulerConfig{Hosts: []string{"a:1", "b:2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts := schd.GetHostsByKey("key"); len(hosts) != 2 || hosts[1].Addr != "b:2" {
+		t.Errorf("bad hosts of custom scheduler: %v", hosts)
+	}
+	if _, err := NewSchedulerByName("nosuch", SchedulerConfig{}); err == nil {
+		t.Error("unknown scheduler should fail")
+	}
+	if _, err := NewSchedulerByName("mod", SchedulerConfig{Hosts: []string{"a:1"}, Hash: "nosuch"}); err == nil {
+		t.Error("unknown hash should fail")
+	}
+	if _, err := NewSchedulerByName("maglev", SchedulerConfig{}); err != ErrNoHosts {
+		t.Errorf("maglev without hosts should fail: %v", err)
+	}
+	schd, err = NewSchedulerByName("mod", SchedulerConfig{Hosts: []string{"a:1"}})
+	if err != nil || schd.GetHostsByKey("key")[0].Addr != "a:1" {
+		t.Errorf("builtin scheduler failed: %v", err)
+	}
+	servers := AutoConfig([]string{"a:1", "b:2", "c:3"}, 16)
+	for _, hash := range []string{"murmur3", "xxhash64", "crc32"} {
+		schd, err = NewSchedulerByName("manual", SchedulerConfig{Servers: servers, Buckets: 16, N: 3, Hash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := schd.(*ManualScheduler).hashMethod([]byte("key")); h != hashMethods[hash]([]byte("key")) {
+			t.Errorf("manual scheduler should hash keys by %s", hash)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicated name should panic")
+		}
+	}()
+	RegisterScheduler("manual", func(cfg SchedulerConfig) Scheduler { return nil })
+}
@@ -0,0 +1,23 @@
+// +build linux
+
+package memcache
+
+import (
+    "context"
+    "net"
+    "syscall"
+)
+
+// not in package syscall of linux
+const soReusePort = 0xf
+
+func listenReusePort(addr string) (net.Listener, error) {
+    lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+        var err error
+        c.Control(func(fd uintptr) {
+            err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+        })
+        return err
+    }}
+    return lc.Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package memcache
+
+import (
+    "errors"
+    "net"
+)
+
+func listenReusePort(addr string) (net.Listener, error) {
+    return nil, errors.New("SO_REUSEPORT is only supported on linux")
+}
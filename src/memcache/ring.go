@@ -0,0 +1,78 @@
+/*
+ * serialized ring of ConsistantHashScheduler, so proxies and offline tools
+ * are guaranteed to use the same ring, even built by other versions
+ */
+
+package memcache
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+)
+
+const ringDumpVersion = 1
+
+type ringDump struct {
+    Version int
+    Hash    string
+    Hosts   []string
+    Points  []uint32 // sorted
+    Owners  []int    // index of host owning every point
+}
+
+func (c *ConsistantHashScheduler) DumpRing() ([]byte, error) {
+    r := c.current()
+    d := ringDump{Version: ringDumpVersion, Hash: c.hashName}
+    d.Hosts = make([]string, len(r.hosts))
+    for i, h := range r.hosts {
+        d.Hosts[i] = h.Addr
+    }
+    d.Points = make([]uint32, len(r.index))
+    d.Owners = make([]int, len(r.index))
+    for i, v := range r.index {
+        d.Points[i] = uint32(v >> 32)
+        d.Owners[i] = int(v & 0xffffffff)
+    }
+    return json.Marshal(&d)
+}
+
+// load the ring dumped by DumpRing, hosts added or removed later
+// get default virtual nodes
+func NewConsistantHashSchedulerFromRing(data []byte) (*ConsistantHashScheduler, error) {
+    var d ringDump
+    if err := json.Unmarshal(data, &d); err != nil {
+        return nil, err
+    }
+    if d.Version != ringDumpVersion {
+        return nil, fmt.Errorf("unsupported version of ring: %d", d.Version)
+    }
+    hashMethod, ok := hashMethods[d.Hash]
+    if !ok {
+        return nil, errors.New("unknown hash method: " + d.Hash)
+    }
+    if len(d.Hosts) == 0 || len(d.Points) == 0 || len(d.Points) != len(d.Owners) {
+        return nil, errors.New("broken ring")
+    }
+    r := &hashRing{hosts: make([]*Host, len(d.Hosts)), index: make([]uint64, len(d.Points))}
+    for i, addr := range d.Hosts {
+        r.hosts[i] = NewHost(addr)
+    }
+    for i, v := range d.Points {
+        if d.Owners[i] < 0 || d.Owners[i] >= len(d.Hosts) {
+            return nil, fmt.Errorf("invalid owner of point %d: %d", i, d.Owners[i])
+        }
+        if i > 0 && v < d.Points[i-1] {
+            return nil, errors.New("points of ring are not sorted")
+        }
+        r.index[i] = (uint64(v) << 32) + uint64(d.Owners[i])
+    }
+
+    c := new(ConsistantHashScheduler)
+    c.hashName = d.Hash
+    c.hashMethod = hashMethod
+    c.points = virtualNodes(hashMethod, VIRTUAL_NODES)
+    c.specs = d.Hosts
+    c.ring.Store(r)
+    return c, nil
+}
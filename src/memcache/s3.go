@@ -0,0 +1,225 @@
+/*
+ * S3 compatible object storage as a Storage, for huge values rarely accessed
+ */
+
+package memcache
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var S3Timeout = time.Second * 10
+
+// S3Store keep every item as an object in the bucket, the flag is kept in
+// meta data, recently read values are cached locally
+type S3Store struct {
+    Endpoint  string // like http://s3.example.com, objects are addressed in path style
+    Bucket    string
+    Region    string
+    AccessKey string
+    SecretKey string
+    client    *http.Client
+    cache     *lruCache
+}
+
+// cacheSize is bytes of values cached in memory, 0 to disable the cache
+func NewS3Store(endpoint, bucket, region, accessKey, secretKey string, cacheSize int) *S3Store {
+    s := &S3Store{Endpoint: strings.TrimRight(endpoint, "/"), Bucket: bucket, Region: region,
+        AccessKey: accessKey, SecretKey: secretKey}
+    if s.Region == "" {
+        s.Region = "us-east-1"
+    }
+    s.client = &http.Client{Timeout: S3Timeout}
+    if cacheSize > 0 {
+        s.cache = newLRUCache(cacheSize)
+    }
+    return s
+}
+
+// escape the key as the canonical URI of signature v4
+func s3Escape(key string) string {
+    var buf bytes.Buffer
+    for _, c := range []byte(key) {
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+            c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+            buf.WriteByte(c)
+        } else {
+            fmt.Fprintf(&buf, "%%%02X", c)
+        }
+    }
+    return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    h := hmac.New(sha256.New, key)
+    h.Write([]byte(data))
+    return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+    h := sha256.Sum256(data)
+    return hex.EncodeToString(h[:])
+}
+
+// sign the request with AWS signature version 4
+func (s *S3Store) sign(req *http.Request, payload []byte, now time.Time) {
+    amzDate := now.UTC().Format("20060102T150405Z")
+    date := amzDate[:8]
+    payloadHash := sha256Hex(payload)
+    req.Header.Set("x-amz-date", amzDate)
+    req.Header.Set("x-amz-content-sha256", payloadHash)
+
+    signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+    canonical := strings.Join([]string{
+        req.Method,
+        req.URL.EscapedPath(),
+        "",
+        "host:" + req.URL.Host,
+        "x-amz-content-sha256:" + payloadHash,
+        "x-amz-date:" + amzDate,
+        "",
+        signedHeaders,
+        payloadHash,
+    }, "\n")
+    scope := date + "/" + s.Region + "/s3/aws4_request"
+    toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+    key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+    key = hmacSHA256(key, s.Region)
+    key = hmacSHA256(key, "s3")
+    key = hmacSHA256(key, "aws4_request")
+    signature := hex.EncodeToString(hmacSHA256(key, toSign))
+    req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        s.AccessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3Store) do(method, key string, body []byte, flag int) (*http.Response, error) {
+    req, err := http.NewRequest(method, s.Endpoint+"/"+s.Bucket+"/"+s3Escape(key), bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    if method == "PUT" {
+        req.Header.Set("x-amz-meta-flag", strconv.Itoa(flag))
+    }
+    s.sign(req, body, time.Now())
+    return s.client.Do(req)
+}
+
+func (s *S3Store) Get(key string) (*Item, error) {
+    if s.cache != nil {
+        if r := s.cache.Get(key); r != nil {
+            return r, nil
+        }
+    }
+    resp, err := s.do("GET", key, nil, 0)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("s3 get %s: %s", key, resp.Status)
+    }
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    flag, _ := strconv.Atoi(resp.Header.Get("x-amz-meta-flag"))
+    r := &Item{Flag: flag, Body: body}
+    if s.cache != nil {
+        s.cache.Put(key, r)
+    }
+    return r, nil
+}
+
+func (s *S3Store) GetMulti(keys []string) (map[string]*Item, error) {
+    rs := make(map[string]*Item, len(keys))
+    for _, key := range keys {
+        r, err := s.Get(key)
+        if err != nil {
+            return rs, err
+        }
+        if r != nil {
+            rs[key] = r
+        }
+    }
+    return rs, nil
+}
+
+func (s *S3Store) Set(key string, item *Item, noreply bool) (bool, error) {
+    if s.cache != nil {
+        s.cache.Remove(key)
+    }
+    resp, err := s.do("PUT", key, item.Body, item.Flag)
+    if err != nil {
+        return false, err
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return false, fmt.Errorf("s3 put %s: %s", key, resp.Status)
+    }
+    return true, nil
+}
+
+func (s *S3Store) Append(key string, value []byte) (bool, error) {
+    r, err := s.Get(key)
+    if err != nil || r == nil || r.Flag != 0 {
+        return false, err
+    }
+    body := make([]byte, 0, len(r.Body)+len(value))
+    body = append(append(body, r.Body...), value...)
+    return s.Set(key, &Item{Flag: r.Flag, Body: body}, false)
+}
+
+func (s *S3Store) Prepend(key string, value []byte) (bool, error) {
+    r, err := s.Get(key)
+    if err != nil || r == nil || r.Flag != 0 {
+        return false, err
+    }
+    body := make([]byte, 0, len(r.Body)+len(value))
+    body = append(append(body, value...), r.Body...)
+    return s.Set(key, &Item{Flag: r.Flag, Body: body}, false)
+}
+
+func (s *S3Store) Incr(key string, v int) (n int, err error) {
+    r, err := s.Get(key)
+    if err != nil {
+        return
+    }
+    if r == nil {
+        return 0, ErrNotFound
+    }
+    if n, err = incrValue(r.Body, v); err != nil {
+        return
+    }
+    _, err = s.Set(key, &Item{Flag: r.Flag, Body: []byte(strconv.Itoa(n))}, false)
+    return
+}
+
+func (s *S3Store) Delete(key string) (bool, error) {
+    if s.cache != nil {
+        s.cache.Remove(key)
+    }
+    resp, err := s.do("DELETE", key, nil, 0)
+    if err != nil {
+        return false, err
+    }
+    resp.Body.Close()
+    return resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK, nil
+}
+
+// objects are not counted
+func (s *S3Store) Len() int {
+    return 0
+}
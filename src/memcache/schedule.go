@@ -2,26 +2,59 @@ package memcache
 
 import (
     "bytes"
+    "crypto/md5"
     "fmt"
     "math"
     "sort"
     "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
     "math/rand"
 )
 
 // Scheduler: route request to nodes
 type Scheduler interface {
-    Feedback(host *Host, key string, adjust float64) // feedback for auto routing
+    Feedback(host *Host, key string, ev FeedbackEvent) // feedback for auto routing
     GetHostsByKey(key string) []*Host                               // route a key to hosts
     DivideKeysByBucket(keys []string) [][]string                    // route some keys to group of hosts
     Stats() map[string][]float64                                    // internal status
 }
 
+// schedulers listing the hosts they route to, the ones of the primary
+// cluster first
+type HostLister interface {
+    Hosts() []*Host
+}
+
+// hosts of sch without duplicates, nil if it could not list them
+func SchedulerHosts(sch Scheduler) []*Host {
+    l, ok := sch.(HostLister)
+    if !ok {
+        return nil
+    }
+    return appendHosts(nil, l.Hosts())
+}
+
+// hosts not in r yet are appended
+func appendHosts(r []*Host, hosts []*Host) []*Host {
+    seen := make(map[string]bool, len(r))
+    for _, h := range r {
+        seen[h.Addr] = true
+    }
+    for _, h := range hosts {
+        if !seen[h.Addr] {
+            seen[h.Addr] = true
+            r = append(r, h)
+        }
+    }
+    return r
+}
+
 type emptyScheduler struct{}
 
-func (c emptyScheduler) Feedback(host *Host, key string, adjust float64) {}
+func (c emptyScheduler) Feedback(host *Host, key string, ev FeedbackEvent) {}
 
 func (c emptyScheduler) Stats() map[string][]float64 { return nil }
 
@@ -42,10 +75,14 @@ func NewModScheduler(hosts []string, hashname string) Scheduler {
     return &c
 }
 
+func (c *ModScheduler) Hosts() []*Host {
+    return c.hosts
+}
+
 func (c *ModScheduler) GetHostsByKey(key string) []*Host {
     h := c.hashMethod([]byte(key))
     r := make([]*Host, 1)
-    r[0] = c.hosts[h%uint32(len(c.hosts))]
+    r[0] = firstAvailable(len(c.hosts), int(h%uint32(len(c.hosts))), func(i int) *Host { return c.hosts[i] })
     return r
 }
 
@@ -85,61 +122,338 @@ func (l uint64Slice) Swap(i, j int) {
 
 // route requests by consistant hash
 type ConsistantHashScheduler struct {
-    hosts      []*Host
-    index      []uint64
+    ring       atomic.Value // *hashRing, replaced as a whole when hosts changed
+    specs      []string     // hosts in config, maybe with weight
+    points     func(addr string, weight int) []uint32
+    hashName   string
     hashMethod HashMethod
+    lock       sync.Mutex // serialize rebuilding
     emptyScheduler
+
+    // distinct hosts returned for a key, the next ones on the ring after
+    // the first, so reads and writes could fail over, 1 by default
+    Replicas int
+}
+
+type hashRing struct {
+    hosts []*Host
+    index []uint64
 }
 
 const VIRTUAL_NODES = 100
 
+// "host:port:weight" means a host with weight times of virtual nodes, the
+// weight is split off only if a host:port is left, so "redis://host:port"
+// and "[::1]:port" keep their ports
+func parseHostWeight(h string) (addr string, weight int) {
+    rest := h
+    if i := strings.Index(h, "://"); i >= 0 {
+        rest = h[i+3:]
+    }
+    if i := strings.LastIndex(rest, ":"); i > 0 && hasPort(rest[:i]) {
+        if w, e := strconv.Atoi(rest[i+1:]); e == nil && w > 0 {
+            return h[:len(h)-len(rest)+i], w
+        }
+    }
+    return h, 1
+}
+
 func NewConsistantHashScheduler(hosts []string, hashname string) Scheduler {
-    var c ConsistantHashScheduler
-    c.hosts = make([]*Host, len(hosts))
-    c.index = make([]uint64, len(hosts)*VIRTUAL_NODES)
+    return NewConsistantHashSchedulerWithNodes(hosts, hashname, VIRTUAL_NODES)
+}
+
+// more virtual nodes give smoother distribution, but cost more time and memory to build the ring
+func NewConsistantHashSchedulerWithNodes(hosts []string, hashname string, vnodes int) Scheduler {
+    if vnodes <= 0 {
+        vnodes = VIRTUAL_NODES
+    }
+    c := new(ConsistantHashScheduler)
+    c.hashName = hashname
     c.hashMethod = hashMethods[hashname]
-    for i, h := range hosts {
-        c.hosts[i] = NewHost(h)
-        for j := 0; j < VIRTUAL_NODES; j++ {
-            v := c.hashMethod([]byte(fmt.Sprintf("%s-%d", h, j)))
+    c.points = virtualNodes(c.hashMethod, vnodes)
+    c.rebuild(hosts)
+    return c
+}
+
+func virtualNodes(hashMethod HashMethod, vnodes int) func(h string, weight int) []uint32 {
+    return func(h string, weight int) []uint32 {
+        vs := make([]uint32, vnodes*weight)
+        for j := range vs {
+            v := hashMethod([]byte(fmt.Sprintf("%s-%d", h, j)))
             ps := strings.SplitN(h, ":", 2)
             host := ps[0]
             port := ps[1]
             if port == "11211" {
-                v = c.hashMethod([]byte(fmt.Sprintf("%s-%d", host, j)))
+                v = hashMethod([]byte(fmt.Sprintf("%s-%d", host, j)))
+            }
+            vs[j] = v
+        }
+        return vs
+    }
+}
+
+// points of every host in ketama's continuum, 4 points for every md5 digest
+const KETAMA_POINTS = 160
+
+// build the ring exactly as libketama does, the hosts should be written
+// as "ip:port" like the clients, so they get the same host for a key
+func NewKetamaScheduler(hosts []string) Scheduler {
+    c := new(ConsistantHashScheduler)
+    c.hashName = "md5"
+    c.hashMethod = md5hash
+    c.points = func(h string, weight int) []uint32 {
+        vs := make([]uint32, 0, KETAMA_POINTS*weight)
+        for j := 0; j < KETAMA_POINTS*weight/4; j++ {
+            d := md5.Sum([]byte(fmt.Sprintf("%s-%d", h, j)))
+            for k := 0; k < 4; k++ {
+                v := (uint32(d[3+k*4]) << 24) | (uint32(d[2+k*4]) << 16) | (uint32(d[1+k*4]) << 8) | uint32(d[k*4])
+                vs = append(vs, v)
             }
-            c.index[i*VIRTUAL_NODES+j] = (uint64(v) << 32) + uint64(i)
         }
+        return vs
     }
-    sort.Sort(uint64Slice(c.index))
-    if !sort.IsSorted(uint64Slice(c.index)) {
-        panic("sort failed")
+    c.rebuild(hosts)
+    return c
+}
+
+// build a new ring aside and replace the old one, so lookups never
+// see a partially built ring, the hosts kept are reused
+func (c *ConsistantHashScheduler) rebuild(specs []string) {
+    old := make(map[string]*Host)
+    if r, ok := c.ring.Load().(*hashRing); ok {
+        for _, h := range r.hosts {
+            old[h.Addr] = h
+        }
     }
-    return &c
+    r := &hashRing{hosts: make([]*Host, len(specs))}
+    for i, spec := range specs {
+        addr, weight := parseHostWeight(spec)
+        h, ok := old[addr]
+        if !ok {
+            h = NewHost(addr)
+        }
+        r.hosts[i] = h
+        for _, v := range c.points(addr, weight) {
+            r.index = append(r.index, (uint64(v)<<32)+uint64(i))
+        }
+    }
+    sort.Sort(uint64Slice(r.index))
+    c.specs = specs
+    c.ring.Store(r)
+}
+
+func (c *ConsistantHashScheduler) current() *hashRing {
+    return c.ring.Load().(*hashRing)
 }
 
-func (c *ConsistantHashScheduler) getHostIndex(key string) int {
+// position of the key in the index of ring
+func (c *ConsistantHashScheduler) ringPosition(r *hashRing, key string) int {
     h := uint64(c.hashMethod([]byte(key))) << 32
-    N := len(c.index)
-    i := sort.Search(N, func(k int) bool { return c.index[k] >= h })
+    N := len(r.index)
+    i := sort.Search(N, func(k int) bool { return r.index[k] >= h })
     if i == N {
         i = 0
     }
-    return int(c.index[i] & 0xffffffff)
+    return i
+}
+
+func (c *ConsistantHashScheduler) getHostIndex(r *hashRing, key string) int {
+    return int(r.index[c.ringPosition(r, key)] & 0xffffffff)
+}
+
+// indexes of the distinct hosts for the key, walking the ring clockwise
+func (c *ConsistantHashScheduler) replicaIndexes(r *hashRing, key string) []int {
+    return c.walkRing(r, key, c.Replicas)
+}
+
+// indexes of the first n distinct hosts from the key
+func (c *ConsistantHashScheduler) walkRing(r *hashRing, key string, n int) []int {
+    if n > len(r.hosts) {
+        n = len(r.hosts)
+    }
+    if n <= 1 {
+        return []int{c.getHostIndex(r, key)}
+    }
+    rs := make([]int, 0, n)
+    p := c.ringPosition(r, key)
+    for k := 0; k < len(r.index) && len(rs) < n; k++ {
+        i := int(r.index[(p+k)%len(r.index)] & 0xffffffff)
+        dup := false
+        for _, j := range rs {
+            if i == j {
+                dup = true
+                break
+            }
+        }
+        if !dup {
+            rs = append(rs, i)
+        }
+    }
+    return rs
+}
+
+func (c *ConsistantHashScheduler) Hosts() []*Host {
+    return c.current().hosts
 }
 
 func (c *ConsistantHashScheduler) GetHostsByKey(key string) []*Host {
-    r := make([]*Host, 1)
-    i := c.getHostIndex(key)
-    r[0] = c.hosts[i]
+    ring := c.current()
+    n := c.Replicas
+    if n < 1 {
+        n = 1
+    }
+    // walk further for the unavailable hosts to be skipped
+    m := unavailableHosts()
+    idx := c.walkRing(ring, key, n+m)
+    r := make([]*Host, len(idx))
+    for k, i := range idx {
+        r[k] = ring.hosts[i]
+    }
+    if m > 0 {
+        r = skipUnavailable(r)
+        if len(r) > n {
+            r = r[:n]
+        }
+    }
     return r
 }
 
+// keys of a group share all their replicas
 func (c *ConsistantHashScheduler) DivideKeysByBucket(keys []string) [][]string {
-    n := len(c.hosts)
-    rs := make([][]string, n)
+    ring := c.current()
+    n := len(ring.hosts)
+    if c.Replicas <= 1 {
+        rs := make([][]string, n)
+        for _, key := range keys {
+            i := c.getHostIndex(ring, key)
+            rs[i] = append(rs[i], key)
+        }
+        return rs
+    }
+    groups := make(map[string]int)
+    var rs [][]string
+    for _, key := range keys {
+        g := fmt.Sprint(c.replicaIndexes(ring, key))
+        k, ok := groups[g]
+        if !ok {
+            k = len(rs)
+            groups[g] = k
+            rs = append(rs, nil)
+        }
+        rs[k] = append(rs[k], key)
+    }
+    return rs
+}
+
+// route requests by highest random weight (rendezvous hashing), only the keys
+// on a host are remapped when it was added or removed
+type RendezvousScheduler struct {
+    state      atomic.Value // *rendezvousState
+    hashMethod HashMethod
+    lock       sync.Mutex
+    emptyScheduler
+}
+
+type rendezvousState struct {
+    hosts []*Host
+    seeds []uint32
+}
+
+func NewRendezvousScheduler(hosts []string, hashname string) Scheduler {
+    c := new(RendezvousScheduler)
+    c.hashMethod = hashMethods[hashname]
+    c.rebuild(hosts)
+    return c
+}
+
+func (c *RendezvousScheduler) rebuild(addrs []string) {
+    old := make(map[string]*Host)
+    if st, ok := c.state.Load().(*rendezvousState); ok {
+        for _, h := range st.hosts {
+            old[h.Addr] = h
+        }
+    }
+    st := &rendezvousState{make([]*Host, len(addrs)), make([]uint32, len(addrs))}
+    for i, addr := range addrs {
+        h, ok := old[addr]
+        if !ok {
+            h = NewHost(addr)
+        }
+        st.hosts[i] = h
+        st.seeds[i] = c.hashMethod([]byte(addr))
+    }
+    c.state.Store(st)
+}
+
+func (c *RendezvousScheduler) current() *rendezvousState {
+    return c.state.Load().(*rendezvousState)
+}
+
+// mix the hash of key with the seed of host, from murmur3's finalizer
+func rendezvousWeight(h, seed uint32) uint32 {
+    h ^= seed
+    h ^= h >> 16
+    h *= 0x85ebca6b
+    h ^= h >> 13
+    h *= 0xc2b2ae35
+    h ^= h >> 16
+    return h
+}
+
+type byWeight struct {
+    index   []int
+    weights []uint32
+}
+
+func (l byWeight) Len() int {
+    return len(l.index)
+}
+
+func (l byWeight) Less(i, j int) bool {
+    return l.weights[l.index[i]] > l.weights[l.index[j]]
+}
+
+func (l byWeight) Swap(i, j int) {
+    l.index[i], l.index[j] = l.index[j], l.index[i]
+}
+
+func (c *RendezvousScheduler) getHostIndex(st *rendezvousState, key string) int {
+    h := c.hashMethod([]byte(key))
+    best, bestw := 0, uint32(0)
+    for i, seed := range st.seeds {
+        if w := rendezvousWeight(h, seed); i == 0 || w > bestw {
+            best, bestw = i, w
+        }
+    }
+    return best
+}
+
+// all the hosts, ordered by weight
+func (c *RendezvousScheduler) Hosts() []*Host {
+    return c.current().hosts
+}
+
+func (c *RendezvousScheduler) GetHostsByKey(key string) []*Host {
+    st := c.current()
+    h := c.hashMethod([]byte(key))
+    l := byWeight{make([]int, len(st.hosts)), make([]uint32, len(st.hosts))}
+    for i, seed := range st.seeds {
+        l.index[i] = i
+        l.weights[i] = rendezvousWeight(h, seed)
+    }
+    sort.Sort(l)
+    r := make([]*Host, len(st.hosts))
+    for i, j := range l.index {
+        r[i] = st.hosts[j]
+    }
+    return skipUnavailable(r)
+}
+
+func (c *RendezvousScheduler) DivideKeysByBucket(keys []string) [][]string {
+    st := c.current()
+    rs := make([][]string, len(st.hosts))
     for _, key := range keys {
-        i := c.getHostIndex(key)
+        i := c.getHostIndex(st, key)
         rs[i] = append(rs[i], key)
     }
     return rs
@@ -155,46 +469,36 @@ type ManualScheduler struct {
     stats      [][]float64
     hashMethod HashMethod
     feedChan   chan *Feedback
+    done       chan struct{} // closed by Close to stop the goroutines
+    closeOnce  sync.Once
+    lock       sync.RWMutex // protect hosts, stats and buckets from feedback, import and reload
+
+    weightConfig HostWeights
+    weights      [][]float64 // bucket -> offset of host -> weight to be put first
+    fixed        bool        // keep the order of hosts in buckets
+    order        []string
+
+    pins bucketPins
 }
 
 // the string is a Hex int string, if it start with -, it means serve the bucket as a backup
 func NewManualScheduler(config map[string][]string, bs, n int) *ManualScheduler {
-    defer func() {
-        if r := recover(); r != nil {
-            ErrorLog.Fatalln("NewManualScheduler panic, maybe node's supporting bucket more than buckets number")
-        }
-    }()
+    if err := CheckBuckets(bs); err != nil {
+        ErrorLog.Fatalln("NewManualScheduler failed:", err)
+    }
     c := new(ManualScheduler)
-    c.hosts = make([]*Host, len(config))
-    c.buckets = make([][]int, bs)
-    c.backups = make([][]int, bs)
-    c.stats = make([][]float64, bs)
     c.N = n
-
-    no := 0
-    for addr, serve_to := range config {
-        host := NewHost(addr)
-        host.offset = no
-        c.hosts[no] = host
-        for _, bucket_str := range serve_to {
-            if strings.HasPrefix(bucket_str, "-") {
-                if bucket, e := strconv.ParseInt(bucket_str[1:], 16, 16); e == nil {
-                    //c.buckets[bucket] = append(c.buckets[bucket], no)
-                    c.backups[bucket] = append(c.backups[bucket], no)
-
-                } else {
-                    ErrorLog.Println("Parse serving bucket config failed, it was not digital")
-                }
-            } else {
-                if bucket, e := strconv.ParseInt(bucket_str, 16, 16); e == nil {
-                    c.buckets[bucket] = append(c.buckets[bucket], no)
-                } else {
-                    ErrorLog.Println("Parse serving bucket config failed, it was not digital")
-                }
-            }
-        }
-        no++
+    hosts, buckets, backups, err := parseManualConfig(config, bs, nil)
+    if err != nil {
+        ErrorLog.Fatalln("NewManualScheduler failed:", err)
+    }
+    for j, h := range hosts {
+        h.offset = j
     }
+    c.hosts = hosts
+    c.buckets = buckets
+    c.backups = backups
+    c.stats = make([][]float64, bs)
     // set c.stats according to c.buckets
     for b := 0; b < bs; b++ {
         c.stats[b] = make([]float64, len(c.hosts))
@@ -202,16 +506,125 @@ func NewManualScheduler(config map[string][]string, bs, n int) *ManualScheduler
     c.hashMethod = fnv1a1
     c.bucketWidth = calBitWidth(bs)
 
+    c.feedChan = make(chan *Feedback, FeedbackQueueSize)
+    c.done = make(chan struct{})
     go c.procFeedback()
     go func() {
         for {
             c.try_reward()
-            time.Sleep(5 * 1e9)
+            select {
+            case <-time.After(5 * 1e9):
+            case <-c.done:
+                return
+            }
         }
     }()
     return c
 }
 
+func (c *ManualScheduler) Close() {
+    c.closeOnce.Do(func() {
+        close(c.done)
+        closeHosts(c.Hosts())
+    })
+}
+
+// hosts in old with the same address are reused
+func parseManualConfig(config map[string][]string, bs int, old map[string]*Host) (hosts []*Host, buckets, backups [][]int, err error) {
+    hosts = make([]*Host, len(config))
+    buckets = make([][]int, bs)
+    backups = make([][]int, bs)
+    no := 0
+    for addr, serve_to := range config {
+        host, ok := old[addr]
+        if !ok {
+            host = NewHost(addr)
+        }
+        hosts[no] = host
+        for _, bucket_str := range serve_to {
+            backup := strings.HasPrefix(bucket_str, "-")
+            if backup {
+                bucket_str = bucket_str[1:]
+            }
+            bucket, e := strconv.ParseInt(bucket_str, 16, 16)
+            if e != nil {
+                ErrorLog.Println("Parse serving bucket config failed, it was not digital")
+                continue
+            }
+            if int(bucket) >= bs {
+                return nil, nil, nil, fmt.Errorf("bucket %X of %s is out of %d buckets", bucket, addr, bs)
+            }
+            if backup {
+                backups[bucket] = append(backups[bucket], no)
+            } else {
+                buckets[bucket] = append(buckets[bucket], no)
+            }
+        }
+        no++
+    }
+    return
+}
+
+// swap the hosts and buckets while requests are in flight,
+// scores of the hosts kept are carried over
+func (c *ManualScheduler) Reload(config map[string][]string) error {
+    c.lock.RLock()
+    bs := len(c.buckets)
+    old := make(map[string]*Host, len(c.hosts))
+    for _, h := range c.hosts {
+        old[h.Addr] = h
+    }
+    c.lock.RUnlock()
+
+    hosts, buckets, backups, err := parseManualConfig(config, bs, old)
+    if err != nil {
+        return err
+    }
+    for b, bucket := range buckets {
+        if len(bucket) < c.N {
+            return fmt.Errorf("bucket %X has %d hosts, less than %d", b, len(bucket), c.N)
+        }
+    }
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    // weights of the hosts removed are dropped
+    weightConfig := make(HostWeights, len(c.weightConfig))
+    for addr, w := range c.weightConfig {
+        if _, ok := config[addr]; ok {
+            weightConfig[addr] = w
+        }
+    }
+    weights, err := parseWeights(weightConfig, hosts, bs)
+    if err != nil {
+        return err
+    }
+    stats := make([][]float64, bs)
+    for b := range stats {
+        stats[b] = make([]float64, len(hosts))
+        for j, h := range hosts {
+            if _, ok := old[h.Addr]; ok && h.offset < len(c.stats[b]) && c.hosts[h.offset] == h {
+                stats[b][j] = c.stats[b][h.offset]
+            }
+        }
+    }
+    for j, h := range hosts {
+        h.offset = j
+    }
+    c.hosts = hosts
+    c.buckets = buckets
+    c.backups = backups
+    c.stats = stats
+    c.weightConfig = weightConfig
+    c.weights = weights
+    if c.fixed {
+        c.sortByOrder()
+    }
+    ErrorLog.Printf("ManualScheduler reloaded with %d hosts", len(hosts))
+    RecordEvent("reload", "", fmt.Sprintf("%d hosts", len(hosts)))
+    return nil
+}
+
 func fastdivideKeysByBucket(hash_func HashMethod, bs int, bw int, keys []string) [][]string {
     rs := make([][]string, bs)
     //bw := calBitWidth(bs)
@@ -239,12 +652,22 @@ func (c *ManualScheduler) dump_scores() {
 
 func (c *ManualScheduler) try_reward() {
     //c.dump_scores()
+    c.lock.RLock()
+    hosts := c.hosts
+    buckets := make([][]int, len(c.buckets))
+    scores := make([][]float64, len(c.stats))
     for i, bucket := range c.buckets {
+        buckets[i] = append([]int(nil), bucket...)
+        scores[i] = append([]float64(nil), c.stats[i]...)
+    }
+    c.lock.RUnlock()
+
+    for i, bucket := range buckets {
         // random raward 2nd, 3rd node
         second_node := bucket[1]
-        if _, err := c.hosts[second_node].Get("@"); err == nil {
+        if _, err := hosts[second_node].Get("@"); err == nil {
             var second_reward float64 = 0.0
-            second_stat := c.stats[i][second_node]
+            second_stat := scores[i][second_node]
             if second_stat < 0 {
                 second_reward = 0 - second_stat
             } else {
@@ -252,13 +675,13 @@ func (c *ManualScheduler) try_reward() {
             }
             c.feedChan <- &Feedback {hostIndex: second_node, bucketIndex: i, adjust: second_reward}
         } else {
-            ErrorLog.Printf("beansdb server : %s in Bucket %X's second node Down while try_reward, the err = %s", c.hosts[second_node].Addr, i, err)
+            ErrorLog.Printf("beansdb server : %s in Bucket %X's second node Down while try_reward, the err = %s", hosts[second_node].Addr, i, err)
         }
 
         third_node := bucket[2]
-        if _, err := c.hosts[third_node].Get("@"); err == nil {
+        if _, err := hosts[third_node].Get("@"); err == nil {
             var third_reward float64 = 0.0
-            third_stat := c.stats[i][second_node]
+            third_stat := scores[i][second_node]
             if third_stat < 0 {
                 third_reward = 0 - third_stat
             } else {
@@ -266,22 +689,32 @@ func (c *ManualScheduler) try_reward() {
             }
             c.feedChan <- &Feedback {hostIndex: third_node, bucketIndex: i, adjust: third_reward}
         } else {
-            ErrorLog.Printf("beansdb server : %s in Bucket %X's third node Down while try_reward, the err = %s", c.hosts[third_node].Addr, i, err)
+            ErrorLog.Printf("beansdb server : %s in Bucket %X's third node Down while try_reward, the err = %s", hosts[third_node].Addr, i, err)
         }
     }
 }
 
 func (c *ManualScheduler) procFeedback() {
-    c.feedChan = make(chan *Feedback, 256)
     for {
-        fb := <-c.feedChan
+        var fb *Feedback
+        select {
+        case fb = <-c.feedChan:
+        case <-c.done:
+            return
+        }
+        c.lock.Lock()
         c.feedback(fb.hostIndex, fb.bucketIndex, fb.adjust)
+        c.lock.Unlock()
     }
 }
 
 func (c *ManualScheduler) feedback(i, bucket_index int, adjust float64) {
 
     stats := c.stats[bucket_index]
+    if i >= len(stats) {
+        // the host was removed by reload
+        return
+    }
     old := stats[i]
     stats[i] += adjust
 
@@ -291,6 +724,9 @@ func (c *ManualScheduler) feedback(i, bucket_index int, adjust float64) {
             stats[index] = stats[index] / 2
         }
     }
+    if c.fixed {
+        return
+    }
     bucket := make([]int, c.N)
     copy(bucket, c.buckets[bucket_index])
 
@@ -301,6 +737,10 @@ func (c *ManualScheduler) feedback(i, bucket_index int, adjust float64) {
             break
         }
     }
+    if k == c.N {
+        // not a primary host of the bucket
+        return
+    }
 
     if stats[i]-old > 0 {
         for k > 0 && stats[bucket[k]] > stats[bucket[k-1]] {
@@ -317,7 +757,19 @@ func (c *ManualScheduler) feedback(i, bucket_index int, adjust float64) {
     c.buckets[bucket_index] = bucket
 }
 
+func (c *ManualScheduler) Hosts() []*Host {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    return append([]*Host(nil), c.hosts...)
+}
+
 func (c *ManualScheduler) GetHostsByKey(key string) (hosts []*Host) {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    return skipUnavailable(c.getHostsByKey(key))
+}
+
+func (c *ManualScheduler) getHostsByKey(key string) (hosts []*Host) {
     i := getBucketByKey(c.hashMethod, c.bucketWidth, key)
     hosts = make([]*Host, c.N + len(c.backups[i]))
     for j, offset := range c.buckets[i] {
@@ -327,19 +779,29 @@ func (c *ManualScheduler) GetHostsByKey(key string) (hosts []*Host) {
     for j, offset := range c.backups[i] {
         hosts[c.N + j] = c.hosts[offset]
     }
-    return
+    preferLocalZone(hosts, c.N)
+    if c.weights != nil && c.weights[i] != nil && !c.fixed {
+        pickWeighted(hosts, c.weights[i], c.N)
+    }
+    return c.pins.apply(i, hosts)
 }
 
 func (c *ManualScheduler) DivideKeysByBucket(keys []string) [][]string {
     return fastdivideKeysByBucket(c.hashMethod, len(c.buckets), c.bucketWidth, keys)
 }
 
-func (c *ManualScheduler) Feedback(host *Host, key string, adjust float64) {
+func (c *ManualScheduler) Feedback(host *Host, key string, ev FeedbackEvent) {
+    adjust := ev.Score()
+    if adjust == 0 {
+        return
+    }
     index := getBucketByKey(c.hashMethod, c.bucketWidth, key)
-    c.feedChan <- &Feedback{hostIndex: host.offset, bucketIndex: index, adjust: adjust}
+    sendFeedback(c.feedChan, &Feedback{hostIndex: host.offset, bucketIndex: index, adjust: adjust})
 }
 
 func (c *ManualScheduler) Stats() map[string][]float64 {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
     r := make(map[string][]float64, len(c.hosts))
     for _, h := range c.hosts {
         r[h.Addr] = make([]float64, len(c.buckets))
@@ -358,19 +820,44 @@ type Feedback struct {
     adjust      float64
 }
 
+// feedback queued for schedulers, more are dropped rather than blocking
+// the requests when schedulers fall behind
+var FeedbackQueueSize = 1024
+
+var feedbackDropped int64
+
+func sendFeedback(ch chan *Feedback, fb *Feedback) {
+    select {
+    case ch <- fb:
+    default:
+        atomic.AddInt64(&feedbackDropped, 1)
+    }
+}
+
 // route requests by auto discoved infomation, used in beansdb
 type AutoScheduler struct {
     n          int
     hosts      []*Host
+    index      map[*Host]int // offsets of hosts, hosts are not changed after created
     buckets    [][]int
     stats      [][]float64
     last_check time.Time
+    last_decay time.Time
+    checkCursor int // next directory to list, of all the directories of all the hosts
+    listed     [][]float64 // bucket -> the last count listed by every host, -1 if not yet, see AutoCheckQuorum
     hashMethod HashMethod
     feedChan   chan *Feedback
+    done       chan struct{} // closed by Close to stop the goroutines
+    closeOnce  sync.Once
     bucketWidth int
+    lock       sync.Mutex // protect stats and buckets from feedback and import
+    pins       bucketPins
 }
 
 func NewAutoScheduler(config []string, bs int) *AutoScheduler {
+    if err := CheckBuckets(bs); err != nil {
+        ErrorLog.Fatalln("NewAutoScheduler failed:", err)
+    }
     c := new(AutoScheduler)
     c.n = len(config)
     c.hosts = make([]*Host, c.n)
@@ -387,20 +874,42 @@ func NewAutoScheduler(config []string, bs int) *AutoScheduler {
             c.stats[j][i] = 0
         }
     }
+    c.indexHosts()
     c.hashMethod = fnv1a1
-    c.bucketWidth = calBitWidth(c.n)
+    if AutoBucketsByCount {
+        c.bucketWidth = calBitWidth(bs)
+    } else {
+        c.bucketWidth = calBitWidth(c.n)
+    }
+    c.feedChan = make(chan *Feedback, FeedbackQueueSize)
+    c.done = make(chan struct{})
     go c.procFeedback()
 
     c.check()
-    go func() {
-        for {
-            c.check()
-            time.Sleep(10 * 1e9)
-        }
-    }()
+    go c.checkLoop()
     return c
 }
 
+func (c *AutoScheduler) Close() {
+    c.closeOnce.Do(func() {
+        close(c.done)
+        closeHosts(c.hosts)
+    })
+}
+
+// buckets are picked by the top bits of hashes, and listed by hex prefixes
+// of @ keys like beansdb, so the count should be a power of 16
+func CheckBuckets(bs int) error {
+    n := bs
+    for n > 1 && n%16 == 0 {
+        n /= 16
+    }
+    if bs <= 0 || n != 1 {
+        return fmt.Errorf("buckets should be a power of 16 (16, 256, 4096), not %d", bs)
+    }
+    return nil
+}
+
 func calBitWidth(number int) int {
     width := 0
     for number > 1 {
@@ -421,6 +930,10 @@ func getBucketByKey(hash_func HashMethod, bucketWidth int, key string) int {
     return (int)(h >> (uint)(32-bucketWidth))
 }
 
+func (c *AutoScheduler) Hosts() []*Host {
+    return c.hosts
+}
+
 func (c *AutoScheduler) GetHostsByKey(key string) []*Host {
     i := getBucketByKey(c.hashMethod, c.bucketWidth, key)
     //host_ids := c.GetBucketSnapshot(i)
@@ -430,7 +943,44 @@ func (c *AutoScheduler) GetHostsByKey(key string) []*Host {
     for j := 0; j < cnt; j++ {
         hosts[j] = c.hosts[host_ids[j]]
     }
-    return hosts
+    n := dataHosts(host_ids, c.stats[i])
+    n = preferLocalZone(hosts, n)
+    preferFastHost(hosts[:n])
+    return skipUnavailable(c.pins.apply(i, hosts))
+}
+
+// hosts with score not less than this ratio of the best one are supposed
+// to have the data, the fastest of them is moved to the first
+var LatencyScoreRatio = 0.8
+
+// the number of leading hosts which are supposed to have the data
+func dataHosts(host_ids []int, stats []float64) int {
+    best := stats[host_ids[0]]
+    if best <= 0 {
+        return 1
+    }
+    n := 1
+    for n < len(host_ids) && stats[host_ids[n]] >= best*LatencyScoreRatio {
+        n++
+    }
+    return n
+}
+
+func preferFastHost(hosts []*Host) {
+    if len(hosts) < 2 || hosts[0].Latency() == 0 {
+        return
+    }
+    fastest := 0
+    for j := 1; j < len(hosts); j++ {
+        if l := hosts[j].Latency(); l > 0 && l < hosts[fastest].Latency() {
+            fastest = j
+        }
+    }
+    if fastest > 0 {
+        h := hosts[fastest]
+        copy(hosts[1:fastest+1], hosts[:fastest])
+        hosts[0] = h
+    }
 }
 
 func divideKeysByBucket(hash_func HashMethod, bs int, keys []string) [][]string {
@@ -472,31 +1022,48 @@ func abs(x float64) float64 {
     return x
 }
 
-func (c *AutoScheduler) hostIndex(host *Host) int {
+// index the hosts for hostIndex, after the hosts are set
+func (c *AutoScheduler) indexHosts() {
+    c.index = make(map[*Host]int, len(c.hosts))
     for i, h := range c.hosts {
-        if h == host {
-            return i
-        }
+        c.index[h] = i
+    }
+}
+
+func (c *AutoScheduler) hostIndex(host *Host) int {
+    if i, ok := c.index[host]; ok {
+        return i
     }
     return -1
 }
 
 func (c *AutoScheduler) procFeedback() {
-    c.feedChan = make(chan *Feedback, 1024)
     for {
-        fb := <-c.feedChan
+        var fb *Feedback
+        select {
+        case fb = <-c.feedChan:
+        case <-c.done:
+            return
+        }
+        c.lock.Lock()
         c.feedback(fb.hostIndex, fb.bucketIndex, fb.adjust)
+        c.lock.Unlock()
     }
 }
 
-func (c *AutoScheduler) Feedback(host *Host, key string, adjust float64) {
+func (c *AutoScheduler) Feedback(host *Host, key string, ev FeedbackEvent) {
+    adjust := ev.Score()
+    // an empty directory listed halves the score
+    if adjust == 0 && ev.Kind != FeedbackListing {
+        return
+    }
     index := getBucketByKey(c.hashMethod, c.bucketWidth, key)
     i := c.hostIndex(host)
     if i < 0 {
         return
     }
     //c.feedback(i, index, adjust)
-    c.feedChan <- &Feedback{hostIndex: i, bucketIndex: index, adjust: adjust}
+    sendFeedback(c.feedChan, &Feedback{hostIndex: i, bucketIndex: index, adjust: adjust})
 }
 
 func (c *AutoScheduler) feedback(i, index int, adjust float64) {
@@ -531,6 +1098,31 @@ func (c *AutoScheduler) feedback(i, index int, adjust float64) {
     c.buckets[index] = buckets
 }
 
+// penalties (negative scores) of AutoScheduler are halved in this time, so a
+// host which failed long ago could win its place back by a few successes
+// after it recovered, 0 to disable
+var ScoreHalfLife = time.Minute * 10
+
+// decay the penalties by the time since last decay, the order of hosts is not
+// changed, as all the penalties are scaled by the same factor
+func (c *AutoScheduler) decay(now time.Time) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    last := c.last_decay
+    c.last_decay = now
+    if ScoreHalfLife <= 0 || last.IsZero() || !now.After(last) {
+        return
+    }
+    factor := math.Pow(0.5, float64(now.Sub(last))/float64(ScoreHalfLife))
+    for _, stats := range c.stats {
+        for i, w := range stats {
+            if w < 0 {
+                stats[i] = w * factor
+            }
+        }
+    }
+}
+
 func hextoi(hex string) int {
     r := rune(0)
     for _, c := range hex {
@@ -558,36 +1150,118 @@ func (c *AutoScheduler) listHost(host *Host, dir string) {
         }
         vv := bytes.SplitN(line, []byte(" "), 3)
         cnt, _ := strconv.ParseFloat(string(vv[2]), 64)
-        adjust := float64(math.Sqrt(cnt))
-        c.Feedback(host, dir+string(vv[0]), adjust)
+        key := dir + string(vv[0])
+        if AutoCheckQuorum && !c.agreed(host, key, cnt) {
+            continue
+        }
+        c.Feedback(host, key, FeedbackEvent{Kind: FeedbackListing, Count: cnt})
     }
 }
 
-func (c *AutoScheduler) check() {
-    defer func() {
-        if e := recover(); e != nil {
-            ErrorLog.Print("error while check()", e)
-        }
-    }()
+// the auto scheduler picks the bucket of a key by the bucket count like
+// beansdb, rather than by the number of hosts as it used to, which moves keys
+// to other buckets, so it is opt-in
+var AutoBucketsByCount = false
+
+// directories listed by a check at most, the others are listed by the next
+// checks in turn, so big clusters are not listed all at once, 0 for no limit
+var AutoCheckListings = 1024
+
+// checks are spaced by AutoCheckInterval, which is doubled (up to
+// AutoCheckMaxInterval) after a round of all the directories found no
+// bucket changed, and reset once any changed
+var AutoCheckInterval = time.Second * 10
+var AutoCheckMaxInterval = time.Second * 160
+
+// directories of every host to list
+func (c *AutoScheduler) checkDirs() []string {
     bs := len(c.buckets)
     bucketWidth := 0
     for bs > 1 {
         bucketWidth++
         bs /= 2
     }
-    count := 1 << (uint)(bucketWidth-4)
     w := bucketWidth/4 - 1
+    if w < 1 {
+        return []string{"@"}
+    }
+    count := 1 << (uint)(bucketWidth-4)
     format := fmt.Sprintf("@%%0%dx", w)
-    for _, host := range c.hosts {
-        if w < 1 {
-            c.listHost(host, "@")
-        } else {
-            for i := 0; i < count; i++ {
-                key := fmt.Sprintf(format, i)
-                c.listHost(host, key)
-            }
-        }
+    dirs := make([]string, count)
+    for i := range dirs {
+        dirs[i] = fmt.Sprintf(format, i)
     }
+    return dirs
+}
+
+// list all the directories of all the hosts
+func (c *AutoScheduler) check() {
+    c.checkSome(0)
+}
 
+// list up to limit directories from the cursor, 0 for all of them, round is
+// true if the last of all the directories was listed
+func (c *AutoScheduler) checkSome(limit int) (round bool) {
+    defer func() {
+        if e := recover(); e != nil {
+            ErrorLog.Print("error while check()", e)
+        }
+    }()
+    dirs := c.checkDirs()
+    total := len(c.hosts) * len(dirs)
+    if limit <= 0 || limit > total {
+        limit = total
+    }
+    for k := 0; k < limit; k++ {
+        p := (c.checkCursor + k) % total
+        c.listHost(c.hosts[p/len(dirs)], dirs[p%len(dirs)])
+    }
+    c.checkCursor += limit
+    if c.checkCursor >= total {
+        c.checkCursor %= total
+        round = true
+    }
     c.last_check = time.Now()
+    return
+}
+
+// the first host of every bucket
+func (c *AutoScheduler) primaries() []int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    ps := make([]int, len(c.buckets))
+    for i, hosts := range c.buckets {
+        ps[i] = hosts[0]
+    }
+    return ps
+}
+
+func (c *AutoScheduler) checkLoop() {
+    interval := AutoCheckInterval
+    last := c.primaries()
+    changed := false
+    for {
+        round := c.checkSome(AutoCheckListings)
+        c.decay(time.Now())
+        ps := c.primaries()
+        for i := range ps {
+            if ps[i] != last[i] {
+                changed = true
+                interval = AutoCheckInterval
+                break
+            }
+        }
+        last = ps
+        if round {
+            if !changed && interval*2 <= AutoCheckMaxInterval {
+                interval *= 2
+            }
+            changed = false
+        }
+        select {
+        case <-time.After(interval):
+        case <-c.done:
+            return
+        }
+    }
 }
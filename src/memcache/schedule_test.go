@@ -1,6 +1,11 @@
 package memcache
 
-import "testing"
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 type testCase struct {
 	key   string
@@ -56,6 +61,25 @@ func TestManualScheduler(t *testing.T) {
 func TestAutoScheduler(t *testing.T) {
 }
 
+func TestAutoSchedulerPreferFastHost(t *testing.T) {
+	schd := newTestAutoScheduler([]string{"a", "b", "c"}, 1)
+	schd.stats[0] = []float64{10, 9, 1}
+	schd.hosts[0].updateLatency(50 * time.Millisecond)
+	schd.hosts[1].updateLatency(time.Millisecond)
+	schd.hosts[2].updateLatency(time.Microsecond)
+	hosts := schd.GetHostsByKey("key")
+	if hosts[0].Addr != "b" || hosts[1].Addr != "a" || hosts[2].Addr != "c" {
+		t.Errorf("the fastest host with data should be the first: %v %v %v", hosts[0].Addr, hosts[1].Addr, hosts[2].Addr)
+	}
+
+	for i := 0; i < 100; i++ {
+		schd.hosts[0].updateLatency(100 * time.Microsecond)
+	}
+	if hosts := schd.GetHostsByKey("key"); hosts[0].Addr != "a" {
+		t.Errorf("a should be preferred after it became fast: %v", hosts[0].Addr)
+	}
+}
+
 var modhosts = []string{
 	"host0:11211", "host0:11212", "host0:11213", "host0:11214",
 	"host1:11211", "host1:11212", "host1:11213", "host1:11214",
@@ -143,3 +167,375 @@ func TestConsistantHashScheduler(t *testing.T) {
 	schd := NewConsistantHashScheduler(chthosts, "md5")
 	testScheduler(t, schd, chtests, true)
 }
+
+func TestRendezvousScheduler(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+	schd := NewRendezvousScheduler(chthosts, "md5")
+	smaller := NewRendezvousScheduler(chthosts[1:], "md5")
+	moved := 0
+	for _, key := range keys {
+		hosts := schd.GetHostsByKey(key)
+		if len(hosts) != len(chthosts) {
+			t.Fatalf("should return all hosts: %d", len(hosts))
+		}
+		first := hosts[0].Addr
+		if first == chthosts[0] {
+			if smaller.GetHostsByKey(key)[0].Addr != hosts[1].Addr {
+				t.Errorf("key %s should move to the next host %s", key, hosts[1].Addr)
+			}
+			continue
+		}
+		if smaller.GetHostsByKey(key)[0].Addr != first {
+			moved++
+		}
+	}
+	if moved > 0 {
+		t.Errorf("%d keys moved which were not on the removed host", moved)
+	}
+	for i, ks := range schd.DivideKeysByBucket(keys) {
+		for _, k := range ks {
+			if schd.GetHostsByKey(k)[0].Addr != chthosts[i] {
+				t.Errorf("key %s is not divided to %s", k, chthosts[i])
+			}
+		}
+	}
+}
+
+var ketamahosts = []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11212"}
+
+// the same as libketama
+var ketamatests = []testCase{
+	testCase{"foo", []string{"10.0.0.2:11211"}},
+	testCase{"bar", []string{"10.0.0.1:11211"}},
+	testCase{"key:1", []string{"10.0.0.3:11212"}},
+	testCase{"key:2", []string{"10.0.0.2:11211"}},
+	testCase{"key:3", []string{"10.0.0.1:11211"}},
+	testCase{"hello world", []string{"10.0.0.1:11211"}},
+}
+
+func TestKetamaScheduler(t *testing.T) {
+	schd := NewKetamaScheduler(ketamahosts)
+	testScheduler(t, schd, ketamatests, true)
+}
+
+func TestMaglevScheduler(t *testing.T) {
+	if _, err := NewMaglevScheduler(nil, "md5", 0); err != ErrNoHosts {
+		t.Errorf("maglev without hosts should fail: %v", err)
+	}
+	schd := newTestMaglevScheduler(chthosts, 1000).current()
+	if len(schd.table) != 1009 {
+		t.Errorf("table size should be the next prime: %d", len(schd.table))
+	}
+	counts := make([]int, len(chthosts))
+	for _, i := range schd.table {
+		counts[i]++
+	}
+	for i, n := range counts {
+		if n < 1009/len(chthosts)-1 || n > 1009/len(chthosts)+1 {
+			t.Errorf("%s has %d slots, not balanced", chthosts[i], n)
+		}
+	}
+
+	smaller := newTestMaglevScheduler(chthosts[1:], 1000).current()
+	moved := 0
+	for i, j := range schd.table {
+		if j != 0 && chthosts[j] != chthosts[1:][smaller.table[i]] {
+			moved++
+		}
+	}
+	if moved > len(schd.table)/10 {
+		t.Errorf("too many slots moved after removing a host: %d", moved)
+	}
+}
+
+func TestConsistantHashReplicas(t *testing.T) {
+	schd := NewConsistantHashScheduler(chthosts, "md5").(*ConsistantHashScheduler)
+	schd.Replicas = 3
+	keys := []string{"a", "b", "c", "d", "e", "f", "g"}
+	for _, key := range keys {
+		hosts := schd.GetHostsByKey(key)
+		if len(hosts) != 3 || hosts[0] == hosts[1] || hosts[1] == hosts[2] || hosts[0] == hosts[2] {
+			t.Errorf("%s should have 3 distinct hosts: %v", key, hosts)
+		}
+		schd.Replicas = 1
+		if first := schd.GetHostsByKey(key); len(first) != 1 || first[0] != hosts[0] {
+			t.Errorf("first host of %s should not change: %v", key, first)
+		}
+		schd.Replicas = 3
+	}
+	n := 0
+	for _, g := range schd.DivideKeysByBucket(keys) {
+		for _, key := range g {
+			if fmt.Sprint(schd.GetHostsByKey(key)) != fmt.Sprint(schd.GetHostsByKey(g[0])) {
+				t.Errorf("%s and %s have different replicas", key, g[0])
+			}
+			n++
+		}
+	}
+	if n != len(keys) {
+		t.Errorf("all the keys should be divided: %d", n)
+	}
+}
+
+func TestParseHostWeight(t *testing.T) {
+	for spec, want := range map[string]struct {
+		addr   string
+		weight int
+	}{
+		"host:11211":        {"host:11211", 1},
+		"host:11211:3":      {"host:11211", 3},
+		"host:11211:0":      {"host:11211:0", 1},
+		"redis://h:6379":    {"redis://h:6379", 1},
+		"redis://h:6379:2":  {"redis://h:6379", 2},
+		"[::1]:11211":       {"[::1]:11211", 1},
+		"[::1]:11211:2":     {"[::1]:11211", 2},
+		"localhost":         {"localhost", 1},
+		"redis://localhost": {"redis://localhost", 1},
+	} {
+		if addr, weight := parseHostWeight(spec); addr != want.addr || weight != want.weight {
+			t.Errorf("%s should be %s with weight %d, not %s %d", spec, want.addr, want.weight, addr, weight)
+		}
+	}
+}
+
+func TestWeightedConsistantHashScheduler(t *testing.T) {
+	schd := NewConsistantHashScheduler([]string{"host0:11211:2", "host1:11211"}, "md5")
+	if hosts := schd.GetHostsByKey("key"); hosts[0].Addr != "host0:11211" && hosts[0].Addr != "host1:11211" {
+		t.Errorf("weight should be stripped from address: %s", hosts[0].Addr)
+	}
+	rs := schd.DivideKeysByBucket(func() []string {
+		keys := make([]string, 3000)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("key:%d", i)
+		}
+		return keys
+	}())
+	ratio := float64(len(rs[0])) / float64(len(rs[1]))
+	if ratio < 1.5 || ratio > 2.5 {
+		t.Errorf("host0 should take about 2x keys of host1: %d %d", len(rs[0]), len(rs[1]))
+	}
+}
+
+func TestConsistantHashSchedulerWithNodes(t *testing.T) {
+	ring := NewConsistantHashSchedulerWithNodes(chthosts, "md5", 10).(*ConsistantHashScheduler).current()
+	if len(ring.index) != 10*len(chthosts) {
+		t.Errorf("ring should have 10 points per host: %d", len(ring.index))
+	}
+	schd := NewConsistantHashSchedulerWithNodes(chthosts, "md5", VIRTUAL_NODES)
+	testScheduler(t, schd, chtests, true)
+}
+
+func newTestMaglevScheduler(hosts []string, size int) *MaglevScheduler {
+	sch, err := NewMaglevScheduler(hosts, "md5", size)
+	if err != nil {
+		panic(err)
+	}
+	return sch.(*MaglevScheduler)
+}
+
+// a ManualScheduler without background goroutines
+func newTestManualScheduler(config map[string][]string, bs, n int) *ManualScheduler {
+	hosts, buckets, backups, err := parseManualConfig(config, bs, nil)
+	if err != nil {
+		panic(err)
+	}
+	c := &ManualScheduler{N: n, hosts: hosts, buckets: buckets, backups: backups}
+	c.stats = make([][]float64, bs)
+	for b := range c.stats {
+		c.stats[b] = make([]float64, len(hosts))
+	}
+	for j, h := range hosts {
+		h.offset = j
+	}
+	c.hashMethod = fnv1a1
+	c.bucketWidth = calBitWidth(bs)
+	return c
+}
+
+func TestCheckBuckets(t *testing.T) {
+	for _, bs := range []int{1, 16, 256} {
+		if err := CheckBuckets(bs); err != nil {
+			t.Errorf("%d buckets should be valid: %s", bs, err)
+		}
+	}
+	for _, bs := range []int{0, -16, 2, 3, 8, 10, 32, 100} {
+		if err := CheckBuckets(bs); err == nil {
+			t.Errorf("%d buckets should be rejected", bs)
+		}
+	}
+	config := map[string][]string{"host1": {"0"}, "host2": {"0"}, "host3": {"0"}}
+	if _, err := NewSchedulerByName("manual", SchedulerConfig{Servers: config, Buckets: 12, N: 3}); err == nil {
+		t.Errorf("manual scheduler with 12 buckets should be rejected")
+	}
+	if _, err := NewSplitScheduler(config, config, 3, 3); err == nil {
+		t.Errorf("split scheduler with 3 buckets should be rejected")
+	}
+}
+
+func TestManualSchedulerReload(t *testing.T) {
+	schd := newTestManualScheduler(map[string][]string{
+		"host1": {"0", "1"},
+		"host2": {"0", "1"},
+	}, 2, 2)
+	old := schd.hosts[0]
+	schd.stats[0][old.offset] = 10
+
+	err := schd.Reload(map[string][]string{
+		"host1": {"0", "1"},
+		"host3": {"0", "1", "2"},
+	})
+	if err == nil {
+		t.Errorf("bucket out of range should be rejected")
+	}
+	if err := schd.Reload(map[string][]string{"host1": {"0", "1"}}); err == nil {
+		t.Errorf("bucket with less than N hosts should be rejected")
+	}
+	if len(schd.hosts) != 2 || schd.hosts[0] != old {
+		t.Errorf("failed reload should not change the scheduler")
+	}
+
+	err = schd.Reload(map[string][]string{
+		old.Addr: {"0", "1"},
+		"host3":  {"0", "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := make(map[string]bool)
+	for _, h := range schd.GetHostsByKey("key") {
+		addrs[h.Addr] = true
+	}
+	if len(addrs) != 2 || !addrs[old.Addr] || !addrs["host3"] {
+		t.Errorf("hosts should be reloaded: %v", addrs)
+	}
+	if schd.hosts[old.offset] != old || schd.stats[0][old.offset] != 10 {
+		t.Errorf("kept host should be reused with its score: %v", schd.stats[0])
+	}
+	// feedback of a removed host is ignored
+	schd.feedback(5, 0, 1)
+}
+
+func TestPreferLocalZone(t *testing.T) {
+	HostZones = map[string]string{"host1": "rack1", "host2": "rack2", "host3": "rack2"}
+	LocalZone = "rack2"
+	defer func() {
+		HostZones = map[string]string{}
+		LocalZone = ""
+	}()
+	schd := newTestManualScheduler(map[string][]string{
+		"host1": {"0"},
+		"host2": {"0"},
+		"host3": {"-0"},
+	}, 1, 2)
+	index := make(map[string]int)
+	for i, h := range schd.hosts {
+		index[h.Addr] = i
+	}
+	schd.buckets[0] = []int{index["host1"], index["host2"]}
+	hosts := schd.GetHostsByKey("key")
+	if hosts[0].Addr != "host2" || hosts[1].Addr != "host1" || hosts[2].Addr != "host3" {
+		t.Errorf("replica in local zone should be the first, backups are not moved: %v %v %v",
+			hosts[0].Addr, hosts[1].Addr, hosts[2].Addr)
+	}
+}
+
+func TestDumpRing(t *testing.T) {
+	schd := NewKetamaScheduler(ketamahosts).(*ConsistantHashScheduler)
+	data, err := schd.DumpRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewConsistantHashSchedulerFromRing(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testScheduler(t, loaded, ketamatests, true)
+	if again, _ := loaded.DumpRing(); string(again) != string(data) {
+		t.Errorf("ring should be byte identical after loaded")
+	}
+	if _, err := NewConsistantHashSchedulerFromRing([]byte(`{"Version":1,"Hash":"md5","Hosts":["a"],"Points":[1],"Owners":[1]}`)); err == nil {
+		t.Errorf("ring with invalid owner should be rejected")
+	}
+}
+
+func TestAutoSchedulerDecay(t *testing.T) {
+	c := newTestAutoScheduler([]string{"a", "b"}, 1)
+	c.feedback(0, 0, -100)
+	c.feedback(1, 0, 2)
+	if c.buckets[0][0] != 1 {
+		t.Fatalf("penalized host should be moved back: %v", c.buckets[0])
+	}
+
+	now := time.Now()
+	c.decay(now)
+	if c.stats[0][0] != -100 {
+		t.Errorf("first decay should only record the time: %v", c.stats[0])
+	}
+	c.decay(now.Add(ScoreHalfLife * 2))
+	if c.stats[0][0] != -25 || c.stats[0][1] != 1 {
+		t.Errorf("only penalties should decay: %v", c.stats[0])
+	}
+	c.decay(now.Add(ScoreHalfLife * 100))
+	c.feedback(0, 0, 4)
+	if c.buckets[0][0] != 0 {
+		t.Errorf("recovered host should win its place back: %v %v", c.buckets[0], c.stats[0])
+	}
+}
+
+func TestFeedbackDropped(t *testing.T) {
+	schd := newTestManualScheduler(map[string][]string{"host1": {"0"}}, 1, 1)
+	schd.feedChan = make(chan *Feedback, 1)
+	host := schd.GetHostsByKey("key")[0]
+	dropped := atomic.LoadInt64(&feedbackDropped)
+	schd.Feedback(host, "key", FeedbackEvent{Kind: FeedbackError})
+	schd.Feedback(host, "key", FeedbackEvent{Kind: FeedbackError}) // no one is consuming
+	if n := atomic.LoadInt64(&feedbackDropped) - dropped; n != 1 {
+		t.Errorf("feedback should be dropped once the queue is full: %d", n)
+	}
+}
+
+func TestAutoSchedulerCheckFanout(t *testing.T) {
+	nodes := []*mockNode{newMockNode(), newMockNode(), newMockNode(), newMockNode()}
+	c := newTestAutoScheduler([]string{"a", "b", "c", "d"}, 256)
+	for i, n := range nodes {
+		c.hosts[i] = NewNodeHost(c.hosts[i].Addr, n)
+	}
+	c.indexHosts()
+	c.feedChan = make(chan *Feedback, FeedbackQueueSize)
+
+	// 16 directories of every host
+	rounds := 0
+	for i := 0; i < 7; i++ {
+		if c.checkSome(10) {
+			rounds++
+		}
+	}
+	if rounds != 1 {
+		t.Errorf("64 directories should be listed in a round of 7 checks, got %d rounds", rounds)
+	}
+	for i, n := range nodes {
+		if n.calls != 16 && !(i == 0 && n.calls == 22) {
+			t.Errorf("host %d listed %d times", i, n.calls)
+		}
+	}
+	calls := nodes[0].calls
+	c.check()
+	if nodes[0].calls != calls+16 {
+		t.Errorf("a full check should list all the directories")
+	}
+}
+
+func TestAutoSchedulerHostIndex(t *testing.T) {
+	c := newTestAutoScheduler([]string{"a", "b", "c"}, 16)
+	for i, h := range c.hosts {
+		if j := c.hostIndex(h); j != i {
+			t.Errorf("%s should be at %d, got %d", h.Addr, i, j)
+		}
+	}
+	if i := c.hostIndex(NewHost("a")); i != -1 {
+		t.Errorf("host not of the scheduler should not be found: %d", i)
+	}
+}
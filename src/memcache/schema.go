@@ -0,0 +1,131 @@
+/*
+ * the documented stats for dashboards, the keys and units of a schema version
+ * are kept, while the internal stats come and go
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "time"
+)
+
+// bumped when a key of the schema is renamed, removed, or its unit changed,
+// adding keys does not bump it
+const StatsSchemaVersion = 1
+
+type StatField struct {
+    Key   string // stable key
+    Unit  string // count, bytes, seconds, ...
+    Help  string
+    Gauge bool   // a level now, not a total since it started
+    from  string // internal key if it's not the same
+}
+
+// stats of the proxy in the schema, counters are totals since it started
+var StatsSchema = []StatField{
+    {Key: "uptime", Unit: "seconds", Help: "since the proxy started", Gauge: true},
+    {Key: "pid", Unit: "id", Help: "process id", Gauge: true},
+    {Key: "threads", Unit: "count", Help: "goroutines", Gauge: true},
+    {Key: "curr_connections", Unit: "count", Help: "open client connections", Gauge: true},
+    {Key: "total_connections", Unit: "count", Help: "client connections accepted"},
+    {Key: "cmd_get", Unit: "count", Help: "keys asked by get and gets"},
+    {Key: "cmd_set", Unit: "count", Help: "storage commands"},
+    {Key: "cmd_delete", Unit: "count", Help: "delete commands"},
+    {Key: "cmd_touch", Unit: "count", Help: "touch commands"},
+    {Key: "get_hits", Unit: "count", Help: "keys found"},
+    {Key: "get_misses", Unit: "count", Help: "keys not found"},
+    {Key: "bytes_read", Unit: "bytes", Help: "read from clients"},
+    {Key: "bytes_written", Unit: "bytes", Help: "written to clients"},
+    {Key: "slow_cmd", Unit: "count", Help: "commands slower than slow in conf"},
+    {Key: "memory", Unit: "kilobytes", Help: "memory of the process", from: "rusage_maxrss", Gauge: true},
+    {Key: "cpu_user", Unit: "seconds", Help: "user cpu time", from: "rusage_user"},
+    {Key: "cpu_system", Unit: "seconds", Help: "system cpu time", from: "rusage_system"},
+    {Key: "hosts_ejected", Unit: "count", Help: "servers ejected after errors now", Gauge: true},
+    {Key: "host_ejections", Unit: "count", Help: "ejections of servers"},
+    {Key: "host_shed", Unit: "count", Help: "requests shed by overloaded servers"},
+    {Key: "feedback_dropped", Unit: "count", Help: "feedbacks dropped by schedulers"},
+    {Key: "fallback_routes", Unit: "count", Help: "keys routed to the fallback servers"},
+    {Key: "sink_written", Unit: "count", Help: "writes to sinks"},
+    {Key: "sink_failed", Unit: "count", Help: "writes given up by sinks"},
+    {Key: "topology_mismatches", Unit: "count", Help: "peers routing differently"},
+    {Key: "epoch", Unit: "unix seconds", Help: "when the topology was first seen by the proxies", Gauge: true},
+    {Key: "stale_writes", Unit: "count", Help: "writes routed by a topology older than on peers"},
+}
+
+// stats of a server in the schema, see HostStats
+var HostStatsSchema = []StatField{
+    {Key: "requests", Unit: "count", Help: "requests sent to the server"},
+    {Key: "errors", Unit: "count", Help: "requests failed"},
+    {Key: "p50", Unit: "milliseconds", Help: "median latency", Gauge: true},
+    {Key: "p99", Unit: "milliseconds", Help: "99th percentile latency", Gauge: true},
+    {Key: "last_failure", Unit: "unix seconds", Help: "0 if never failed", Gauge: true},
+    {Key: "buckets", Unit: "weights", Help: "weights of buckets in the scheduler"},
+    {Key: "annotation", Unit: "text", Help: "note of operators"},
+    {Key: "maintenance", Unit: "bool", Help: "in maintenance", Gauge: true},
+    {Key: "ejected", Unit: "bool", Help: "ejected after errors", Gauge: true},
+    {Key: "draining", Unit: "bool", Help: "being drained", Gauge: true},
+    {Key: "name", Unit: "text", Help: "alias or address shown to operators"},
+    {Key: "max_value", Unit: "bytes", Help: "largest value stored, 0 if no limit", Gauge: true},
+}
+
+func checkSchemaVersion(version int) error {
+    if version != StatsSchemaVersion {
+        return fmt.Errorf("unknown stats schema version %d, the current is %d", version, StatsSchemaVersion)
+    }
+    return nil
+}
+
+// the stats of Stats.Stats() in the schema, missing ones are 0
+func VersionedStats(st map[string]int64, version int) (map[string]int64, error) {
+    if err := checkSchemaVersion(version); err != nil {
+        return nil, err
+    }
+    r := make(map[string]int64, len(StatsSchema)+1)
+    for _, f := range StatsSchema {
+        from := f.from
+        if from == "" {
+            from = f.Key
+        }
+        r[f.Key] = st[from]
+    }
+    r["schema_version"] = int64(version)
+    return r, nil
+}
+
+func ms(d time.Duration) float64 {
+    return float64(d) / float64(time.Millisecond)
+}
+
+// the stats of StatsV2() in the schema
+func VersionedHostStats(hosts map[string]*HostStats, version int) (map[string]map[string]interface{}, error) {
+    if err := checkSchemaVersion(version); err != nil {
+        return nil, err
+    }
+    r := make(map[string]map[string]interface{}, len(hosts))
+    for addr, h := range hosts {
+        var last int64
+        if !h.LastFailure.IsZero() {
+            last = h.LastFailure.Unix()
+        }
+        buckets := h.Buckets
+        if buckets == nil {
+            buckets = []float64{}
+        }
+        r[addr] = map[string]interface{}{
+            "requests":     h.Requests,
+            "errors":       h.Errors,
+            "p50":          ms(h.P50),
+            "p99":          ms(h.P99),
+            "last_failure": last,
+            "buckets":      buckets,
+            "annotation":   h.Annotation,
+            "maintenance":  h.Maintenance,
+            "ejected":      h.Ejected,
+            "draining":     h.Draining,
+            "name":         h.Name,
+            "max_value":    h.MaxValue,
+        }
+    }
+    return r, nil
+}
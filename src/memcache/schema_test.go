@@ -0,0 +1,39 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVersionedStats(t *testing.T) {
+	st := NewStats()
+	st.cmd_get = 3
+	st.UpdateStat("slow_cmd", 2)
+	vs, err := VersionedStats(st.Stats(), StatsSchemaVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != len(StatsSchema)+1 || vs["schema_version"] != StatsSchemaVersion {
+		t.Errorf("every key of the schema should be reported: %v", vs)
+	}
+	if vs["cmd_get"] != 3 || vs["slow_cmd"] != 2 || vs["memory"] <= 0 {
+		t.Errorf("bad stats: %v", vs)
+	}
+	if _, err := VersionedStats(st.Stats(), StatsSchemaVersion+1); err == nil {
+		t.Errorf("unknown schema version should fail")
+	}
+
+	hs, err := VersionedHostStats(map[string]*HostStats{
+		"a:1": {Requests: 10, P99: 1500 * time.Microsecond, LastFailure: time.Unix(100, 0)},
+	}, StatsSchemaVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := hs["a:1"]
+	if len(h) != len(HostStatsSchema) {
+		t.Errorf("every key of the schema should be reported: %v", h)
+	}
+	if h["requests"] != int64(10) || h["p99"] != 1.5 || h["last_failure"] != int64(100) {
+		t.Errorf("bad host stats: %v", h)
+	}
+}
@@ -10,21 +10,44 @@ import (
     "os/signal"
     "strings"
     "sync"
+    "sync/atomic"
     "syscall"
     "time"
 )
 
 var SlowCmdTime = time.Millisecond * 100 // 100ms
 
+// period of TCP keepalive probes on client connections, 0 to use the default
+var KeepAlivePeriod time.Duration
+
+// close client connections idle for longer than this, 0 to disable,
+// half-open connections from firewalled clients will not linger forever
+// even if the keepalive probes are dropped
+var IdleTimeout time.Duration
+
+var idleClosed int64
+
 type ServerConn struct {
     RemoteAddr      string
     rwc             io.ReadWriteCloser // i/o connection
     closeAfterReply bool
+    noAccessLog     bool // like the traffic of self benchmark
+    oneShot         bool // the client used to send one command per connection
+    cmds            int
+    deadline        time.Duration // budget of requests to annotate responses with, 0 to disable
+    compressed      bool          // the client accepts compressed values as stored
+    admin           bool          // allowed to flush_all
+    id              int64         // in stats conns
+    opened          time.Time
+    mem             connMemory
+    fp              clientFingerprint
+    recorder        *captureRecorder
 }
 
 func newServerConn(conn net.Conn) *ServerConn {
     c := new(ServerConn)
     c.RemoteAddr = conn.RemoteAddr().String()
+    c.admin = isFlushAdmin(clientIP(conn.RemoteAddr()))
     c.rwc = conn
     return c
 }
@@ -36,83 +59,165 @@ func (c *ServerConn) Close() {
     }
 }
 
+func (c *ServerConn) setIdleDeadline() {
+    if IdleTimeout <= 0 {
+        return
+    }
+    if conn, ok := c.rwc.(net.Conn); ok {
+        conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+    }
+}
+
 func (c *ServerConn) Shutdown() {
     c.closeAfterReply = true
 }
 
 func (c *ServerConn) Serve(store DistributeStorage, stats *Stats) (e error) {
-    rbuf := bufio.NewReader(c.rwc)
-    wbuf := bufio.NewWriter(c.rwc)
+    var rbuf *bufio.Reader
+    var wbuf *bufio.Writer
+    c.recorder = &captureRecorder{rw: c.rwc}
+    if c.oneShot {
+        rbuf = bufio.NewReaderSize(c.recorder, oneShotBufSize)
+        wbuf = bufio.NewWriterSize(c.recorder, oneShotBufSize)
+    } else {
+        rbuf = bufio.NewReader(c.recorder)
+        wbuf = bufio.NewWriter(c.recorder)
+    }
+    c.register(rbuf.Size() + wbuf.Size())
+    defer c.unregister()
+
+    c.setIdleDeadline()
+    if b, err := rbuf.Peek(1); err == nil && b[0] == binaryRequestMagic {
+        e = c.serveBinary(rbuf, wbuf, store, stats)
+    } else {
+        e = c.serveText(rbuf, wbuf, store, stats)
+    }
+    if FingerprintCommands > 0 {
+        c.fp.settle(c.RemoteAddr, true)
+    }
+    c.Close()
+    return
+}
 
+// commands of the text protocol
+func (c *ServerConn) serveText(rbuf *bufio.Reader, wbuf *bufio.Writer, store DistributeStorage, stats *Stats) (e error) {
     req := new(Request)
     for {
+        c.setIdleDeadline()
+        var arrived time.Time
+        if c.deadline > 0 {
+            // wait for the request to arrive
+            rbuf.Peek(1)
+            arrived = time.Now()
+        }
         e = req.Read(rbuf)
         if e != nil {
+            if ne, ok := e.(net.Error); ok && ne.Timeout() {
+                atomic.AddInt64(&idleClosed, 1)
+            }
             break
         }
+        c.countCmd()
 
         t := time.Now()
         var err error
+        req.admin = c.admin
+        c.mem.hold(requestBytes(req), 0)
         resp, hosts, err := req.Process(store, stats)
         if resp == nil {
             break
         }
+        c.mem.hold(requestBytes(req), responseBytes(resp))
         dt := time.Since(t)
         if dt > SlowCmdTime {
             stats.UpdateStat("slow_cmd", 1)
         }
 
+        if CompressFlag != 0 && !c.compressed && len(resp.items) > 0 {
+            decompressItems(resp)
+        }
         if !resp.noreply {
+            if c.deadline > 0 && req.Cmd != "deadline" {
+                writeDeadline(wbuf, c.deadline, t.Sub(arrived), dt)
+            }
             if resp.Write(wbuf) != nil || wbuf.Flush() != nil {
                 break
             }
         }
-
-        if AccessLog != nil {
-            key := strings.Join(req.Keys, ":")
-            size := 0
-            switch req.Cmd {
-            case "get", "gets":
-                for _, v := range resp.items {
-                    size += len(v.Body)
-                }
-            case "set", "add", "replace":
-                size = len(req.Item.Body)
-            }
-            if err != nil {
-                size = -1
-            }
-            if len(hosts) == 0 {
-                hosts = append(hosts, "NoWhere")
-            }
-            var hosts_str string
-            if req.Cmd == "get" && size == 0 {
-                hosts_str = fmt.Sprintf("FAILED with %s", strings.Join(hosts, ","))
-            } else {
-                hosts_str = fmt.Sprintf("from %s", strings.Join(hosts, ","))
-            }
-            AccessLog.Printf("%s %s %s %d %s %dms", c.RemoteAddr, req.Cmd, key, size, hosts_str, dt.Nanoseconds()/1e6)
+        c.fingerprint(req, err, dt)
+        if req.Cmd == "deadline" && resp.status == "OK" {
+            c.deadline, _ = parseDeadline(req.Keys)
         }
+        if req.Cmd == "compression" && resp.status == "OK" {
+            c.compressed, _ = parseCompression(req.Keys)
+        }
+
+        c.logAccess(req, resp, hosts, err, dt)
+        c.capture(req, resp, rbuf.Buffered())
 
         req.Clear()
         resp.CleanBuffer()
+        c.mem.hold(0, 0)
 
         if c.closeAfterReply {
             break
         }
     }
-    c.Close()
     return
 }
 
+func (c *ServerConn) countCmd() {
+    c.cmds++
+}
+
+func (c *ServerConn) logAccess(req *Request, resp *Response, hosts []string, err error, dt time.Duration) {
+    if AccessLog == nil || c.noAccessLog {
+        return
+    }
+    key := strings.Join(req.Keys, ":")
+    size := 0
+    switch req.Cmd {
+    case "get", "gets", "getif", "gat", "gats":
+        for _, v := range resp.items {
+            size += len(v.Body)
+        }
+    case "set", "add", "replace", "cas", "append", "prepend":
+        size = len(req.Item.Body)
+    }
+    if err != nil {
+        size = -1
+    }
+    if len(hosts) == 0 {
+        hosts = append(hosts, "NoWhere")
+    }
+    var hosts_str string
+    if req.Cmd == "get" && size == 0 {
+        hosts_str = fmt.Sprintf("FAILED with %s", strings.Join(hosts, ","))
+    } else {
+        hosts_str = fmt.Sprintf("from %s", strings.Join(hosts, ","))
+    }
+    if len(Experiments) > 0 {
+        if ids := experimentIDs(req.Keys); ids != "" {
+            hosts_str += " exp=" + ids
+        }
+    }
+    AccessLog.Printf("%s %s %s %d %s %dms", c.RemoteAddr, req.Cmd, key, size, hosts_str, dt.Nanoseconds()/1e6)
+}
+
 type Server struct {
     sync.Mutex
     addr  string
     l     net.Listener
+    ls    []net.Listener // listeners sharing addr by SO_REUSEPORT, l is the first
     store DistributeStorage
     conns map[string]*ServerConn
     stats *Stats
     stop  bool
+
+    oneShot *oneShotTracker
+
+    AcceptLoops   int  // goroutines accepting connections, spread over Ps
+    IgnoreSignals bool // embedded in a process which handles the signals itself
 }
 
 func NewServer(store DistributeStorage) *Server {
@@ -120,6 +225,7 @@ func NewServer(store DistributeStorage) *Server {
     s.store = store
     s.conns = make(map[string]*ServerConn, 1024)
     s.stats = NewStats()
+    s.oneShot = newOneShotTracker()
     return s
 }
 
@@ -129,44 +235,137 @@ func (s *Server) Listen(addr string) (e error) {
     return
 }
 
+// serve on a listener opened by the caller instead of Listen
+func (s *Server) Use(l net.Listener) {
+    s.addr = l.Addr().String()
+    s.l = l
+}
+
+func (s *Server) Addr() string {
+    return s.addr
+}
+
+// open n listeners on addr with SO_REUSEPORT, the kernel spreads new
+// connections over them, so they do not contend on one accept queue
+func (s *Server) ListenReusePort(addr string, n int) error {
+    s.addr = addr
+    for i := 0; i < n; i++ {
+        l, err := listenReusePort(addr)
+        if err != nil {
+            s.closeListeners()
+            s.ls = nil
+            return err
+        }
+        if i == 0 {
+            // the port may be chosen by system
+            addr = l.Addr().String()
+        }
+        s.ls = append(s.ls, l)
+    }
+    s.l = s.ls[0]
+    return nil
+}
+
+func (s *Server) closeListeners() {
+    for _, l := range s.ls {
+        l.Close()
+    }
+    if s.l != nil {
+        s.l.Close()
+    }
+}
+
 func (s *Server) Serve() (e error) {
     if s.l == nil {
         return errors.New("no listener")
     }
 
     // trap signal
-    sch := make(chan os.Signal, 10)
-    signal.Notify(sch, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT,
-        syscall.SIGHUP, syscall.SIGSTOP, syscall.SIGQUIT)
-    go func(ch <-chan os.Signal) {
-        for {
-            sig := <-ch
-            if sig == syscall.SIGINT {  // Ctrl+C
-                OpenAccessLog(AccessLogPath)
-                OpenErrorLog(ErrorLogPath)
-            } else {
-                ErrorLog.Print("signal recieved " + sig.String())
-                AccessFd.Close()
-                ErrorFd.Close()
-                s.Shutdown()
-                break
+    if !s.IgnoreSignals {
+        sch := make(chan os.Signal, 10)
+        signal.Notify(sch, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT,
+            syscall.SIGHUP, syscall.SIGSTOP, syscall.SIGQUIT)
+        go func(ch <-chan os.Signal) {
+            for {
+                sig := <-ch
+                if sig == syscall.SIGINT {  // Ctrl+C
+                    OpenAccessLog(AccessLogPath)
+                    OpenErrorLog(ErrorLogPath)
+                } else {
+                    ErrorLog.Print("signal recieved " + sig.String())
+                    AccessFd.Close()
+                    ErrorFd.Close()
+                    s.Shutdown()
+                    break
+                }
             }
-        }
-    }(sch)
+        }(sch)
+    }
 
     // log.Print("start serving at ", s.addr, "...\n")
+    loops := s.AcceptLoops
+    if loops < 1 {
+        loops = 1
+    }
+    listeners := s.ls
+    if len(listeners) == 0 {
+        listeners = []net.Listener{s.l}
+    }
+    for _, l := range listeners {
+        for i := 0; i < loops; i++ {
+            // the first loop of s.l runs in this goroutine
+            if l != s.l || i > 0 {
+                go s.accept(l)
+            }
+        }
+    }
+    if e = s.accept(s.l); e != nil {
+        return e
+    }
+    s.closeListeners()
+    // wait for connections to close
+    for i := 0; i < 20; i++ {
+        s.Lock()
+        n := len(s.conns)
+        s.Unlock()
+        if n == 0 {
+            return nil
+        }
+        time.Sleep(1e8)
+    }
+    ErrorLog.Print("shutdown ", s.addr, "\n")
+    return nil
+}
+
+// accept connections until the server is stopped
+func (s *Server) accept(l net.Listener) error {
     for {
-        rw, e := s.l.Accept()
+        rw, e := l.Accept()
         if e != nil {
+            if s.stop {
+                // closed by another accept loop
+                return nil
+            }
             ErrorLog.Print("Accept failed: ", e)
             return e
         }
         if s.stop {
-            break
+            // wake up other accept loops
+            s.closeListeners()
+            return nil
+        }
+        if tc, ok := rw.(*net.TCPConn); ok && KeepAlivePeriod > 0 {
+            tc.SetKeepAlive(true)
+            tc.SetKeepAlivePeriod(KeepAlivePeriod)
         }
         c := newServerConn(rw)
+        ip := clientIP(rw.RemoteAddr())
+        c.oneShot = s.oneShot.isOneShot(ip)
         go func() {
             s.Lock()
+            if c.oneShot {
+                s.stats.UpdateStat("oneshot_connections", 1)
+            }
             s.conns[c.RemoteAddr] = c
             s.stats.curr_connections++
             s.stats.total_connections++
@@ -178,27 +377,25 @@ func (s *Server) Serve() (e error) {
             s.stats.curr_connections--
             delete(s.conns, c.RemoteAddr)
             s.Unlock()
+            s.oneShot.done(ip, c.cmds)
         }()
     }
-    s.l.Close()
-    // wait for connections to close
-    for i := 0; i < 20; i++ {
-        s.Lock()
-        if len(s.conns) == 0 {
-            return nil
-        }
-        s.Unlock()
-        time.Sleep(1e8)
-    }
-    ErrorLog.Print("shutdown ", s.addr, "\n")
-    return nil
+}
+
+// the same as the stats command
+func (s *Server) Stats() map[string]int64 {
+    st := s.stats.Stats()
+    n := int64(s.store.Len())
+    st["curr_items"] = n
+    st["total_items"] = n
+    return st
 }
 
 func (s *Server) Shutdown() {
     s.stop = true
 
-    // try to connect
-    net.Dial("tcp", s.addr)
+    // wake up the accept loops, the listener may not be of tcp
+    s.closeListeners()
 
     // notify conns
     s.Lock()
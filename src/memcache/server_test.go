@@ -1,6 +1,8 @@
 package memcache
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net"
 	"testing"
 	"time"
@@ -32,3 +34,85 @@ func TestShutdown(t *testing.T) {
 	}
 
 }
+
+func TestIdleTimeout(t *testing.T) {
+	IdleTimeout = time.Millisecond * 50
+	defer func() { IdleTimeout = 0 }()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newServerConn(server)
+	done := make(chan error, 1)
+	go func() { done <- c.Serve(nil, NewStats()) }()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("idle conn should be closed by timeout: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle conn is not closed")
+	}
+	if n := NewStats().Stats()["conn_idle_closed"]; n < 1 {
+		t.Errorf("idle close is not counted: %d", n)
+	}
+}
+
+func TestAcceptLoops(t *testing.T) {
+	s := NewServer(newMapDistStore())
+	s.AcceptLoops = 4
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	s.addr = s.l.Addr().String()
+	done := make(chan error, 1)
+	go func() { done <- s.Serve() }()
+
+	host := NewHost(s.addr)
+	for i := 0; i < 10; i++ {
+		if ok, err := host.Set("key", &Item{Body: []byte("v")}, false); !ok {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+	s.Shutdown()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve should return nil after shutdown: %v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Error("all the accept loops should be stopped")
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	store := newMapDistStore()
+	s := NewServer(store)
+	if err := s.ListenReusePort("127.0.0.1:0", 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.ls) != 3 || s.ls[1].Addr().String() != s.l.Addr().String() {
+		t.Fatalf("listeners should share the address: %d", len(s.ls))
+	}
+	s.addr = s.l.Addr().String()
+	done := make(chan error, 1)
+	go func() { done <- s.Serve() }()
+
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("tcp", s.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "set key%d 0 0 1\r\nv\r\nquit\r\n", i)
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+	if store.Len() != 10 {
+		t.Errorf("all the connections should be served: %d", store.Len())
+	}
+	s.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Error("all the listeners should be closed")
+	}
+}
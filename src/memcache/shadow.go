@@ -0,0 +1,188 @@
+/*
+ * mirror some of the requests to a shadow cluster, like a canary of beansdb
+ */
+
+package memcache
+
+import (
+    "bytes"
+    "math/rand"
+    "sync"
+    "sync/atomic"
+)
+
+// requests waiting to be mirrored, more are dropped
+var ShadowQueueSize = 1024
+
+// counters of mirrored requests, reported in stats
+var shadowMirrored, shadowDropped, shadowMismatches int64
+
+// ShadowClient send a fraction of reads and writes to the shadow cluster in
+// background, the responses of the shadow are only compared, never returned.
+type ShadowClient struct {
+    store     DistributeStorage
+    shadow    DistributeStorage
+    readRate  float64
+    writeRate float64
+    queue     chan func()
+    done      chan struct{} // closed by Close, the queued are dropped
+    closeOnce sync.Once
+}
+
+func NewShadowClient(store, shadow DistributeStorage, readRate, writeRate float64) *ShadowClient {
+    c := &ShadowClient{store: store, shadow: shadow, readRate: readRate, writeRate: writeRate,
+        queue: make(chan func(), ShadowQueueSize), done: make(chan struct{})}
+    go func() {
+        for {
+            select {
+            case f := <-c.queue:
+                f()
+            case <-c.done:
+                return
+            }
+        }
+    }()
+    return c
+}
+
+func (c *ShadowClient) Close() {
+    c.closeOnce.Do(func() {
+        close(c.done)
+        CloseStorage(c.store)
+        CloseStorage(c.shadow)
+    })
+}
+
+func (c *ShadowClient) mirror(rate float64, f func()) {
+    if rate <= 0 || rand.Float64() >= rate {
+        return
+    }
+    select {
+    case c.queue <- f:
+        atomic.AddInt64(&shadowMirrored, 1)
+    default:
+        atomic.AddInt64(&shadowDropped, 1)
+    }
+}
+
+func copyItem(r *Item) *Item {
+    if r == nil {
+        return nil
+    }
+    return &Item{Flag: r.Flag, Exptime: r.Exptime, Body: append([]byte(nil), r.Body...)}
+}
+
+func sameItem(a, b *Item) bool {
+    if a == nil || b == nil {
+        return a == b
+    }
+    return a.Flag == b.Flag && bytes.Equal(a.Body, b.Body)
+}
+
+func (c *ShadowClient) Get(key string) (r *Item, targets []string, err error) {
+    r, targets, err = c.store.Get(key)
+    if err == nil {
+        // the body may be freed after the response was sent
+        expected := copyItem(r)
+        c.mirror(c.readRate, func() {
+            r2, _, err := c.shadow.Get(key)
+            if err == nil && !sameItem(expected, r2) {
+                atomic.AddInt64(&shadowMismatches, 1)
+                ErrorLog.Printf("shadow: %s differs from the primary cluster", key)
+            }
+        })
+    }
+    return
+}
+
+func (c *ShadowClient) GetMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+    rs, targets, err = c.store.GetMulti(keys)
+    if err == nil {
+        expected := make(map[string]*Item, len(rs))
+        for k, r := range rs {
+            expected[k] = copyItem(r)
+        }
+        c.mirror(c.readRate, func() {
+            rs2, _, err := c.shadow.GetMulti(keys)
+            if err != nil {
+                return
+            }
+            for _, k := range keys {
+                if !sameItem(expected[k], rs2[k]) {
+                    atomic.AddInt64(&shadowMismatches, 1)
+                    ErrorLog.Printf("shadow: %s differs from the primary cluster", k)
+                }
+            }
+        })
+    }
+    return
+}
+
+func (c *ShadowClient) Set(key string, item *Item, noreply bool) (ok bool, targets []string, err error) {
+    it := copyItem(item)
+    ok, targets, err = c.store.Set(key, item, noreply)
+    if ok {
+        c.mirror(c.writeRate, func() { c.shadow.Set(key, it, true) })
+    }
+    return
+}
+
+func (c *ShadowClient) Append(key string, value []byte) (ok bool, targets []string, err error) {
+    v := append([]byte(nil), value...)
+    ok, targets, err = c.store.Append(key, value)
+    if ok {
+        c.mirror(c.writeRate, func() { c.shadow.Append(key, v) })
+    }
+    return
+}
+
+func (c *ShadowClient) Prepend(key string, value []byte) (ok bool, targets []string, err error) {
+    v := append([]byte(nil), value...)
+    ok, targets, err = c.store.Prepend(key, value)
+    if ok {
+        c.mirror(c.writeRate, func() { c.shadow.Prepend(key, v) })
+    }
+    return
+}
+
+func (c *ShadowClient) Incr(key string, value int) (result int, targets []string, err error) {
+    result, targets, err = c.store.Incr(key, value)
+    if err == nil {
+        c.mirror(c.writeRate, func() { c.shadow.Incr(key, value) })
+    }
+    return
+}
+
+func (c *ShadowClient) Delete(key string) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Delete(key)
+    if err == nil {
+        c.mirror(c.writeRate, func() { c.shadow.Delete(key) })
+    }
+    return
+}
+
+func (c *ShadowClient) Touch(key string, exptime int) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Touch(key, exptime)
+    if err == nil {
+        c.mirror(c.writeRate, func() { c.shadow.Touch(key, exptime) })
+    }
+    return
+}
+
+func (c *ShadowClient) Gets(key string) (*Item, []string, error) {
+    return c.store.Gets(key)
+}
+
+// cas uniques of the shadow differ, the item stored is mirrored by set
+func (c *ShadowClient) Cas(key string, item *Item) (status string, targets []string, err error) {
+    it := copyItem(item)
+    status, targets, err = c.store.Cas(key, item)
+    if status == "STORED" {
+        c.mirror(c.writeRate, func() { c.shadow.Set(key, it, true) })
+    }
+    return
+}
+
+func (c *ShadowClient) Len() int {
+    return c.store.Len()
+}
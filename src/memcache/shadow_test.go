@@ -0,0 +1,40 @@
+package memcache
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShadowClient(t *testing.T) {
+	store, shadow := newMapDistStore(), newMapDistStore()
+	c := NewShadowClient(store, shadow, 1, 1)
+	c.Set("a", &Item{Body: []byte("1")}, false)
+	c.Incr("a", 2)
+	c.Set("b", &Item{Body: []byte("b")}, false)
+	c.Delete("b")
+	time.Sleep(10 * time.Millisecond)
+	if r, _ := shadow.mapStore.Get("a"); r == nil || string(r.Body) != "3" {
+		t.Errorf("writes should be mirrored: %v", r)
+	}
+	if r, _ := shadow.mapStore.Get("b"); r != nil {
+		t.Errorf("delete should be mirrored: %v", r)
+	}
+
+	mismatches := atomic.LoadInt64(&shadowMismatches)
+	shadow.mapStore.Set("a", &Item{Body: []byte("4")}, false)
+	if r, _, _ := c.Get("a"); r == nil || string(r.Body) != "3" {
+		t.Errorf("response should come from the primary: %v", r)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt64(&shadowMismatches) != mismatches+1 {
+		t.Errorf("mismatch of shadow should be counted")
+	}
+
+	c = NewShadowClient(store, shadow, 0, 0)
+	mirrored := atomic.LoadInt64(&shadowMirrored)
+	c.Set("c", &Item{Body: []byte("c")}, false)
+	if atomic.LoadInt64(&shadowMirrored) != mirrored {
+		t.Errorf("nothing should be mirrored with rate 0")
+	}
+}
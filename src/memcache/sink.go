@@ -0,0 +1,325 @@
+/*
+ * write through the proxy to sinks, like a database or a search index
+ */
+
+package memcache
+
+import (
+    "bytes"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Sink receives the writes of keys with a prefix after they were stored,
+// failed writes are retried, and the ones given up go to the dead letters
+type Sink interface {
+    Set(key string, item *Item) error
+    Delete(key string) error
+}
+
+type SinkFactory func(arg string) (Sink, error)
+
+var (
+    sinksLock sync.RWMutex
+    sinks     = make(map[string]SinkFactory)
+)
+
+// register a sink by name, so it could be chosen in config
+func RegisterSink(name string, factory SinkFactory) {
+    sinksLock.Lock()
+    defer sinksLock.Unlock()
+    if _, ok := sinks[name]; ok {
+        panic("sink registered twice: " + name)
+    }
+    sinks[name] = factory
+}
+
+func NewSinkByName(name, arg string) (Sink, error) {
+    sinksLock.RLock()
+    factory, ok := sinks[name]
+    sinksLock.RUnlock()
+    if !ok {
+        return nil, fmt.Errorf("unknown sink %q", name)
+    }
+    return factory(arg)
+}
+
+// writes waiting for every sink, more go to the dead letters at once
+var SinkQueueSize = 1024
+
+// retries of a failed write, the delay is doubled after every retry
+var SinkRetries = 3
+var SinkRetryDelay time.Duration = time.Millisecond * 100
+
+// dead letters kept, the oldest are dropped
+var SinkDeadLetters = 1000
+
+// counters of sinks, reported in stats
+var sinkWritten, sinkRetried, sinkFailed int64
+
+type sinkEvent struct {
+    op   string // set, delete, or refresh to read the value back after append or incr
+    key  string
+    item *Item
+}
+
+// a write given up by a sink
+type DeadLetter struct {
+    Sink  string
+    Op    string
+    Key   string
+    Error string
+    Time  time.Time
+    event *sinkEvent
+    route *sinkRoute
+}
+
+type sinkRoute struct {
+    name   string
+    prefix string
+    sink   Sink
+    queue  chan *sinkEvent
+}
+
+// SinkClient writes through to the sinks of the prefixes of keys in
+// background, in the order of the writes of every sink.
+type SinkClient struct {
+    store     DistributeStorage
+    routes    []*sinkRoute
+    lock      sync.Mutex
+    dead      []*DeadLetter
+    done      chan struct{} // closed by Close, the queued writes are dropped
+    closeOnce sync.Once
+}
+
+func NewSinkClient(store DistributeStorage) *SinkClient {
+    return &SinkClient{store: store, done: make(chan struct{})}
+}
+
+func (c *SinkClient) Close() {
+    c.closeOnce.Do(func() {
+        close(c.done)
+        CloseStorage(c.store)
+    })
+}
+
+// send writes of keys with the prefix to the sink, "" for all the keys
+func (c *SinkClient) AddSink(name, prefix string, sink Sink) {
+    r := &sinkRoute{name, prefix, sink, make(chan *sinkEvent, SinkQueueSize)}
+    c.routes = append(c.routes, r)
+    go func() {
+        for {
+            select {
+            case e := <-r.queue:
+                c.deliver(r, e)
+            case <-c.done:
+                return
+            }
+        }
+    }()
+}
+
+func (c *SinkClient) deliver(r *sinkRoute, e *sinkEvent) {
+    delay := SinkRetryDelay
+    var err error
+    for i := 0; i <= SinkRetries; i++ {
+        if i > 0 {
+            atomic.AddInt64(&sinkRetried, 1)
+            time.Sleep(delay)
+            delay *= 2
+        }
+        if err = c.apply(r.sink, e); err == nil {
+            atomic.AddInt64(&sinkWritten, 1)
+            return
+        }
+    }
+    c.giveUp(r, e, err)
+}
+
+func (c *SinkClient) apply(sink Sink, e *sinkEvent) error {
+    switch e.op {
+    case "delete":
+        return sink.Delete(e.key)
+    case "refresh":
+        r, _, err := c.store.Get(e.key)
+        if err != nil {
+            return err
+        }
+        if r == nil {
+            return sink.Delete(e.key)
+        }
+        return sink.Set(e.key, copyItem(r))
+    }
+    return sink.Set(e.key, e.item)
+}
+
+func (c *SinkClient) giveUp(r *sinkRoute, e *sinkEvent, err error) {
+    atomic.AddInt64(&sinkFailed, 1)
+    ErrorLog.Printf("sink %s: %s %s given up: %s", r.name, e.op, e.key, err)
+    d := &DeadLetter{Sink: r.name, Op: e.op, Key: e.key, Error: err.Error(), Time: time.Now(), event: e, route: r}
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.dead = append(c.dead, d)
+    if len(c.dead) > SinkDeadLetters {
+        c.dead = c.dead[len(c.dead)-SinkDeadLetters:]
+    }
+}
+
+func (c *SinkClient) emit(op, key string, item *Item) {
+    for _, r := range c.routes {
+        if !strings.HasPrefix(key, r.prefix) {
+            continue
+        }
+        e := &sinkEvent{op, key, item}
+        select {
+        case r.queue <- e:
+        default:
+            c.giveUp(r, e, fmt.Errorf("queue is full"))
+        }
+    }
+}
+
+// writes given up by the sinks, the oldest first
+func (c *SinkClient) DeadLetters() []DeadLetter {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    ds := make([]DeadLetter, len(c.dead))
+    for i, d := range c.dead {
+        ds[i] = *d
+    }
+    return ds
+}
+
+// queue the dead letters again, return how many were queued
+func (c *SinkClient) RetryDeadLetters() int {
+    c.lock.Lock()
+    dead := c.dead
+    c.dead = nil
+    c.lock.Unlock()
+    n := 0
+    for _, d := range dead {
+        select {
+        case d.route.queue <- d.event:
+            n++
+        default:
+            c.giveUp(d.route, d.event, fmt.Errorf("queue is full"))
+        }
+    }
+    return n
+}
+
+func (c *SinkClient) Get(key string) (*Item, []string, error) {
+    return c.store.Get(key)
+}
+
+func (c *SinkClient) GetMulti(keys []string) (map[string]*Item, []string, error) {
+    return c.store.GetMulti(keys)
+}
+
+func (c *SinkClient) Set(key string, item *Item, noreply bool) (ok bool, targets []string, err error) {
+    // the body may be freed after the response was sent
+    it := copyItem(item)
+    ok, targets, err = c.store.Set(key, item, noreply)
+    if ok {
+        c.emit("set", key, it)
+    }
+    return
+}
+
+func (c *SinkClient) Append(key string, value []byte) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Append(key, value)
+    if ok {
+        c.emit("refresh", key, nil)
+    }
+    return
+}
+
+func (c *SinkClient) Prepend(key string, value []byte) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Prepend(key, value)
+    if ok {
+        c.emit("refresh", key, nil)
+    }
+    return
+}
+
+func (c *SinkClient) Incr(key string, value int) (result int, targets []string, err error) {
+    result, targets, err = c.store.Incr(key, value)
+    if err == nil {
+        c.emit("refresh", key, nil)
+    }
+    return
+}
+
+func (c *SinkClient) Delete(key string) (ok bool, targets []string, err error) {
+    ok, targets, err = c.store.Delete(key)
+    if err == nil {
+        c.emit("delete", key, nil)
+    }
+    return
+}
+
+// the value is not changed, sinks are not told
+func (c *SinkClient) Touch(key string, exptime int) (bool, []string, error) {
+    return c.store.Touch(key, exptime)
+}
+
+func (c *SinkClient) Gets(key string) (*Item, []string, error) {
+    return c.store.Gets(key)
+}
+
+func (c *SinkClient) Cas(key string, item *Item) (status string, targets []string, err error) {
+    it := copyItem(item)
+    status, targets, err = c.store.Cas(key, item)
+    if status == "STORED" {
+        c.emit("set", key, it)
+    }
+    return
+}
+
+func (c *SinkClient) Len() int {
+    return c.store.Len()
+}
+
+// HTTPSink puts values to, and deletes them from, url/key
+type HTTPSink struct {
+    URL    string
+    Client *http.Client
+}
+
+func (s *HTTPSink) do(method, key string, body []byte) error {
+    req, err := http.NewRequest(method, strings.TrimRight(s.URL, "/")+"/"+url.PathEscape(key), bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    resp, err := s.Client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 && !(method == "DELETE" && resp.StatusCode == http.StatusNotFound) {
+        return fmt.Errorf("%s %s: %s", method, key, resp.Status)
+    }
+    return nil
+}
+
+func (s *HTTPSink) Set(key string, item *Item) error {
+    return s.do("PUT", key, item.Body)
+}
+
+func (s *HTTPSink) Delete(key string) error {
+    return s.do("DELETE", key, nil)
+}
+
+func init() {
+    RegisterSink("http", func(arg string) (Sink, error) {
+        if !strings.HasPrefix(arg, "http://") && !strings.HasPrefix(arg, "https://") {
+            return nil, fmt.Errorf("invalid url of http sink: %q", arg)
+        }
+        return &HTTPSink{URL: arg, Client: &http.Client{Timeout: WriteTimeout}}, nil
+    })
+}
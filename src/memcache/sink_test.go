@@ -0,0 +1,124 @@
+package memcache
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordSink struct {
+	lock  sync.Mutex
+	data  map[string]string
+	fails int // fail the next writes
+}
+
+func (s *recordSink) Set(key string, item *Item) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("sink down")
+	}
+	s.data[key] = string(item.Body)
+	return nil
+}
+
+func (s *recordSink) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
+func (s *recordSink) get(key string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, ok := s.data[key]
+	return v, ok
+}
+
+func TestSinkClient(t *testing.T) {
+	retries, delay := SinkRetries, SinkRetryDelay
+	SinkRetries, SinkRetryDelay = 1, time.Millisecond
+	defer func() { SinkRetries, SinkRetryDelay = retries, delay }()
+
+	sink := &recordSink{data: make(map[string]string)}
+	c := NewSinkClient(newMapDistStore())
+	c.AddSink("record", "user:", sink)
+	c.Set("user:1", &Item{Body: []byte("a")}, false)
+	c.Append("user:1", []byte("b"))
+	c.Set("user:2", &Item{Body: []byte("x")}, false)
+	c.Delete("user:2")
+	c.Set("other", &Item{Body: []byte("o")}, false)
+	time.Sleep(20 * time.Millisecond)
+	if v, _ := sink.get("user:1"); v != "ab" {
+		t.Errorf("value in sink should be read back after append: %q", v)
+	}
+	if _, ok := sink.get("user:2"); ok {
+		t.Errorf("delete should be written through")
+	}
+	if _, ok := sink.get("other"); ok {
+		t.Errorf("keys without the prefix should not go to the sink")
+	}
+
+	sink.fails = 1
+	c.Set("user:3", &Item{Body: []byte("3")}, false)
+	time.Sleep(20 * time.Millisecond)
+	if v, _ := sink.get("user:3"); v != "3" {
+		t.Errorf("failed write should be retried: %q", v)
+	}
+
+	sink.fails = 2
+	c.Set("user:4", &Item{Body: []byte("4")}, false)
+	time.Sleep(20 * time.Millisecond)
+	dead := c.DeadLetters()
+	if len(dead) != 1 || dead[0].Key != "user:4" || dead[0].Sink != "record" {
+		t.Fatalf("write given up should be a dead letter: %v", dead)
+	}
+	if n := c.RetryDeadLetters(); n != 1 {
+		t.Errorf("%d dead letters retried", n)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if v, _ := sink.get("user:4"); v != "4" || len(c.DeadLetters()) != 0 {
+		t.Errorf("dead letter should be written when retried: %q", v)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var lock sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		lock.Lock()
+		got = append(got, req.Method+" "+req.URL.Path+" "+string(body))
+		lock.Unlock()
+		if req.Method == "DELETE" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	sink, err := NewSinkByName("http", srv.URL+"/kv/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Set("a b", &Item{Body: []byte("v")}); err != nil {
+		t.Error(err)
+	}
+	if err := sink.Delete("a b"); err != nil {
+		t.Errorf("deleting a missing key should succeed: %s", err)
+	}
+	if len(got) != 2 || got[0] != "PUT /kv/a b v" || got[1] != "DELETE /kv/a b " {
+		t.Errorf("bad requests: %q", got)
+	}
+	if _, err := NewSinkByName("http", "localhost"); err == nil {
+		t.Errorf("invalid url should fail")
+	}
+	if _, err := NewSinkByName("nosuch", ""); err == nil {
+		t.Errorf("unknown sink should fail")
+	}
+}
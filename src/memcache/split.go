@@ -0,0 +1,162 @@
+/*
+ * route writes to primary hosts and reads to a wider set of replicas
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "math/rand"
+    "strconv"
+    "strings"
+)
+
+// schedulers which route reads to different hosts from writes,
+// GetHostsByKey returns the hosts to write
+type ReadWriteScheduler interface {
+    Scheduler
+    GetReadHostsByKey(key string) []*Host
+}
+
+// hosts to read the key from, or the first n hosts to write if reads are
+// not routed differently, n <= 0 means all of them
+func readHostsByKey(sch Scheduler, key string, n int) []*Host {
+    if os, ok := sch.(OperationScheduler); ok {
+        return os.GetHostsByOp(key, OpRead)
+    }
+    if rw, ok := sch.(ReadWriteScheduler); ok {
+        return rw.GetReadHostsByKey(key)
+    }
+    hosts := sch.GetHostsByKey(key)
+    if n > 0 && n < len(hosts) {
+        hosts = hosts[:n]
+    }
+    return hosts
+}
+
+type SplitScheduler struct {
+    hosts       []*Host
+    writers     [][]int // by bucket
+    readers     [][]int // writers and read only replicas by bucket
+    hashMethod  HashMethod
+    bucketWidth int
+}
+
+func parseBuckets(serve_to []string, bs int) ([]int, error) {
+    buckets := make([]int, 0, len(serve_to))
+    for _, s := range serve_to {
+        b, err := strconv.ParseInt(strings.TrimPrefix(s, "-"), 16, 16)
+        if err != nil || int(b) >= bs {
+            return nil, fmt.Errorf("invalid bucket %s", s)
+        }
+        buckets = append(buckets, int(b))
+    }
+    return buckets, nil
+}
+
+// writers and readers are in the config format of ManualScheduler, host -> buckets,
+// writers also serve reads, every bucket should have n writers at least
+func NewSplitScheduler(writers, readers map[string][]string, bs, n int) (*SplitScheduler, error) {
+    if err := CheckBuckets(bs); err != nil {
+        return nil, err
+    }
+    c := new(SplitScheduler)
+    c.writers = make([][]int, bs)
+    c.readers = make([][]int, bs)
+    index := make(map[string]int)
+    add := func(addr string, serve_to []string, write bool) error {
+        buckets, err := parseBuckets(serve_to, bs)
+        if err != nil {
+            return fmt.Errorf("%s: %s", addr, err)
+        }
+        i, ok := index[addr]
+        if !ok {
+            i = len(c.hosts)
+            index[addr] = i
+            c.hosts = append(c.hosts, NewHost(addr))
+        }
+        for _, b := range buckets {
+            if write {
+                c.writers[b] = append(c.writers[b], i)
+            }
+            c.readers[b] = append(c.readers[b], i)
+        }
+        return nil
+    }
+    for addr, serve_to := range writers {
+        if err := add(addr, serve_to, true); err != nil {
+            return nil, err
+        }
+    }
+    for addr, serve_to := range readers {
+        if err := add(addr, serve_to, false); err != nil {
+            return nil, err
+        }
+    }
+    for b, w := range c.writers {
+        if len(w) < n {
+            return nil, fmt.Errorf("bucket %X has %d writers, less than %d", b, len(w), n)
+        }
+    }
+    c.hashMethod = fnv1a1
+    c.bucketWidth = calBitWidth(bs)
+    return c, nil
+}
+
+func (c *SplitScheduler) Hosts() []*Host {
+    return c.hosts
+}
+
+func (c *SplitScheduler) GetHostsByKey(key string) []*Host {
+    b := getBucketByKey(c.hashMethod, c.bucketWidth, key)
+    hosts := make([]*Host, len(c.writers[b]))
+    for j, i := range c.writers[b] {
+        hosts[j] = c.hosts[i]
+    }
+    return skipUnavailable(hosts)
+}
+
+// all the replicas of the bucket, starting from a random one to spread reads
+func (c *SplitScheduler) GetReadHostsByKey(key string) []*Host {
+    b := getBucketByKey(c.hashMethod, c.bucketWidth, key)
+    ids := c.readers[b]
+    hosts := make([]*Host, len(ids))
+    if len(ids) == 0 {
+        return hosts
+    }
+    start := rand.Intn(len(ids))
+    for j := range ids {
+        hosts[j] = c.hosts[ids[(start+j)%len(ids)]]
+    }
+    return skipUnavailable(hosts)
+}
+
+func (c *SplitScheduler) GetHostsByOp(key string, op Operation) []*Host {
+    if op == OpRead {
+        return c.GetReadHostsByKey(key)
+    }
+    return c.GetHostsByKey(key)
+}
+
+func (c *SplitScheduler) Feedback(host *Host, key string, ev FeedbackEvent) {}
+
+func (c *SplitScheduler) DivideKeysByBucket(keys []string) [][]string {
+    return divideKeysByBucket(c.hashMethod, len(c.writers), keys)
+}
+
+// 2 for writers of the bucket, 1 for read only replicas
+func (c *SplitScheduler) Stats() map[string][]float64 {
+    r := make(map[string][]float64, len(c.hosts))
+    for _, h := range c.hosts {
+        r[h.Addr] = make([]float64, len(c.writers))
+    }
+    for b := range c.readers {
+        for _, i := range c.readers[b] {
+            r[c.hosts[i].Addr][b] += 1
+        }
+        for _, i := range c.writers[b] {
+            r[c.hosts[i].Addr][b] += 1
+        }
+    }
+    return r
+}
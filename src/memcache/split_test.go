@@ -0,0 +1,36 @@
+package memcache
+
+import "testing"
+
+func TestSplitScheduler(t *testing.T) {
+	// r1 reads the lower half of buckets, r2 the upper half
+	writers := AutoConfig([]string{"w1", "w2"}, 16)
+	readers := map[string][]string{"r1": {"0", "1", "2", "3", "4", "5", "6", "7"}, "r2": {"8", "9", "a", "b", "c", "d", "e", "f"}}
+	if _, err := NewSplitScheduler(writers, readers, 16, 3); err == nil {
+		t.Errorf("buckets with less than n writers should be rejected")
+	}
+	schd, err := NewSplitScheduler(writers, readers, 16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		b := getBucketByKey(fnv1a1, 4, key)
+		for _, h := range schd.GetHostsByKey(key) {
+			if h.Addr != "w1" && h.Addr != "w2" {
+				t.Errorf("%s should not be written to %s", key, h.Addr)
+			}
+		}
+		reads := readHostsByKey(schd, key, 2)
+		if len(reads) != 3 {
+			t.Fatalf("%s should be read from 3 hosts: %d", key, len(reads))
+		}
+		for _, h := range reads {
+			if h.Addr == "r1" && b >= 8 || h.Addr == "r2" && b < 8 {
+				t.Errorf("%s in bucket %d should not be read from %s", key, b, h.Addr)
+			}
+		}
+	}
+	if st := schd.Stats(); st["w1"][0] != 2 || st["r1"][0] != 1 || st["r1"][8] != 0 {
+		t.Errorf("wrong stats: %v", st)
+	}
+}
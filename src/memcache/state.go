@@ -0,0 +1,180 @@
+/*
+ * export and import the learned state of schedulers
+ */
+
+package memcache
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// learned routing state, hosts are identified by address,
+// so it could be imported into another proxy
+type SchedulerState struct {
+    Stats   map[string][]float64 // scores of every bucket of a host
+    Buckets [][]string           // order of hosts in every bucket
+}
+
+type StatefulScheduler interface {
+    ExportState() *SchedulerState
+    ImportState(st *SchedulerState) error
+}
+
+func exportState(hosts []*Host, buckets [][]int, stats [][]float64) *SchedulerState {
+    st := &SchedulerState{Stats: make(map[string][]float64, len(hosts))}
+    for _, h := range hosts {
+        st.Stats[h.Addr] = make([]float64, len(buckets))
+    }
+    for i, ss := range stats {
+        for j, w := range ss {
+            st.Stats[hosts[j].Addr][i] = w
+        }
+    }
+    st.Buckets = make([][]string, len(buckets))
+    for i, bucket := range buckets {
+        st.Buckets[i] = make([]string, len(bucket))
+        for j, n := range bucket {
+            st.Buckets[i][j] = hosts[n].Addr
+        }
+    }
+    return st
+}
+
+// a bucket is imported only when it has the same hosts as now
+func importState(st *SchedulerState, hosts []*Host, buckets [][]int, stats [][]float64) error {
+    if len(st.Buckets) != len(buckets) {
+        return fmt.Errorf("number of buckets not match: %d <> %d", len(st.Buckets), len(buckets))
+    }
+    index := make(map[string]int, len(hosts))
+    for i, h := range hosts {
+        index[h.Addr] = i
+    }
+    for i, addrs := range st.Buckets {
+        if len(addrs) != len(buckets[i]) {
+            continue
+        }
+        bucket := make([]int, 0, len(addrs))
+        same := make(map[int]bool, len(addrs))
+        for _, n := range buckets[i] {
+            same[n] = true
+        }
+        for _, addr := range addrs {
+            if n, ok := index[addr]; ok && same[n] {
+                bucket = append(bucket, n)
+                delete(same, n)
+            }
+        }
+        if len(same) > 0 {
+            ErrorLog.Printf("skip importing bucket %X: hosts not match", i)
+            continue
+        }
+        buckets[i] = bucket
+    }
+    for addr, ss := range st.Stats {
+        j, ok := index[addr]
+        if !ok {
+            continue
+        }
+        for i, w := range ss {
+            if i < len(stats) {
+                stats[i][j] = w
+            }
+        }
+    }
+    return nil
+}
+
+func (c *AutoScheduler) ExportState() *SchedulerState {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return exportState(c.hosts, c.buckets, c.stats)
+}
+
+func (c *AutoScheduler) ImportState(st *SchedulerState) error {
+    if st == nil {
+        return errors.New("empty state")
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return importState(st, c.hosts, c.buckets, c.stats)
+}
+
+func (c *ManualScheduler) ExportState() *SchedulerState {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    return exportState(c.hosts, c.buckets, c.stats)
+}
+
+func (c *ManualScheduler) ImportState(st *SchedulerState) error {
+    if st == nil {
+        return errors.New("empty state")
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    err := importState(st, c.hosts, c.buckets, c.stats)
+    if c.fixed {
+        // only the scores are learned
+        c.sortByOrder()
+    }
+    return err
+}
+
+// save the state into file atomically, by renaming a temporary file
+func SaveState(sch StatefulScheduler, path string) error {
+    data, err := json.Marshal(sch.ExportState())
+    if err != nil {
+        return err
+    }
+    f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+    if err != nil {
+        return err
+    }
+    if _, err = f.Write(data); err == nil {
+        err = f.Sync()
+    }
+    if e := f.Close(); err == nil {
+        err = e
+    }
+    if err == nil {
+        err = os.Rename(f.Name(), path)
+    }
+    if err != nil {
+        os.Remove(f.Name())
+    }
+    return err
+}
+
+// load the state saved by SaveState, the error satisfies os.IsNotExist
+// if it was never saved
+func LoadState(sch StatefulScheduler, path string) error {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    st := new(SchedulerState)
+    if err := json.Unmarshal(data, st); err != nil {
+        return fmt.Errorf("invalid state in %s: %s", path, err)
+    }
+    return sch.ImportState(st)
+}
+
+// save the state every interval, so a restarted proxy routes by the learned
+// state rather than the order of config, run it in a goroutine
+func PersistState(sch StatefulScheduler, path string, interval time.Duration, done <-chan struct{}) {
+    for {
+        select {
+        case <-time.After(interval):
+        case <-done:
+            return
+        }
+        if err := SaveState(sch, path); err != nil {
+            ErrorLog.Print("save state failed: ", err)
+        }
+    }
+}
@@ -0,0 +1,86 @@
+package memcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestAutoScheduler(addrs []string, bs int) *AutoScheduler {
+	c := new(AutoScheduler)
+	c.n = len(addrs)
+	c.hosts = make([]*Host, c.n)
+	for i, addr := range addrs {
+		c.hosts[i] = NewHost(addr)
+	}
+	c.buckets = make([][]int, bs)
+	c.stats = make([][]float64, bs)
+	for i := 0; i < bs; i++ {
+		c.buckets[i] = make([]int, c.n)
+		c.stats[i] = make([]float64, c.n)
+		for j := range addrs {
+			c.buckets[i][j] = j
+		}
+	}
+	c.hashMethod = fnv1a1
+	c.bucketWidth = calBitWidth(bs)
+	c.indexHosts()
+	return c
+}
+
+func TestSchedulerState(t *testing.T) {
+	src := newTestAutoScheduler([]string{"a", "b", "c"}, 4)
+	src.stats[1][2] = 10
+	src.buckets[1] = []int{2, 0, 1}
+	st := src.ExportState()
+
+	dst := newTestAutoScheduler([]string{"c", "b", "a"}, 4)
+	if err := dst.ImportState(st); err != nil {
+		t.Fatal(err)
+	}
+	if dst.stats[1][0] != 10 {
+		t.Errorf("score of c in bucket 1 should be imported: %v", dst.stats[1])
+	}
+	if order := dst.ExportState().Buckets[1]; order[0] != "c" || order[1] != "a" || order[2] != "b" {
+		t.Errorf("order of bucket 1 should be imported: %v", order)
+	}
+	if err := newTestAutoScheduler([]string{"a"}, 8).ImportState(st); err == nil {
+		t.Errorf("import with different number of buckets should fail")
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	dst := newTestAutoScheduler([]string{"a", "b", "c"}, 4)
+	if err := LoadState(dst, path); !os.IsNotExist(err) {
+		t.Errorf("state should not exist: %v", err)
+	}
+
+	src := newTestAutoScheduler([]string{"a", "b", "c"}, 4)
+	src.stats[3][1] = 5
+	src.buckets[3] = []int{1, 2, 0}
+	if err := SaveState(src, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadState(dst, path); err != nil {
+		t.Fatal(err)
+	}
+	if dst.stats[3][1] != 5 || dst.buckets[3][0] != 1 {
+		t.Errorf("state should be loaded: %v %v", dst.stats[3], dst.buckets[3])
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("temporary file should be renamed: %d files", len(files))
+	}
+
+	ioutil.WriteFile(path, []byte("{"), 0644)
+	if err := LoadState(dst, path); err == nil {
+		t.Error("invalid state should fail")
+	}
+}
@@ -4,6 +4,7 @@ import (
     "cmem"
     "os"
     "runtime"
+    "sync/atomic"
     "syscall"
     "time"
 )
@@ -12,7 +13,9 @@ type Stats struct {
     start                               time.Time
     curr_item, total_items              int64
     cmd_get, cmd_set, cmd_delete        int64
+    cmd_touch                           int64
     get_hits, get_misses                int64
+    get_not_modified                    int64
     threads                             int64
     curr_connections, total_connections int64
     bytes_read, bytes_written           int64
@@ -66,18 +69,50 @@ func (s *Stats) Stats() map[string]int64 {
     st["cmd_get"] = s.cmd_get
     st["cmd_set"] = s.cmd_set
     st["cmd_delete"] = s.cmd_delete
+    st["cmd_touch"] = s.cmd_touch
     st["get_hits"] = s.get_hits
     st["get_misses"] = s.get_misses
+    st["get_not_modified"] = s.get_not_modified
     st["curr_connections"] = s.curr_connections
     st["total_connections"] = s.total_connections
     st["bytes_read"] = s.bytes_read
     st["bytes_written"] = s.bytes_written
+    st["gray_checks"] = atomic.LoadInt64(&grayChecks)
+    st["gray_mismatches"] = atomic.LoadInt64(&grayMismatches)
+    st["gray_slow"] = atomic.LoadInt64(&graySlow)
+    st["host_shed"] = atomic.LoadInt64(&hostShed)
+    st["shadow_mirrored"] = atomic.LoadInt64(&shadowMirrored)
+    st["shadow_dropped"] = atomic.LoadInt64(&shadowDropped)
+    st["shadow_mismatches"] = atomic.LoadInt64(&shadowMismatches)
+    st["fallback_routes"] = atomic.LoadInt64(&fallbackRoutes)
+    st["conn_idle_closed"] = atomic.LoadInt64(&idleClosed)
+    st["binary_requests"] = atomic.LoadInt64(&binaryRequests)
+    st["expiry_skewed"] = atomic.LoadInt64(&skewedExpiries)
+    st["bench_regressions"] = atomic.LoadInt64(&benchRegressions)
+    st["feedback_dropped"] = atomic.LoadInt64(&feedbackDropped)
+    st["topology_mismatches"] = atomic.LoadInt64(&topologyMismatches)
+    st["sink_written"] = atomic.LoadInt64(&sinkWritten)
+    st["sink_retried"] = atomic.LoadInt64(&sinkRetried)
+    st["sink_failed"] = atomic.LoadInt64(&sinkFailed)
+    st["hosts_ejected"] = atomic.LoadInt64(&ejectedCount)
+    st["host_ejections"] = atomic.LoadInt64(&hostEjections)
+    st["decompressed"] = atomic.LoadInt64(&decompressed)
+    st["decompress_failed"] = atomic.LoadInt64(&decompressFailed)
+    st["listings_held"] = atomic.LoadInt64(&listingsHeld)
+    st["dry_run_writes"] = atomic.LoadInt64(&dryRunWrites)
+    st["values_too_large"] = atomic.LoadInt64(&valuesTooLarge)
+    if h := Topology(); h != 0 {
+        st["topology"] = h
+        st["epoch"] = RoutingEpoch()
+    }
+    st["stale_writes"] = atomic.LoadInt64(&staleWrites)
+    st["writes_reconciled"] = atomic.LoadInt64(&writesReconciled)
     for k, v := range s.stat {
         st[k] = v
     }
 
     t := time.Now()
-    st["time"] = int64(t.Second())
+    st["time"] = t.Unix()
     st["uptime"] = int64(t.Sub(s.start).Seconds())
     st["pid"] = int64(os.Getpid())
     st["threads"] = int64(runtime.NumGoroutine())
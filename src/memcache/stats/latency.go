@@ -0,0 +1,148 @@
+/*
+ * latency histograms of requests to backends, and timeout advice from them
+ */
+
+package stats
+
+import (
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const latencyBuckets = 40
+
+// upper bound of the i-th bucket is 100us * 2^(i/2), about 70s for the last one
+var latencyBounds = func() []time.Duration {
+    bounds := make([]time.Duration, latencyBuckets)
+    d := float64(100 * time.Microsecond)
+    for i := range bounds {
+        bounds[i] = time.Duration(d)
+        d *= 1.4142135623730951
+    }
+    return bounds
+}()
+
+type LatencyHistogram struct {
+    Bounds []time.Duration // upper bound of every bucket
+    Counts []int64
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+    return &LatencyHistogram{latencyBounds, make([]int64, latencyBuckets)}
+}
+
+func (h *LatencyHistogram) Add(d time.Duration) {
+    i := sort.Search(len(h.Bounds), func(i int) bool { return h.Bounds[i] >= d })
+    if i == len(h.Bounds) {
+        i--
+    }
+    atomic.AddInt64(&h.Counts[i], 1)
+}
+
+func (h *LatencyHistogram) Count() (n int64) {
+    for i := range h.Counts {
+        n += atomic.LoadInt64(&h.Counts[i])
+    }
+    return
+}
+
+// the latency under which q of requests finished, interpolated inside the bucket
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+    total := h.Count()
+    if total == 0 {
+        return 0
+    }
+    rank := q * float64(total)
+    var seen float64
+    for i := range h.Counts {
+        n := float64(atomic.LoadInt64(&h.Counts[i]))
+        if n > 0 && seen+n >= rank {
+            var lower time.Duration
+            if i > 0 {
+                lower = h.Bounds[i-1]
+            }
+            return lower + time.Duration(float64(h.Bounds[i]-lower)*(rank-seen)/n)
+        }
+        seen += n
+    }
+    return h.Bounds[len(h.Bounds)-1]
+}
+
+var latencyLock sync.RWMutex
+var latencies = map[string]*LatencyHistogram{}
+
+// record the latency of a command sent to backends
+func RecordLatency(cmd string, d time.Duration) {
+    latencyLock.RLock()
+    h, ok := latencies[cmd]
+    latencyLock.RUnlock()
+    if !ok {
+        latencyLock.Lock()
+        if h, ok = latencies[cmd]; !ok {
+            h = NewLatencyHistogram()
+            latencies[cmd] = h
+        }
+        latencyLock.Unlock()
+    }
+    h.Add(d)
+}
+
+// a copy of the recorded histograms by command
+func Latencies() map[string]*LatencyHistogram {
+    latencyLock.RLock()
+    defer latencyLock.RUnlock()
+    r := make(map[string]*LatencyHistogram, len(latencies))
+    for cmd, h := range latencies {
+        c := NewLatencyHistogram()
+        for i := range h.Counts {
+            c.Counts[i] = atomic.LoadInt64(&h.Counts[i])
+        }
+        r[cmd] = c
+    }
+    return r
+}
+
+// requests less than this are not enough to say anything about p99.9
+var MinLatencySamples int64 = 1000
+
+type TimeoutAdvice struct {
+    Cmd        string
+    Count      int64
+    P50        time.Duration
+    P99        time.Duration
+    P999       time.Duration
+    Timeout    time.Duration // twice of p99.9
+    HedgeDelay time.Duration // p95, when to send the request to another replica
+}
+
+// recommend timeout of every command with enough samples
+func RecommendTimeouts(hists map[string]*LatencyHistogram) []TimeoutAdvice {
+    var rs []TimeoutAdvice
+    for cmd, h := range hists {
+        n := h.Count()
+        if n < MinLatencySamples {
+            continue
+        }
+        a := TimeoutAdvice{Cmd: cmd, Count: n}
+        a.P50 = h.Quantile(0.5)
+        a.P99 = h.Quantile(0.99)
+        a.P999 = h.Quantile(0.999)
+        a.Timeout = roundUpMillisecond(a.P999 * 2)
+        a.HedgeDelay = roundUpMillisecond(h.Quantile(0.95))
+        rs = append(rs, a)
+    }
+    sort.Sort(byCmd(rs))
+    return rs
+}
+
+func roundUpMillisecond(d time.Duration) time.Duration {
+    return (d + time.Millisecond - 1) / time.Millisecond * time.Millisecond
+}
+
+type byCmd []TimeoutAdvice
+
+func (s byCmd) Len() int           { return len(s) }
+func (s byCmd) Less(i, j int) bool { return s[i].Cmd < s[j].Cmd }
+func (s byCmd) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
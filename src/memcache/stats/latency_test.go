@@ -0,0 +1,36 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := NewLatencyHistogram()
+	if h.Quantile(0.99) != 0 {
+		t.Errorf("empty histogram should have no latency")
+	}
+	for i := 0; i < 990; i++ {
+		h.Add(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.Add(time.Second)
+	}
+	if p := h.Quantile(0.5); p > 2*time.Millisecond {
+		t.Errorf("p50 should be about 1ms: %v", p)
+	}
+	if p := h.Quantile(0.999); p < 500*time.Millisecond || p > 2*time.Second {
+		t.Errorf("p99.9 should be about 1s: %v", p)
+	}
+
+	rs := RecommendTimeouts(map[string]*LatencyHistogram{"get": h, "set": NewLatencyHistogram()})
+	if len(rs) != 1 || rs[0].Cmd != "get" {
+		t.Fatalf("only commands with enough samples should be advised: %v", rs)
+	}
+	if rs[0].Timeout < 2*rs[0].P999 || rs[0].Timeout%time.Millisecond != 0 {
+		t.Errorf("timeout should be twice of p99.9 in ms: %v", rs[0])
+	}
+	if rs[0].HedgeDelay > roundUpMillisecond(rs[0].P99) {
+		t.Errorf("hedge delay should be less than p99: %v", rs[0])
+	}
+}
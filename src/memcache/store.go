@@ -1,17 +1,40 @@
 package memcache
 
 import (
+    "errors"
     "math/rand"
     "strconv"
+    "strings"
     "sync"
 )
 
+// errors of Incr
+var (
+    ErrNotFound   = errors.New("not found")
+    ErrNonNumeric = errors.New("cannot increment or decrement non-numeric value")
+)
+
+// the value incremented by v, or decremented if v < 0, not below 0 like decr
+// of memcached
+func incrValue(body []byte, v int) (int, error) {
+    n, err := strconv.Atoi(strings.TrimSpace(string(body)))
+    if err != nil || n < 0 {
+        return 0, ErrNonNumeric
+    }
+    n += v
+    if n < 0 {
+        n = 0
+    }
+    return n, nil
+}
+
 type Storage interface {
     Get(key string) (*Item, error)
     GetMulti(keys []string) (map[string]*Item, error)
     Set(key string, item *Item, noreply bool) (bool, error)
     Append(key string, value []byte) (bool, error)
-    Incr(key string, value int) (int, error)
+    Prepend(key string, value []byte) (bool, error)
+    Incr(key string, value int) (int, error) // decremented if value < 0, ErrNotFound if key is missing
     Delete(key string) (bool, error)
     Len() int
 }
@@ -21,8 +44,12 @@ type DistributeStorage interface {
     GetMulti(keys []string) (map[string]*Item, []string, error)
     Set(key string, item *Item, noreply bool) (bool, []string, error)
     Append(key string, value []byte) (bool, []string, error)
-    Incr(key string, value int) (int, []string, error)
+    Prepend(key string, value []byte) (bool, []string, error)
+    Incr(key string, value int) (int, []string, error) // like Storage.Incr
     Delete(key string) (bool, []string, error)
+    Touch(key string, exptime int) (bool, []string, error)
+    Gets(key string) (*Item, []string, error)
+    Cas(key string, item *Item) (string, []string, error) // STORED, EXISTS or NOT_FOUND
     Len() int
 }
 
@@ -83,20 +110,30 @@ func (s *mapStore) Append(key string, value []byte) (suc bool, err error) {
     return false, nil
 }
 
+func (s *mapStore) Prepend(key string, value []byte) (suc bool, err error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    r, ok := s.data[key]
+    if ok && r.Flag == 0 {
+        r.Body = append(append([]byte(nil), value...), r.Body...)
+        s.data[key] = r
+        return true, nil
+    }
+    return false, nil
+}
+
 func (s *mapStore) Incr(key string, v int) (n int, err error) {
     s.lock.Lock()
     defer s.lock.Unlock()
     r, ok := s.data[key]
-    if ok {
-        n, err = strconv.Atoi(string(r.Body))
-        if err != nil {
-            return
-        }
-        n += v
-        r.Body = []byte(strconv.Itoa(n))
-    } else {
-        n = 0
+    if !ok {
+        return 0, ErrNotFound
     }
+    if n, err = incrValue(r.Body, v); err != nil {
+        return
+    }
+    r.Body = []byte(strconv.Itoa(n))
     return
 }
 
@@ -111,6 +148,104 @@ func (s *mapStore) Delete(key string) (r bool, err error) {
     return
 }
 
+func (s *mapStore) Touch(key string, exptime int) (bool, error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    r, ok := s.data[key]
+    if ok {
+        r.Exptime = exptime
+    }
+    return ok, nil
+}
+
+func (s *mapStore) Cas(key string, item *Item) (string, error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    r, ok := s.data[key]
+    if !ok {
+        return "NOT_FOUND", nil
+    }
+    if r.Cas != item.Cas {
+        return "EXISTS", nil
+    }
+    it := *item
+    it.Cas = rand.Int()
+    it.alloc = nil
+    s.data[key] = &it
+    return "STORED", nil
+}
+
 func (s *mapStore) Len() int {
     return len(s.data)
 }
+
+// serve a Storage on this node as a DistributeStorage, all the keys live on addr
+type localStorage struct {
+    store   Storage
+    targets []string
+}
+
+func NewLocalStorage(store Storage, addr string) DistributeStorage {
+    return &localStorage{store, []string{addr}}
+}
+
+func (s *localStorage) Get(key string) (*Item, []string, error) {
+    r, err := s.store.Get(key)
+    return r, s.targets, err
+}
+
+func (s *localStorage) GetMulti(keys []string) (map[string]*Item, []string, error) {
+    rs, err := s.store.GetMulti(keys)
+    return rs, s.targets, err
+}
+
+func (s *localStorage) Set(key string, item *Item, noreply bool) (bool, []string, error) {
+    ok, err := s.store.Set(key, item, noreply)
+    return ok, s.targets, err
+}
+
+func (s *localStorage) Append(key string, value []byte) (bool, []string, error) {
+    ok, err := s.store.Append(key, value)
+    return ok, s.targets, err
+}
+
+func (s *localStorage) Prepend(key string, value []byte) (bool, []string, error) {
+    ok, err := s.store.Prepend(key, value)
+    return ok, s.targets, err
+}
+
+func (s *localStorage) Incr(key string, value int) (int, []string, error) {
+    n, err := s.store.Incr(key, value)
+    return n, s.targets, err
+}
+
+func (s *localStorage) Delete(key string) (bool, []string, error) {
+    ok, err := s.store.Delete(key)
+    return ok, s.targets, err
+}
+
+func (s *localStorage) Touch(key string, exptime int) (bool, []string, error) {
+    t, ok := s.store.(toucher)
+    if !ok {
+        return false, s.targets, ErrTouchNotSupported
+    }
+    ok, err := t.Touch(key, exptime)
+    return ok, s.targets, err
+}
+
+func (s *localStorage) Gets(key string) (*Item, []string, error) {
+    return s.Get(key)
+}
+
+func (s *localStorage) Cas(key string, item *Item) (string, []string, error) {
+    c, ok := s.store.(caser)
+    if !ok {
+        return "", s.targets, ErrCasNotSupported
+    }
+    status, err := c.Cas(key, item)
+    return status, s.targets, err
+}
+
+func (s *localStorage) Len() int {
+    return s.store.Len()
+}
@@ -0,0 +1,194 @@
+/*
+ * move huge or rarely accessed values to a cold tier, like S3
+ */
+
+package memcache
+
+import (
+    "errors"
+    "strings"
+)
+
+// flag of the placeholder kept in hot tier for a value living in cold tier,
+// reserved, values of clients with it are refused
+const ColdTierFlag = 0x40000000
+
+var ErrColdTierFlag = errors.New("flag 0x40000000 is reserved for the cold tier")
+
+// TierClient route keys with some prefixes, and values larger than minSize,
+// to the cold tier, values larger than minSize leave a placeholder in the hot
+// tier, so they are addressable by the same key.
+type TierClient struct {
+    hot      DistributeStorage
+    cold     Storage
+    coldName string // target name of cold tier in access log
+    prefixes []string
+    minSize  int
+}
+
+func NewTierClient(hot DistributeStorage, cold Storage, coldName string, prefixes []string, minSize int) *TierClient {
+    return &TierClient{hot, cold, coldName, prefixes, minSize}
+}
+
+func (c *TierClient) isColdKey(key string) bool {
+    for _, p := range c.prefixes {
+        if strings.HasPrefix(key, p) {
+            return true
+        }
+    }
+    return false
+}
+
+func isColdPlaceholder(r *Item) bool {
+    return r != nil && r.Flag&ColdTierFlag != 0
+}
+
+func (c *TierClient) Get(key string) (r *Item, targets []string, err error) {
+    if c.isColdKey(key) {
+        r, err = c.cold.Get(key)
+        return r, []string{c.coldName}, err
+    }
+    r, targets, err = c.hot.Get(key)
+    if err == nil && isColdPlaceholder(r) {
+        r, err = c.cold.Get(key)
+        targets = append(targets, c.coldName)
+    }
+    return
+}
+
+func (c *TierClient) GetMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+    hot := make([]string, 0, len(keys))
+    var cold []string
+    for _, key := range keys {
+        if c.isColdKey(key) {
+            cold = append(cold, key)
+        } else {
+            hot = append(hot, key)
+        }
+    }
+    if len(hot) > 0 {
+        rs, targets, err = c.hot.GetMulti(hot)
+    }
+    if rs == nil {
+        rs = make(map[string]*Item, len(cold))
+    }
+    for key, r := range rs {
+        if isColdPlaceholder(r) {
+            delete(rs, key)
+            cold = append(cold, key)
+        }
+    }
+    if len(cold) > 0 {
+        crs, e := c.cold.GetMulti(cold)
+        if e != nil {
+            err = e
+        }
+        for key, r := range crs {
+            rs[key] = r
+        }
+        targets = append(targets, c.coldName)
+    }
+    return
+}
+
+func (c *TierClient) Set(key string, item *Item, noreply bool) (ok bool, targets []string, err error) {
+    if item.Flag&ColdTierFlag != 0 {
+        return false, nil, ErrColdTierFlag
+    }
+    if c.isColdKey(key) {
+        ok, err = c.cold.Set(key, item, noreply)
+        return ok, []string{c.coldName}, err
+    }
+    if c.minSize <= 0 || len(item.Body) <= c.minSize {
+        // the object left in cold tier is shadowed by the value
+        return c.hot.Set(key, item, noreply)
+    }
+    if ok, err = c.cold.Set(key, item, noreply); !ok {
+        return false, []string{c.coldName}, err
+    }
+    placeholder := &Item{Flag: ColdTierFlag, Exptime: item.Exptime}
+    ok, targets, err = c.hot.Set(key, placeholder, noreply)
+    return ok, append(targets, c.coldName), err
+}
+
+// the value of key is in cold tier
+func (c *TierClient) inCold(key string) bool {
+    if c.isColdKey(key) {
+        return true
+    }
+    r, _, err := c.hot.Get(key)
+    return err == nil && isColdPlaceholder(r)
+}
+
+func (c *TierClient) Append(key string, value []byte) (ok bool, targets []string, err error) {
+    if !c.isColdKey(key) {
+        ok, targets, err = c.hot.Append(key, value)
+        if ok || !c.inCold(key) {
+            return
+        }
+    }
+    ok, err = c.cold.Append(key, value)
+    return ok, append(targets, c.coldName), err
+}
+
+func (c *TierClient) Prepend(key string, value []byte) (ok bool, targets []string, err error) {
+    if !c.isColdKey(key) {
+        ok, targets, err = c.hot.Prepend(key, value)
+        if ok || !c.inCold(key) {
+            return
+        }
+    }
+    ok, err = c.cold.Prepend(key, value)
+    return ok, append(targets, c.coldName), err
+}
+
+func (c *TierClient) Incr(key string, value int) (n int, targets []string, err error) {
+    if c.isColdKey(key) {
+        n, err = c.cold.Incr(key, value)
+        return n, []string{c.coldName}, err
+    }
+    return c.hot.Incr(key, value)
+}
+
+func (c *TierClient) Delete(key string) (ok bool, targets []string, err error) {
+    if c.isColdKey(key) {
+        ok, err = c.cold.Delete(key)
+        return ok, []string{c.coldName}, err
+    }
+    cold := c.inCold(key)
+    ok, targets, err = c.hot.Delete(key)
+    if cold {
+        c.cold.Delete(key)
+        targets = append(targets, c.coldName)
+    }
+    return
+}
+
+// values in the cold tier never expire
+func (c *TierClient) Touch(key string, exptime int) (bool, []string, error) {
+    if c.isColdKey(key) {
+        return false, []string{c.coldName}, ErrTouchNotSupported
+    }
+    return c.hot.Touch(key, exptime)
+}
+
+func (c *TierClient) Gets(key string) (*Item, []string, error) {
+    if c.isColdKey(key) {
+        return nil, []string{c.coldName}, ErrCasNotSupported
+    }
+    return c.hot.Gets(key)
+}
+
+func (c *TierClient) Cas(key string, item *Item) (string, []string, error) {
+    if item.Flag&ColdTierFlag != 0 {
+        return "", nil, ErrColdTierFlag
+    }
+    if c.isColdKey(key) || c.minSize > 0 && len(item.Body) > c.minSize {
+        return "", []string{c.coldName}, ErrCasNotSupported
+    }
+    return c.hot.Cas(key, item)
+}
+
+func (c *TierClient) Len() int {
+    return c.hot.Len()
+}
@@ -0,0 +1,111 @@
+package memcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTierClient(t *testing.T) {
+	hot := newMapDistStore()
+	cold := NewMapStore()
+	c := NewTierClient(hot, cold, "cold", []string{"archive:"}, 10)
+
+	c.Set("archive:1", &Item{Body: []byte("old")}, false)
+	c.Set("small", &Item{Body: []byte("small")}, false)
+	c.Set("large", &Item{Flag: 0, Body: []byte("a large value")}, false)
+	if r, _ := hot.mapStore.Get("archive:1"); r != nil {
+		t.Errorf("keys with cold prefix should not be in hot tier")
+	}
+	if r, _ := hot.mapStore.Get("large"); r == nil || r.Flag != ColdTierFlag || len(r.Body) != 0 {
+		t.Errorf("large value should leave a placeholder in hot tier: %v", r)
+	}
+
+	rs, targets, _ := c.GetMulti([]string{"archive:1", "small", "large"})
+	if len(rs) != 3 || string(rs["archive:1"].Body) != "old" || string(rs["large"].Body) != "a large value" {
+		t.Errorf("values should be read from both tiers: %v", rs)
+	}
+	if targets[len(targets)-1] != "cold" {
+		t.Errorf("cold tier should be in targets: %v", targets)
+	}
+
+	if ok, _, _ := c.Append("large", []byte("!")); !ok {
+		t.Errorf("append to value in cold tier should succeed")
+	}
+	if r, _, _ := c.Get("large"); r == nil || string(r.Body) != "a large value!" {
+		t.Errorf("append failed: %v", r)
+	}
+	c.Delete("large")
+	if r, _ := cold.Get("large"); r != nil {
+		t.Errorf("value in cold tier should be deleted with the placeholder")
+	}
+
+	if ok, _, err := c.Set("forged", &Item{Flag: ColdTierFlag | 1, Body: []byte("x")}, false); ok || err != ErrColdTierFlag {
+		t.Errorf("values with the flag of placeholders should be refused: %v %v", ok, err)
+	}
+	if r, _ := hot.mapStore.Get("forged"); r != nil {
+		t.Errorf("refused value should not be stored: %v", r)
+	}
+	if _, _, err := c.Cas("small", &Item{Flag: ColdTierFlag, Body: []byte("x"), Cas: 1}); err != ErrColdTierFlag {
+		t.Errorf("cas with the flag of placeholders should be refused: %v", err)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	var lock sync.Mutex
+	objects := make(map[string][]byte)
+	flags := make(map[string]string)
+	gets := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=ak/") || req.Header.Get("x-amz-date") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		path := req.URL.EscapedPath()
+		switch req.Method {
+		case "PUT":
+			objects[path], _ = ioutil.ReadAll(req.Body)
+			flags[path] = req.Header.Get("x-amz-meta-flag")
+		case "GET":
+			gets++
+			body, ok := objects[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("x-amz-meta-flag", flags[path])
+			w.Write(body)
+		case "DELETE":
+			delete(objects, path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	s := NewS3Store(srv.URL, "bucket", "", "ak", "sk", 1024)
+	if ok, err := s.Set("a key", &Item{Flag: 2, Body: []byte("value")}, false); !ok {
+		t.Fatal("put failed", err)
+	}
+	if _, ok := objects["/bucket/a%20key"]; !ok {
+		t.Errorf("key should be escaped in path: %v", objects)
+	}
+	for i := 0; i < 2; i++ {
+		r, err := s.Get("a key")
+		if err != nil || r == nil || r.Flag != 2 || string(r.Body) != "value" {
+			t.Errorf("get failed: %v %v", r, err)
+		}
+	}
+	if gets != 1 {
+		t.Errorf("second get should hit local cache: %d", gets)
+	}
+	s.Delete("a key")
+	if r, _ := s.Get("a key"); r != nil {
+		t.Errorf("deleted object should be missing: %v", r)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * events changing the routing, like ejections, maintenance and reloads, kept
+ * in memory, so the timeline of an incident documents itself
+ */
+
+package memcache
+
+import (
+    "sync"
+    "time"
+)
+
+// events kept, the oldest are dropped
+var TimelineSize = 1000
+
+type TimelineEvent struct {
+    Time   time.Time
+    Kind   string // eject, recover, maintenance, drain, pin, weights, reload, fault ...
+    Host   string `json:",omitempty"`
+    Detail string `json:",omitempty"`
+}
+
+var (
+    timelineLock sync.Mutex
+    timeline     []TimelineEvent // ring of TimelineSize
+    timelineNext int             // total events recorded
+)
+
+// record an event changing the routing, host is empty if it's not of a host
+func RecordEvent(kind, host, detail string) {
+    if host != "" {
+        host = NormalizeAddr(host)
+    }
+    e := TimelineEvent{time.Now(), kind, host, detail}
+    timelineLock.Lock()
+    defer timelineLock.Unlock()
+    if TimelineSize <= 0 {
+        return
+    }
+    if len(timeline) != TimelineSize {
+        // resized
+        old := timelineEvents()
+        if len(old) > TimelineSize {
+            old = old[len(old)-TimelineSize:]
+        }
+        timeline = make([]TimelineEvent, TimelineSize)
+        timelineNext = copy(timeline, old)
+    }
+    timeline[timelineNext%TimelineSize] = e
+    timelineNext++
+}
+
+func timelineEvents() []TimelineEvent {
+    n := len(timeline)
+    if timelineNext <= n {
+        return append([]TimelineEvent(nil), timeline[:timelineNext]...)
+    }
+    r := make([]TimelineEvent, 0, n)
+    r = append(r, timeline[timelineNext%n:]...)
+    return append(r, timeline[:timelineNext%n]...)
+}
+
+// the events kept, the oldest first
+func Timeline() []TimelineEvent {
+    timelineLock.Lock()
+    defer timelineLock.Unlock()
+    return timelineEvents()
+}
@@ -0,0 +1,36 @@
+package memcache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTimeline(t *testing.T) {
+	size := TimelineSize
+	TimelineSize = 3
+	defer func() { TimelineSize = size }()
+
+	for i := 0; i < 5; i++ {
+		RecordEvent("test", fmt.Sprintf("host%d", i), "")
+	}
+	es := Timeline()
+	if len(es) != 3 || es[0].Host != "host2" || es[2].Host != "host4" {
+		t.Errorf("the latest events should be kept, the oldest first: %v", es)
+	}
+
+	SetMaintenance("timeline:11211", true)
+	SetMaintenance("timeline:11211", false)
+	DrainHost("timeline:11211", time.Minute)
+	es = Timeline()
+	if len(es) != 3 || es[0].Kind != "maintenance" || es[0].Detail != "on" || es[2].Kind != "drain" {
+		t.Errorf("routing events should be recorded: %v", es)
+	}
+	UndrainHost("timeline:11211")
+
+	TimelineSize = 5
+	RecordEvent("test", "", "resized")
+	if es = Timeline(); len(es) != 4 || es[3].Detail != "resized" {
+		t.Errorf("events should be kept after resizing: %v", es)
+	}
+}
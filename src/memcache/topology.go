@@ -0,0 +1,101 @@
+/*
+ * detect proxies routing by different configs, split routing configs
+ * silently corrupt the placement of data
+ */
+
+package memcache
+
+import (
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// hash of the effective topology of this proxy, reported as topology in
+// stats, 0 if unknown
+var topologyHash int64
+
+var topologyMismatches int64
+
+// set the topology by its canonical description, nil to forget it
+func SetTopology(desc []byte) {
+    var h int64
+    if desc != nil {
+        h = int64(fnv1a(desc))
+    }
+    if atomic.SwapInt64(&topologyHash, h) != h && h != 0 {
+        newEpoch()
+    }
+}
+
+func Topology() int64 {
+    return atomic.LoadInt64(&topologyHash)
+}
+
+// TopologyCheck compare the topology with peer proxies periodically
+type TopologyCheck struct {
+    Peers    []string
+    Interval time.Duration
+    Done     <-chan struct{} // closed to stop Run, nil runs forever
+    lock     sync.Mutex
+    hosts    []*Host
+    last     map[string]string // peer -> ok, differs, unknown or the error
+}
+
+// status of every peer
+func (c *TopologyCheck) Check() map[string]string {
+    if c.hosts == nil {
+        c.hosts = make([]*Host, len(c.Peers))
+        for i, peer := range c.Peers {
+            c.hosts[i] = NewHost(peer)
+        }
+    }
+    own := Topology()
+    r := make(map[string]string, len(c.hosts))
+    for _, h := range c.hosts {
+        st, err := h.Stat(nil)
+        if err != nil {
+            r[h.Addr] = err.Error()
+            continue
+        }
+        v, ok := st["topology"]
+        if !ok {
+            r[h.Addr] = "unknown"
+            continue
+        }
+        epoch, _ := strconv.ParseInt(st["epoch"], 10, 64)
+        if hash, _ := strconv.ParseInt(v, 10, 64); hash != own {
+            observeEpoch(h.Addr, epoch, false)
+            r[h.Addr] = "differs"
+            atomic.AddInt64(&topologyMismatches, 1)
+            ErrorLog.Printf("TOPOLOGY MISMATCH: proxy %s routes by a different config (%s vs %d), data may be misplaced",
+                h.Addr, v, own)
+        } else {
+            observeEpoch(h.Addr, epoch, true)
+            r[h.Addr] = "ok"
+        }
+    }
+    c.lock.Lock()
+    c.last = r
+    c.lock.Unlock()
+    return r
+}
+
+func (c *TopologyCheck) Last() map[string]string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.last
+}
+
+// run forever, in a goroutine
+func (c *TopologyCheck) Run() {
+    for {
+        select {
+        case <-time.After(c.Interval):
+        case <-c.Done:
+            return
+        }
+        c.Check()
+    }
+}
@@ -0,0 +1,139 @@
+package memcache
+
+import (
+	"container/list"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// a peer reporting the stats
+type statNode struct {
+	*mockNode
+	stats map[string]string
+}
+
+func (n *statNode) Stat(keys []string) (map[string]string, error) {
+	if n.stats == nil {
+		return nil, errors.New("connection refused")
+	}
+	return n.stats, nil
+}
+
+func TestTopologyCheck(t *testing.T) {
+	defer SetTopology(nil)
+	SetTopology([]byte("servers: a b"))
+	own := strconv.FormatInt(Topology(), 10)
+	if NewStats().Stats()["topology"] != Topology() {
+		t.Errorf("topology should be reported in stats")
+	}
+
+	peers := map[string]map[string]string{
+		"same":    {"topology": own},
+		"differs": {"topology": "1"},
+		"old":     {"pid": "1"},
+		"down":    nil,
+	}
+	c := &TopologyCheck{}
+	for addr, st := range peers {
+		c.Peers = append(c.Peers, addr)
+		c.hosts = append(c.hosts, NewNodeHost(addr, &statNode{newMockNode(), st}))
+	}
+	r := c.Check()
+	want := map[string]string{"same": "ok", "differs": "differs", "old": "unknown", "down": "connection refused"}
+	for addr, status := range want {
+		if r[addr] != status {
+			t.Errorf("%s should be %s: %s", addr, status, r[addr])
+		}
+	}
+	if c.Last()["differs"] != "differs" {
+		t.Errorf("last status should be kept: %v", c.Last())
+	}
+}
+
+func TestRoutingEpoch(t *testing.T) {
+	defer func() {
+		SetTopology(nil)
+		routingEpoch, epochBehind = 0, 0
+	}()
+	SetTopology([]byte("servers: a b"))
+	first := RoutingEpoch()
+	if first <= 0 {
+		t.Fatalf("a topology should have an epoch: %d", first)
+	}
+	SetTopology([]byte("servers: a b"))
+	if RoutingEpoch() != first {
+		t.Errorf("the same topology should keep the epoch")
+	}
+	SetTopology([]byte("servers: a b c"))
+	second := RoutingEpoch()
+	if second <= first {
+		t.Errorf("a new topology should have a larger epoch: %d <= %d", second, first)
+	}
+	if NewStats().Stats()["epoch"] != second {
+		t.Errorf("epoch should be reported in stats")
+	}
+
+	own := strconv.FormatInt(Topology(), 10)
+	earlier := strconv.FormatInt(second-10, 10)
+	newer := strconv.FormatInt(second+10, 10)
+	c := &TopologyCheck{Peers: []string{"same", "newer"}}
+	c.hosts = []*Host{
+		NewNodeHost("same", &statNode{newMockNode(), map[string]string{"topology": own, "epoch": earlier}}),
+		NewNodeHost("newer", &statNode{newMockNode(), map[string]string{"topology": "1", "epoch": newer}}),
+	}
+	c.Check()
+	if RoutingEpoch() != second-10 {
+		t.Errorf("the epoch should be the earliest of the same topology: %d", RoutingEpoch())
+	}
+	if EpochBehind() != second+10 {
+		t.Errorf("a newer topology on peers should be seen: %d", EpochBehind())
+	}
+	stale := atomic.LoadInt64(&staleWrites)
+	stampWrite("k", []string{"old"})
+	if atomic.LoadInt64(&staleWrites) != stale+1 {
+		t.Errorf("writes by a stale topology should be counted")
+	}
+}
+
+func TestReconcileWrites(t *testing.T) {
+	EpochLedgerSize = 2
+	defer func() {
+		EpochLedgerSize = 0
+		SetTopology(nil)
+		routingEpoch = 0
+		writeLedger.writes = make(map[string]*list.Element)
+		writeLedger.order.Init()
+		delete(writeLedger.hosts, "old")
+	}()
+	SetTopology([]byte("servers: old"))
+	old := newMockNode()
+	writeLedger.hosts["old"] = NewNodeHost("old", old)
+	for _, key := range []string{"dropped", "deleted", "moved", "kept"} {
+		old.Set(key, &Item{Body: []byte(key)}, false)
+		stampWrite(key, []string{"old"})
+		if key == "deleted" {
+			forgetWrite(key)
+		}
+	}
+	if n := len(EpochLedger()); n != 2 {
+		t.Fatalf("the ledger should be bounded: %d", n)
+	}
+
+	SetTopology([]byte("servers: new"))
+	store := newMapDistStore()
+	store.Set("kept", &Item{Body: []byte("new")}, false)
+	if n := ReconcileWrites(store); n != 1 {
+		t.Errorf("one key should be copied: %d", n)
+	}
+	if r, _, _ := store.Get("moved"); r == nil || string(r.Body) != "moved" {
+		t.Errorf("key missing under the new topology should be copied: %v", r)
+	}
+	if r, _, _ := store.Get("kept"); string(r.Body) != "new" {
+		t.Errorf("key found under the new topology should be kept: %s", r.Body)
+	}
+	if len(EpochLedger()) != 0 {
+		t.Errorf("reconciled writes should be forgotten: %v", EpochLedger())
+	}
+}
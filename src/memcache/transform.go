@@ -0,0 +1,345 @@
+/*
+ * value transformers: derive a response from a stored value
+ */
+
+package memcache
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "image"
+    "image/gif"
+    "image/jpeg"
+    "image/png"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// a key like "photo:123#thumb=64" means the value of "photo:123"
+// transformed by "thumb" with argument "64", only for the prefixes given to
+// TransformClient, so other keys with "#" are left alone
+const TransformSep = "#"
+
+// images larger than this are not decoded for thumbnails, checked by the
+// size in the header, so a small image claiming huge dimensions is refused
+var MaxThumbnailPixels = 4096 * 4096
+
+var errImageTooLarge = errors.New("image too large for thumbnail")
+
+// Transformer derive a new item from the stored one
+type Transformer func(item *Item, arg string) (*Item, error)
+
+var transformLock sync.RWMutex
+var transformers = map[string]Transformer{
+    "json":  jsonProjection,
+    "thumb": thumbnail,
+}
+
+func RegisterTransformer(name string, t Transformer) {
+    transformLock.Lock()
+    defer transformLock.Unlock()
+    transformers[name] = t
+}
+
+func getTransformer(name string) Transformer {
+    transformLock.RLock()
+    defer transformLock.RUnlock()
+    return transformers[name]
+}
+
+// split a key into base key and transformer, t is nil for plain keys, and
+// the keys without any of prefixes
+func parseTransformKey(key string, prefixes []string) (base string, t Transformer, arg string) {
+    p := strings.LastIndex(key, TransformSep)
+    if p <= 0 || !hasAnyPrefix(key[:p], prefixes) {
+        return key, nil, ""
+    }
+    name := key[p+1:]
+    if i := strings.Index(name, "="); i >= 0 {
+        name, arg = name[:i], name[i+1:]
+    }
+    t = getTransformer(name)
+    if t == nil {
+        return key, nil, ""
+    }
+    return key[:p], t, arg
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+    for _, p := range prefixes {
+        if strings.HasPrefix(key, p) {
+            return true
+        }
+    }
+    return false
+}
+
+// pick some top level fields of a json object, "user:1#json=name,age"
+func jsonProjection(item *Item, arg string) (*Item, error) {
+    var obj map[string]interface{}
+    if err := json.Unmarshal(item.Body, &obj); err != nil {
+        return nil, err
+    }
+    r := make(map[string]interface{})
+    for _, f := range strings.Split(arg, ",") {
+        if v, ok := obj[f]; ok {
+            r[f] = v
+        }
+    }
+    body, err := json.Marshal(r)
+    if err != nil {
+        return nil, err
+    }
+    return &Item{Flag: item.Flag, Exptime: item.Exptime, Body: body}, nil
+}
+
+// scale an image down to fit in a box of arg pixels (128 by default)
+func thumbnail(item *Item, arg string) (*Item, error) {
+    size := 128
+    if arg != "" {
+        n, err := strconv.Atoi(arg)
+        if err != nil || n <= 0 {
+            return nil, errors.New("invalid thumbnail size: " + arg)
+        }
+        size = n
+    }
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(item.Body))
+    if err != nil {
+        return nil, err
+    }
+    if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > MaxThumbnailPixels/cfg.Height {
+        return nil, errImageTooLarge
+    }
+    src, format, err := image.Decode(bytes.NewReader(item.Body))
+    if err != nil {
+        return nil, err
+    }
+    b := src.Bounds()
+    w, h := b.Dx(), b.Dy()
+    if w > size || h > size {
+        if w > h {
+            w, h = size, h*size/w
+        } else {
+            w, h = w*size/h, size
+        }
+    }
+    if w < 1 {
+        w = 1
+    }
+    if h < 1 {
+        h = 1
+    }
+    dst := image.NewRGBA(image.Rect(0, 0, w, h))
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            dst.Set(x, y, src.At(b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h))
+        }
+    }
+    var buf bytes.Buffer
+    switch format {
+    case "png":
+        err = png.Encode(&buf, dst)
+    case "gif":
+        err = gif.Encode(&buf, dst, nil)
+    default:
+        err = jpeg.Encode(&buf, dst, nil)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &Item{Flag: item.Flag, Exptime: item.Exptime, Body: buf.Bytes()}, nil
+}
+
+type transformed struct {
+    item   *Item
+    expire time.Time
+}
+
+// transformed values cached at most, the expired ones are swept every ttl
+var MaxTransformed = 1 << 16
+
+// TransformClient compute transformed values of keys with prefixes in proxy,
+// cache them for a while
+type TransformClient struct {
+    store    DistributeStorage
+    ttl      time.Duration
+    prefixes []string
+    lock     sync.Mutex
+    cache    map[string]*transformed
+    derived  map[string][]string // base key -> transformed keys in cache
+    swept    time.Time
+}
+
+func NewTransformClient(store DistributeStorage, ttl time.Duration, prefixes []string) *TransformClient {
+    c := new(TransformClient)
+    c.store = store
+    c.ttl = ttl
+    c.prefixes = prefixes
+    c.cache = make(map[string]*transformed)
+    c.derived = make(map[string][]string)
+    return c
+}
+
+func (c *TransformClient) cached(key string) *Item {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if t, ok := c.cache[key]; ok {
+        if time.Now().Before(t.expire) {
+            return t.item
+        }
+        delete(c.cache, key)
+    }
+    return nil
+}
+
+func (c *TransformClient) remember(base, key string, item *Item) {
+    if c.ttl <= 0 {
+        return
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    now := time.Now()
+    if now.Sub(c.swept) > c.ttl {
+        c.sweep(now)
+    }
+    if _, ok := c.cache[key]; !ok {
+        if len(c.cache) >= MaxTransformed {
+            return
+        }
+        c.derived[base] = append(c.derived[base], key)
+    }
+    c.cache[key] = &transformed{item, now.Add(c.ttl)}
+}
+
+// drop the expired values, and their keys in derived, with lock held
+func (c *TransformClient) sweep(now time.Time) {
+    for key, t := range c.cache {
+        if !now.Before(t.expire) {
+            delete(c.cache, key)
+        }
+    }
+    for base, keys := range c.derived {
+        live := keys[:0]
+        for _, k := range keys {
+            if _, ok := c.cache[k]; ok {
+                live = append(live, k)
+            }
+        }
+        if len(live) == 0 {
+            delete(c.derived, base)
+        } else {
+            c.derived[base] = live
+        }
+    }
+    c.swept = now
+}
+
+func (c *TransformClient) invalidate(key string) {
+    if c.ttl <= 0 {
+        return
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    for _, k := range c.derived[key] {
+        delete(c.cache, k)
+    }
+    delete(c.derived, key)
+}
+
+func (c *TransformClient) Get(key string) (r *Item, targets []string, err error) {
+    base, t, arg := parseTransformKey(key, c.prefixes)
+    if t == nil {
+        return c.store.Get(key)
+    }
+    if r = c.cached(key); r != nil {
+        return
+    }
+    var item *Item
+    item, targets, err = c.store.Get(base)
+    if err != nil || item == nil {
+        return
+    }
+    r, err = t(item, arg)
+    if err != nil {
+        ErrorLog.Printf("transform %s failed: %s", key, err)
+        return nil, targets, err
+    }
+    c.remember(base, key, r)
+    return
+}
+
+func (c *TransformClient) GetMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+    plain := make([]string, 0, len(keys))
+    var derived []string
+    for _, key := range keys {
+        if _, t, _ := parseTransformKey(key, c.prefixes); t != nil {
+            derived = append(derived, key)
+        } else {
+            plain = append(plain, key)
+        }
+    }
+    if len(plain) > 0 {
+        rs, targets, err = c.store.GetMulti(plain)
+    }
+    if rs == nil {
+        rs = make(map[string]*Item, len(derived))
+    }
+    for _, key := range derived {
+        item, t, e := c.Get(key)
+        if e != nil {
+            err = e
+            continue
+        }
+        if item != nil {
+            rs[key] = item
+            targets = append(targets, t...)
+        }
+    }
+    return
+}
+
+func (c *TransformClient) Set(key string, item *Item, noreply bool) (bool, []string, error) {
+    c.invalidate(key)
+    return c.store.Set(key, item, noreply)
+}
+
+func (c *TransformClient) Append(key string, value []byte) (bool, []string, error) {
+    c.invalidate(key)
+    return c.store.Append(key, value)
+}
+
+func (c *TransformClient) Prepend(key string, value []byte) (bool, []string, error) {
+    c.invalidate(key)
+    return c.store.Prepend(key, value)
+}
+
+func (c *TransformClient) Incr(key string, value int) (int, []string, error) {
+    c.invalidate(key)
+    return c.store.Incr(key, value)
+}
+
+func (c *TransformClient) Delete(key string) (bool, []string, error) {
+    c.invalidate(key)
+    return c.store.Delete(key)
+}
+
+func (c *TransformClient) Touch(key string, exptime int) (bool, []string, error) {
+    c.invalidate(key)
+    return c.store.Touch(key, exptime)
+}
+
+func (c *TransformClient) Gets(key string) (*Item, []string, error) {
+    return c.store.Gets(key)
+}
+
+func (c *TransformClient) Cas(key string, item *Item) (string, []string, error) {
+    c.invalidate(key)
+    return c.store.Cas(key, item)
+}
+
+func (c *TransformClient) Len() int {
+    return c.store.Len()
+}
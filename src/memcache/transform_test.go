@@ -0,0 +1,132 @@
+package memcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// mapStore as a DistributeStorage living on a single fake host
+type mapDistStore struct {
+	*mapStore
+}
+
+func newMapDistStore() *mapDistStore {
+	return &mapDistStore{NewMapStore()}
+}
+
+var localTargets = []string{"local"}
+
+func (s *mapDistStore) Get(key string) (*Item, []string, error) {
+	r, err := s.mapStore.Get(key)
+	return r, localTargets, err
+}
+
+func (s *mapDistStore) GetMulti(keys []string) (map[string]*Item, []string, error) {
+	rs, err := s.mapStore.GetMulti(keys)
+	return rs, localTargets, err
+}
+
+func (s *mapDistStore) Set(key string, item *Item, noreply bool) (bool, []string, error) {
+	ok, err := s.mapStore.Set(key, item, noreply)
+	return ok, localTargets, err
+}
+
+func (s *mapDistStore) Touch(key string, exptime int) (bool, []string, error) {
+	ok, err := s.mapStore.Touch(key, exptime)
+	return ok, localTargets, err
+}
+
+func (s *mapDistStore) Gets(key string) (*Item, []string, error) {
+	return s.Get(key)
+}
+
+func (s *mapDistStore) Cas(key string, item *Item) (string, []string, error) {
+	status, err := s.mapStore.Cas(key, item)
+	return status, localTargets, err
+}
+
+func (s *mapDistStore) Append(key string, value []byte) (bool, []string, error) {
+	ok, err := s.mapStore.Append(key, value)
+	return ok, localTargets, err
+}
+
+func (s *mapDistStore) Prepend(key string, value []byte) (bool, []string, error) {
+	ok, err := s.mapStore.Prepend(key, value)
+	return ok, localTargets, err
+}
+
+func (s *mapDistStore) Incr(key string, value int) (int, []string, error) {
+	n, err := s.mapStore.Incr(key, value)
+	return n, localTargets, err
+}
+
+func (s *mapDistStore) Delete(key string) (bool, []string, error) {
+	ok, err := s.mapStore.Delete(key)
+	return ok, localTargets, err
+}
+
+func TestTransformClient(t *testing.T) {
+	c := NewTransformClient(newMapDistStore(), time.Minute, []string{"user:"})
+	c.Set("user:1", &Item{Body: []byte(`{"name":"bean","age":3,"city":"bj"}`)}, false)
+	c.Set("tag:1#json", &Item{Body: []byte("plain")}, false)
+
+	r, _, err := c.Get("user:1#json=name,age")
+	if err != nil || r == nil || string(r.Body) != `{"age":3,"name":"bean"}` {
+		t.Errorf("json projection failed: %v %v", r, err)
+	}
+	if r, _, _ := c.Get("user:1#unknown"); r != nil {
+		t.Errorf("unknown transformer should be a plain key")
+	}
+	if r, _, _ := c.Get("tag:1#json"); r == nil || string(r.Body) != "plain" {
+		t.Errorf("keys without the prefixes should not be transformed: %v", r)
+	}
+
+	c.Set("user:1", &Item{Body: []byte(`{"name":"eye"}`)}, false)
+	rs, _, _ := c.GetMulti([]string{"user:1", "user:1#json=name,age"})
+	if len(rs) != 2 || string(rs["user:1#json=name,age"].Body) != `{"name":"eye"}` {
+		t.Errorf("transformed value should be invalidated by set: %v", rs)
+	}
+}
+
+func TestTransformCacheBounded(t *testing.T) {
+	old := MaxTransformed
+	MaxTransformed = 2
+	defer func() { MaxTransformed = old }()
+	c := NewTransformClient(newMapDistStore(), 10*time.Millisecond, []string{"a", "b", "c"})
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, &Item{Body: []byte(`{"name":"bean"}`)}, false)
+		c.Get(key + "#json=name")
+	}
+	if len(c.cache) != 2 || len(c.derived) != 2 {
+		t.Errorf("no more than 2 values should be cached: %d %d", len(c.cache), len(c.derived))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	c.Get("c#json=name")
+	if len(c.cache) != 1 || len(c.derived) != 1 || len(c.derived["c"]) != 1 {
+		t.Errorf("expired values should be swept: %v %v", c.cache, c.derived)
+	}
+}
+
+func TestThumbnailTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 256, 256)))
+	if r, err := thumbnail(&Item{Body: buf.Bytes()}, "64"); err != nil || r == nil {
+		t.Fatalf("thumbnail failed: %v", err)
+	}
+
+	// the dimensions in the header of a png are at offset 16, followed by
+	// the crc of the chunk
+	huge := append([]byte(nil), buf.Bytes()...)
+	binary.BigEndian.PutUint32(huge[16:], 1<<20)
+	binary.BigEndian.PutUint32(huge[20:], 1<<20)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	if _, err := thumbnail(&Item{Body: huge}, "64"); err != errImageTooLarge {
+		t.Errorf("image claiming huge dimensions should be refused: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * the largest values backends store, configured or probed, so writes too
+ * large for a server are not sent to it, rather than failing there
+ */
+
+package memcache
+
+import (
+    "errors"
+    "strconv"
+    "sync/atomic"
+)
+
+// largest values of backends in bytes, 0 means no limit
+var DefaultMaxValueSize = 0
+var HostMaxValueSize = map[string]int{}
+
+var ErrValueTooLarge = errors.New("object too large for cache")
+
+var valuesTooLarge int64
+
+func (host *Host) MaxValueSize() int {
+    return int(atomic.LoadInt64(&host.counter.maxValue))
+}
+
+// shared by the hosts of the same address
+func (host *Host) SetMaxValueSize(n int) {
+    atomic.StoreInt64(&host.counter.maxValue, int64(n))
+}
+
+// ask the backend by "stats settings", memcached reports item_size_max
+func (host *Host) ProbeMaxValueSize() (int, error) {
+    st, err := host.Stat([]string{"settings"})
+    if err != nil {
+        return 0, err
+    }
+    v, ok := st["item_size_max"]
+    if !ok {
+        return 0, errors.New("item_size_max is unknown")
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n <= 0 {
+        return 0, errors.New("invalid item_size_max: " + v)
+    }
+    host.SetMaxValueSize(n)
+    return n, nil
+}
+
+func (host *Host) checkValueSize(item *Item) error {
+    if max := host.MaxValueSize(); max > 0 && len(item.Body) > max {
+        atomic.AddInt64(&valuesTooLarge, 1)
+        return ErrValueTooLarge
+    }
+    return nil
+}
@@ -0,0 +1,39 @@
+package memcache
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaxValueSize(t *testing.T) {
+	small := NewNodeHost("valuesize-small", &statNode{newMockNode(), map[string]string{"item_size_max": "4"}})
+	big := NewNodeHost("valuesize-big", &statNode{newMockNode(), map[string]string{}})
+	defer small.SetMaxValueSize(0)
+
+	if n, err := small.ProbeMaxValueSize(); err != nil || n != 4 || small.MaxValueSize() != 4 {
+		t.Fatalf("item_size_max should be probed: %d %v", n, err)
+	}
+	if _, err := big.ProbeMaxValueSize(); err == nil || big.MaxValueSize() != 0 {
+		t.Errorf("no limit should be probed without item_size_max")
+	}
+	if NewHost("valuesize-small").MaxValueSize() != 4 {
+		t.Errorf("the limit should be shared by the hosts of the address")
+	}
+
+	large := &Item{Body: []byte(strings.Repeat("v", 5))}
+	if ok, err := small.Set("k", large, false); ok || err != ErrValueTooLarge {
+		t.Errorf("value too large should not be sent: %v %v", ok, err)
+	}
+
+	client := NewClient(&staticScheduler{hosts: []*Host{small, big}}, 2, 1, 1)
+	if ok, targets, _ := client.Set("k", large, false); !ok || len(targets) != 1 || targets[0] != "valuesize-big" {
+		t.Errorf("value should be written to the host storing it: %v %v", ok, targets)
+	}
+	client = NewClient(&staticScheduler{hosts: []*Host{small}}, 1, 1, 1)
+	if ok, _, err := client.Set("k", large, false); ok || err != ErrValueTooLarge {
+		t.Errorf("value too large for every host should be rejected: %v %v", ok, err)
+	}
+	if ok, _, err := client.Set("k", &Item{Body: []byte("v")}, false); !ok || err != nil {
+		t.Errorf("small value should be written: %v %v", ok, err)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * weights of hosts to be put first in the buckets of ManualScheduler,
+ * to shift read traffic slowly, like during a node replacement
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "math/rand"
+    "strconv"
+)
+
+// address -> bucket (hex) -> weight, the first host of a bucket is picked
+// in proportion to weights, hosts not listed in a bucket weigh 1
+type HostWeights map[string]map[string]float64
+
+// weights of hosts by bucket and offset, nil for buckets without weights
+func parseWeights(config HostWeights, hosts []*Host, bs int) ([][]float64, error) {
+    offsets := make(map[string]int, len(hosts))
+    for j, h := range hosts {
+        offsets[h.Addr] = j
+    }
+    var weights [][]float64
+    for addr, buckets := range config {
+        j, ok := offsets[addr]
+        if !ok {
+            return nil, fmt.Errorf("weights of unknown host %s", addr)
+        }
+        for bucket_str, w := range buckets {
+            bucket, e := strconv.ParseInt(bucket_str, 16, 16)
+            if e != nil || int(bucket) >= bs || bucket < 0 {
+                return nil, fmt.Errorf("bad bucket %s in weights of %s", bucket_str, addr)
+            }
+            if w < 0 {
+                return nil, fmt.Errorf("negative weight of %s in bucket %s", addr, bucket_str)
+            }
+            if weights == nil {
+                weights = make([][]float64, bs)
+            }
+            if weights[bucket] == nil {
+                weights[bucket] = make([]float64, len(hosts))
+                for k := range weights[bucket] {
+                    weights[bucket][k] = 1
+                }
+            }
+            weights[bucket][j] = w
+        }
+    }
+    return weights, nil
+}
+
+// replace the weights of hosts, nil to clear them
+func (c *ManualScheduler) SetWeights(config HostWeights) error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    weights, err := parseWeights(config, c.hosts, len(c.buckets))
+    if err != nil {
+        return err
+    }
+    c.weightConfig = config
+    c.weights = weights
+    RecordEvent("weights", "", fmt.Sprintf("%v", config))
+    return nil
+}
+
+// move a host picked by weights to the front of the first n hosts,
+// the order is kept if all of them weigh 0
+func pickWeighted(hosts []*Host, weights []float64, n int) {
+    if n > len(hosts) {
+        n = len(hosts)
+    }
+    total := 0.0
+    for _, h := range hosts[:n] {
+        total += weights[h.offset]
+    }
+    if total <= 0 {
+        return
+    }
+    r := rand.Float64() * total
+    for k, h := range hosts[:n] {
+        r -= weights[h.offset]
+        if r < 0 {
+            copy(hosts[1:k+1], hosts[:k])
+            hosts[0] = h
+            return
+        }
+    }
+}
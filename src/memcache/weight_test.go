@@ -0,0 +1,42 @@
+package memcache
+
+import "testing"
+
+func TestManualSchedulerWeights(t *testing.T) {
+	schd := newTestManualScheduler(map[string][]string{
+		"old": {"0", "1"},
+		"new": {"0", "1"},
+	}, 2, 2)
+	if err := schd.SetWeights(HostWeights{"missing": {"0": 1}}); err == nil {
+		t.Errorf("weights of unknown host should fail")
+	}
+	if err := schd.SetWeights(HostWeights{"new": {"2": 1}}); err == nil {
+		t.Errorf("weights of bucket out of range should fail")
+	}
+	if err := schd.SetWeights(HostWeights{"old": {"0": 1}, "new": {"0": 3, "1": 0}}); err != nil {
+		t.Fatal(err)
+	}
+
+	firsts := map[int]map[string]int{0: {}, 1: {}}
+	for i := 0; i < 4000; i++ {
+		key := string(rune('a'+i%26)) + string(rune('a'+i/26%26))
+		b := getBucketByKey(schd.hashMethod, schd.bucketWidth, key)
+		firsts[b][schd.GetHostsByKey(key)[0].Addr]++
+	}
+	if n := firsts[0]["new"]; n < firsts[0]["old"]*2 {
+		t.Errorf("new should be first for about 3/4 keys in bucket 0: %v", firsts[0])
+	}
+	if n := firsts[1]["new"]; n != 0 {
+		t.Errorf("new weighs 0 in bucket 1: %v", firsts[1])
+	}
+
+	if err := schd.Reload(map[string][]string{
+		"old":   {"0", "1"},
+		"other": {"0", "1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := schd.weightConfig["new"]; ok || schd.weights[0] == nil {
+		t.Errorf("weights of removed hosts should be dropped: %v", schd.weightConfig)
+	}
+}
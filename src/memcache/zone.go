@@ -0,0 +1,35 @@
+/*
+ * topology of hosts, read from the same zone (or rack) first
+ */
+
+package memcache
+
+// zone of hosts by address, and the zone of this proxy
+var HostZones = map[string]string{}
+var LocalZone = ""
+
+// move hosts in LocalZone before the others in hosts[:n], the order is kept
+// otherwise, return the number of hosts in LocalZone, or n if it's not known
+func preferLocalZone(hosts []*Host, n int) int {
+    if LocalZone == "" {
+        return n
+    }
+    if n > len(hosts) {
+        n = len(hosts)
+    }
+    local := make([]*Host, 0, n)
+    var others []*Host
+    for _, h := range hosts[:n] {
+        if h != nil && h.Zone == LocalZone {
+            local = append(local, h)
+        } else {
+            others = append(others, h)
+        }
+    }
+    if len(local) == 0 {
+        return n
+    }
+    copy(hosts, local)
+    copy(hosts[len(local):], others)
+    return len(local)
+}
@@ -0,0 +1,641 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/douban/goyaml"
+	"io/ioutil"
+	"log"
+	"memcache"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// the scheduler of the servers, before pins, pools and regions, keys are
+// bucketed by it
+var bucketScheduler memcache.Scheduler
+
+// POST /api/fault?host=addr&delay=ms&error=percent, POST /api/fault?bucket=hex,
+// POST /api/fault?clear=1, refused unless faults is set in conf
+func FaultHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !eyeconfig.Faults {
+		http.Error(w, "fault injection is disabled in conf", http.StatusForbidden)
+		return
+	}
+	if req.FormValue("clear") != "" {
+		memcache.ClearFaults()
+	}
+	if host := req.FormValue("host"); host != "" {
+		if v := req.FormValue("delay"); v != "" {
+			ms, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "invalid delay: "+v, http.StatusBadRequest)
+				return
+			}
+			memcache.InjectDelay(host, time.Duration(ms)*time.Millisecond)
+		}
+		if v := req.FormValue("error"); v != "" {
+			percent, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				http.Error(w, "invalid error rate: "+v, http.StatusBadRequest)
+				return
+			}
+			memcache.InjectErrors(host, percent)
+		}
+	}
+	if v := req.FormValue("bucket"); v != "" {
+		bucket, err := strconv.ParseInt(v, 16, 32)
+		if err != nil {
+			http.Error(w, "invalid bucket: "+v, http.StatusBadRequest)
+			return
+		}
+		if err := memcache.PartitionBucket(bucketScheduler, int(bucket)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	hosts, buckets := memcache.Faults()
+	writeJSON(w, map[string]interface{}{"hosts": hosts, "buckets": buckets})
+}
+
+// /api/explain?key=xxx
+func ExplainHandler(w http.ResponseWriter, req *http.Request) {
+	key := req.FormValue("key")
+	if key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, memcache.ExplainRoute(schd, key))
+}
+
+// GET /api/state to export the learned state of scheduler, POST to import
+func StateHandler(w http.ResponseWriter, req *http.Request) {
+	sch, ok := schd.(memcache.StatefulScheduler)
+	if !ok {
+		http.Error(w, "scheduler has no state", http.StatusNotImplemented)
+		return
+	}
+	if req.Method == "POST" {
+		var st memcache.SchedulerState
+		if err := json.NewDecoder(req.Body).Decode(&st); err != nil {
+			http.Error(w, "invalid state: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := sch.ImportState(&st); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Print("scheduler state imported from ", req.RemoteAddr)
+	}
+	writeJSON(w, sch.ExportState())
+}
+
+// POST /api/hosts?add=addr or POST /api/hosts?remove=addr
+func HostsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	sch, ok := schd.(memcache.DynamicScheduler)
+	if !ok {
+		http.Error(w, "hosts of scheduler could not be changed", http.StatusNotImplemented)
+		return
+	}
+	if addr := req.FormValue("add"); addr != "" {
+		sch.AddHost(addr)
+		log.Print("host added: ", addr)
+		memcache.RecordEvent("hosts", addr, "added")
+	}
+	if addr := req.FormValue("remove"); addr != "" {
+		if err := sch.RemoveHost(addr); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Print("host removed: ", addr)
+		memcache.RecordEvent("hosts", addr, "removed")
+	}
+	writeJSON(w, "ok")
+}
+
+// /api/reload to reload the bucket table (or hosts of ring) of servers from config file
+func ReloadHandler(w http.ResponseWriter, req *http.Request) {
+	switch schd.(type) {
+	case *memcache.ManualScheduler, memcache.MembershipScheduler:
+	default:
+		http.Error(w, "scheduler could not be reloaded", http.StatusNotImplemented)
+		return
+	}
+	if eyeconfig.path == "" {
+		http.Error(w, "no config file to reload", http.StatusNotImplemented)
+		return
+	}
+	content, err := ioutil.ReadFile(eyeconfig.path)
+	if err != nil {
+		http.Error(w, "read config failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var c Eye
+	if err := goyaml.Unmarshal(content, &c); err != nil {
+		http.Error(w, "parse config failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(c.Servers) == 0 {
+		http.Error(w, "no servers in conf", http.StatusBadRequest)
+		return
+	}
+	sch, ok := schd.(*memcache.ManualScheduler)
+	if !ok {
+		// the new ring is built aside, lookups in flight keep the old one
+		schd.(memcache.MembershipScheduler).SetHosts(serverAddrs(c.Servers))
+		configLock.Lock()
+		eyeconfig.Servers = c.Servers
+		configLock.Unlock()
+		memcache.RecordEvent("reload", "", strconv.Itoa(len(c.Servers))+" hosts")
+		updateTopology()
+		log.Print("hosts reloaded from ", eyeconfig.path)
+		writeJSON(w, "ok")
+		return
+	}
+	if err := sch.Reload(serverConfigs(c.Servers)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	configLock.Lock()
+	eyeconfig.Servers = c.Servers
+	configLock.Unlock()
+	if eyeconfig.FixedOrder {
+		sch.SetFixedOrder(serverAddrs(c.Servers))
+	}
+	if err := sch.SetWeights(c.Weights); err != nil {
+		http.Error(w, "servers reloaded, but weights failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	configLock.Lock()
+	eyeconfig.Weights = c.Weights
+	configLock.Unlock()
+	updateTopology()
+	log.Print("servers reloaded from ", eyeconfig.path)
+	writeJSON(w, "ok")
+}
+
+// /api/latency, histograms of requests to backends by command
+func LatencyHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, memcache.Latencies())
+}
+
+// /api/health, requests, errors, latencies and last failure of servers
+func HealthHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, memcache.StatsV2(schd))
+}
+
+// POST /api/annotations?host=addr&note=text or POST /api/annotations?bucket=hex&note=text,
+// an empty note removes the annotation
+func AnnotationsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	note := req.FormValue("note")
+	changed := false
+	if host := req.FormValue("host"); host != "" {
+		memcache.AnnotateHost(host, note)
+		changed = true
+	}
+	if v := req.FormValue("bucket"); v != "" {
+		bucket, err := strconv.ParseInt(v, 16, 32)
+		if err != nil || int(bucket) >= eyeconfig.Buckets {
+			http.Error(w, "invalid bucket: "+v, http.StatusBadRequest)
+			return
+		}
+		memcache.AnnotateBucket(int(bucket), note)
+		changed = true
+	}
+	if changed && eyeconfig.Annotations != "" {
+		if err := memcache.SaveAnnotations(eyeconfig.Annotations); err != nil {
+			http.Error(w, "save annotations failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, memcache.GetAnnotations())
+}
+
+// /api/maintenance?host=addr&on=1 to skip the host in all the schedulers, on=0 to
+// bring it back, the buckets of it are kept
+func MaintenanceHandler(w http.ResponseWriter, req *http.Request) {
+	if host := req.FormValue("host"); host != "" {
+		on, err := strconv.ParseBool(req.FormValue("on"))
+		if err != nil {
+			http.Error(w, "invalid on: "+req.FormValue("on"), http.StatusBadRequest)
+			return
+		}
+		memcache.SetMaintenance(host, on)
+	}
+	writeJSON(w, memcache.MaintenanceHosts())
+}
+
+// /api/drain?host=addr&seconds=T to stop writes to the host, and reads after T
+// seconds, /api/drain?undrain=addr to cancel it
+func DrainHandler(w http.ResponseWriter, req *http.Request) {
+	if host := req.FormValue("host"); host != "" {
+		seconds, err := strconv.Atoi(req.FormValue("seconds"))
+		if err != nil || seconds < 0 {
+			http.Error(w, "invalid seconds: "+req.FormValue("seconds"), http.StatusBadRequest)
+			return
+		}
+		memcache.DrainHost(host, time.Duration(seconds)*time.Second)
+	}
+	if host := req.FormValue("undrain"); host != "" {
+		memcache.UndrainHost(host)
+	}
+	writeJSON(w, memcache.DrainingHosts())
+}
+
+// /api/timeline, events changing the routing, the oldest first
+func TimelineHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, memcache.Timeline())
+}
+
+// /api/clients, traffic by the fingerprints of client libraries
+func ClientsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, memcache.Fingerprints())
+}
+
+var topologyCheck *memcache.TopologyCheck
+
+var proxyClient memcache.DistributeStorage
+
+// set the topology by the config and the pins, after they changed, writes
+// routed by the old one are copied in the background
+func updateTopology() {
+	var pinned map[string][]string
+	if pins != nil {
+		pinned = pins.Pins()
+	}
+	configLock.RLock()
+	topology := eyeconfig.topology(pinned)
+	configLock.RUnlock()
+	epoch := memcache.RoutingEpoch()
+	memcache.SetTopology(topology)
+	if memcache.RoutingEpoch() != epoch && epoch != 0 && proxyClient != nil {
+		go func() {
+			if n := memcache.ReconcileWrites(proxyClient); n > 0 {
+				log.Print(n, " keys written by the old topology are copied")
+			}
+		}()
+	}
+}
+
+// /api/epoch, the epoch of the topology and writes kept with their epochs,
+// /api/epoch?reconcile=1 to copy the writes of older epochs now
+func EpochHandler(w http.ResponseWriter, req *http.Request) {
+	r := map[string]interface{}{"epoch": memcache.RoutingEpoch(), "behind": memcache.EpochBehind()}
+	if req.FormValue("reconcile") != "" && proxyClient != nil {
+		r["reconciled"] = memcache.ReconcileWrites(proxyClient)
+	}
+	r["ledger"] = memcache.EpochLedger()
+	writeJSON(w, r)
+}
+
+// /api/topology, status of the topology of peer proxies
+func TopologyHandler(w http.ResponseWriter, req *http.Request) {
+	if topologyCheck == nil {
+		http.Error(w, "topology check is disabled", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"topology": memcache.Topology(), "epoch": memcache.RoutingEpoch(), "peers": topologyCheck.Last()})
+}
+
+var routingAudit *memcache.RoutingAudit
+
+// /api/audit, the last report of routing audit
+func AuditHandler(w http.ResponseWriter, req *http.Request) {
+	if routingAudit == nil {
+		http.Error(w, "routing audit is disabled", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, routingAudit.Last())
+}
+
+var pins *memcache.PinScheduler
+
+// /api/pins?pin=key&hosts=addr,addr or /api/pins?unpin=key, a key ending
+// with * is a prefix
+func PinsHandler(w http.ResponseWriter, req *http.Request) {
+	if pins == nil {
+		http.Error(w, "pinning is disabled", http.StatusNotImplemented)
+		return
+	}
+	if pattern := req.FormValue("pin"); pattern != "" {
+		if err := pins.Pin(pattern, strings.Split(req.FormValue("hosts"), ",")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Print("pinned ", pattern, " onto ", req.FormValue("hosts"))
+	}
+	if pattern := req.FormValue("unpin"); pattern != "" {
+		if pins.Unpin(pattern) {
+			log.Print("unpinned ", pattern)
+		}
+	}
+	updateTopology()
+	writeJSON(w, pins.Pins())
+}
+
+var bucketPinner memcache.BucketPinner
+
+// /api/bucketpins?bucket=hex&hosts=addr,addr&seconds=T to put the hosts first
+// in the bucket for T seconds, /api/bucketpins?unpin=hex to remove it
+func BucketPinsHandler(w http.ResponseWriter, req *http.Request) {
+	if bucketPinner == nil {
+		http.Error(w, "buckets of scheduler could not be pinned", http.StatusNotImplemented)
+		return
+	}
+	if v := req.FormValue("bucket"); v != "" {
+		bucket, err := strconv.ParseInt(v, 16, 32)
+		if err != nil {
+			http.Error(w, "invalid bucket: "+v, http.StatusBadRequest)
+			return
+		}
+		seconds, err := strconv.Atoi(req.FormValue("seconds"))
+		if err != nil {
+			http.Error(w, "invalid seconds: "+req.FormValue("seconds"), http.StatusBadRequest)
+			return
+		}
+		hosts := strings.Split(req.FormValue("hosts"), ",")
+		if err := bucketPinner.PinBucket(int(bucket), hosts, time.Duration(seconds)*time.Second); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("bucket %x pinned onto %v for %d seconds", bucket, hosts, seconds)
+	}
+	if v := req.FormValue("unpin"); v != "" {
+		bucket, err := strconv.ParseInt(v, 16, 32)
+		if err != nil {
+			http.Error(w, "invalid bucket: "+v, http.StatusBadRequest)
+			return
+		}
+		if bucketPinner.UnpinBucket(int(bucket)) {
+			log.Printf("bucket %x unpinned", bucket)
+		}
+	}
+	writeJSON(w, bucketPinner.BucketPins())
+}
+
+// /api/buckets, the bucket table of servers, /api/buckets?assign=hex:addr,addr
+// (repeated, backups prefixed by "-") moves buckets between the servers at once,
+// or none of them if any is invalid, dry=1 to check them only
+func BucketsHandler(w http.ResponseWriter, req *http.Request) {
+	sch, ok := schd.(*memcache.ManualScheduler)
+	if !ok {
+		http.Error(w, "buckets of scheduler could not be assigned", http.StatusNotImplemented)
+		return
+	}
+	req.ParseForm()
+	if len(req.Form["assign"]) == 0 {
+		writeJSON(w, sch.BucketConfig())
+		return
+	}
+	assign := make(map[int][]string)
+	for _, v := range req.Form["assign"] {
+		i := strings.Index(v, ":")
+		if i < 0 {
+			http.Error(w, "invalid assignment: "+v, http.StatusBadRequest)
+			return
+		}
+		bucket, err := strconv.ParseInt(v[:i], 16, 32)
+		if err != nil {
+			http.Error(w, "invalid bucket: "+v[:i], http.StatusBadRequest)
+			return
+		}
+		assign[int(bucket)] = strings.Split(v[i+1:], ",")
+	}
+	if req.FormValue("dry") != "" {
+		if err := sch.CheckAssignment(assign); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, "ok")
+		return
+	}
+	if err := sch.AssignBuckets(assign); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config := sch.BucketConfig()
+	configLock.Lock()
+	servers := make([]string, 0, len(eyeconfig.Servers))
+	for _, addr := range serverAddrs(eyeconfig.Servers) {
+		servers = append(servers, strings.Join(append([]string{addr}, config[addr]...), " "))
+	}
+	eyeconfig.Servers = servers
+	configLock.Unlock()
+	updateTopology()
+	log.Printf("buckets reassigned: %v", req.Form["assign"])
+	writeJSON(w, config)
+}
+
+var regionScheduler *memcache.RegionScheduler
+
+// /api/regions, the regions by measured latency and their pinned prefixes
+func RegionsHandler(w http.ResponseWriter, req *http.Request) {
+	if regionScheduler == nil {
+		http.Error(w, "no regions", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, regionScheduler.Regions())
+}
+
+// /api/conns?top=N, the N client connections holding the most memory (10
+// by default, 0 for all), /api/conns?top=N&log=1 to dump them into the log too
+func ConnsHandler(w http.ResponseWriter, req *http.Request) {
+	top := 10
+	if v := req.FormValue("top"); v != "" {
+		var err error
+		if top, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+	}
+	conns := memcache.HeaviestConns(top)
+	if req.FormValue("log") != "" {
+		for _, c := range conns {
+			log.Printf("conn %d of %s: held %d (buffers %d, request %d, pending %d), peak %d, opened %s",
+				c.ID, c.Addr, c.Held, c.Buffers, c.Request, c.Pending, c.Peak, c.Opened.Format(time.RFC3339))
+		}
+	}
+	writeJSON(w, conns)
+}
+
+// POST /api/compact to compact the data files of the embedded store now,
+// returns their size after it
+func CompactHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if embeddedStore == nil {
+		http.Error(w, "no embedded store", http.StatusNotImplemented)
+		return
+	}
+	if err := embeddedStore.Compact(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Print("embedded store compacted by ", req.RemoteAddr)
+	writeJSON(w, map[string]int64{"size": embeddedStore.Size()})
+}
+
+var sinkClient *memcache.SinkClient
+
+// /api/sinks, writes given up by the sinks, /api/sinks?retry=1 to retry them
+func SinksHandler(w http.ResponseWriter, req *http.Request) {
+	if sinkClient == nil {
+		http.Error(w, "no sinks", http.StatusNotImplemented)
+		return
+	}
+	if req.FormValue("retry") != "" {
+		log.Print(sinkClient.RetryDeadLetters(), " dead letters of sinks retried")
+	}
+	writeJSON(w, sinkClient.DeadLetters())
+}
+
+var selfBench *memcache.SelfBench
+
+// /api/bench, results of the self benchmark
+func BenchHandler(w http.ResponseWriter, req *http.Request) {
+	if selfBench == nil {
+		http.Error(w, "self benchmark is disabled", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, selfBench.Results())
+}
+
+// /api/imbalance, keys every server would get first and requests it got,
+// max/avg and stddev/avg of them, 1 and 0 are perfectly balanced
+func ImbalanceHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, memcache.ImbalanceOf(schd, serverAddrs(currentServers())))
+}
+
+var proxyServer *memcache.Server
+
+// of the embedded store, nil if it is disabled
+var embeddedStore *memcache.BitcaskStore
+
+// /api/stats?version=1, stats of the proxy and servers in the documented
+// schema, the current version by default, /api/stats?schema=1 to describe it
+func StatsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.FormValue("schema") != "" {
+		writeJSON(w, map[string]interface{}{"version": memcache.StatsSchemaVersion,
+			"proxy": memcache.StatsSchema, "servers": memcache.HostStatsSchema})
+		return
+	}
+	version := memcache.StatsSchemaVersion
+	if v := req.FormValue("version"); v != "" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid version", http.StatusBadRequest)
+			return
+		}
+	}
+	hosts, err := memcache.VersionedHostStats(memcache.StatsV2(schd), version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	im := memcache.ImbalanceOf(schd, serverAddrs(currentServers()))
+	r := map[string]interface{}{"schema_version": version, "servers": hosts,
+		"imbalance": map[string]float64{"keys_max": im.KeysMax, "keys_stddev": im.KeysStddev,
+			"requests_max": im.RequestsMax, "requests_stddev": im.RequestsStddev}}
+	if proxyServer != nil {
+		r["proxy"], _ = memcache.VersionedStats(proxyServer.Stats(), version)
+	}
+	writeJSON(w, r)
+}
+
+// /api/metrics, the stats of /api/stats in the text format of prometheus,
+// see the dashboard command for a grafana dashboard of them
+func MetricsHandler(w http.ResponseWriter, req *http.Request) {
+	hosts, _ := memcache.VersionedHostStats(memcache.StatsV2(schd), memcache.StatsSchemaVersion)
+	var proxy map[string]int64
+	if proxyServer != nil {
+		proxy, _ = memcache.VersionedStats(proxyServer.Stats(), memcache.StatsSchemaVersion)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	memcache.WriteMetrics(w, proxy, hosts)
+}
+
+// POST /api/capture?key=k&client=ip&seconds=T&max=bytes to capture the
+// exchanges of the key or the client for T seconds, values redacted unless
+// redact=0, POST /api/capture?stop=1 to stop it, GET for the running capture
+func CaptureHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeJSON(w, memcache.CurrentCapture())
+		return
+	}
+	if req.FormValue("stop") != "" {
+		writeJSON(w, memcache.StopCapture())
+		return
+	}
+	seconds, err := strconv.Atoi(req.FormValue("seconds"))
+	if err != nil || seconds <= 0 {
+		http.Error(w, "invalid seconds: "+req.FormValue("seconds"), http.StatusBadRequest)
+		return
+	}
+	var max int64
+	if s := req.FormValue("max"); s != "" {
+		if max, err = strconv.ParseInt(s, 10, 64); err != nil || max < 0 || max > memcache.CaptureLimitBytes {
+			http.Error(w, "invalid max: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	c, err := memcache.StartCapture(req.FormValue("key"), req.FormValue("client"),
+		time.Duration(seconds)*time.Second, max, req.FormValue("redact") != "0")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, c)
+}
+
+func initAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/api/fault", FaultHandler)
+	mux.HandleFunc("/api/explain", ExplainHandler)
+	mux.HandleFunc("/api/state", StateHandler)
+	mux.HandleFunc("/api/hosts", HostsHandler)
+	mux.HandleFunc("/api/reload", ReloadHandler)
+	mux.HandleFunc("/api/latency", LatencyHandler)
+	mux.HandleFunc("/api/bench", BenchHandler)
+	mux.HandleFunc("/api/health", HealthHandler)
+	mux.HandleFunc("/api/pins", PinsHandler)
+	mux.HandleFunc("/api/audit", AuditHandler)
+	mux.HandleFunc("/api/annotations", AnnotationsHandler)
+	mux.HandleFunc("/api/topology", TopologyHandler)
+	mux.HandleFunc("/api/epoch", EpochHandler)
+	mux.HandleFunc("/api/sinks", SinksHandler)
+	mux.HandleFunc("/api/maintenance", MaintenanceHandler)
+	mux.HandleFunc("/api/clients", ClientsHandler)
+	mux.HandleFunc("/api/drain", DrainHandler)
+	mux.HandleFunc("/api/stats", StatsHandler)
+	mux.HandleFunc("/api/metrics", MetricsHandler)
+	mux.HandleFunc("/api/imbalance", ImbalanceHandler)
+	mux.HandleFunc("/api/bucketpins", BucketPinsHandler)
+	mux.HandleFunc("/api/timeline", TimelineHandler)
+	mux.HandleFunc("/api/capture", CaptureHandler)
+	mux.HandleFunc("/api/buckets", BucketsHandler)
+	mux.HandleFunc("/api/regions", RegionsHandler)
+	mux.HandleFunc("/api/conns", ConnsHandler)
+	mux.HandleFunc("/api/compact", CompactHandler)
+}
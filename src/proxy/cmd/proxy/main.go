@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"memcache"
+	"proxy"
+	"runtime"
+)
+
+var conf *string = flag.String("conf", "conf/example.yaml", "config path")
+
+// var debug *bool = flag.Bool("debug", false, "debug info")
+var allocLimit *int = flag.Int("alloc", 1024*4, "cmem alloc limit")
+var basepath = flag.String("basepath", "", "base path")
+
+func main() {
+	flag.Parse()
+	config, err := proxy.LoadConfig(*conf)
+	if err != nil {
+		log.Fatal("read config failed ", err)
+	}
+	if *basepath != "" {
+		config.Basepath = *basepath
+	}
+	memcache.AllocLimit = *allocLimit
+
+	if flag.NArg() > 0 {
+		if err := proxy.RunCommand(config, flag.Arg(0), flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if config.Threads <= 0 {
+		if n, ok := memcache.CgroupMaxProcs(); ok {
+			// the cpus of host are not all ours in a container
+			runtime.GOMAXPROCS(n)
+			log.Print("GOMAXPROCS by cpu quota of cgroup: ", n)
+		}
+	}
+	s, err := proxy.NewServer(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.HandleSignals = true
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	s.Wait()
+	log.Print("shut down gracefully.")
+}
@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/douban/goyaml"
+	"io"
+	"io/ioutil"
+	"memcache"
+	"memcache/stats"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// subcommands run instead of the proxy, like `proxy -conf x.yaml checkroute -keys keys.txt`
+var commands = map[string]func(args []string, server_configs map[string][]string, servers []string) error{
+	"checkroute":  checkRoute,
+	"conformance": conformance,
+	"timeouts":    recommendTimeouts,
+	"verify":      verifyMigration,
+	"plan":        planMigration,
+	"simulate":    simulateRouting,
+	"dashboard":   grafanaDashboard,
+}
+
+// RunCommand runs a subcommand of the proxy command for the cluster of config
+func RunCommand(config *Eye, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return errors.New("unknown command: " + name)
+	}
+	eyeconfig = *config
+	server_configs := serverConfigs(eyeconfig.Servers)
+	servers := make([]string, 0, len(server_configs))
+	for server, _ := range server_configs {
+		servers = append(servers, server)
+	}
+	return cmd(args, server_configs, servers)
+}
+
+func readKeys(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var keys []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// verify that the keys are routed to the same hosts as a client library
+func checkRoute(args []string, server_configs map[string][]string, servers []string) error {
+	fs := flag.NewFlagSet("checkroute", flag.ExitOnError)
+	client := fs.String("client", "ketama", "routing of client: ketama, mod-<hash>, consistent-<hash>")
+	keysPath := fs.String("keys", "-", "file of sample keys, one per line")
+	n := fs.Int("n", 1, "number of hosts to compare")
+	fs.Parse(args)
+
+	keys, err := readKeys(*keysPath)
+	if err != nil {
+		return err
+	}
+	expected, err := memcache.ClientScheduler(*client, servers)
+	if err != nil {
+		return err
+	}
+	N := eyeconfig.N
+	if N == 0 {
+		N = 3
+	}
+	got := memcache.NewManualScheduler(server_configs, eyeconfig.Buckets, min(N, len(servers)))
+	rs := memcache.CompareRouting(expected, got, keys, *n)
+	for _, r := range rs {
+		fmt.Printf("%s\t%s\t%s\n", r.Key, strings.Join(r.Expected, ","), strings.Join(r.Got, ","))
+	}
+	fmt.Printf("%d of %d keys mismatched\n", len(rs), len(keys))
+	return nil
+}
+
+// run protocol conformance checks against the proxy or a backend
+func conformance(args []string, server_configs map[string][]string, servers []string) error {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	addr := fs.String("addr", fmt.Sprintf("localhost:%d", eyeconfig.Port), "address of proxy or backend")
+	fs.Parse(args)
+
+	failed := 0
+	for _, r := range memcache.RunConformance(*addr) {
+		if r.Error != nil {
+			failed++
+			fmt.Printf("FAIL\t%s\t%s\n", r.Name, r.Error)
+		} else {
+			fmt.Printf("ok\t%s\n", r.Name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed against %s", failed, *addr)
+	}
+	return nil
+}
+
+// recommend timeouts from latency histograms of a running proxy, or dumped into a file
+func recommendTimeouts(args []string, server_configs map[string][]string, servers []string) error {
+	fs := flag.NewFlagSet("timeouts", flag.ExitOnError)
+	from := fs.String("from", fmt.Sprintf("http://localhost:%d/api/latency", eyeconfig.WebPort), "url or file of latency histograms")
+	fs.Parse(args)
+
+	var r io.Reader
+	if strings.HasPrefix(*from, "http://") || strings.HasPrefix(*from, "https://") {
+		resp, err := http.Get(*from)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		r = resp.Body
+	} else {
+		f, err := os.Open(*from)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var hists map[string]*stats.LatencyHistogram
+	if err := json.NewDecoder(r).Decode(&hists); err != nil {
+		return fmt.Errorf("invalid latency histograms from %s: %s", *from, err)
+	}
+
+	rs := stats.RecommendTimeouts(hists)
+	if len(rs) == 0 {
+		return errors.New("not enough requests recorded")
+	}
+	var read, write time.Duration
+	fmt.Println("# cmd\tcount\tp50\tp99\tp99.9\ttimeout\thedge")
+	for _, a := range rs {
+		fmt.Printf("# %s\t%d\t%v\t%v\t%v\t%v\t%v\n", a.Cmd, a.Count, a.P50, a.P99, a.P999, a.Timeout, a.HedgeDelay)
+		switch a.Cmd {
+		case "get", "gets":
+			if a.Timeout > read {
+				read = a.Timeout
+			}
+		case "set", "add", "replace", "append", "prepend", "delete", "incr":
+			if a.Timeout > write {
+				write = a.Timeout
+			}
+		}
+	}
+	if read > 0 {
+		fmt.Printf("readtimeout: %d\n", read/time.Millisecond)
+	}
+	if write > 0 {
+		fmt.Printf("writetimeout: %d\n", write/time.Millisecond)
+	}
+	return nil
+}
+
+// client of a cluster configured like eyeconfig
+func clusterClient(servers []string, buckets, n int) memcache.DistributeStorage {
+	if n == 0 {
+		n = 3
+	}
+	n = min(n, len(servers))
+	return memcache.NewClient(memcache.NewManualScheduler(serverConfigs(servers), buckets, n), n, 1, 1)
+}
+
+// LoadConfig reads the config in yaml of the proxy from path
+func LoadConfig(path string) (*Eye, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e := new(Eye)
+	if err := goyaml.Unmarshal(content, e); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %s", path, err)
+	}
+	if len(e.Servers) == 0 {
+		return nil, errors.New("no servers in " + path)
+	}
+	e.path = path
+	return e, nil
+}
+
+// buckets of servers, every server has all the buckets in auto scheduler
+func bucketConfigs(e *Eye) map[string][]string {
+	if e.Scheduler == "auto" {
+		return memcache.AutoConfig(serverAddrs(e.Servers), e.Buckets)
+	}
+	return serverConfigs(e.Servers)
+}
+
+// list the buckets to copy from the cluster of old config to this one
+func planMigration(args []string, server_configs map[string][]string, servers []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	from := fs.String("from", "", "old config file of the cluster")
+	execute := fs.Bool("execute", false, "copy the buckets")
+	lock := fs.String("lock", "", "memcached to lock the buckets in while copying, shared by all the jobs moving buckets, locked in this process only by default")
+	fs.Parse(args)
+
+	old, err := LoadConfig(*from)
+	if err != nil {
+		return err
+	}
+	if old.Buckets != eyeconfig.Buckets {
+		return fmt.Errorf("buckets changed from %d to %d", old.Buckets, eyeconfig.Buckets)
+	}
+	moves, err := memcache.PlanMigration(bucketConfigs(old), bucketConfigs(&eyeconfig), eyeconfig.Buckets)
+	if err != nil {
+		return err
+	}
+	memcache.EstimateMoves(moves, eyeconfig.Buckets)
+	total := 0
+	for _, m := range moves {
+		fmt.Printf("%X\t%s\t%s\t%d\n", m.Bucket, strings.Join(m.From, ","), m.To, m.Keys)
+		if m.Keys > 0 {
+			total += m.Keys
+		}
+	}
+	fmt.Printf("%d buckets to copy, about %d keys\n", len(moves), total)
+	if !*execute {
+		return nil
+	}
+	var locker memcache.BucketLocker = memcache.NewLocalBucketLocker()
+	if *lock != "" {
+		locker = memcache.NewHostBucketLocker(*lock)
+	}
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("migrate@%s:%d", hostname, os.Getpid())
+	for _, m := range moves {
+		copied, err := m.Execute(eyeconfig.Buckets, locker, owner)
+		if err != nil {
+			return fmt.Errorf("copy bucket %X to %s failed after %d keys: %s", m.Bucket, m.To, copied, err)
+		}
+		fmt.Printf("bucket %X copied to %s: %d keys\n", m.Bucket, m.To, copied)
+	}
+	return nil
+}
+
+// compare a sample of keys in the source cluster of a migration with this one
+func verifyMigration(args []string, server_configs map[string][]string, servers []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	from := fs.String("from", "", "config file of the source cluster")
+	keysPath := fs.String("keys", "-", "file of migrated keys, one per line")
+	rate := fs.Float64("rate", 0.01, "fraction of keys to verify")
+	versions := fs.Bool("versions", false, "compare versions, if the migration keeps them")
+	max := fs.Float64("max", 0, "fail if the mismatch rate is higher than this")
+	fs.Parse(args)
+
+	src, err := LoadConfig(*from)
+	if err != nil {
+		return err
+	}
+	keys, err := readKeys(*keysPath)
+	if err != nil {
+		return err
+	}
+
+	source := clusterClient(src.Servers, src.Buckets, src.N)
+	dest := clusterClient(eyeconfig.Servers, eyeconfig.Buckets, eyeconfig.N)
+	r := memcache.VerifyMigration(source, dest, keys, *rate, *versions)
+	for _, m := range r.Mismatches {
+		fmt.Printf("%s\t%s\n", m.Key, m.Reason)
+	}
+	fmt.Printf("%d keys sampled, %d mismatched (%d missing), %d errors, mismatch rate %.4f%%\n",
+		r.Sampled, r.Mismatched, r.Missing, r.Errors, r.MismatchRate()*100)
+	if r.Errors > 0 || r.MismatchRate() > *max {
+		return errors.New("source should not be retired yet")
+	}
+	return nil
+}
+
+// scheduler routing like the proxy with the config, but never checking the
+// backends, the auto scheduler is simulated by all the buckets on every server
+func offlineScheduler(e *Eye) (memcache.Scheduler, error) {
+	N := e.N
+	if N == 0 {
+		N = 3
+	}
+	N = min(N, len(e.Servers))
+	if len(e.Readers) > 0 {
+		return memcache.NewSplitScheduler(serverConfigs(e.Servers), serverConfigs(e.Readers), e.Buckets, N)
+	}
+	name := e.Scheduler
+	if name == "" || name == "auto" {
+		name = "manual"
+	}
+	sch, err := memcache.NewSchedulerByName(name, memcache.SchedulerConfig{Servers: bucketConfigs(e),
+		Hosts: serverAddrs(e.Servers), Buckets: e.Buckets, N: N, Hash: e.Hash})
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := sch.(*memcache.ManualScheduler); ok {
+		if e.FixedOrder {
+			m.SetFixedOrder(serverAddrs(e.Servers))
+		} else if err := m.SetWeights(e.Weights); err != nil {
+			return nil, err
+		}
+	}
+	if len(e.Pools) > 0 {
+		pools := make(map[string]memcache.Scheduler, len(e.Pools))
+		for prefix, servers := range e.Pools {
+			pool_configs := serverConfigs(servers)
+			pools[prefix] = memcache.NewManualScheduler(pool_configs, e.Buckets, min(N, len(pool_configs)))
+		}
+		sch = memcache.NewPrefixScheduler(pools, sch, N)
+	}
+	if len(e.Pins) > 0 {
+		pins := memcache.NewPinScheduler(sch, N)
+		for pattern, addrs := range e.Pins {
+			if err := pins.Pin(pattern, addrs); err != nil {
+				return nil, err
+			}
+		}
+		sch = pins
+	}
+	return sch, nil
+}
+
+// print the hosts the keys would be routed to by the config, and how many
+// keys every host got, to validate a config before deploying it
+func simulateRouting(args []string, server_configs map[string][]string, servers []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	keysPath := fs.String("keys", "-", "file of sample keys, one per line")
+	n := fs.Int("n", 1, "number of hosts of every key")
+	quiet := fs.Bool("quiet", false, "print the histogram only")
+	fs.Parse(args)
+
+	keys, err := readKeys(*keysPath)
+	if err != nil {
+		return err
+	}
+	sch, err := offlineScheduler(&eyeconfig)
+	if err != nil {
+		return err
+	}
+	routes, hist := memcache.SimulateRouting(sch, keys, *n)
+	if !*quiet {
+		for i, key := range keys {
+			fmt.Printf("%s\t%s\n", key, strings.Join(routes[i], ","))
+		}
+	}
+	addrs := make([]string, 0, len(hist))
+	for addr := range hist {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	fmt.Println("# host\tkeys\tpercent")
+	for _, addr := range addrs {
+		fmt.Printf("# %s\t%d\t%.2f%%\n", addr, hist[addr], float64(hist[addr])*100/float64(len(keys)))
+	}
+	return nil
+}
+
+// print a grafana dashboard of the metrics of /api/metrics for a cluster
+func grafanaDashboard(args []string, server_configs map[string][]string, servers []string) error {
+	fs := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	cluster := fs.String("cluster", "", "value of the cluster label added to the proxies by prometheus")
+	fs.Parse(args)
+
+	if *cluster == "" {
+		return errors.New("-cluster is required")
+	}
+	b, err := json.MarshalIndent(memcache.GrafanaDashboard(*cluster), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -1,19 +1,260 @@
-package main
+package proxy
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"memcache"
+)
 
 type Eye struct {
-	Servers   []string
+	Servers       []string
+	Scheduler     string               // name of a registered scheduler, manual by default
+	Hash          string               // hash method of the scheduler, fnv1a1 by default
+	BoundedLoad   float64              // epsilon of the bounded scheduler, a host gets up to (1+epsilon) of average load
+	StateFile     string               // learned state of scheduler is saved into, and loaded on start
+	StateInterval int                  // seconds between saves of the state
+	Annotations   string               // file the notes of operators on servers and buckets are saved into
+	ScoreHalfLife int                  // seconds to halve penalties of hosts in auto scheduler, -1 to disable
+	FeedbackQueue int                  // feedback queued for the scheduler, more are dropped, 1024 by default
+	Readers       []string             // read only replicas in the format of Servers, writes go to Servers only
+	Fallback      []string             // used when all the servers of a key are down, like a DR cluster
+	Bulk          []string             // replicas (or links) in the format of Servers, for prefixes with large values
+	BulkSize      int                  // prefixes with average value size above this go to Bulk, in bytes
+	Pools         map[string][]string  // keys with the prefix go to the servers, others go to Servers
+	Weights       memcache.HostWeights // address -> bucket -> weight of being read first, for the manual scheduler
+	FixedOrder    bool                 // keep servers of buckets in the order of config, for the manual scheduler
+	Pinning       bool                 // enable /api/pins to pin keys onto hosts at runtime
+	Pins          map[string][]string  // key (or prefix*) -> servers, route before the scheduler
+	Port          int
+	WebPort       int
+	Threads       int // GOMAXPROCS, 0 to follow the cpu quota of cgroup (or leave it to the process embedding the proxy)
+	AcceptLoops   int // goroutines accepting connections of proxy
+	ReusePort     int // listeners of proxy sharing the port by SO_REUSEPORT, linux only
+	N             int
+	W             int
+	R             int
+	Buckets       int
+	Slow          int
+	Listen        string
+	Proxies       []string
+	AccessLog     string
+	ErrorLog      string
+	Basepath      string
+	Readonly      bool
+
+	Transform       []string // prefixes of keys derived by suffix, like photo: for photo:1#thumb, other keys with # are plain
+	TransformCache  int      // seconds to cache transformed values
+	HotKeyQPS       int      // spread keys with more qps than this to shards
+	HotKeyShards    int
+	GraySample      float64 // fraction of reads compared with another replica
+	HostQPS         int     // qps ceiling of every backend
+	HostQPSMap      map[string]int
+	MaxValue        int               // bytes of the largest value stored by every backend, 0 if no limit
+	MaxValueMap     map[string]int    // server -> bytes of the largest value it stores
+	ProbeMaxValue   bool              // ask servers not in MaxValueMap their item_size_max at start
+	ReadTimeout     int               // ms, timeout of reading from backends
+	WriteTimeout    int               // ms
+	KeepAlive       int               // seconds between TCP keepalive probes on client connections
+	IdleTimeout     int               // seconds, close client connections idle for longer, 0 to disable
+	OneShot         int               // single-command connections in a row to serve a client with small buffers, 0 to disable
+	MaxClockSkew    int               // seconds, absolute expiries behind by no more than this are skewed
+	FixClockSkew    bool              // move skewed expiries later, otherwise only log them
+	ExpiryModes     map[string]string // memcached, relative or absolute expiries of servers
+	Embedded        string            // data dir of embedded store, served on EmbeddedPort
+	EmbeddedPort    int
+	EmbeddedCompact int // minutes between compactions of the embedded store, 0 to disable
+	Cold            ColdTier
+	L2Cache         string            // dir of persistent cache of values in proxy, empty to disable
+	L2CacheSize     int               // MB
+	L2CacheTTL      int               // seconds
+	L2CachePrefix   []string          // keys to cache, empty means all
+	BatchWindow     int               // microseconds to hold small writes to send together, 0 to disable
+	BatchBytes      int               // send a batch at once if it's larger than this
+	Shadow          []string          // shadow cluster in the format of Servers
+	ShadowReads     float64           // fraction of reads mirrored to shadow
+	ShadowWrites    float64           // fraction of writes mirrored to shadow
+	Zone            string            // zone (or rack) of this proxy
+	Zones           map[string]string // zone of servers, read from the same zone first
+	Experiments     []ExperimentConfig
+	Bench           int   // minutes between self benchmarks, 0 to disable
+	BenchHours      []int // hours of day to run the self benchmark in, off peak
+	Audit           int   // minutes between audits of keys misplaced on servers, 0 to disable
+	AuditSample     int   // keys sampled in every bucket of every server
+
+	MultiGetCache     int // ms to cache results of multigets, 0 to disable
+	MultiGetCacheKeys int // cache multigets with at least these keys
+	MultiGetCacheSize int // results of multigets cached
+
+	Datacenter    string             // name of the datacenter of Servers
+	Datacenters   []DatacenterConfig // remote datacenters, read from in order if Servers failed
+	DCConsistency string             // one, local or all of datacenters to succeed in a write
+
+	Region  string            // name of the region of Servers
+	Regions []RegionConfig    // remote regions, keys are served by the nearest region
+	GeoPins map[string]string // keys with the prefix live in the region only
+
+	TopologyCheck int // seconds between comparing the topology with Proxies, 0 to disable
+	EpochLedger   int // recent writes kept to copy them after the topology changed, 0 to disable
+
+	Sinks []SinkConfig // write through to sinks, like a database or a search index
+
+	Fingerprint int // commands of a connection to guess the client library by, 16 by default, -1 to disable
+
+	Eject       int // errors in a row to skip a server until it answers probes, 0 to disable
+	EjectProbes int // successful probes in a row to bring an ejected server back, 3 by default
+
+	CompressFlag int // bit in flags of zlib compressed values, decompressed for clients not sending "compression zlib", 0 to disable
+
+	AutoListings int     // directories listed by a check of the auto scheduler at most, the rest in the next checks, -1 for no limit
+	AutoInterval int     // seconds between checks of the auto scheduler at most, backed off from 10 while buckets are stable
+	AutoBuckets  bool    // the auto scheduler picks buckets by the bucket count like beansdb, not by the number of servers, keys move on switching
+	AutoQuorum   float64 // counts of a bucket listed differing by less than this ratio agree, a count is taken if the majority of servers agree, or listed twice, 0 to disable
+
+	DryRun bool // writes are routed, logged and acknowledged, but not sent, for staging proxies
+	Faults bool // faults could be injected on /api/fault for game-day drills, refused if false
+
+	Aliases     map[string]string // server -> name shown in stats and the monitor
+	HostDisplay string            // how servers without aliases are shown: addr (default), ip to resolve names, or name to resolve IPs
+
+	CaptureDir string // directory of captures started on /api/capture, the temp dir by default
+
+	BucketLoad float64 // buckets assigned on /api/buckets to a server up to this many times the average, 1.5 by default, -1 for no limit
+
+	Listeners []ListenerConfig // more ports serving the same servers, with their own policies
+
+	FlushAll    bool     // fan flush_all out to all the servers, refused if false
+	FlushAdmins []string // IPs or networks of the clients allowed to flush_all
+
+	path string // read from by LoadConfig, reloaded by /api/reload
+}
+
+// S3 compatible object storage for huge or rarely accessed values
+type ColdTier struct {
+	Endpoint  string // like http://s3.example.com, empty to disable
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Prefixes  []string // keys with these prefixes live in cold tier
+	MinSize   int      // values larger than this live in cold tier, 0 to disable
+	CacheSize int      // MB of values cached in memory
+}
+
+// a port for legacy applications, their keys are prefixed by the namespace,
+// and their writes never expiring expire after ttl
+type ListenerConfig struct {
 	Port      int
-	WebPort   int
-	Threads   int
-	N         int
-	W         int
-	R         int
-	Buckets   int
-	Slow      int
-	Listen    string
-	Proxies   []string
-	AccessLog string
-	ErrorLog  string
-	Basepath  string
-	Readonly  bool
+	Namespace string
+	TTL       int // seconds, 0 to keep them never expire
+}
+
+// remote datacenter with its own servers, writes go to all the datacenters
+type DatacenterConfig struct {
+	Name    string
+	Servers []string // in the format of Servers
+}
+
+// remote region with its own servers, routed to by latency
+type RegionConfig struct {
+	Name     string
+	Servers  []string // in the format of Servers
+	Estimate int      // ms, latency of the region until it's measured
+}
+
+// writes of keys with the prefix are sent to the sink after they were stored
+type SinkConfig struct {
+	Prefix string // empty for all the keys
+	Type   string // name of a registered sink, like http
+	Arg    string // like the url of http sink
+}
+
+// A/B experiment on a fraction of keys with the prefix
+type ExperimentConfig struct {
+	ID     string
+	Prefix string
+	Rate   float64  // fraction of keys in the experiment
+	TTL    int      // exptime of writes, 0 to keep it
+	Pool   []string // experimental pool in the format of Servers, empty to keep the routing
+}
+
+// canonical description of the routing, proxies with the same description
+// route keys to the same servers
+func (e *Eye) topology(pins map[string][]string) []byte {
+	sorted := func(ss []string) []string {
+		r := append([]string(nil), ss...)
+		sort.Strings(r)
+		return r
+	}
+	pools := make(map[string][]string, len(e.Pools))
+	for prefix, servers := range e.Pools {
+		pools[prefix] = sorted(servers)
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"servers":     sorted(e.Servers),
+		"scheduler":   e.Scheduler,
+		"hash":        e.Hash,
+		"buckets":     e.Buckets,
+		"n":           e.N,
+		"readers":     sorted(e.Readers),
+		"fallback":    sorted(e.Fallback),
+		"bulk":        sorted(e.Bulk),
+		"pools":       pools,
+		"fixedorder":  e.FixedOrder,
+		"pins":        pins,
+		"datacenters": e.Datacenters,
+		"regions":     e.Regions,
+		"geopins":     e.GeoPins,
+	})
+	return data
+}
+
+// "host:port bucket bucket ..." -> host:port: [bucket bucket ...]
+func serverConfigs(servers []string) map[string][]string {
+	configs := make(map[string][]string, len(servers))
+	for _, server := range servers {
+		fields := strings.Split(server, " ")
+		configs[fields[0]] = fields[1:]
+	}
+	return configs
+}
+
+// addresses of all the servers behind the proxy but the embedded store,
+// sorted
+func (e *Eye) backendAddrs(embedded string) []string {
+	groups := [][]string{e.Servers, e.Readers, e.Fallback, e.Bulk, e.Shadow}
+	for _, servers := range e.Pools {
+		groups = append(groups, servers)
+	}
+	for _, dc := range e.Datacenters {
+		groups = append(groups, dc.Servers)
+	}
+	for _, r := range e.Regions {
+		groups = append(groups, r.Servers)
+	}
+	for _, ex := range e.Experiments {
+		groups = append(groups, ex.Pool)
+	}
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, servers := range groups {
+		for _, addr := range serverAddrs(servers) {
+			if addr != embedded && !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// addresses of servers in the order of config
+func serverAddrs(servers []string) []string {
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		addrs[i] = strings.Split(server, " ")[0]
+	}
+	return addrs
 }
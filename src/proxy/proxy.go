@@ -1,34 +1,33 @@
-package main
+package proxy
 
 import (
 	"bytes"
 	"compress/gzip"
-	"flag"
 	"fmt"
-	"github.com/douban/goyaml"
+	"html/template"
 	"io"
-	"io/ioutil"
 	"log"
 	"math"
-	. "memcache"
-	"net"
+	"memcache"
 	"net/http"
 	_ "net/http/pprof"
-	"os"
-	"runtime"
 	"strconv"
 	"strings"
-	"text/template"
+	"sync"
 	"time"
 )
 
-var conf *string = flag.String("conf", "conf/example.yaml", "config path")
+var eyeconfig Eye
 
-//var debug *bool = flag.Bool("debug", false, "debug info")
-var allocLimit *int = flag.Int("alloc", 1024*4, "cmem alloc limit")
-var basepath = flag.String("basepath", "", "base path")
+// guards eyeconfig.Servers and eyeconfig.Weights, changed by the admin api
+// while the monitor and the api read them
+var configLock sync.RWMutex
 
-var eyeconfig Eye
+func currentServers() []string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return eyeconfig.Servers
+}
 
 type gzipResponseWriter struct {
 	io.Writer
@@ -154,25 +153,30 @@ func number(v interface{}) string {
 }
 
 var tmpls *template.Template
-var SECTIONS = [][]string{{"IN", "Info"}, {"SS", "Server"}, {"ST", "Status"}}
+var SECTIONS = [][]string{{"IN", "Info"}, {"SS", "Server"}, {"ST", "Status"}, {"TL", "Timeline"}}
 
 var server_stats []map[string]interface{}
 var proxy_stats []map[string]interface{}
 var total_records, uniq_records uint64
 var bucket_stats []string
-var schd Scheduler
+var schd memcache.Scheduler
 
-func update_stats(servers []string, hosts []*Host, server_stats []map[string]interface{}, isNode bool) {
+func update_stats(servers []string, hosts []*memcache.Host, server_stats []map[string]interface{}, isNode bool, done <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	default:
+	}
 	if hosts == nil {
-		hosts = make([]*Host, len(servers))
+		hosts = make([]*memcache.Host, len(servers))
 		for i, s := range servers {
-			hosts[i] = NewHost(s)
+			hosts[i] = memcache.NewHost(s)
 		}
 	}
 
 	// call self after 10 seconds
 	time.AfterFunc(time.Second*10, func() {
-		update_stats(servers, hosts, server_stats, isNode)
+		update_stats(servers, hosts, server_stats, isNode, done)
 	})
 
 	defer func() {
@@ -333,7 +337,7 @@ func update_stats(servers []string, hosts []*Host, server_stats []map[string]int
 	}
 }
 
-func Init(basepath string) {
+func Init(basepath string) error {
 	funcs := make(template.FuncMap)
 	funcs["in"] = in
 	funcs["sum"] = sum
@@ -345,12 +349,15 @@ func Init(basepath string) {
 		basepath = basepath + "/"
 	}
 
-	tmpls = new(template.Template)
-	tmpls = tmpls.Funcs(funcs)
-	tmpls = template.Must(tmpls.ParseFiles(basepath+"static/index.html",
+	t, err := template.New("").Funcs(funcs).ParseFiles(basepath+"static/index.html",
 		basepath+"static/header.html", basepath+"static/info.html",
 		basepath+"static/matrix.html", basepath+"static/server.html",
-		basepath+"static/stats.html"))
+		basepath+"static/stats.html", basepath+"static/timeline.html")
+	if err != nil {
+		return err
+	}
+	tmpls = t
+	return nil
 }
 
 func Status(w http.ResponseWriter, req *http.Request) {
@@ -380,16 +387,32 @@ func Status(w http.ResponseWriter, req *http.Request) {
 	data["total_records"] = total_records
 	data["uniq_records"] = uniq_records
 
-	st := schd.Stats()
+	st := memcache.StatsV2(schd)
 	stats := make([]map[string]interface{}, len(server_stats))
 	for i, _ := range stats {
 		d := make(map[string]interface{})
 		name := server_stats[i]["name"].(string)
-		d["name"] = name
-		d["stat"] = st[name]
+		d["name"] = memcache.DisplayHost(name)
+		if h, ok := st[name]; ok {
+			d["stat"] = h.Buckets
+			d["requests"] = h.Requests
+			d["errors"] = h.Errors
+			d["p99"] = h.P99
+			d["note"] = h.Annotation
+			if !h.LastFailure.IsZero() {
+				d["last_failure"] = h.LastFailure.Format("01-02 15:04:05")
+			}
+		}
 		stats[i] = d
 	}
 	data["stats"] = stats
+	data["bucket_notes"] = memcache.GetAnnotations().Buckets
+
+	events := memcache.Timeline()
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	data["timeline"] = events
 
 	err := tmpls.ExecuteTemplate(w, "index.html", data)
 	if err != nil {
@@ -403,144 +426,3 @@ func min(a, b int) int {
 	}
 	return b
 }
-
-func main() {
-	flag.Parse()
-	//c, err := config.ReadDefault(*conf)
-	content, err := ioutil.ReadFile(*conf)
-	if err != nil {
-		log.Fatal("read config failed", *conf, err.Error())
-	}
-
-	if err := goyaml.Unmarshal(content, &eyeconfig); err != nil {
-		log.Fatal("unmarshal yaml format config failed")
-	}
-	if *basepath == "" {
-		if eyeconfig.Basepath == "" {
-			curr_path, err1 := os.Getwd()
-			if err1 != nil {
-				log.Fatal("Cannot get pwd")
-				return
-			}
-			*basepath = curr_path
-		} else {
-			*basepath = eyeconfig.Basepath
-		}
-	}
-	Init(*basepath)
-
-	if eyeconfig.Threads > 0 {
-		runtime.GOMAXPROCS(eyeconfig.Threads)
-	}
-
-	if len(eyeconfig.Servers) == 0 {
-		log.Fatal("no servers in conf")
-	}
-	server_configs := make(map[string][]string, len(eyeconfig.Servers))
-	for _, server := range eyeconfig.Servers {
-		fields := strings.Split(server, " ")
-		server_configs[fields[0]] = fields[1:]
-	}
-	servers := make([]string, 0, len(server_configs))
-	for server, _ := range server_configs {
-		servers = append(servers, server)
-	}
-
-	if eyeconfig.WebPort <= 0 {
-		log.Print("error webport in conf: ", eyeconfig.WebPort)
-	} else if eyeconfig.Buckets <= 0 {
-		log.Print("error buckets in conf: ", eyeconfig.Buckets)
-	} else {
-		server_stats = make([]map[string]interface{}, len(servers))
-		bucket_stats = make([]string, eyeconfig.Buckets)
-		go update_stats(servers, nil, server_stats, true)
-
-		if len(eyeconfig.Proxies) > 0 {
-			proxy_stats = make([]map[string]interface{}, len(eyeconfig.Proxies))
-			go update_stats(eyeconfig.Proxies, nil, proxy_stats, false)
-		}
-
-		http.Handle("/", http.HandlerFunc(makeGzipHandler(Status)))
-		http.Handle("/static/", http.FileServer(http.Dir(*basepath)))
-		go func() {
-			if len(eyeconfig.Listen) == 0 {
-				eyeconfig.Listen = "0.0.0.0"
-			}
-			addr := fmt.Sprintf("%s:%d", eyeconfig.Listen, eyeconfig.WebPort)
-			lt, e := net.Listen("tcp", addr)
-			if e != nil {
-				log.Println("monitor listen failed on ", addr, e)
-			}
-			log.Println("monitor listen on ", addr)
-			http.Serve(lt, nil)
-		}()
-	}
-
-	AllocLimit = *allocLimit
-
-    var success bool
-
-	if len(eyeconfig.AccessLog) > 0 {
-        AccessLogPath = eyeconfig.AccessLog
-        if success, err = OpenAccessLog(eyeconfig.AccessLog); !success {
-            log.Fatalf("open AccessLog file in path: %s with error : %s", eyeconfig.AccessLog, err.Error())
-        }
-	}
-
-	if len(eyeconfig.ErrorLog) > 0 {
-        ErrorLogPath = eyeconfig.ErrorLog
-        if success, err = OpenErrorLog(eyeconfig.ErrorLog); !success {
-            log.Fatalf("open ErrorLog file in path: %s with error : %s", eyeconfig.ErrorLog, err.Error())
-        }
-	}
-
-	slow := eyeconfig.Slow
-	if slow == 0 {
-		slow = 100
-	}
-	SlowCmdTime = time.Duration(int64(slow) * 1e6)
-
-	readonly := eyeconfig.Readonly
-
-	n := len(servers)
-	if eyeconfig.N == 0 {
-		eyeconfig.N = 3
-	}
-	N := min(eyeconfig.N, n)
-
-	if eyeconfig.W == 0 {
-		eyeconfig.W = 2
-	}
-	W := min(eyeconfig.W, n-1)
-
-	if eyeconfig.R == 0 {
-		eyeconfig.R = 1
-	}
-	R := eyeconfig.R
-
-	//schd = NewAutoScheduler(servers, 16)
-	schd = NewManualScheduler(server_configs, eyeconfig.Buckets, N)
-
-	var client DistributeStorage
-	if readonly {
-		client = NewRClient(schd, N, W, R)
-	} else {
-		client = NewClient(schd, N, W, R)
-	}
-
-	http.HandleFunc("/data", func(w http.ResponseWriter, req *http.Request) {
-	})
-
-	proxy := NewServer(client)
-	if eyeconfig.Port <= 0 {
-		log.Fatal("error proxy port in config it is ", eyeconfig.Port)
-	}
-	addr := fmt.Sprintf("%s:%d", eyeconfig.Listen, eyeconfig.Port)
-	if e := proxy.Listen(addr); e != nil {
-		log.Fatal("proxy listen failed", e.Error())
-	}
-
-	log.Println("proxy listen on ", addr)
-	proxy.Serve()
-	log.Print("shut down gracefully.")
-}
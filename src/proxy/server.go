@@ -0,0 +1,766 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"memcache"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Server is the proxy of a config with its monitor and admin api, to be
+// embedded in a go process instead of running the proxy command. The routing
+// and the stats are globals of the process, so there is one Server at a
+// time, another could be created after it is stopped.
+type Server struct {
+	Listener      net.Listener // of the proxy, instead of listen:port of the config
+	WebListener   net.Listener // of the monitor and the admin api, instead of listen:webport
+	HandleSignals bool         // shut down on SIGTERM and reopen the logs on SIGINT, like the proxy command
+
+	proxy    *memcache.Server
+	servers  []*memcache.Server // of the namespaces
+	store    *memcache.BitcaskStore
+	embedded *memcache.Server
+	web      *http.Server
+	served   chan error    // by the proxy
+	done     chan struct{} // closed by Stop to stop the background checks
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+var (
+	currentLock sync.Mutex
+	current     *Server
+)
+
+// defaults of the memcache globals that are only set by some configs, so
+// the config of another Server starts from them again
+var defaults = struct {
+	batchBytes          int
+	readTimeout         time.Duration
+	writeTimeout        time.Duration
+	feedbackQueueSize   int
+	fingerprintCommands int
+	captureDir          string
+	maxBucketLoad       float64
+	autoCheckListings   int
+	autoCheckInterval   time.Duration
+	hostDisplay         string
+	autoQuorumThreshold float64
+	recoverProbes       int
+	boundedLoadEpsilon  float64
+	scoreHalfLife       time.Duration
+}{
+	memcache.BatchBytes, memcache.ReadTimeout, memcache.WriteTimeout,
+	memcache.FeedbackQueueSize, memcache.FingerprintCommands, memcache.CaptureDir,
+	memcache.MaxBucketLoad, memcache.AutoCheckListings, memcache.AutoCheckMaxInterval,
+	memcache.HostDisplay, memcache.AutoQuorumThreshold, memcache.RecoverProbes,
+	memcache.BoundedLoadEpsilon, memcache.ScoreHalfLife,
+}
+
+// resetGlobals puts the memcache globals set by configure back to their
+// defaults, nothing of the last config is kept.
+func resetGlobals() {
+	memcache.HostMaxQPS = map[string]int{}
+	memcache.HostMaxValueSize = map[string]int{}
+	memcache.HostZones, memcache.LocalZone = map[string]string{}, ""
+	memcache.BatchBytes = defaults.batchBytes
+	memcache.ReadTimeout = defaults.readTimeout
+	memcache.WriteTimeout = defaults.writeTimeout
+	memcache.FeedbackQueueSize = defaults.feedbackQueueSize
+	memcache.FingerprintCommands = defaults.fingerprintCommands
+	memcache.CaptureDir = defaults.captureDir
+	memcache.MaxBucketLoad = defaults.maxBucketLoad
+	memcache.AutoCheckListings = defaults.autoCheckListings
+	memcache.AutoCheckMaxInterval = defaults.autoCheckInterval
+	memcache.HostAliases = map[string]string{}
+	memcache.HostDisplay = defaults.hostDisplay
+	memcache.AutoCheckQuorum = false
+	memcache.AutoQuorumThreshold = defaults.autoQuorumThreshold
+	memcache.RecoverProbes = defaults.recoverProbes
+	memcache.BoundedLoadEpsilon = defaults.boundedLoadEpsilon
+	memcache.ScoreHalfLife = defaults.scoreHalfLife
+	memcache.Experiments = nil
+	memcache.FlushEnabled, memcache.FlushAdmins = false, nil
+}
+
+// NewServer sets the routing up by config, and opens the logs and stores
+// in it, nothing is listened on until Start.
+func NewServer(config *Eye) (*Server, error) {
+	currentLock.Lock()
+	defer currentLock.Unlock()
+	if current != nil {
+		return nil, errors.New("a proxy is already created in the process")
+	}
+	if len(config.Servers) == 0 {
+		return nil, errors.New("no servers in conf")
+	}
+	eyeconfig = *config
+	if len(eyeconfig.Listen) == 0 {
+		eyeconfig.Listen = "0.0.0.0"
+	}
+	if eyeconfig.Threads > 0 {
+		runtime.GOMAXPROCS(eyeconfig.Threads)
+	}
+	s := &Server{done: make(chan struct{})}
+	if err := s.configure(); err != nil {
+		close(s.done)
+		s.release()
+		return nil, err
+	}
+	current = s
+	return s, nil
+}
+
+func (s *Server) configure() error {
+	var err error
+	// left by the last Server
+	schd, proxyClient = nil, nil
+	pins, regionScheduler, sinkClient = nil, nil, nil
+	selfBench, topologyCheck, routingAudit = nil, nil, nil
+	resetGlobals()
+	server_configs := serverConfigs(eyeconfig.Servers)
+	servers := make([]string, 0, len(server_configs))
+	for server, _ := range server_configs {
+		servers = append(servers, server)
+	}
+
+	if len(eyeconfig.AccessLog) > 0 {
+		memcache.AccessLogPath = eyeconfig.AccessLog
+		if success, err := memcache.OpenAccessLog(eyeconfig.AccessLog); !success {
+			return fmt.Errorf("open AccessLog file in path: %s with error : %s", eyeconfig.AccessLog, err)
+		}
+	}
+
+	if len(eyeconfig.ErrorLog) > 0 {
+		memcache.ErrorLogPath = eyeconfig.ErrorLog
+		if success, err := memcache.OpenErrorLog(eyeconfig.ErrorLog); !success {
+			return fmt.Errorf("open ErrorLog file in path: %s with error : %s", eyeconfig.ErrorLog, err)
+		}
+	} else if memcache.ErrorLog == nil {
+		memcache.ErrorLog = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	slow := eyeconfig.Slow
+	if slow == 0 {
+		slow = 100
+	}
+	memcache.SlowCmdTime = time.Duration(int64(slow) * 1e6)
+
+	readonly := eyeconfig.Readonly
+
+	n := len(servers)
+	if eyeconfig.N == 0 {
+		eyeconfig.N = 3
+	}
+	N := min(eyeconfig.N, n)
+
+	if eyeconfig.W == 0 {
+		eyeconfig.W = 2
+	}
+	W := min(eyeconfig.W, n-1)
+
+	if eyeconfig.R == 0 {
+		eyeconfig.R = 1
+	}
+	R := eyeconfig.R
+
+	memcache.DefaultMaxQPS = eyeconfig.HostQPS
+	if eyeconfig.HostQPSMap != nil {
+		memcache.HostMaxQPS = eyeconfig.HostQPSMap
+	}
+	memcache.DefaultMaxValueSize = eyeconfig.MaxValue
+	if eyeconfig.MaxValueMap != nil {
+		memcache.HostMaxValueSize = eyeconfig.MaxValueMap
+	}
+	if eyeconfig.ProbeMaxValue {
+		for _, addr := range serverAddrs(eyeconfig.Servers) {
+			if _, ok := memcache.HostMaxValueSize[addr]; ok {
+				continue
+			}
+			host := memcache.NewHost(addr)
+			if n, err := host.ProbeMaxValueSize(); err != nil {
+				log.Printf("probe the max value size of %s failed: %s", addr, err)
+			} else {
+				log.Printf("values larger than %d bytes are not written to %s", n, addr)
+			}
+			host.Close()
+		}
+	}
+	if eyeconfig.Zones != nil {
+		memcache.HostZones = eyeconfig.Zones
+		memcache.LocalZone = eyeconfig.Zone
+	}
+	memcache.BatchWindow = time.Duration(eyeconfig.BatchWindow) * time.Microsecond
+	if eyeconfig.BatchBytes > 0 {
+		memcache.BatchBytes = eyeconfig.BatchBytes
+	}
+	if eyeconfig.ReadTimeout > 0 {
+		memcache.ReadTimeout = time.Duration(eyeconfig.ReadTimeout) * time.Millisecond
+	}
+	if eyeconfig.WriteTimeout > 0 {
+		memcache.WriteTimeout = time.Duration(eyeconfig.WriteTimeout) * time.Millisecond
+	}
+	memcache.KeepAlivePeriod = time.Duration(eyeconfig.KeepAlive) * time.Second
+	memcache.IdleTimeout = time.Duration(eyeconfig.IdleTimeout) * time.Second
+	if eyeconfig.Annotations != "" {
+		if err := memcache.LoadAnnotations(eyeconfig.Annotations); err != nil && !os.IsNotExist(err) {
+			log.Print("load annotations failed: ", err)
+		}
+	}
+	if eyeconfig.FeedbackQueue > 0 {
+		memcache.FeedbackQueueSize = eyeconfig.FeedbackQueue
+	}
+	memcache.OneShotThreshold = eyeconfig.OneShot
+	if eyeconfig.Fingerprint != 0 {
+		memcache.FingerprintCommands = eyeconfig.Fingerprint
+	}
+	memcache.EjectErrors = eyeconfig.Eject
+	memcache.EpochLedgerSize = eyeconfig.EpochLedger
+	memcache.CompressFlag = eyeconfig.CompressFlag
+	if eyeconfig.CaptureDir != "" {
+		memcache.CaptureDir = eyeconfig.CaptureDir
+	}
+	if eyeconfig.BucketLoad != 0 {
+		memcache.MaxBucketLoad = eyeconfig.BucketLoad
+	}
+	if eyeconfig.AutoListings != 0 {
+		memcache.AutoCheckListings = eyeconfig.AutoListings
+	}
+	if eyeconfig.AutoInterval > 0 {
+		memcache.AutoCheckMaxInterval = time.Duration(eyeconfig.AutoInterval) * time.Second
+	}
+	for addr, alias := range eyeconfig.Aliases {
+		memcache.HostAliases[memcache.NormalizeAddr(addr)] = alias
+	}
+	switch eyeconfig.HostDisplay {
+	case "":
+	case memcache.DisplayAddr, memcache.DisplayIP, memcache.DisplayName:
+		memcache.HostDisplay = eyeconfig.HostDisplay
+	default:
+		return fmt.Errorf("invalid hostdisplay in conf: %s", eyeconfig.HostDisplay)
+	}
+	memcache.AutoBucketsByCount = eyeconfig.AutoBuckets
+	if eyeconfig.AutoQuorum > 0 {
+		memcache.AutoCheckQuorum = true
+		memcache.AutoQuorumThreshold = eyeconfig.AutoQuorum
+	}
+	if eyeconfig.EjectProbes > 0 {
+		memcache.RecoverProbes = eyeconfig.EjectProbes
+	}
+	memcache.MaxClockSkew = time.Duration(eyeconfig.MaxClockSkew) * time.Second
+	memcache.FixClockSkew = eyeconfig.FixClockSkew
+	if eyeconfig.BoundedLoad > 0 {
+		memcache.BoundedLoadEpsilon = eyeconfig.BoundedLoad
+	}
+	if eyeconfig.ScoreHalfLife != 0 {
+		memcache.ScoreHalfLife = time.Duration(eyeconfig.ScoreHalfLife) * time.Second
+	}
+	for addr, mode := range eyeconfig.ExpiryModes {
+		if mode != memcache.ExpiryMemcached && mode != memcache.ExpiryRelative && mode != memcache.ExpiryAbsolute {
+			return fmt.Errorf("invalid expiry mode of %s in conf: %s", addr, mode)
+		}
+	}
+	memcache.HostExpiry = eyeconfig.ExpiryModes
+
+	//schd = NewAutoScheduler(servers, 16)
+	if len(eyeconfig.Readers) > 0 {
+		schd, err = memcache.NewSplitScheduler(server_configs, serverConfigs(eyeconfig.Readers), eyeconfig.Buckets, N)
+		if err != nil {
+			return fmt.Errorf("invalid readers in conf: %s", err)
+		}
+		memcache.SchedulerName = "split"
+	} else {
+		name := eyeconfig.Scheduler
+		if name == "" {
+			name = "manual"
+		}
+		memcache.SchedulerName = name
+		schd, err = memcache.NewSchedulerByName(name, memcache.SchedulerConfig{Servers: server_configs,
+			Hosts: serverAddrs(eyeconfig.Servers), Buckets: eyeconfig.Buckets, N: N, Hash: eyeconfig.Hash})
+		if err != nil {
+			return fmt.Errorf("invalid scheduler in conf: %s", err)
+		}
+	}
+
+	bucketPinner, _ = schd.(memcache.BucketPinner)
+	bucketScheduler = schd
+
+	if len(eyeconfig.Weights) > 0 {
+		sch, ok := schd.(*memcache.ManualScheduler)
+		if !ok {
+			return errors.New("weights need the manual scheduler")
+		}
+		if err := sch.SetWeights(eyeconfig.Weights); err != nil {
+			return fmt.Errorf("invalid weights in conf: %s", err)
+		}
+	}
+	if eyeconfig.FixedOrder {
+		sch, ok := schd.(*memcache.ManualScheduler)
+		if !ok {
+			return errors.New("fixed order needs the manual scheduler")
+		}
+		if len(eyeconfig.Weights) > 0 {
+			return errors.New("weights could not be used with fixed order")
+		}
+		sch.SetFixedOrder(serverAddrs(eyeconfig.Servers))
+	}
+
+	if sch, ok := schd.(memcache.StatefulScheduler); ok && eyeconfig.StateFile != "" {
+		if err := memcache.LoadState(sch, eyeconfig.StateFile); err != nil && !os.IsNotExist(err) {
+			log.Print("load state failed: ", err)
+		}
+		interval := eyeconfig.StateInterval
+		if interval <= 0 {
+			interval = 60
+		}
+		go memcache.PersistState(sch, eyeconfig.StateFile, time.Duration(interval)*time.Second, s.done)
+	}
+
+	if len(eyeconfig.Pools) > 0 {
+		pools := make(map[string]memcache.Scheduler, len(eyeconfig.Pools))
+		for prefix, servers := range eyeconfig.Pools {
+			pool_configs := serverConfigs(servers)
+			pools[prefix] = memcache.NewManualScheduler(pool_configs, eyeconfig.Buckets, min(N, len(pool_configs)))
+		}
+		schd = memcache.NewPrefixScheduler(pools, schd, N)
+	}
+
+	if len(eyeconfig.Regions) > 0 {
+		local := eyeconfig.Region
+		regions := map[string]memcache.Scheduler{local: schd}
+		var order []string
+		for _, r := range eyeconfig.Regions {
+			region_configs := serverConfigs(r.Servers)
+			regions[r.Name] = memcache.NewManualScheduler(region_configs, eyeconfig.Buckets, min(N, len(region_configs)))
+			order = append(order, r.Name)
+		}
+		rs, err := memcache.NewRegionScheduler(local, regions, order, eyeconfig.GeoPins, N)
+		if err != nil {
+			return fmt.Errorf("invalid regions in conf: %s", err)
+		}
+		for _, r := range eyeconfig.Regions {
+			if r.Estimate > 0 {
+				rs.SetEstimate(r.Name, time.Duration(r.Estimate)*time.Millisecond)
+			}
+		}
+		regionScheduler = rs
+		schd = rs
+	}
+
+	if len(eyeconfig.Fallback) > 0 {
+		fallback_configs := serverConfigs(eyeconfig.Fallback)
+		fallback := memcache.NewManualScheduler(fallback_configs, eyeconfig.Buckets, min(N, len(fallback_configs)))
+		schd = memcache.NewFallbackScheduler(schd, fallback)
+	}
+
+	if len(eyeconfig.Bulk) > 0 {
+		bulk_configs := serverConfigs(eyeconfig.Bulk)
+		bulk := memcache.NewManualScheduler(bulk_configs, eyeconfig.Buckets, min(N, len(bulk_configs)))
+		bulk_size := eyeconfig.BulkSize
+		if bulk_size <= 0 {
+			bulk_size = 100 * 1024
+		}
+		schd = memcache.NewBulkScheduler(schd, bulk, bulk_size, N)
+	}
+
+	if eyeconfig.Pinning || len(eyeconfig.Pins) > 0 {
+		pins = memcache.NewPinScheduler(schd, N)
+		for pattern, addrs := range eyeconfig.Pins {
+			if err := pins.Pin(pattern, addrs); err != nil {
+				return fmt.Errorf("invalid pins in conf: %s", err)
+			}
+		}
+		schd = pins
+	}
+
+	var client memcache.DistributeStorage
+	if readonly {
+		client = memcache.NewRClient(schd, N, W, R)
+	} else {
+		c := memcache.NewClient(schd, N, W, R)
+		c.GraySampleRate = eyeconfig.GraySample
+		client = c
+	}
+	if len(eyeconfig.Datacenters) > 0 {
+		local := eyeconfig.Datacenter
+		clients := map[string]memcache.DistributeStorage{local: client}
+		var order []string
+		for _, dc := range eyeconfig.Datacenters {
+			dc_configs := serverConfigs(dc.Servers)
+			dn := min(N, len(dc_configs))
+			dc_schd := memcache.NewManualScheduler(dc_configs, eyeconfig.Buckets, dn)
+			clients[dc.Name] = memcache.NewClient(dc_schd, dn, min(W, dn), R)
+			order = append(order, dc.Name)
+		}
+		dc, err := memcache.NewDCClient(local, clients, order, eyeconfig.DCConsistency)
+		if err != nil {
+			return fmt.Errorf("invalid datacenters in conf: %s", err)
+		}
+		client = dc
+	}
+	if len(eyeconfig.Experiments) > 0 {
+		pools := make(map[string]memcache.DistributeStorage)
+		for _, e := range eyeconfig.Experiments {
+			memcache.Experiments = append(memcache.Experiments, &memcache.Experiment{ID: e.ID, Prefix: e.Prefix, Rate: e.Rate,
+				TTL: e.TTL, Pool: len(e.Pool) > 0})
+			if len(e.Pool) > 0 {
+				pool_configs := serverConfigs(e.Pool)
+				pn := min(N, len(pool_configs))
+				pool_schd := memcache.NewManualScheduler(pool_configs, eyeconfig.Buckets, pn)
+				pools[e.ID] = memcache.NewClient(pool_schd, pn, min(W, pn), R)
+			}
+		}
+		client = memcache.NewExperimentClient(client, pools)
+	}
+	if len(eyeconfig.Shadow) > 0 {
+		shadow_configs := serverConfigs(eyeconfig.Shadow)
+		sn := min(N, len(shadow_configs))
+		shadow_schd := memcache.NewManualScheduler(shadow_configs, eyeconfig.Buckets, sn)
+		shadow := memcache.NewClient(shadow_schd, sn, min(W, sn), R)
+		client = memcache.NewShadowClient(client, shadow, eyeconfig.ShadowReads, eyeconfig.ShadowWrites)
+	}
+	if cold := eyeconfig.Cold; cold.Endpoint != "" {
+		store := memcache.NewS3Store(cold.Endpoint, cold.Bucket, cold.Region, cold.AccessKey, cold.SecretKey, cold.CacheSize<<20)
+		client = memcache.NewTierClient(client, store, cold.Endpoint, cold.Prefixes, cold.MinSize)
+	}
+	if eyeconfig.L2Cache != "" {
+		cache, err := memcache.OpenBitcaskStore(eyeconfig.L2Cache)
+		if err != nil {
+			return fmt.Errorf("open l2 cache failed: %s", err)
+		}
+		if eyeconfig.L2CacheSize > 0 {
+			// evicted by data files
+			cache.MaxFileSize = int64(eyeconfig.L2CacheSize) << 20 / 16
+		}
+		client = memcache.NewL2CacheClient(client, cache, eyeconfig.L2CachePrefix,
+			time.Duration(eyeconfig.L2CacheTTL)*time.Second, int64(eyeconfig.L2CacheSize)<<20)
+	}
+	if eyeconfig.HotKeyQPS > 0 {
+		if eyeconfig.HotKeyShards <= 1 {
+			eyeconfig.HotKeyShards = 3
+		}
+		client = memcache.NewHotKeyClient(client, eyeconfig.HotKeyQPS, eyeconfig.HotKeyShards)
+	}
+	if eyeconfig.MultiGetCache > 0 {
+		min_keys := eyeconfig.MultiGetCacheKeys
+		if min_keys <= 0 {
+			min_keys = 10
+		}
+		entries := eyeconfig.MultiGetCacheSize
+		if entries <= 0 {
+			entries = 1024
+		}
+		client = memcache.NewMultiGetCacheClient(client, time.Duration(eyeconfig.MultiGetCache)*time.Millisecond, min_keys, entries)
+	}
+	if len(eyeconfig.Transform) > 0 {
+		client = memcache.NewTransformClient(client, time.Duration(eyeconfig.TransformCache)*time.Second, eyeconfig.Transform)
+	}
+	if len(eyeconfig.Sinks) > 0 {
+		sc := memcache.NewSinkClient(client)
+		for _, c := range eyeconfig.Sinks {
+			sink, err := memcache.NewSinkByName(c.Type, c.Arg)
+			if err != nil {
+				return fmt.Errorf("invalid sinks in conf: %s", err)
+			}
+			sc.AddSink(c.Type+" "+c.Arg, c.Prefix, sink)
+		}
+		sinkClient = sc
+		client = sc
+	}
+	if eyeconfig.DryRun {
+		// outermost, so nothing behind the proxy is written
+		client = memcache.NewDryRunClient(client, schd, N)
+		log.Print("dry run: writes are acknowledged, but not sent")
+	}
+	proxyClient = client
+	memcache.SetFeatures(map[string]bool{
+		"readonly":      readonly,
+		"pools":         len(eyeconfig.Pools) > 0,
+		"regions":       len(eyeconfig.Regions) > 0,
+		"fallback":      len(eyeconfig.Fallback) > 0,
+		"bulk":          len(eyeconfig.Bulk) > 0,
+		"pinning":       eyeconfig.Pinning || len(eyeconfig.Pins) > 0,
+		"datacenters":   len(eyeconfig.Datacenters) > 0,
+		"experiments":   len(eyeconfig.Experiments) > 0,
+		"shadow":        len(eyeconfig.Shadow) > 0,
+		"cold":          eyeconfig.Cold.Endpoint != "",
+		"l2cache":       eyeconfig.L2Cache != "",
+		"hotkeys":       eyeconfig.HotKeyQPS > 0,
+		"multigetcache": eyeconfig.MultiGetCache > 0,
+		"transform":     len(eyeconfig.Transform) > 0,
+		"sinks":         len(eyeconfig.Sinks) > 0,
+		"dryrun":        eyeconfig.DryRun,
+		"faults":        eyeconfig.Faults,
+		"listeners":     len(eyeconfig.Listeners) > 0,
+		"flush_all":     eyeconfig.FlushAll,
+	})
+	var embedded string
+	if eyeconfig.Embedded != "" {
+		embedded = fmt.Sprintf("%s:%d", eyeconfig.Listen, eyeconfig.EmbeddedPort)
+	}
+	memcache.SetBackends(schd, serverAddrs(eyeconfig.Servers), eyeconfig.backendAddrs(embedded), N)
+	if eyeconfig.FlushAll {
+		admins, err := memcache.ParseFlushAdmins(eyeconfig.FlushAdmins)
+		if err != nil {
+			return fmt.Errorf("invalid flushadmins in conf: %s", err)
+		}
+		memcache.FlushEnabled, memcache.FlushAdmins = true, admins
+	}
+
+	updateTopology()
+
+	if eyeconfig.Embedded != "" {
+		s.store, err = memcache.OpenBitcaskStore(eyeconfig.Embedded)
+		if err != nil {
+			return fmt.Errorf("open embedded store failed: %s", err)
+		}
+		s.embedded = memcache.NewServer(memcache.NewLocalStorage(s.store, embedded))
+	}
+	s.proxy = memcache.NewServer(client)
+	s.proxy.AcceptLoops = eyeconfig.AcceptLoops
+	proxyServer = s.proxy
+	embeddedStore = s.store
+	for _, lc := range eyeconfig.Listeners {
+		ns := memcache.NewServer(memcache.NewNamespaceClient(client, lc.Namespace, lc.TTL))
+		ns.AcceptLoops = eyeconfig.AcceptLoops
+		s.servers = append(s.servers, ns)
+	}
+	return nil
+}
+
+// Start listens and serves the proxy, the listeners of namespaces, the
+// embedded store and the monitor in background, and starts the checks of
+// the config, ctx is checked before every listen.
+func (s *Server) Start(ctx context.Context) (err error) {
+	if s.served != nil {
+		return errors.New("proxy already started")
+	}
+	s.served = make(chan error, 1)
+	defer func() {
+		if err != nil {
+			s.shutdown()
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.startMonitor(); err != nil {
+		return err
+	}
+	s.startChecks()
+
+	if s.embedded != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		addr := fmt.Sprintf("%s:%d", eyeconfig.Listen, eyeconfig.EmbeddedPort)
+		if e := s.embedded.Listen(addr); e != nil {
+			return fmt.Errorf("embedded store listen failed: %s", e)
+		}
+		log.Println("embedded store listen on ", addr)
+		s.serve(s.embedded, nil)
+	}
+
+	for i, lc := range eyeconfig.Listeners {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		addr := fmt.Sprintf("%s:%d", eyeconfig.Listen, lc.Port)
+		if e := s.servers[i].Listen(addr); e != nil {
+			return fmt.Errorf("listen failed: %s", e)
+		}
+		log.Printf("listen on %s, namespace %q, ttl %d", addr, lc.Namespace, lc.TTL)
+		s.serve(s.servers[i], nil)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.Listener != nil {
+		s.proxy.Use(s.Listener)
+	} else {
+		if eyeconfig.Port <= 0 {
+			return fmt.Errorf("error proxy port in config it is %d", eyeconfig.Port)
+		}
+		addr := fmt.Sprintf("%s:%d", eyeconfig.Listen, eyeconfig.Port)
+		if eyeconfig.ReusePort > 1 {
+			if e := s.proxy.ListenReusePort(addr, eyeconfig.ReusePort); e != nil {
+				return fmt.Errorf("proxy listen with SO_REUSEPORT failed: %s", e)
+			}
+		} else if e := s.proxy.Listen(addr); e != nil {
+			return fmt.Errorf("proxy listen failed: %s", e)
+		}
+	}
+	log.Println("proxy listen on ", s.proxy.Addr())
+	s.serve(s.proxy, s.served)
+	return nil
+}
+
+func (s *Server) serve(server *memcache.Server, served chan error) {
+	server.IgnoreSignals = !s.HandleSignals
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := server.Serve()
+		if served != nil {
+			served <- err
+		}
+	}()
+}
+
+func (s *Server) startMonitor() error {
+	l := s.WebListener
+	if l == nil && eyeconfig.WebPort <= 0 {
+		log.Print("error webport in conf: ", eyeconfig.WebPort)
+		return nil
+	}
+	if eyeconfig.Buckets <= 0 {
+		log.Print("error buckets in conf: ", eyeconfig.Buckets)
+		return nil
+	}
+	basepath := eyeconfig.Basepath
+	if basepath == "" {
+		curr_path, err := os.Getwd()
+		if err != nil {
+			return errors.New("Cannot get pwd")
+		}
+		basepath = curr_path
+	}
+	if err := Init(basepath); err != nil {
+		return err
+	}
+	if l == nil {
+		addr := fmt.Sprintf("%s:%d", eyeconfig.Listen, eyeconfig.WebPort)
+		var err error
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return fmt.Errorf("monitor listen failed on %s: %s", addr, err)
+		}
+	}
+
+	servers := serverAddrs(eyeconfig.Servers)
+	server_stats = make([]map[string]interface{}, len(servers))
+	bucket_stats = make([]string, eyeconfig.Buckets)
+	go update_stats(servers, nil, server_stats, true, s.done)
+	if len(eyeconfig.Proxies) > 0 {
+		proxy_stats = make([]map[string]interface{}, len(eyeconfig.Proxies))
+		go update_stats(eyeconfig.Proxies, nil, proxy_stats, false, s.done)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.HandlerFunc(makeGzipHandler(Status)))
+	mux.Handle("/static/", http.FileServer(http.Dir(basepath)))
+	mux.Handle("/debug/pprof/", http.DefaultServeMux)
+	mux.HandleFunc("/data", func(w http.ResponseWriter, req *http.Request) {
+	})
+	initAdmin(mux)
+	s.web = &http.Server{Handler: mux}
+	log.Println("monitor listen on ", l.Addr())
+	go s.web.Serve(l)
+	return nil
+}
+
+func (s *Server) startChecks() {
+	if eyeconfig.Bench > 0 {
+		selfBench = &memcache.SelfBench{Interval: time.Duration(eyeconfig.Bench) * time.Minute,
+			Duration: time.Second * 5, Workers: 8, Hours: eyeconfig.BenchHours, Done: s.done}
+		go selfBench.Run()
+	}
+	if eyeconfig.TopologyCheck > 0 && len(eyeconfig.Proxies) > 0 {
+		topologyCheck = &memcache.TopologyCheck{Peers: eyeconfig.Proxies,
+			Interval: time.Duration(eyeconfig.TopologyCheck) * time.Second, Done: s.done}
+		go topologyCheck.Run()
+	}
+	if eyeconfig.Audit > 0 {
+		sample := eyeconfig.AuditSample
+		if sample <= 0 {
+			sample = 10
+		}
+		routingAudit = &memcache.RoutingAudit{Scheduler: schd, Addrs: serverAddrs(eyeconfig.Servers),
+			Buckets: eyeconfig.Buckets, Sample: sample, Interval: time.Duration(eyeconfig.Audit) * time.Minute,
+			Done: s.done}
+		go routingAudit.Run()
+	}
+	if s.store != nil && eyeconfig.EmbeddedCompact > 0 {
+		go s.store.CompactEvery(time.Duration(eyeconfig.EmbeddedCompact)*time.Minute, s.done)
+	}
+}
+
+// the address the proxy is listening on, after Start
+func (s *Server) Addr() string {
+	return s.proxy.Addr()
+}
+
+// Wait blocks until the proxy stops serving, by Stop or by a signal if
+// HandleSignals.
+func (s *Server) Wait() error {
+	if s.served == nil {
+		return errors.New("proxy not started")
+	}
+	return <-s.served
+}
+
+func (s *Server) shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.proxy.Shutdown()
+		for _, ns := range s.servers {
+			ns.Shutdown()
+		}
+		if s.embedded != nil {
+			s.embedded.Shutdown()
+		}
+	})
+}
+
+// release closes the clients and the schedulers with the connections of
+// their hosts, stops their goroutines and closes the embedded store.
+func (s *Server) release() {
+	if proxyClient != nil {
+		memcache.CloseStorage(proxyClient)
+	}
+	if schd != nil {
+		memcache.CloseScheduler(schd)
+	}
+	memcache.StopProbes()
+	memcache.SetBackends(nil, nil, nil, 1)
+	if s.store != nil {
+		s.store.Close()
+	}
+}
+
+// Stop shuts the servers down gracefully and waits for them until ctx is
+// done. Once they are drained, the clients, the schedulers and the embedded
+// store are closed, then another Server could be created. If ctx is done
+// first, the error of ctx is returned and the Server is kept, as its
+// connections are still served.
+func (s *Server) Stop(ctx context.Context) error {
+	s.shutdown()
+	var err error
+	if s.web != nil {
+		err = s.web.Shutdown(ctx)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.release()
+	currentLock.Lock()
+	if current == s {
+		current = nil
+	}
+	currentLock.Unlock()
+	return err
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"memcache"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedServer(t *testing.T) {
+	bl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := memcache.NewServer(memcache.NewLocalStorage(memcache.NewMapStore(), bl.Addr().String()))
+	backend.IgnoreSignals = true
+	backend.Use(bl)
+	go backend.Serve()
+	defer backend.Shutdown()
+
+	config := &Eye{Servers: []string{bl.Addr().String()}, Scheduler: "ketama", Buckets: 16, N: 1, W: 1, R: 1,
+		Basepath: "../.."}
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(config); err == nil {
+		t.Error("the second proxy should not be created")
+	}
+	if s.Listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if s.WebListener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s.Addr() != s.Listener.Addr().String() {
+		t.Errorf("proxy listens on %s, not the listener %s", s.Addr(), s.Listener.Addr())
+	}
+
+	host := memcache.NewHost(s.Addr())
+	if ok, err := host.Set("a", &memcache.Item{Body: []byte("1")}, false); !ok || err != nil {
+		t.Fatalf("set through the proxy failed: %v %v", ok, err)
+	}
+	if item, _ := memcache.NewHost(bl.Addr().String()).Get("a"); item == nil || string(item.Body) != "1" {
+		t.Errorf("set through the proxy is not on the server: %v", item)
+	}
+
+	resp, err := http.Get("http://" + s.WebListener.Addr().String() + "/api/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/api/stats of the embedded proxy: %s", resp.Status)
+	}
+	web := "http://" + s.WebListener.Addr().String()
+	note := url.Values{"host": {bl.Addr().String()}, "note": {"<script>x</script>"}}
+	if resp, err = http.Get(web + "/api/annotations?" + note.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("annotations should be changed by POST only: %s", resp.Status)
+	}
+	if resp, err = http.PostForm(web+"/api/annotations", note); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp, err = http.Get(web + "/?sections=ST"); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if bytes.Contains(page, []byte("<script>x")) || !bytes.Contains(page, []byte("&lt;script&gt;x")) {
+		t.Errorf("notes should be escaped in the monitor: %s", page)
+	}
+	memcache.AnnotateHost(bl.Addr().String(), "")
+	if resp, err = http.PostForm(web+"/api/fault", url.Values{"bucket": {"0"}}); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("faults should not be injected unless set in conf: %s", resp.Status)
+	}
+
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Wait(); err != nil {
+		t.Error(err)
+	}
+	if _, err := net.Dial("tcp", s.Addr()); err == nil {
+		t.Error("proxy still listens after stopped")
+	}
+	s, err = NewServer(config)
+	if err != nil {
+		t.Fatal("a proxy should be created after the last stopped: ", err)
+	}
+	if s.Listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// served until the connection is closed
+	short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	if err := s.Stop(short); err != context.DeadlineExceeded {
+		t.Errorf("stop before the connection is closed: %v", err)
+	}
+	if _, err := NewServer(config); err == nil {
+		t.Error("a proxy should not be created before the last is drained")
+	}
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewServer(config)
+	if err != nil {
+		t.Fatal("a proxy should be created after the last drained: ", err)
+	}
+	s.Stop(ctx)
+}
+
+func TestServerResetsGlobals(t *testing.T) {
+	addr := "127.0.0.1:11299"
+	readTimeout := memcache.ReadTimeout
+	config := &Eye{Servers: []string{addr}, Buckets: 16, N: 1, W: 1, R: 1, Basepath: "../..",
+		FlushAll: true, FlushAdmins: []string{"127.0.0.1"}, Aliases: map[string]string{addr: "a"}, ReadTimeout: 10}
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !memcache.FlushEnabled || memcache.HostAliases[addr] != "a" || memcache.ReadTimeout != 10*time.Millisecond {
+		t.Fatal("the config is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewServer(&Eye{Servers: []string{addr}, Buckets: 16, N: 1, W: 1, R: 1, Basepath: "../.."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(ctx)
+	if memcache.FlushEnabled || memcache.FlushAdmins != nil {
+		t.Error("flush_all is kept from the last config")
+	}
+	if len(memcache.HostAliases) != 0 {
+		t.Errorf("aliases are kept from the last config: %v", memcache.HostAliases)
+	}
+	if memcache.ReadTimeout != readTimeout {
+		t.Errorf("read timeout is kept from the last config: %s", memcache.ReadTimeout)
+	}
+}